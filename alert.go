@@ -0,0 +1,38 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit code of the run raising corruption alert.
+const ExitCorrupt = 4
+
+var ErrCorrupt = errors.New("Corruption alert")
+
+// Alert if at least AlertBlocks blocks failed to be read or written,
+// or failed verification against the statefile.
+func (j *Job) alert(failed int64) error {
+	if j.AlertBlocks <= 0 || failed < j.AlertBlocks {
+		return nil
+	}
+	return fmt.Errorf("%w: %d blocks failed", ErrCorrupt, failed)
+}
@@ -0,0 +1,152 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// Region of the source with its changes statistics.
+type Region struct {
+	First   int64 // block
+	Last    int64 // block
+	Changes uint64
+}
+
+// Share of runs changing the block to consider it always changing.
+const HotRatio = 0.9
+
+// Rank the most frequently changing regions of the source using counters
+// of the tracked statefile, and suggest blocksize or exclusions.
+func analyze(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	opts := addStateFlags(fs)
+	top := fs.Int("top", 10, "Number of regions to show")
+	regionSize := fs.Int64("region", 1024, "Region size (MiB)")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		log.Fatalln("Usage: syncer analyze [options] STATE")
+	}
+	st := opts.Read(fs.Arg(0))
+	if st.Counts == nil {
+		log.Fatalln("Statefile does not count changes, use -track-changes")
+	}
+	runs := st.Meta.Runs - st.Meta.TrackedSince + 1
+	blocks := st.Blocks()
+	perRegion := *regionSize * (1 << 20) / st.Bs
+	if perRegion == 0 {
+		perRegion = 1
+	}
+
+	var regions []Region
+	var total uint64
+	for i := int64(0); i < blocks; i++ {
+		if i%perRegion == 0 {
+			regions = append(regions, Region{First: i})
+		}
+		r := &regions[len(regions)-1]
+		r.Last = i
+		r.Changes += uint64(st.Counts[i])
+		total += uint64(st.Counts[i])
+	}
+	fmt.Printf(
+		"%d runs tracked, %.1f of %d %d byte blocks changed per run\n\n",
+		runs, float64(total)/float64(runs), blocks, st.Bs,
+	)
+	sort.SliceStable(regions, func(a, b int) bool {
+		return regions[a].Changes > regions[b].Changes
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "OFFSET\tLENGTH\tCHANGES\tPER RUN\tSHARE\t")
+	for n, r := range regions {
+		if n == *top || r.Changes == 0 {
+			break
+		}
+		fmt.Fprintf(
+			w, "%d\t%d\t%d\t%.1f\t%.1f%%\t\n",
+			r.First*st.Bs, (r.Last-r.First+1)*st.Bs, r.Changes,
+			float64(r.Changes)/float64(runs),
+			100*float64(r.Changes)/float64(total),
+		)
+	}
+	w.Flush()
+
+	// Changed blocks of the last run grouped to contiguous extents: if
+	// they are long, then larger blocks transfer about the same, but
+	// make statefile smaller
+	var extents, extentBlocks int64
+	for i := int64(0); i < blocks; i++ {
+		if int64(st.Changes[i]) != st.Meta.Runs {
+			continue
+		}
+		if i == 0 || int64(st.Changes[i-1]) != st.Meta.Runs {
+			extents++
+		}
+		extentBlocks++
+	}
+	fmt.Println()
+	if extents > 0 {
+		avg := float64(extentBlocks) / float64(extents)
+		mult := int64(1)
+		for float64(mult*2) <= avg {
+			mult *= 2
+		}
+		if mult >= 4 {
+			fmt.Printf(
+				"Changes come in %.1f blocks long extents: -blk %d makes statefile %d times smaller\n",
+				avg, st.Bs*mult>>10, mult,
+			)
+		} else if avg < 1.5 && st.Bs > 64<<10 {
+			fmt.Printf(
+				"Changes are scattered single blocks: smaller -blk %d transfers less\n",
+				st.Bs>>11,
+			)
+		}
+	}
+
+	// Extents changing in nearly every run are probably swap or
+	// temporary data not worth syncing
+	if runs < 3 {
+		return
+	}
+	hot := func(i int64) bool {
+		return float64(st.Counts[i]) >= HotRatio*float64(runs)
+	}
+	for i := int64(0); i < blocks; i++ {
+		if !hot(i) {
+			continue
+		}
+		first := i
+		for i+1 < blocks && hot(i+1) {
+			i++
+		}
+		if i-first+1 < perRegion/16 && i-first+1 < blocks/100 {
+			continue
+		}
+		fmt.Printf(
+			"Bytes %d-%d change in nearly every run: consider excluding them\n",
+			first*st.Bs, (i+1)*st.Bs-1,
+		)
+	}
+}
@@ -0,0 +1,270 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Audit log records: run's start, written (or stored) extent, run's
+// result.
+const (
+	AuditStart  = "start"
+	AuditWrite  = "write"
+	AuditFinish = "finish"
+)
+
+var ErrAuditChain = errors.New("Broken audit log chain")
+
+// Audit log is append-only file of JSON lines, each one containing
+// hexadecimal BLAKE2b-256 hash of the previous line, so any modification
+// breaks the chain.
+type AuditRecord struct {
+	Prev   string    `json:"prev"`
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Job    string    `json:"job,omitempty"`
+	Run    string    `json:"run,omitempty"`
+	Src    string    `json:"src,omitempty"`
+	Dst    string    `json:"dst,omitempty"`
+	Syncer string    `json:"syncer,omitempty"`
+
+	Offset int64 `json:"offset,omitempty"`
+	Length int64 `json:"length,omitempty"`
+
+	Result  string `json:"result,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Changed int64  `json:"changed,omitempty"`
+	Written int64  `json:"written,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+}
+
+// Records buffered before they are appended to the audit log.
+const AuditBatch = 1024
+
+// Job's audit log kept open for the run. Records are buffered and
+// appended at commit with a single write and fsync, holding lock of the
+// log, so jobs sharing it keep the chain intact.
+type auditWriter struct {
+	fd      *os.File
+	path    string
+	size    int64  // of the log when last was taken
+	last    string // hash of its last line
+	records []*AuditRecord
+}
+
+func openAudit(path string) (*auditWriter, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditWriter{fd: fd, path: path, size: -1}, nil
+}
+
+func auditHash(line []byte) string {
+	sum := blake2bSum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// Hash of the last line of the audit log, empty if there is none.
+func auditLast(fd *os.File, size int64) (string, error) {
+	var tail []byte
+	for offset := size; offset > 0; {
+		n := min(offset, 1<<16)
+		offset -= n
+		chunk := make([]byte, n)
+		if _, err := fd.ReadAt(chunk, offset); err != nil {
+			return "", err
+		}
+		tail = append(chunk, tail...)
+		if i := bytes.LastIndexByte(bytes.TrimSuffix(tail, []byte("\n")), '\n'); i != -1 || offset == 0 {
+			return auditHash(bytes.TrimSuffix(tail[i+1:], []byte("\n"))), nil
+		}
+	}
+	return "", nil
+}
+
+// Append buffered records chained to the last line. The tail is scanned
+// again only if somebody else appended since our last commit.
+func (a *auditWriter) commit() error {
+	if len(a.records) == 0 {
+		return nil
+	}
+	unlock, err := waitLock(a.path+".lock", false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	size, err := a.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size != a.size {
+		if a.last, err = auditLast(a.fd, size); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	last := a.last
+	for _, r := range a.records {
+		r.Prev = last
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		last = auditHash(line)
+	}
+	if _, err = a.fd.Write(buf.Bytes()); err != nil {
+		// Partial write leaves the size unknown
+		a.size = -1
+		return err
+	}
+	if err = a.fd.Sync(); err != nil {
+		return err
+	}
+	a.size, a.last, a.records = size+int64(buf.Len()), last, a.records[:0]
+	return nil
+}
+
+func (a *auditWriter) close() error {
+	err := a.commit()
+	if cerr := a.fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Buffer record for the job's audit log, committing full batch.
+func (j *Job) audit(r *AuditRecord) error {
+	r.Time = time.Now()
+	r.Job, r.Run = j.Name, j.Stats.Run
+	j.auditor.records = append(j.auditor.records, r)
+	if len(j.auditor.records) < AuditBatch {
+		return nil
+	}
+	return j.auditor.commit()
+}
+
+// Open the audit log for the run and commit its start record.
+func (j *Job) auditStart() (err error) {
+	if j.auditor, err = openAudit(j.AuditLog); err != nil {
+		return err
+	}
+	dst := j.Dst
+	if j.Store != "" {
+		dst = j.Store
+	}
+	j.audit(&AuditRecord{
+		Type: AuditStart, Src: j.Src, Dst: dst, Syncer: Version,
+	})
+	if err = j.auditor.commit(); err != nil {
+		j.auditor.fd.Close()
+		j.auditor = nil
+	}
+	return err
+}
+
+func (j *Job) auditWrite(e Extent) {
+	if err := j.audit(&AuditRecord{
+		Type: AuditWrite, Offset: e.Offset, Length: e.Length,
+	}); err != nil {
+		j.log.Println("Unable to write audit log:", err)
+	}
+}
+
+func (j *Job) auditFinish(runErr error) {
+	r := AuditRecord{
+		Type:    AuditFinish,
+		Result:  "ok",
+		Changed: j.Stats.Changed,
+		Written: j.Stats.Written,
+		Digest:  j.Stats.Digest,
+	}
+	if runErr != nil {
+		r.Result, r.Error = "failed", runErr.Error()
+	}
+	j.audit(&r)
+	if err := j.auditor.close(); err != nil {
+		j.log.Println("Unable to write audit log:", err)
+	}
+	j.auditor = nil
+}
+
+// Commit buffered records at the end of the write phase.
+func (j *Job) auditCommit() {
+	if err := j.auditor.commit(); err != nil {
+		j.log.Println("Unable to write audit log:", err)
+	}
+}
+
+// Verify audit log's chain, returning number of records and runs, and
+// hash of the last line.
+func verifyAudit(r io.Reader) (n, runs int, last string, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		n++
+		var r AuditRecord
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return n, runs, last, fmt.Errorf("Line %d: %w", n, err)
+		}
+		if r.Prev != last {
+			return n, runs, last, fmt.Errorf("Line %d: %w", n, ErrAuditChain)
+		}
+		if r.Type == AuditStart {
+			runs++
+		}
+		last = auditHash(scanner.Bytes())
+	}
+	if err = scanner.Err(); err != nil {
+		return n, runs, last, fmt.Errorf("Unable to read audit log: %w", err)
+	}
+	return n, runs, last, nil
+}
+
+// Verify audit log's chain.
+func audit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		log.Fatalln("Usage: audit AUDIT_LOG")
+	}
+	fd, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalln("Unable to open audit log:", err)
+	}
+	defer fd.Close()
+	n, runs, last, err := verifyAudit(fd)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(n, "records of", runs, "runs, chain is intact, last hash", last)
+}
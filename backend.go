@@ -0,0 +1,62 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"strings"
+)
+
+// Source read from a custom backend, like SAN volume.
+type Source interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+var (
+	sourceBackends = make(map[string]func(url string) (Source, error))
+	imageFormats   = make(map[string]func(path string, mode int, size int64) (Image, error))
+)
+
+// Add backend opening sources with URLs of that scheme, like
+// "san://array1/vol7". Backends are files of syncer's own source tree
+// calling it in init(), it is not a library to extend from outside.
+func registerSource(scheme string, open func(url string) (Source, error)) {
+	sourceBackends[scheme] = open
+}
+
+// Add destination format, used with -dst-format name, the same way.
+// Image is created of virtual size if it does not exist.
+func registerFormat(name string, open func(path string, mode int, size int64) (Image, error)) {
+	imageFormats[name] = open
+}
+
+func hasScheme(path string) bool {
+	return strings.Contains(path, "://")
+}
+
+// Backend opening the source, nil if it is a local file or device.
+func sourceBackend(path string) func(url string) (Source, error) {
+	scheme, _, ok := strings.Cut(path, "://")
+	if !ok {
+		return nil
+	}
+	return sourceBackends[scheme]
+}
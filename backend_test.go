@@ -0,0 +1,148 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Source and destination image kept in memory.
+type memImage struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (m *memImage) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	return copy(p, m.data[off:]), nil
+}
+
+func (m *memImage) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	return copy(m.data[off:], p), nil
+}
+
+func (m *memImage) Size() int64  { return int64(len(m.data)) }
+func (m *memImage) Sync() error  { return nil }
+func (m *memImage) Close() error { return nil }
+
+// Registered source backend and destination format are used by the run.
+func TestRegisteredBackend(t *testing.T) {
+	j := testJob(t, 0)
+	src := &memImage{data: writeRandom(t, j.Src, 1<<20)}
+	dst := &memImage{}
+	registerSource("mem", func(url string) (Source, error) {
+		if url != "mem://src" {
+			return nil, errors.New("Unknown source: " + url)
+		}
+		return src, nil
+	})
+	registerFormat("mem", func(path string, mode int, size int64) (Image, error) {
+		return dst, nil
+	})
+	defer delete(sourceBackends, "mem")
+	defer delete(imageFormats, "mem")
+	j.Src, j.DstFormat = "mem://src", "mem"
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst.data, src.data) {
+		t.Fatal("Destination differs from source")
+	}
+}
+
+// Registered hash algorithm is used by the run and recorded in state.
+func TestRegisteredHash(t *testing.T) {
+	var calls atomic.Int64
+	registerHash("test-sha256", sha256.Size, func(data []byte) []byte {
+		calls.Add(1)
+		sum := sha256.Sum256(data)
+		return sum[:]
+	})
+	defer delete(hashers, "test-sha256")
+	j := testJob(t, 1<<20)
+	j.Hash = "test-sha256"
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sameFiles(t, j.Src, j.Dst)
+	st, err := ReadStateFile(j.State, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Meta.Hash != "test-sha256" || calls.Load() == 0 {
+		t.Fatal("Registered hash is not used")
+	}
+}
+
+// Transform XORing data with the byte of its argument.
+type xorTransform byte
+
+func (x xorTransform) Encode(data []byte, offset int64) error {
+	for i := range data {
+		data[i] ^= byte(x)
+	}
+	return nil
+}
+
+func (x xorTransform) Decode(data []byte, offset int64) error {
+	return x.Encode(data, offset)
+}
+
+// Registered transform is applied to the destination and inverted when
+// it is read back.
+func TestRegisteredTransform(t *testing.T) {
+	registerTransform("xor", func(arg string) (Transform, error) {
+		return xorTransform(len(arg)), nil
+	})
+	defer delete(transforms, "xor")
+	j := testJob(t, 1<<20)
+	j.DstTransform, j.Paranoid = "xor:abcde", ParanoidAbort
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// Paranoid run reads the old blocks back through the transform
+	src := writeRandom(t, j.Src, 1<<20)
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := ioutil.ReadFile(j.Dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xorTransform(5).Decode(dst, 0)
+	if !bytes.Equal(src, dst) {
+		t.Fatal("Destination is not transformed")
+	}
+}
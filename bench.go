@@ -0,0 +1,212 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Block sizes tried during the read benchmark, KiB.
+var BenchBlks = []int64{64, 256, 1024, 2048, 4096, 8192}
+
+func mibps(size int64, d time.Duration) float64 {
+	return float64(size) / (1 << 20) / d.Seconds()
+}
+
+// Hash size bytes by bs long blocks with that number of workers.
+func benchHash(h *Hasher, bs, size int64, workers int) float64 {
+	var wg sync.WaitGroup
+	started := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			buf := make([]byte, bs)
+			for done := int64(0); done < size/int64(workers); done += bs {
+				h.Sum(buf)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	return mibps(size, time.Since(started))
+}
+
+// Sequentially read size bytes by bs long blocks, each block size from
+// different area of the source, so they do not hit the cache.
+func benchRead(src *os.File, srcSize, bs, size, area int64) (float64, error) {
+	if size > srcSize {
+		size = srcSize
+	}
+	offset := area * size
+	if offset+size > srcSize {
+		offset = 0
+	}
+	buf := make([]byte, bs)
+	started := time.Now()
+	for done := int64(0); done < size; done += bs {
+		if _, err := src.ReadAt(buf, offset+done); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return mibps(size, time.Since(started)), nil
+}
+
+// Write size bytes of incompressible data to the new file, including
+// time to sync it, and remove it.
+func benchWrite(path string, bs, size int64) (float64, error) {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(path)
+	defer fd.Close()
+	buf := make([]byte, bs)
+	rand.Read(buf)
+	started := time.Now()
+	for done := int64(0); done < size; done += bs {
+		buf[0]++
+		if _, err = fd.Write(buf); err != nil {
+			return 0, err
+		}
+	}
+	if err = fd.Sync(); err != nil {
+		return 0, err
+	}
+	return mibps(size, time.Since(started)), nil
+}
+
+// Measure hashing, source reading and destination writing throughput,
+// and recommend workers number and block size.
+func bench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	srcPath := fs.String("src", "", "Path to source disk to read")
+	dstPath := fs.String("dst", "", "Path to new file on destination filesystem, removed afterwards")
+	sizeMiB := fs.Int64("size", 256, "Amount of data for each measurement (MiB)")
+	blk := fs.Int64("blk", DefaultBlk, "Block size (KiB)")
+	parseFlags(fs, args)
+	size := *sizeMiB * (1 << 20)
+	bs := *blk * (1 << 10)
+	cpus := runtime.NumCPU()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+
+	names := make([]string, 0, len(hashers))
+	for name := range hashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hashSpeed := make(map[string]float64)
+	fmt.Fprintf(w, "HASH\t1 WORKER, MiB/s\tALL %d CPUS, MiB/s\t\n", cpus)
+	for _, name := range names {
+		// Both BLAKE2b implementations are measured, the best is used
+		impls := []string{""}
+		if strings.HasPrefix(name, "blake2b") {
+			impls = []string{BLAKE2bGeneric, BLAKE2bXCrypto}
+		}
+		for _, impl := range impls {
+			label := name
+			if impl != "" {
+				SelectBLAKE2b(impl)
+				label += " (" + impl + ")"
+			}
+			speed := benchHash(hashers[name], bs, size, 1)
+			hashSpeed[name] = math.Max(hashSpeed[name], speed)
+			fmt.Fprintf(
+				w, "%s\t%.0f\t%.0f\t\n", label, speed,
+				benchHash(hashers[name], bs, size*int64(cpus), cpus),
+			)
+		}
+	}
+	SelectBLAKE2b(BLAKE2bXCrypto)
+	w.Flush()
+
+	var readSpeed float64
+	var bestBlk int64
+	if *srcPath != "" {
+		src, err := os.Open(*srcPath)
+		if err != nil {
+			log.Fatalln("Unable to open src:", err)
+		}
+		srcSize, err := srcSize(src)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		speeds := make([]float64, len(BenchBlks))
+		var best float64
+		fmt.Fprintln(w, "\nREAD BLOCK, KiB\tMiB/s\t")
+		for n, blk := range BenchBlks {
+			if speeds[n], err = benchRead(src, srcSize, blk<<10, size, int64(n)); err != nil {
+				log.Fatalln("Error during src read:", err)
+			}
+			best = math.Max(best, speeds[n])
+			fmt.Fprintf(w, "%d\t%.0f\t\n", blk, speeds[n])
+		}
+		w.Flush()
+		src.Close()
+		for n, blk := range BenchBlks {
+			if speeds[n] >= 0.9*best {
+				bestBlk, readSpeed = blk, speeds[n]
+				break
+			}
+		}
+	}
+
+	if *dstPath != "" {
+		if _, err := os.Stat(*dstPath); err == nil {
+			log.Fatalln("Destination benchmark file already exists:", *dstPath)
+		}
+		speed, err := benchWrite(*dstPath, bs, size)
+		if err != nil {
+			log.Fatalln("Error during dst write:", err)
+		}
+		fmt.Printf("\nWrite: %.0f MiB/s\n", speed)
+	}
+
+	fmt.Println()
+	if readSpeed > 0 {
+		need := int(math.Ceil(readSpeed / hashSpeed[DefaultHash]))
+		if need > cpus {
+			need = cpus
+		}
+		fmt.Printf(
+			"Recommended: -blk %d (%.0f MiB/s read) and -workers %d for %s hashing to keep up\n",
+			bestBlk, readSpeed, need, DefaultHash,
+		)
+	}
+	fastest := names[0]
+	for _, name := range names {
+		if hashSpeed[name] > hashSpeed[fastest] {
+			fastest = name
+		}
+	}
+	fmt.Println("Fastest hash on this machine:", fastest)
+}
@@ -0,0 +1,95 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Per-block failure, collected during the run.
+type blockError struct {
+	i   int64
+	err error
+}
+
+// Failures of the run's blocks by their kind: read, write, store,
+// verify.
+type blockErrors struct {
+	sync.Mutex
+	kinds map[string][]blockError
+}
+
+func (b *blockErrors) add(kind string, i int64, err error) {
+	b.Lock()
+	if b.kinds == nil {
+		b.kinds = make(map[string][]blockError)
+	}
+	b.kinds[kind] = append(b.kinds[kind], blockError{i, err})
+	b.Unlock()
+}
+
+// Log every collected failure grouped by kind, and return overall
+// error, if there were any.
+func (j *Job) reportErrors() error {
+	b := &j.blockErrs
+	b.Lock()
+	defer b.Unlock()
+	if len(b.kinds) == 0 {
+		return nil
+	}
+	kinds := make([]string, 0, len(b.kinds))
+	for kind := range b.kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	var total int
+	counts := make([]string, 0, len(kinds))
+	j.log.Println("Error report:")
+	for _, kind := range kinds {
+		errs := b.kinds[kind]
+		sort.Slice(errs, func(a, b int) bool { return errs[a].i < errs[b].i })
+		j.log.Printf("  %s: %d blocks\n", kind, len(errs))
+		for _, e := range errs {
+			j.log.Printf("    block %d: %s\n", e.i, e.err)
+		}
+		total += len(errs)
+		counts = append(counts, fmt.Sprintf("%s %d", kind, len(errs)))
+	}
+	return fmt.Errorf("%d blocks failed: %s", total, strings.Join(counts, ", "))
+}
+
+// Handle failure of the block. Unless KeepGoing is set, the error is
+// returned to stop the run. Otherwise it is collected and block's
+// state is invalidated, so the next run reads and writes it again.
+func (j *Job) blockFailed(st *State, i int64, kind string, err error) error {
+	j.fail(i)
+	if !j.KeepGoing {
+		return err
+	}
+	j.log.Println("Block", i, "failed:", err)
+	j.blockErrs.add(kind, i, err)
+	clear(st.Hash(i))
+	if st.CRCs != nil {
+		st.CRCs[i] = ^st.CRCs[i]
+	}
+	return nil
+}
@@ -0,0 +1,437 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/dchest/blake2b"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Chunk codecs, recorded in the first byte of the chunk.
+const (
+	CodecRaw  = 0
+	CodecZstd = 1
+
+	// Current store format version. Chunks of version 0 stores have no
+	// codec header. Generations of version 1 and older stores are not
+	// bound to their numbers.
+	StoreVersion = 2
+)
+
+// Content addressed chunk store. Each unique block is kept only once,
+// in a file named after its hash. Each run's block to chunk index is
+// kept as numbered generation in statefile format.
+//
+// Chunks in current format versions start with codec byte, so they can
+// be optionally compressed.
+//
+// Encrypted store keeps both chunks and indexes as nonce||ciphertext and
+// names chunks after keyed hash, so plaintext hashes are not revealed.
+type Store struct {
+	path     string
+	cfg      StoreConfig
+	aead     cipher.AEAD
+	nameKey  []byte
+	nonceKey []byte
+	enc      *zstd.Encoder
+	dec      *zstd.Decoder
+}
+
+// Store parameters, saved in its config file during creation.
+type StoreConfig struct {
+	Version int    `json:",omitempty"`
+	Cipher  string `json:",omitempty"`
+	Nonce   string `json:",omitempty"`
+
+	// Compress newly stored chunks, not saved in config
+	Compress bool `json:"-"`
+}
+
+// OpenStore opens or creates the store. Existing store's configuration
+// takes precedence over cfg, which may be empty. key is required only
+// for encrypted stores.
+func OpenStore(path string, key []byte, cfg StoreConfig) (*Store, error) {
+	for _, dir := range []string{"chunks", "generations"} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0700); err != nil {
+			return nil, err
+		}
+	}
+	s := &Store{path: path}
+	cfgPath := filepath.Join(path, "config")
+	data, err := ioutil.ReadFile(cfgPath)
+	if err == nil {
+		if err = json.Unmarshal(data, &s.cfg); err != nil {
+			return nil, err
+		}
+		if cfg.Cipher != "" && cfg.Cipher != s.cfg.Cipher {
+			return nil, errors.New("Store uses different cipher: " + s.cfg.Cipher)
+		}
+		s.cfg.Compress = cfg.Compress
+	} else if os.IsNotExist(err) {
+		if key != nil && cfg.Cipher == "" {
+			cfg.Cipher = CipherXChaCha
+		}
+		if cfg.Cipher != "" && cfg.Nonce == "" {
+			cfg.Nonce = NonceRandom
+		}
+		// Store created before config file appeared has generations
+		gens, err := s.Generations()
+		if err != nil {
+			return nil, err
+		}
+		if len(gens) == 0 {
+			cfg.Version = StoreVersion
+		}
+		s.cfg = cfg
+		if data, err = json.Marshal(s.cfg); err != nil {
+			return nil, err
+		}
+		if err = ioutil.WriteFile(cfgPath, data, 0600); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+	if s.cfg.Compress && s.cfg.Version < 1 {
+		return nil, errors.New("Store format does not support compression")
+	}
+	if s.cfg.Version > StoreVersion {
+		return nil, errors.New("Unsupported store version")
+	}
+	if s.cfg.Compress {
+		if s.enc, err = zstd.NewWriter(nil); err != nil {
+			return nil, err
+		}
+	}
+	if s.dec, err = zstd.NewReader(nil); err != nil {
+		return nil, err
+	}
+	if s.cfg.Cipher == "" {
+		if key != nil {
+			return nil, errors.New("Store is not encrypted")
+		}
+		return s, nil
+	}
+	if key == nil {
+		return nil, errors.New("Store is encrypted, key is required")
+	}
+	if s.cfg.Nonce != NonceRandom && s.cfg.Nonce != NonceConverged {
+		return nil, errors.New("Unknown nonce mode: " + s.cfg.Nonce)
+	}
+	if s.aead, err = NewAEAD(s.cfg.Cipher, subKey(key, "chunk")); err != nil {
+		return nil, err
+	}
+	s.nameKey = subKey(key, "name")
+	s.nonceKey = subKey(key, "nonce")
+	return s, nil
+}
+
+// Chunk's file name: its hash, or keyed hash of it for encrypted store.
+func (s *Store) chunkName(sum []byte) string {
+	if s.aead == nil {
+		return hex.EncodeToString(sum)
+	}
+	mac := blake2b.NewMAC(blake2b.Size, s.nameKey)
+	mac.Write(sum)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Store) chunkPath(sum []byte) string {
+	h := s.chunkName(sum)
+	return filepath.Join(s.path, "chunks", h[:2], h)
+}
+
+// Encrypt data if store is encrypted. Convergent nonce is derived from
+// the plaintext's hash.
+func (s *Store) seal(data, sum, ad []byte) ([]byte, error) {
+	if s.aead == nil {
+		return data, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if s.cfg.Nonce == NonceConverged && sum != nil {
+		mac := blake2b.NewMAC(blake2b.Size, s.nonceKey)
+		mac.Write(sum)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, data, ad), nil
+}
+
+func (s *Store) open(data, ad []byte) ([]byte, error) {
+	if s.aead == nil {
+		return data, nil
+	}
+	if len(data) < s.aead.NonceSize() {
+		return nil, errors.New("Ciphertext is too short")
+	}
+	n := s.aead.NonceSize()
+	return s.aead.Open(nil, data[:n], data[n:], ad)
+}
+
+// Prepend codec header to the chunk, compressing it if this is enabled
+// and makes chunk smaller.
+func (s *Store) pack(data []byte) []byte {
+	if s.cfg.Version < 1 {
+		return data
+	}
+	if s.enc != nil {
+		z := s.enc.EncodeAll(data, []byte{CodecZstd})
+		if len(z) < len(data)+1 {
+			return z
+		}
+	}
+	return append([]byte{CodecRaw}, data...)
+}
+
+func (s *Store) unpack(data []byte) ([]byte, error) {
+	if s.cfg.Version < 1 {
+		return data, nil
+	}
+	if len(data) == 0 {
+		return nil, errors.New("Chunk has no codec header")
+	}
+	switch data[0] {
+	case CodecRaw:
+		return data[1:], nil
+	case CodecZstd:
+		return s.dec.DecodeAll(data[1:], nil)
+	}
+	return nil, errors.New("Unknown chunk codec")
+}
+
+// Atomically write file in the store.
+func (s *Store) writeFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(s.path, "tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// Size of the chunk holding no data: its codec header, nonce and tag.
+func (s *Store) overhead() int64 {
+	var n int64
+	if s.cfg.Version >= 1 {
+		n++
+	}
+	if s.aead != nil {
+		n += int64(s.aead.NonceSize() + s.aead.Overhead())
+	}
+	return n
+}
+
+// Has the store got chunk with that sum? Chunk truncated to its
+// overhead or less, by crash for example, is missing.
+func (s *Store) Has(sum []byte) bool {
+	fi, err := os.Stat(s.chunkPath(sum))
+	return err == nil && fi.Size() > s.overhead()
+}
+
+// Put saves data under its sum. It returns false if the chunk was
+// already stored, so nothing was written. Stored chunk is verified
+// against data first, and replaced if it is damaged.
+func (s *Store) Put(sum, data []byte) (bool, error) {
+	if s.Has(sum) {
+		if stored, err := s.Get(sum); err == nil && bytes.Equal(stored, data) {
+			return false, nil
+		}
+	}
+	p := s.chunkPath(sum)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return false, err
+	}
+	data, err := s.seal(s.pack(data), sum, []byte(s.chunkName(sum)))
+	if err != nil {
+		return false, err
+	}
+	return true, s.writeFile(p, data)
+}
+
+func (s *Store) Get(sum []byte) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.chunkPath(sum))
+	if err != nil {
+		return nil, err
+	}
+	if data, err = s.open(data, []byte(s.chunkName(sum))); err != nil {
+		return nil, err
+	}
+	return s.unpack(data)
+}
+
+func (s *Store) genPath(n int) string {
+	return filepath.Join(s.path, "generations", strconv.Itoa(n))
+}
+
+// Numbers of all retained generations, in ascending order.
+func (s *Store) Generations() ([]int, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(s.path, "generations"))
+	if err != nil {
+		return nil, err
+	}
+	gens := make([]int, 0, len(fis))
+	for _, fi := range fis {
+		n, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue
+		}
+		gens = append(gens, n)
+	}
+	sort.Ints(gens)
+	return gens, nil
+}
+
+func (s *Store) ReadGeneration(n int) (*State, error) {
+	data, err := ioutil.ReadFile(s.genPath(n))
+	if err != nil {
+		return nil, err
+	}
+	if data, err = s.open(data, s.genAD(n)); err != nil {
+		return nil, err
+	}
+	return ReadState(bytes.NewReader(data))
+}
+
+// Associated data of the encrypted generation, binding it to its
+// number, so generations can not be swapped or replayed.
+func (s *Store) genAD(n int) []byte {
+	if s.cfg.Version < 2 {
+		return []byte("generation")
+	}
+	return []byte("generation " + strconv.Itoa(n))
+}
+
+// Lock the store: runs hold it shared until their generation is added,
+// so chunks they have just written are not collected, while GC and
+// pruning hold it exclusively.
+func (s *Store) Lock(exclusive bool) (func(), error) {
+	return waitLock(filepath.Join(s.path, "lock"), !exclusive)
+}
+
+// AddGeneration saves state as the next generation and returns its number.
+// Concurrent runs take the generations' lock, so they get distinct
+// numbers, and existing generation is never overwritten.
+func (s *Store) AddGeneration(st *State) (int, error) {
+	var buf bytes.Buffer
+	if err := st.Write(&buf); err != nil {
+		return 0, err
+	}
+	unlock, err := waitLock(filepath.Join(s.path, "generations.lock"), false)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	gens, err := s.Generations()
+	if err != nil {
+		return 0, err
+	}
+	n := 1
+	if len(gens) > 0 {
+		n = gens[len(gens)-1] + 1
+	}
+	data, err := s.seal(buf.Bytes(), nil, s.genAD(n))
+	if err != nil {
+		return 0, err
+	}
+	fd, err := os.OpenFile(s.genPath(n), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = fd.Write(data); err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(s.genPath(n))
+		return 0, err
+	}
+	syncDir(filepath.Dir(s.genPath(n)))
+	return n, nil
+}
+
+// GC removes chunks not referenced by any retained generation, store
+// has to be locked exclusively. With
+// dryRun nothing is removed, only counted. It returns the number of
+// unreferenced chunks and their total size.
+func (s *Store) GC(dryRun bool) (int64, int64, error) {
+	gens, err := s.Generations()
+	if err != nil {
+		return 0, 0, err
+	}
+	refs := make(map[string]struct{})
+	for _, n := range gens {
+		st, err := s.ReadGeneration(n)
+		if err != nil {
+			return 0, 0, err
+		}
+		for i := int64(0); i < st.Blocks(); i++ {
+			refs[s.chunkName(st.Hash(i))] = struct{}{}
+		}
+	}
+	var count, size int64
+	err = filepath.Walk(
+		filepath.Join(s.path, "chunks"),
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+			if _, ok := refs[fi.Name()]; ok {
+				return nil
+			}
+			count++
+			size += fi.Size()
+			if dryRun {
+				return nil
+			}
+			return os.Remove(path)
+		},
+	)
+	return count, size, err
+}
@@ -0,0 +1,315 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Encrypted store in temporary directory.
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := OpenStore(t.TempDir(), bytes.Repeat([]byte{1}, 32), StoreConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Chunk truncated by crash is missing, and stored again.
+func TestStoreDamagedChunk(t *testing.T) {
+	s := testStore(t)
+	hash, _ := LookupHash("")
+	data := []byte("block contents")
+	sum := hash.Sum(data)
+	if _, err := s.Put(sum, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(s.chunkPath(sum), s.overhead()); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(sum) {
+		t.Fatal("truncated chunk is present")
+	}
+	if written, err := s.Put(sum, data); err != nil || !written {
+		t.Fatalf("truncated chunk is not replaced: %v", err)
+	}
+	fd, err := os.OpenFile(s.chunkPath(sum), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte{0xff}, s.overhead())
+	fd.Close()
+	if written, err := s.Put(sum, data); err != nil || !written {
+		t.Fatalf("corrupted chunk is not replaced: %v", err)
+	}
+	if got, err := s.Get(sum); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("chunk is not restored: %v", err)
+	}
+}
+
+// Encrypted generations are bound to their numbers.
+func TestStoreGenerationSwap(t *testing.T) {
+	s := testStore(t)
+	hash, _ := LookupHash("")
+	for i := 0; i < 2; i++ {
+		if _, err := s.AddGeneration(NewState(int64(16*(i+1)), 16, hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Rename(s.genPath(1), s.genPath(2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReadGeneration(2); err == nil {
+		t.Fatal("swapped generation is accepted")
+	}
+}
+
+// Chunks are deduplicated and read back in every store mode.
+func TestStorePutGet(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	for name, cfg := range map[string]struct {
+		key []byte
+		cfg StoreConfig
+	}{
+		"plain":      {nil, StoreConfig{}},
+		"compressed": {nil, StoreConfig{Compress: true}},
+		"random":     {key, StoreConfig{Nonce: NonceRandom}},
+		"convergent": {key, StoreConfig{Nonce: NonceConverged, Compress: true}},
+		"aes-gcm":    {key, StoreConfig{Cipher: CipherAESGCM}},
+	} {
+		path := t.TempDir()
+		s, err := OpenStore(path, cfg.key, cfg.cfg)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		hash, _ := LookupHash("")
+		compressible := bytes.Repeat([]byte("compressible "), 1000)
+		random := make([]byte, 4096)
+		rand.Read(random)
+		for _, data := range [][]byte{compressible, random} {
+			sum := hash.Sum(data)
+			if s.Has(sum) {
+				t.Fatal(name, "chunk is present before it is stored")
+			}
+			if written, err := s.Put(sum, data); err != nil || !written {
+				t.Fatal(name, written, err)
+			}
+			if written, err := s.Put(sum, data); err != nil || written {
+				t.Fatal(name, "chunk is not deduplicated", err)
+			}
+			if got, err := s.Get(sum); err != nil || !bytes.Equal(got, data) {
+				t.Fatal(name, "chunk differs", err)
+			}
+		}
+		if fi, err := os.Stat(s.chunkPath(hash.Sum(compressible))); err != nil ||
+			cfg.cfg.Compress != (fi.Size() < int64(len(compressible))) {
+			t.Fatal(name, "compression is not applied as asked", err)
+		}
+		if cfg.key != nil {
+			if _, err = OpenStore(path, nil, StoreConfig{}); err == nil {
+				t.Fatal(name, "encrypted store is opened without key")
+			}
+			other, err := OpenStore(path, bytes.Repeat([]byte{2}, 32), StoreConfig{})
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			if other.Has(hash.Sum(random)) {
+				t.Fatal(name, "chunk is named after plaintext hash")
+			}
+		}
+	}
+}
+
+// GC removes only chunks not referenced by retained generations.
+func TestStoreGC(t *testing.T) {
+	s := testStore(t)
+	hash, _ := LookupHash("")
+	blocks := make([][]byte, 4)
+	for i := range blocks {
+		blocks[i] = make([]byte, 16)
+		rand.Read(blocks[i])
+		if _, err := s.Put(hash.Sum(blocks[i]), blocks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Generation 1 references blocks 0 and 1, generation 2 blocks 1 and 2
+	for _, refs := range [][]int{{0, 1}, {1, 2}} {
+		st := NewState(32, 16, hash)
+		for i, ref := range refs {
+			copy(st.Hash(int64(i)), hash.Sum(blocks[ref]))
+		}
+		if _, err := s.AddGeneration(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, size, err := s.GC(true); err != nil || count != 1 || size == 0 {
+		t.Fatalf("dry run: %d chunks, %d bytes: %v", count, size, err)
+	}
+	if !s.Has(hash.Sum(blocks[3])) {
+		t.Fatal("dry run removed the chunk")
+	}
+	if err := os.Remove(s.genPath(1)); err != nil {
+		t.Fatal(err)
+	}
+	if count, _, err := s.GC(false); err != nil || count != 2 {
+		t.Fatalf("%d chunks removed: %v", count, err)
+	}
+	for i, present := range []bool{false, true, true, false} {
+		if s.Has(hash.Sum(blocks[i])) != present {
+			t.Fatalf("block %d: present is not %v", i, present)
+		}
+	}
+	if gens, err := s.Generations(); err != nil || len(gens) != 1 || gens[0] != 2 {
+		t.Fatal(gens, err)
+	}
+}
+
+// Runs into the store keep generations restorable and prune old ones.
+func TestStoreRuns(t *testing.T) {
+	j := testJob(t, 1<<20)
+	j.Store = filepath.Join(filepath.Dir(j.Dst), "store")
+	j.KeepLast = 1
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.OpenFile(j.Src, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt(bytes.Repeat([]byte{0xaa}, 64<<10), 0)
+	fd.Close()
+	if err = j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenStore(j.Store, nil, StoreConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gens, err := s.Generations()
+	if err != nil || len(gens) != 1 || gens[0] != 2 {
+		t.Fatal(gens, err)
+	}
+	st, err := s.ReadGeneration(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored []byte
+	for i := int64(0); i < st.Blocks(); i++ {
+		data, err := s.Get(st.Hash(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored = append(restored, data...)
+	}
+	path := filepath.Join(filepath.Dir(j.Dst), "restored")
+	if err = ioutil.WriteFile(path, restored, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sameFiles(t, j.Src, path)
+	if count, _, err := s.GC(true); err != nil || count != 0 {
+		t.Fatalf("%d unreferenced chunks left: %v", count, err)
+	}
+}
+
+// Concurrent runs adding generations to one store get distinct numbers.
+func TestStoreConcurrentGenerations(t *testing.T) {
+	path := t.TempDir()
+	hash, _ := LookupHash("")
+	nums := make(chan int, 40)
+	errs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		go func() {
+			s, err := OpenStore(path, nil, StoreConfig{})
+			for i := 0; i < 10 && err == nil; i++ {
+				var n int
+				if n, err = s.AddGeneration(NewState(16, 16, hash)); err == nil {
+					nums <- n
+				}
+			}
+			errs <- err
+		}()
+	}
+	for w := 0; w < 4; w++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(nums)
+	seen := make(map[int]bool)
+	for n := range nums {
+		if seen[n] {
+			t.Fatalf("generation %d is added twice", n)
+		}
+		seen[n] = true
+	}
+	if len(seen) != 40 {
+		t.Fatalf("%d generations instead of 40", len(seen))
+	}
+}
+
+// GC waits for the run holding the store, so its chunks not referenced
+// by generation yet are not collected.
+func TestStoreGCWaitsForRun(t *testing.T) {
+	s := testStore(t)
+	hash, _ := LookupHash("")
+	unlock, err := s.Lock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("chunk of the running sync")
+	if _, err = s.Put(hash.Sum(data), data); err != nil {
+		t.Fatal(err)
+	}
+	collected := make(chan int64)
+	go func() {
+		unlock, err := s.Lock(true)
+		if err != nil {
+			t.Error(err)
+			collected <- -1
+			return
+		}
+		defer unlock()
+		count, _, _ := s.GC(false)
+		collected <- count
+	}()
+	select {
+	case <-collected:
+		t.Fatal("GC does not wait for the run")
+	case <-time.After(100 * time.Millisecond):
+	}
+	st := NewState(16, 16, hash)
+	copy(st.Hash(0), hash.Sum(data))
+	if _, err = s.AddGeneration(st); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if count := <-collected; count != 0 {
+		t.Fatalf("%d chunks collected", count)
+	}
+	if !s.Has(hash.Sum(data)) {
+		t.Fatal("chunk of the run is collected")
+	}
+}
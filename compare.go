@@ -0,0 +1,102 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log"
+	"os"
+)
+
+// Mirror source to destination without the state: read both and write
+// only differing blocks.
+func compare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	srcPath := fs.String("src", "", "Path to source disk")
+	dstPath := fs.String("dst", "", "Path to destination disk")
+	blk := fs.Int64("blk", DefaultBlk, "Block size (KiB)")
+	dryRun := fs.Bool("n", false, "Only report differing blocks, do not write them")
+	parseFlags(fs, args)
+	if *srcPath == "" || *dstPath == "" {
+		log.Fatalln("-src and -dst are required")
+	}
+	bs := *blk * (1 << 10)
+
+	src, err := os.Open(*srcPath)
+	if err != nil {
+		log.Fatalln("Unable to open src:", err)
+	}
+	defer src.Close()
+	size, err := srcSize(src)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	mode := os.O_RDWR | os.O_CREATE
+	if *dryRun {
+		mode = os.O_RDONLY
+	}
+	dst, err := os.OpenFile(*dstPath, mode, 0600)
+	if err != nil {
+		log.Fatalln("Unable to open dst:", err)
+	}
+	defer dst.Close()
+
+	blocks := size / bs
+	if size%bs != 0 {
+		blocks++
+	}
+	log.Println(blocks, bs, "byte blocks")
+	srcBuf := make([]byte, bs)
+	dstBuf := make([]byte, bs)
+	var changed int64
+	prn("[")
+	for i := int64(0); i < blocks; i++ {
+		data := srcBuf[:min(bs, size-i*bs)]
+		if _, err = src.ReadAt(data, i*bs); err != nil && err != io.EOF {
+			log.Fatalln("Error during src read:", err)
+		}
+
+		// Destination may be shorter, its missing part differs
+		n, err := dst.ReadAt(dstBuf[:len(data)], i*bs)
+		if err != nil && err != io.EOF {
+			log.Fatalln("Error during dst read:", err)
+		}
+		if n == len(data) && bytes.Equal(data, dstBuf[:n]) {
+			prn(".")
+			continue
+		}
+		changed++
+		prn("%")
+		if *dryRun {
+			continue
+		}
+		if _, err = dst.WriteAt(data, i*bs); err != nil {
+			log.Fatalln("Error during dst write:", err)
+		}
+	}
+	prn("]\n")
+	if !*dryRun {
+		if err = dst.Sync(); err != nil {
+			log.Fatalln("Unable to sync dst:", err)
+		}
+	}
+	log.Println(changed, "of", blocks, "blocks differ")
+}
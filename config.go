@@ -0,0 +1,197 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const DefaultBlk = 2 * 1 << 10
+
+// Configuration file with multiple jobs, each in its own [job.NAME]
+// table, and named profiles of command line options, each in its own
+// [profile.NAME] table.
+type Config struct {
+	Jobs     map[string]*Job                   `toml:"job"`
+	Profiles map[string]map[string]interface{} `toml:"profile"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	var cfg Config
+	md, err := toml.DecodeFile(path, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, errors.New("Unknown config key: " + undecoded[0].String())
+	}
+	// Keys set in jobs' and members' tables, so members inherit only
+	// the missing ones
+	var raw struct {
+		Jobs map[string]map[string]interface{} `toml:"job"`
+	}
+	if _, err = toml.DecodeFile(path, &raw); err != nil {
+		return nil, err
+	}
+	for name, job := range cfg.Jobs {
+		job.Name = name
+		if job.Blk == 0 {
+			job.Blk = DefaultBlk
+		}
+		members := job.Group
+		if len(members) == 0 {
+			members = []*Job{job}
+		}
+		if len(job.Group) > 0 {
+			if key := findKey(raw.Jobs[name], memberKeys); key != "" {
+				return nil, errors.New("Job " + name + ": group has " + key)
+			}
+		}
+		tables, _ := raw.Jobs[name]["group"].([]map[string]interface{})
+		for i, m := range job.Group {
+			if len(m.Group) > 0 {
+				return nil, errors.New("Job " + name + ": nested groups")
+			}
+			var table map[string]interface{}
+			if i < len(tables) {
+				table = tables[i]
+			}
+			if key := findKey(table, groupKeys); key != "" {
+				return nil, errors.New("Job " + name + ": group's member has " + key)
+			}
+			m.inherit(job, table)
+		}
+		for _, m := range members {
+			if m.Src == "" || (m.State == "" && m.StateDir == "") {
+				return nil, errors.New("Job " + name + ": src and state or state_dir are required")
+			}
+			if m.Dst == "" && m.Store == "" {
+				return nil, errors.New("Job " + name + ": either dst or store is required")
+			}
+			if err = checkRetry(m.Retry); err != nil {
+				return nil, errors.New("Job " + name + ": " + err.Error())
+			}
+		}
+		if job.Cron != "" && job.Interval.Duration != 0 {
+			return nil, errors.New("Job " + name + ": both cron and interval are set")
+		}
+		if job.Cron != "" {
+			if _, err = ParseCron(job.Cron); err != nil {
+				return nil, errors.New("Job " + name + ": " + err.Error())
+			}
+		}
+		if job.ScrubCron != "" && job.ScrubInterval.Duration != 0 {
+			return nil, errors.New("Job " + name + ": both scrub_cron and scrub_interval are set")
+		}
+		if job.ScrubCron != "" {
+			if _, err = ParseCron(job.ScrubCron); err != nil {
+				return nil, errors.New("Job " + name + ": " + err.Error())
+			}
+		}
+	}
+	if err = cfg.checkDestinations(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// First in sorted order of the table's keys found in the set, empty if
+// none.
+func findKey(table map[string]interface{}, keys map[string]bool) string {
+	var found []string
+	for key := range table {
+		if keys[key] {
+			found = append(found, key)
+		}
+	}
+	if len(found) == 0 {
+		return ""
+	}
+	sort.Strings(found)
+	return found[0]
+}
+
+// Check that no two jobs, or group's members, write to the same
+// destination, so concurrent daemon's jobs never clash. Chunk stores
+// can be shared, as runs and GC take store's lock.
+func (cfg *Config) checkDestinations() error {
+	seen := make(map[string]string)
+	for _, name := range cfg.Names() {
+		job := cfg.Jobs[name]
+		members := job.Group
+		if len(members) == 0 {
+			members = []*Job{job}
+		}
+		for i, m := range members {
+			if m.Dst == "" || m.Dst == os.DevNull {
+				continue
+			}
+			mname := name
+			if len(job.Group) > 0 {
+				mname += "/" + strconv.Itoa(i)
+			}
+			dst := identity(m.Dst)
+			if other, ok := seen[dst]; ok {
+				return errors.New("Jobs " + other + " and " + mname + " have the same dst: " + dst)
+			}
+			seen[dst] = mname
+		}
+	}
+	return nil
+}
+
+// Duration written as "1h30m" string in configuration file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
+}
+
+// Names of all jobs in sorted order.
+func (cfg *Config) Names() []string {
+	names := make([]string, 0, len(cfg.Jobs))
+	for name := range cfg.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Jobs with specified comma separated names.
+func (cfg *Config) Select(names string) ([]*Job, error) {
+	var jobs []*Job
+	for _, name := range strings.Split(names, ",") {
+		job, ok := cfg.Jobs[name]
+		if !ok {
+			return nil, errors.New("Unknown job: " + name)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
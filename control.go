@@ -0,0 +1,376 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrCancelled = errors.New("Run was cancelled")
+
+// How often progress is streamed by control API.
+const ControlProgressInterval = time.Second
+
+// Run's control: reading can be paused, throttled or cancelled from
+// another goroutine.
+type control struct {
+	mu     sync.Mutex
+	paused chan struct{} // closed on resume, nil if not paused
+	cancel chan struct{} // closed on cancel, recreated for each run
+	rate   int64         // bytes per second, unlimited if zero
+	next   time.Time     // when the next read is allowed by rate
+	delay  time.Duration // added to each read under system's pressure
+}
+
+func (c *control) reset() {
+	c.mu.Lock()
+	c.cancel = make(chan struct{})
+	c.mu.Unlock()
+}
+
+func (c *control) pause() {
+	c.mu.Lock()
+	if c.paused == nil {
+		c.paused = make(chan struct{})
+	}
+	c.mu.Unlock()
+}
+
+func (c *control) resume() {
+	c.mu.Lock()
+	if c.paused != nil {
+		close(c.paused)
+		c.paused = nil
+	}
+	c.mu.Unlock()
+}
+
+func (c *control) stop() {
+	c.mu.Lock()
+	select {
+	case <-c.cancel:
+	default:
+		if c.cancel != nil {
+			close(c.cancel)
+		}
+	}
+	c.mu.Unlock()
+}
+
+func (c *control) throttle(rate int64) {
+	c.mu.Lock()
+	c.rate = rate
+	c.mu.Unlock()
+}
+
+// Wait while paused, failing if cancelled.
+func (c *control) wait() error {
+	c.mu.Lock()
+	paused, cancel := c.paused, c.cancel
+	c.mu.Unlock()
+	if paused != nil {
+		select {
+		case <-paused:
+		case <-cancel:
+		}
+	}
+	select {
+	case <-cancel:
+		return ErrCancelled
+	default:
+	}
+	return nil
+}
+
+func (c *control) backoff(delay time.Duration) {
+	c.mu.Lock()
+	c.delay = delay
+	c.mu.Unlock()
+}
+
+// Account n read bytes, sleeping to keep within the rate.
+func (c *control) limit(n int) {
+	c.mu.Lock()
+	if c.rate <= 0 {
+		delay := c.delay
+		c.mu.Unlock()
+		time.Sleep(delay)
+		return
+	}
+	now := time.Now()
+	if c.next.Before(now) {
+		c.next = now
+	}
+	c.next = c.next.Add(time.Duration(float64(n) / float64(c.rate) * float64(time.Second)))
+	delay := c.next.Sub(now) + c.delay
+	c.mu.Unlock()
+	time.Sleep(delay)
+}
+
+func (c *control) state() (paused bool, rate int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused != nil, c.rate
+}
+
+// Controls of the job and its group members.
+func (j *Job) controls() []*control {
+	ctls := []*control{&j.ctl}
+	for _, m := range j.Group {
+		ctls = append(ctls, &m.ctl)
+	}
+	return ctls
+}
+
+func (j *Job) Pause() {
+	for _, c := range j.controls() {
+		c.pause()
+	}
+}
+
+func (j *Job) Resume() {
+	for _, c := range j.controls() {
+		c.resume()
+	}
+}
+
+func (j *Job) Cancel() {
+	for _, c := range j.controls() {
+		c.stop()
+	}
+}
+
+// Limit reading to rate bytes per second, zero removes the limit.
+func (j *Job) Throttle(rate int64) {
+	for _, c := range j.controls() {
+		c.throttle(rate)
+	}
+}
+
+// Run daemon's job now instead of waiting for its schedule.
+func (j *Job) Start() error {
+	if j.start == nil {
+		return errors.New("Job is not scheduled by daemon")
+	}
+	select {
+	case j.start <- struct{}{}:
+		return nil
+	default:
+		return errors.New("Job start is already pending")
+	}
+}
+
+func (j *Job) controlStatus() controlStatus {
+	s := controlStatus{Name: j.Name}
+	s.Paused, s.Rate = j.ctl.state()
+	s.Done, s.Size = j.Progress()
+	return s
+}
+
+type controlStatus struct {
+	Name   string `json:"name"`
+	Paused bool   `json:"paused"`
+	Rate   int64  `json:"rate,omitempty"`
+	Done   int64  `json:"done"`
+	Size   int64  `json:"size"`
+}
+
+// Version of control API, prefixing its paths.
+const ControlAPIVersion = "v1"
+
+// OpenAPI definition of control API, served at /v1/openapi.json.
+//
+//go:embed control.v1.json
+var controlAPIDefinition []byte
+
+// Whether TCP address listens on loopback interface only.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Serve control API for the jobs in background, either on
+// "unix:/path/to/socket" or "host:port". Requests have to carry the
+// token as bearer one, if it is set. It is required on TCP, unless it
+// listens on loopback.
+func serveControl(addr, token string, jobs []*Job) error {
+	var l net.Listener
+	var err error
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		os.Remove(path)
+		if l, err = net.Listen("unix", path); err != nil {
+			return err
+		}
+		if err = os.Chmod(path, 0600); err != nil {
+			return err
+		}
+	} else if token == "" && !isLoopback(addr) {
+		return errors.New("Control API on non-loopback address requires token")
+	} else if l, err = net.Listen("tcp", addr); err != nil {
+		return err
+	}
+	// gRPC clients speak HTTP/2 without TLS
+	srv := &http.Server{Handler: controlHandler(token, jobs), Protocols: new(http.Protocols)}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	go func() {
+		log.Println("Unable to serve control API:", srv.Serve(l))
+	}()
+	return nil
+}
+
+// Job with that name, the only one if it is empty.
+func findJob(jobs []*Job, name string) (*Job, error) {
+	if name == "" && len(jobs) == 1 {
+		return jobs[0], nil
+	}
+	for _, job := range jobs {
+		if job.Name == name {
+			return job, nil
+		}
+	}
+	return nil, errors.New("Unknown job: " + name)
+}
+
+// Control API's handler for the jobs, checking the token if it is set.
+func controlHandler(token string, jobs []*Job) http.Handler {
+	find := func(w http.ResponseWriter, r *http.Request) *Job {
+		job, err := findJob(jobs, r.FormValue("job"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+		return job
+	}
+	mux := http.NewServeMux()
+	v := "/" + ControlAPIVersion
+	mux.HandleFunc("GET "+v+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(controlAPIDefinition)
+	})
+	mux.HandleFunc("GET "+v+"/control.proto", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(controlProtoDefinition)
+	})
+	mux.Handle("POST /"+GRPCService+"/", grpcHandler(jobs))
+	mux.HandleFunc("GET "+v+"/status", func(w http.ResponseWriter, r *http.Request) {
+		statuses := make([]controlStatus, 0, len(jobs))
+		for _, job := range jobs {
+			statuses = append(statuses, job.controlStatus())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statuses)
+	})
+	mux.HandleFunc("GET "+v+"/progress", func(w http.ResponseWriter, r *http.Request) {
+		job := find(w, r)
+		if job == nil {
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		ticker := time.NewTicker(ControlProgressInterval)
+		defer ticker.Stop()
+		for {
+			if enc.Encode(job.controlStatus()) != nil {
+				return
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+	mux.HandleFunc("GET "+v+"/result", func(w http.ResponseWriter, r *http.Request) {
+		job := find(w, r)
+		if job == nil {
+			return
+		}
+		n := job.last.Load()
+		if n == nil {
+			http.Error(w, "Job has not finished yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n)
+	})
+	mux.HandleFunc("POST "+v+"/start", func(w http.ResponseWriter, r *http.Request) {
+		if job := find(w, r); job != nil {
+			if err := job.Start(); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	action := func(do func(*Job)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if job := find(w, r); job != nil {
+				do(job)
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}
+	}
+	mux.HandleFunc("POST "+v+"/pause", action((*Job).Pause))
+	mux.HandleFunc("POST "+v+"/resume", action((*Job).Resume))
+	mux.HandleFunc("POST "+v+"/cancel", action((*Job).Cancel))
+	mux.HandleFunc("POST "+v+"/throttle", func(w http.ResponseWriter, r *http.Request) {
+		rate, err := parseSize(r.FormValue("rate"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if job := find(w, r); job != nil {
+			job.Throttle(rate)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	if token == "" {
+		return mux
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
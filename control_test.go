@@ -0,0 +1,255 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestControlToken(t *testing.T) {
+	job := &Job{Name: "a"}
+	server := httptest.NewServer(controlHandler("secret", []*Job{job}))
+	defer server.Close()
+	for auth, want := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusNoContent,
+	} {
+		req, _ := http.NewRequest("POST", server.URL+"/v1/pause", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%q: status %d instead of %d", auth, resp.StatusCode, want)
+		}
+	}
+	if paused, _ := job.ctl.state(); !paused {
+		t.Fatal("job is not paused")
+	}
+}
+
+// Every path of the definition is served.
+func TestControlDefinition(t *testing.T) {
+	var def struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(controlAPIDefinition, &def); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(controlHandler("", []*Job{{Name: "a"}}))
+	defer server.Close()
+	for path, methods := range def.Paths {
+		for method := range methods {
+			if method == "get" && path == "/progress" {
+				continue
+			}
+			req, _ := http.NewRequest(map[string]string{"get": "GET", "post": "POST"}[method], server.URL+"/v1"+path, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusMethodNotAllowed ||
+				resp.StatusCode == http.StatusNotFound && path != "/result" {
+				t.Errorf("%s %s: status %d", method, path, resp.StatusCode)
+			}
+		}
+	}
+}
+
+func TestControlLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:0": true,
+		"[::1]:0":     true,
+		"localhost:0": true,
+		":0":          false,
+		"0.0.0.0:0":   false,
+		"10.0.0.1:0":  false,
+	} {
+		if isLoopback(addr) != want {
+			t.Errorf("%s: loopback is not %v", addr, want)
+		}
+	}
+	if err := serveControl(":0", "", nil); err == nil {
+		t.Fatal("control API is served on all interfaces without token")
+	}
+}
+
+func TestStatusHealthy(t *testing.T) {
+	status := NewStatus()
+	job := &Job{Name: "test"}
+	js := status.Add(job)
+	if !status.Healthy(time.Minute) {
+		t.Fatal("Fresh job is not healthy")
+	}
+	status.mu.Lock()
+	js.beat = time.Now().Add(-2 * time.Minute)
+	status.mu.Unlock()
+	if status.Healthy(time.Minute) {
+		t.Fatal("Stuck scheduler loop is healthy")
+	}
+	status.Beat(js)
+	if !status.Healthy(time.Minute) {
+		t.Fatal("Beating scheduler loop is not healthy")
+	}
+
+	status.Running(js)
+	job.beat.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+	if status.Healthy(time.Minute) {
+		t.Fatal("Hung job is healthy")
+	}
+	if s := status.Summary(); s != "test running" {
+		t.Fatal("Unexpected summary:", s)
+	}
+	job.bs = 1
+	job.size.Store(4)
+	job.block(0, blockChanged)
+	if !status.Healthy(time.Minute) {
+		t.Fatal("Progressing job is not healthy")
+	}
+	if s := status.Summary(); s != "test running 25.0%" {
+		t.Fatal("Unexpected summary:", s)
+	}
+	status.Finished(js, errors.New("failed"))
+	if s := status.Summary(); s != "test failed" {
+		t.Fatal("Unexpected summary:", s)
+	}
+}
+
+// Call gRPC method of control API, returning its replies.
+func grpcCall(t *testing.T, base, method string, req protoBuf) ([]protoBuf, string) {
+	t.Helper()
+	p := new(http.Protocols)
+	p.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: p}}
+	frame := make([]byte, 5, 5+len(req))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(req)))
+	hreq, _ := http.NewRequest("POST", base+"/"+GRPCService+"/"+method, bytes.NewReader(append(frame, req...)))
+	hreq.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(hreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var replies []protoBuf
+	for method != "WatchProgress" || len(replies) == 0 {
+		if _, err = io.ReadFull(resp.Body, frame); err != nil {
+			break
+		}
+		msg := make(protoBuf, binary.BigEndian.Uint32(frame[1:]))
+		if _, err = io.ReadFull(resp.Body, msg); err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, msg)
+	}
+	return replies, resp.Trailer.Get("Grpc-Status")
+}
+
+func TestControlGRPC(t *testing.T) {
+	a := &Job{Name: "a", start: make(chan struct{}, 1)}
+	b := &Job{Name: "b"}
+	b.last.Store(&Notification{Job: "b", Result: "ok", Changed: 7})
+	server := httptest.NewUnstartedServer(controlHandler("", []*Job{a, b}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+	fields := func(msg protoBuf) map[int]any {
+		got := make(map[int]any)
+		if err := protoFields(msg, func(field int, v uint64, b []byte) {
+			if b != nil {
+				got[field] = string(b)
+			} else {
+				got[field] = int64(v)
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	job := func(name string, rate int64) protoBuf {
+		var req protoBuf
+		req.string(1, name)
+		req.int(2, rate)
+		return req
+	}
+
+	replies, status := grpcCall(t, server.URL, "ListJobs", nil)
+	if status != "0" || len(replies) != 1 {
+		t.Fatal("ListJobs failed:", status)
+	}
+	var names []any
+	protoFields(replies[0], func(field int, v uint64, b []byte) {
+		names = append(names, fields(b)[1])
+	})
+	if !reflect.DeepEqual(names, []any{"a", "b"}) {
+		t.Fatal("Unexpected jobs:", names)
+	}
+
+	if _, status = grpcCall(t, server.URL, "StartJob", job("a", 0)); status != "0" {
+		t.Fatal("StartJob failed:", status)
+	}
+	select {
+	case <-a.start:
+	default:
+		t.Fatal("Job is not started")
+	}
+	if _, status = grpcCall(t, server.URL, "StartJob", job("b", 0)); status != strconv.Itoa(GRPCFailedPrecondition) {
+		t.Fatal("Unscheduled job is started:", status)
+	}
+	if _, status = grpcCall(t, server.URL, "ThrottleJob", job("a", 1<<20)); status != "0" {
+		t.Fatal("ThrottleJob failed:", status)
+	}
+	if _, rate := a.ctl.state(); rate != 1<<20 {
+		t.Fatal("Job is not throttled")
+	}
+	replies, status = grpcCall(t, server.URL, "WatchProgress", job("a", 0))
+	if len(replies) != 1 || fields(replies[0])[3] != int64(1<<20) {
+		t.Fatal("Unexpected progress:", status)
+	}
+
+	if _, status = grpcCall(t, server.URL, "GetResult", job("a", 0)); status != strconv.Itoa(GRPCNotFound) {
+		t.Fatal("Result of unfinished job:", status)
+	}
+	replies, status = grpcCall(t, server.URL, "GetResult", job("b", 0))
+	if status != "0" || fields(replies[0])[6] != "ok" || fields(replies[0])[11] != int64(7) {
+		t.Fatal("Unexpected result:", status)
+	}
+	if _, status = grpcCall(t, server.URL, "PauseJob", job("c", 0)); status != strconv.Itoa(GRPCNotFound) {
+		t.Fatal("Unknown job is paused:", status)
+	}
+	if _, status = grpcCall(t, server.URL, "Unknown", nil); status != strconv.Itoa(GRPCUnimplemented) {
+		t.Fatal("Unknown method is called:", status)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parsed five field cron expression: minute, hour, day of month, month
+// and day of week. Each field is a set of allowed values.
+type Cron struct {
+	fields [5]map[int]bool
+	domAny bool
+	dowAny bool
+}
+
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// ParseCron parses comma separated lists of values, "*", ranges "A-B"
+// and steps "*/N", "A-B/N".
+func ParseCron(expr string) (*Cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("Cron expression must have 5 fields")
+	}
+	c := Cron{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	for i, field := range fields {
+		c.fields[i] = make(map[int]bool)
+		min, max := cronRanges[i][0], cronRanges[i][1]
+		for _, part := range strings.Split(field, ",") {
+			step := 1
+			if n := strings.Index(part, "/"); n != -1 {
+				var err error
+				if step, err = strconv.Atoi(part[n+1:]); err != nil || step < 1 {
+					return nil, errors.New("Invalid cron step: " + part)
+				}
+				part = part[:n]
+			}
+			from, to := min, max
+			if part != "*" {
+				bounds := strings.SplitN(part, "-", 2)
+				var err error
+				if from, err = strconv.Atoi(bounds[0]); err != nil {
+					return nil, errors.New("Invalid cron value: " + part)
+				}
+				to = from
+				if len(bounds) == 2 {
+					if to, err = strconv.Atoi(bounds[1]); err != nil {
+						return nil, errors.New("Invalid cron value: " + part)
+					}
+				}
+			}
+			if i == 4 && to == 7 {
+				// Sunday can be written as 7 too
+				c.fields[i][0] = true
+				if to = 6; from == 7 {
+					continue
+				}
+			}
+			if from < min || to > max || from > to {
+				return nil, errors.New("Cron value out of range: " + part)
+			}
+			for v := from; v <= to; v += step {
+				c.fields[i][v] = true
+			}
+		}
+	}
+	return &c, nil
+}
+
+func (c *Cron) matchDay(t time.Time) bool {
+	dom := c.fields[2][t.Day()]
+	dow := c.fields[4][int(t.Weekday())]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	// Cron treats restricted both day fields as either of them
+	return dom || dow
+}
+
+// Next time after t matching the expression in t's location. Zero time
+// is returned if there is none during the next five years. Wall clock
+// time skipped by DST transition never matches, and repeated one
+// matches only once.
+func (c *Cron) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		var next time.Time
+		switch {
+		case !c.fields[3][int(t.Month())]:
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.matchDay(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case !c.fields[1][t.Hour()]:
+			next = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case !c.fields[0][t.Minute()]:
+			next = t.Add(time.Minute)
+		default:
+			first := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+			if !first.Before(t) {
+				return t
+			}
+			next = t.Add(time.Minute)
+		}
+		if !next.After(t) {
+			// Midnight or hour skipped by DST transition
+			next = t.Add(time.Hour)
+		}
+		t = next
+	}
+	return time.Time{}
+}
@@ -0,0 +1,117 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func zone(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skip(err)
+	}
+	return loc
+}
+
+func TestCronNext(t *testing.T) {
+	utc := time.UTC
+	kolkata := zone(t, "Asia/Kolkata")
+	chatham := zone(t, "Pacific/Chatham")
+	for _, c := range []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"0 3 * * *", time.Date(2024, 1, 1, 2, 0, 0, 0, utc), time.Date(2024, 1, 1, 3, 0, 0, 0, utc)},
+		{"0 3 * * *", time.Date(2024, 1, 1, 3, 0, 0, 0, utc), time.Date(2024, 1, 2, 3, 0, 0, 0, utc)},
+		{"*/15 * * * *", time.Date(2024, 1, 1, 3, 7, 30, 0, utc), time.Date(2024, 1, 1, 3, 15, 0, 0, utc)},
+		{"30 4 1 * *", time.Date(2024, 1, 31, 5, 0, 0, 0, utc), time.Date(2024, 2, 1, 4, 30, 0, 0, utc)},
+		{"0 0 29 2 *", time.Date(2024, 3, 1, 0, 0, 0, 0, utc), time.Date(2028, 2, 29, 0, 0, 0, 0, utc)},
+		{"0 12 * * 0", time.Date(2024, 1, 1, 0, 0, 0, 0, utc), time.Date(2024, 1, 7, 12, 0, 0, 0, utc)},
+		{"0 12 1 * 1", time.Date(2024, 1, 2, 0, 0, 0, 0, utc), time.Date(2024, 1, 8, 12, 0, 0, 0, utc)},
+
+		// Half and quarter hour zones
+		{"0 3 * * *", time.Date(2024, 1, 1, 12, 0, 0, 0, kolkata), time.Date(2024, 1, 2, 3, 0, 0, 0, kolkata)},
+		{"0 * * * *", time.Date(2024, 1, 1, 12, 10, 0, 0, kolkata), time.Date(2024, 1, 1, 13, 0, 0, 0, kolkata)},
+		{"0 0 1 * *", time.Date(2024, 1, 15, 0, 0, 0, 0, kolkata), time.Date(2024, 2, 1, 0, 0, 0, 0, kolkata)},
+		{"45 5 * * *", time.Date(2024, 1, 1, 6, 0, 0, 0, chatham), time.Date(2024, 1, 2, 5, 45, 0, 0, chatham)},
+	} {
+		cron, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cron.Next(c.from); !got.Equal(c.want) {
+			t.Errorf("%q after %s: %s instead of %s", c.expr, c.from, got, c.want)
+		}
+	}
+}
+
+func TestCronDST(t *testing.T) {
+	ny := zone(t, "America/New_York")
+
+	// 02:30 does not exist on 2024-03-10
+	cron, _ := ParseCron("30 2 * * *")
+	got := cron.Next(time.Date(2024, 3, 10, 0, 0, 0, 0, ny))
+	if want := time.Date(2024, 3, 11, 2, 30, 0, 0, ny); !got.Equal(want) {
+		t.Errorf("spring forward: %s instead of %s", got, want)
+	}
+	cron, _ = ParseCron("0 * * * *")
+	got = cron.Next(time.Date(2024, 3, 10, 1, 30, 0, 0, ny))
+	if want := time.Date(2024, 3, 10, 3, 0, 0, 0, ny); !got.Equal(want) {
+		t.Errorf("spring forward hourly: %s instead of %s", got, want)
+	}
+
+	// 01:30 happens twice on 2024-11-03, but only the first matches
+	cron, _ = ParseCron("30 1 * * *")
+	first := cron.Next(time.Date(2024, 11, 3, 0, 0, 0, 0, ny))
+	if first.Hour() != 1 || first.Minute() != 30 || first.Day() != 3 {
+		t.Fatalf("fall back: %s", first)
+	}
+	second := cron.Next(first)
+	if want := time.Date(2024, 11, 4, 1, 30, 0, 0, ny); !second.Equal(want) {
+		t.Errorf("fall back repeated: %s instead of %s", second, want)
+	}
+
+	// Midnight does not exist in Santiago on 2024-09-08
+	santiago := zone(t, "America/Santiago")
+	cron, _ = ParseCron("0 5 * * *")
+	got = cron.Next(time.Date(2024, 9, 7, 23, 0, 0, 0, santiago))
+	if want := time.Date(2024, 9, 8, 5, 0, 0, 0, santiago); !got.Equal(want) {
+		t.Errorf("midnight skipped: %s instead of %s", got, want)
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%q is accepted", expr)
+		}
+	}
+	cron, err := ParseCron("0 0 * * 7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := cron.Next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if want := time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Sunday as 7: %s instead of %s", got, want)
+	}
+}
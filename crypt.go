@@ -0,0 +1,90 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+
+	"github.com/dchest/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	CipherAESGCM   = "aes-gcm"
+	CipherXChaCha  = "xchacha20-poly1305"
+	KeySize        = 32
+	NonceRandom    = "random"
+	NonceConverged = "convergent"
+)
+
+// ReadKey reads 256-bit key from the file, either raw or hexadecimal.
+func ReadKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == KeySize {
+		return data, nil
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != KeySize {
+		return nil, errors.New("Key must be 32 raw or 64 hexadecimal bytes")
+	}
+	return key, nil
+}
+
+// Read key from the path specified in command line. Empty path means no
+// key at all.
+func mustReadKey(path string) []byte {
+	if path == "" {
+		return nil
+	}
+	key, err := ReadKey(path)
+	if err != nil {
+		log.Fatalln("Unable to read key:", err)
+	}
+	return key
+}
+
+// Derive independent subkey for specified purpose.
+func subKey(key []byte, purpose string) []byte {
+	mac := blake2b.NewMAC(KeySize, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func NewAEAD(name string, key []byte) (cipher.AEAD, error) {
+	switch name {
+	case CipherAESGCM:
+		b, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(b)
+	case CipherXChaCha:
+		return chacha20poly1305.NewX(key)
+	}
+	return nil, errors.New("Unknown cipher: " + name)
+}
@@ -0,0 +1,209 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Next time of either cron or interval schedule after t.
+func nextTime(cron string, interval time.Duration, t time.Time) time.Time {
+	if cron != "" {
+		c, _ := ParseCron(cron)
+		return c.Next(t)
+	}
+	return t.Add(interval)
+}
+
+// Next time the job has to be run after t.
+func (j *Job) nextRun(t time.Time) time.Time {
+	next := nextTime(j.Cron, j.Interval.Duration, t)
+	if jitter := int64(j.Jitter.Duration); jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(jitter)))
+	}
+	return next
+}
+
+// Keep running and execute jobs according to their schedules. Each job
+// runs in its own goroutine, so slow job does not delay others, but the
+// same job never runs concurrently with itself.
+func daemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	cfgPath := fs.String("config", DefaultConfig, "Path to configuration file")
+	journal := fs.Bool("journal", false, "Log to journald with per-job fields")
+	pprofAddr := fs.String("pprof", "", "Address to serve net/http/pprof endpoints on, like :6060")
+	httpAddr := fs.String("http", "", "Address to serve read-only status page on, like :8080")
+	controlAddr := fs.String("control", "", "Serve control API on unix:PATH or HOST:PORT")
+	controlToken := fs.String("control-token", "", "Bearer token required by control API, mandatory on non-loopback HOST:PORT")
+	blake2bImpl := addBLAKE2bFlag(fs)
+	logging := addLogFlags(fs)
+	parseFlags(fs, args)
+	if *journal && (*logging.syslog != "" || *logging.file != "") {
+		log.Fatalln("Either -journal, -log-syslog or -log-file can be used")
+	}
+	errlog := logging.setup()
+	blake2bImpl()
+	servePprof(*pprofAddr)
+	cfg, err := LoadConfig(*cfgPath)
+	if err != nil {
+		log.Fatalln("Unable to load config:", err)
+	}
+	status := NewStatus()
+	if *httpAddr != "" {
+		status.Serve(*httpAddr)
+	}
+	if *journal {
+		w, err := newJournalWriter("", JournalInfo)
+		if err != nil {
+			log.Fatalln("Unable to connect to journald:", err)
+		}
+		log.SetOutput(w)
+		log.SetFlags(0)
+		if w, err = newJournalWriter("", JournalErr); err != nil {
+			log.Fatalln("Unable to connect to journald:", err)
+		}
+		errlog = log.New(w, "", 0)
+	}
+
+	var jobs []*Job
+	for _, name := range cfg.Names() {
+		job := cfg.Jobs[name]
+		if job.Cron == "" && job.Interval.Duration == 0 && !job.scrubbed() {
+			log.Println("Job", name, "has no schedule, skipping")
+			continue
+		}
+		job.start = make(chan struct{}, 1)
+		jobs = append(jobs, job)
+	}
+	handleSignals(jobs)
+	if *controlAddr != "" {
+		if err = serveControl(*controlAddr, *controlToken, jobs); err != nil {
+			log.Fatalln("Unable to serve control API:", err)
+		}
+	}
+
+	watchdog := sdWatchdogInterval()
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		job.quiet = true
+		joberr := errlog
+		if *journal {
+			w, err := newJournalWriter(job.Name, JournalInfo)
+			if err != nil {
+				log.Fatalln("Unable to connect to journald:", err)
+			}
+			job.log = log.New(w, "", 0)
+			if w, err = newJournalWriter(job.Name, JournalErr); err != nil {
+				log.Fatalln("Unable to connect to journald:", err)
+			}
+			joberr = log.New(w, "", 0)
+		}
+		if job.scrubbed() {
+			job.initLog()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				job.scrubLoop(joberr)
+			}()
+		}
+		if job.Cron == "" && job.Interval.Duration == 0 {
+			continue
+		}
+		js := status.Add(job)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Waiting loop beats twice per watchdog interval
+			var beat <-chan time.Time
+			if watchdog != 0 {
+				t := time.NewTicker(watchdog / 2)
+				defer t.Stop()
+				beat = t.C
+			}
+			for {
+				next := job.nextRun(time.Now())
+				if next.IsZero() {
+					log.Println("Job", job.Name, "will never run again")
+					return
+				}
+				log.Println("Job", job.Name, "scheduled at", next.Format(time.RFC3339))
+				status.Scheduled(js, next)
+				timer := time.NewTimer(time.Until(next))
+			wait:
+				for {
+					select {
+					case <-timer.C:
+						break wait
+					case <-job.start:
+						timer.Stop()
+						log.Println("Job", job.Name, "started through control API")
+						break wait
+					case <-beat:
+						status.Beat(js)
+					}
+				}
+				log.Println("Running job", job.Name)
+				status.Running(js)
+				sdNotify("STATUS=" + status.Summary())
+				err := job.Run()
+				status.Finished(js, err)
+				if err != nil {
+					joberr.Println("Job", job.Name, "run", job.Stats.Run, "failed:", err)
+				} else {
+					log.Println("Job", job.Name, "run", job.Stats.Run, "finished")
+				}
+				sdNotify("STATUS=" + status.Summary())
+			}
+		}()
+	}
+	sdNotify("READY=1\nSTATUS=" + status.Summary())
+	sdWatchdog(watchdog, status)
+	wg.Wait()
+}
+
+// Job has its own scrub schedule.
+func (j *Job) scrubbed() bool {
+	return j.ScrubCron != "" || j.ScrubInterval.Duration != 0
+}
+
+// Scrub the job according to its scrub schedule, notifying about each
+// result through the job's targets.
+func (j *Job) scrubLoop(errlog *log.Logger) {
+	for {
+		next := nextTime(j.ScrubCron, j.ScrubInterval.Duration, time.Now())
+		if next.IsZero() {
+			log.Println("Job", j.Name, "will never be scrubbed again")
+			return
+		}
+		log.Println("Job", j.Name, "scrub scheduled at", next.Format(time.RFC3339))
+		time.Sleep(time.Until(next))
+		log.Println("Scrubbing job", j.Name)
+		n := j.scrub()
+		if n.Error != "" {
+			errlog.Println("Job", j.Name, "scrub failed:", n.Error)
+		} else {
+			log.Println("Job", j.Name, "scrubbed:", n.Blocks, "blocks verified")
+		}
+		j.send(n)
+	}
+}
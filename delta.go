@@ -0,0 +1,207 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// Granularity of delta writes: page of databases and filesystems.
+const DeltaUnit = 4096
+
+// Destination where changed block is compared with its current content
+// and only differing units are written, so few modified bytes per page
+// do not cost the whole block's transfer to slow or remote destination.
+type deltaImage struct {
+	Image
+	written atomic.Int64
+	skipped atomic.Int64
+}
+
+func (d *deltaImage) WriteAt(p []byte, off int64) (int, error) {
+	old := make([]byte, len(p))
+	n, err := d.Image.ReadAt(old, off)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	run := -1 // start of differing units not yet written
+	for i := 0; i <= len(p); i += DeltaUnit {
+		end := min(i+DeltaUnit, len(p))
+		same := i == len(p) || (end <= n && bytes.Equal(p[i:end], old[i:end]))
+		if !same && run < 0 {
+			run = i
+		}
+		if same && run >= 0 {
+			if _, err = d.Image.WriteAt(p[run:i], off+int64(run)); err != nil {
+				return 0, err
+			}
+			d.written.Add(int64(i - run))
+			run = -1
+		}
+		if same && i < len(p) {
+			d.skipped.Add(int64(end - i))
+		}
+	}
+	return len(p), nil
+}
+
+func (d *deltaImage) Flush() error {
+	return flushImage(d.Image)
+}
+
+// Length of truncated BLAKE2b-256 hash of destination's page, telling
+// the HTTP source which pages the receiver already has.
+const DeltaHashLen = 16
+
+// Hashes of data's pages, the last one may be short.
+func pageHashes(data []byte) []byte {
+	hashes := make([]byte, 0, (len(data)+DeltaUnit-1)/DeltaUnit*DeltaHashLen)
+	for i := 0; i < len(data); i += DeltaUnit {
+		sum := blake2bSum256(data[i:min(i+DeltaUnit, len(data))])
+		hashes = append(hashes, sum[:DeltaHashLen]...)
+	}
+	return hashes
+}
+
+// Patch of data against the receiver's pages with those hashes: bitmap
+// of differing pages, followed by them.
+func makePatch(data, hashes []byte) []byte {
+	pages := (len(data) + DeltaUnit - 1) / DeltaUnit
+	patch := make([]byte, (pages+7)/8)
+	for p := 0; p < pages; p++ {
+		page := data[p*DeltaUnit : min((p+1)*DeltaUnit, len(data))]
+		sum := blake2bSum256(page)
+		if !bytes.Equal(sum[:DeltaHashLen], hashes[p*DeltaHashLen:(p+1)*DeltaHashLen]) {
+			patch[p/8] |= 1 << (p % 8)
+			patch = append(patch, page...)
+		}
+	}
+	return patch
+}
+
+// Replace data's pages with the patch's ones, returning the number of
+// replaced bytes.
+func applyPatch(data, patch []byte) (int, error) {
+	pages := (len(data) + DeltaUnit - 1) / DeltaUnit
+	if len(patch) < (pages+7)/8 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	bitmap, rest := patch[:(pages+7)/8], patch[(pages+7)/8:]
+	replaced := 0
+	for p := 0; p < pages; p++ {
+		if bitmap[p/8]&(1<<(p%8)) == 0 {
+			continue
+		}
+		page := data[p*DeltaUnit : min((p+1)*DeltaUnit, len(data))]
+		if len(rest) < len(page) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		rest = rest[copy(page, rest):]
+		replaced += len(page)
+	}
+	if len(rest) > 0 {
+		return 0, errors.New("Patch is longer than the range")
+	}
+	return replaced, nil
+}
+
+// Server does not make patches.
+var errNoPatches = errors.New("Server does not support patches")
+
+// Fetch patch of the range at offset against data, which is the
+// receiver's current content of it, and apply it.
+func (s *httpSource) patch(data []byte, off int64) (int, error) {
+	url := s.url + ".patch?off=" + strconv.FormatInt(off, 10) +
+		"&len=" + strconv.Itoa(len(data))
+	req, err := http.NewRequest("POST", url, bytes.NewReader(pageHashes(data)))
+	if err != nil {
+		return 0, err
+	}
+	if s.compress != "none" {
+		req.Header.Set("Accept-Encoding", "zstd")
+		if s.compress != "" {
+			req.Header.Set(ZstdLevelHeader, s.compress)
+		}
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return 0, errNoPatches
+	default:
+		return 0, &httpStatusError{resp.Status, resp.StatusCode}
+	}
+	patch, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Header.Get("Content-Encoding") == "zstd" {
+		if patch, err = s.dec.DecodeAll(patch, nil); err != nil {
+			return 0, fmt.Errorf("Unable to decompress: %w", err)
+		}
+	}
+	return applyPatch(data, patch)
+}
+
+// HTTP source fetching only pages of changed blocks differing from the
+// destination's ones. Blocks not yet present in the destination, and
+// all of them if the server can not make patches, are fetched whole.
+type patchSource struct {
+	io.ReaderAt
+	hs       *httpSource
+	dst      Image
+	noPatch  atomic.Bool
+	received atomic.Int64
+	skipped  atomic.Int64
+}
+
+func (s *patchSource) ReadAt(p []byte, off int64) (int, error) {
+	if s.dst == nil || s.noPatch.Load() || off >= s.hs.size {
+		return s.ReaderAt.ReadAt(p, off)
+	}
+	data := p[:min(off+int64(len(p)), s.hs.size)-off]
+	if n, _ := s.dst.ReadAt(data, off); n < len(data) {
+		return s.ReaderAt.ReadAt(p, off)
+	}
+	replaced, err := s.hs.patch(data, off)
+	if errors.Is(err, errNoPatches) {
+		s.noPatch.Store(true)
+		return s.ReaderAt.ReadAt(p, off)
+	}
+	if err != nil {
+		s.hs.client.CloseIdleConnections()
+		return 0, err
+	}
+	s.received.Add(int64(replaced))
+	s.skipped.Add(int64(len(data) - replaced))
+	if len(data) < len(p) {
+		return len(data), io.EOF
+	}
+	return len(data), nil
+}
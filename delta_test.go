@@ -0,0 +1,119 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestPatch(t *testing.T) {
+	data := make([]byte, 5*DeltaUnit+100)
+	rand.Read(data)
+	old := append([]byte(nil), data...)
+	old[DeltaUnit+5] ^= 1
+	old[len(old)-1] ^= 1
+	patch := makePatch(data, pageHashes(old))
+	if want := 1 + DeltaUnit + 100; len(patch) != want {
+		t.Fatalf("patch of %d bytes instead of %d", len(patch), want)
+	}
+	replaced, err := applyPatch(old, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced != DeltaUnit+100 || !bytes.Equal(old, data) {
+		t.Fatal("patch is not applied")
+	}
+	if _, err = applyPatch(old, patch[:len(patch)-1]); err == nil {
+		t.Fatal("truncated patch is applied")
+	}
+}
+
+// Published source with few changed bytes is pulled by patches.
+func TestPatchSource(t *testing.T) {
+	pub := testJob(t, 1<<20)
+	pub.Dst = os.DevNull
+	if err := pub.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src")
+	if err := os.Rename(pub.Src, srcPath); err != nil {
+		t.Fatal(err)
+	}
+	pub.Src = srcPath
+	if err := os.Rename(pub.State, srcPath+".state"); err != nil {
+		t.Fatal(err)
+	}
+	pub.State = srcPath + ".state"
+	mux, err := serveMux(pub.Src, pub.State, "", nil, zstd.SpeedDefault, 16<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ranges, patches atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		if strings.HasSuffix(r.URL.Path, ".patch") {
+			patches.Add(1)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	j := testJob(t, 0)
+	j.Src = server.URL + "/src"
+	j.DeltaWrite = true
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sameFiles(t, pub.Src, j.Dst)
+	if ranges.Load() != 16 || patches.Load() != 0 {
+		t.Fatalf("first run: %d ranges and %d patches", ranges.Load(), patches.Load())
+	}
+
+	fd, err := os.OpenFile(pub.Src, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte("changed"), 300000)
+	fd.WriteAt([]byte("changed"), 900000)
+	fd.Close()
+	if err = pub.Run(); err != nil {
+		t.Fatal(err)
+	}
+	ranges.Store(0)
+	if err = j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sameFiles(t, pub.Src, j.Dst)
+	if ranges.Load() != 0 || patches.Load() != 2 {
+		t.Fatalf("second run: %d ranges and %d patches", ranges.Load(), patches.Load())
+	}
+}
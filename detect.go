@@ -0,0 +1,84 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Error of the run stopped at the first changed block.
+var ErrChanged = errors.New("Source has changed")
+
+// Read the source only until the first block differing from the
+// statefile, without writing anything.
+func (j *Job) detectChange() error {
+	src, err := os.Open(j.Src)
+	if err != nil {
+		return fmt.Errorf("Unable to open src: %w", err)
+	}
+	defer src.Close()
+	size, err := srcSize(src)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(j.State); err != nil {
+		return fmt.Errorf("%w: no state file", ErrChanged)
+	}
+	secret, signKey, err := stateSecrets(j.StateKey, j.StatePassphrase, j.SignKey)
+	if err != nil {
+		return err
+	}
+	st, err := ReadStateFile(j.State, secret, signKey)
+	if err != nil {
+		return fmt.Errorf("Unable to read statefile: %w", err)
+	}
+	if size != st.Size {
+		return fmt.Errorf("%w: size %d instead of %d", ErrChanged, size, st.Size)
+	}
+	extents, err := j.dirtyExtents(st)
+	if err != nil {
+		return fmt.Errorf("Unable to get changed extents: %w", err)
+	}
+	var dirty []bool
+	if extents != nil {
+		dirty = dirtyBlocks(extents, st.Bs, st.Blocks())
+	}
+	buf := make([]byte, st.Bs)
+	j.prn("[")
+	defer j.prn("]\n")
+	for i := int64(0); i < st.Blocks(); i++ {
+		if dirty != nil && !dirty[i] {
+			continue
+		}
+		data := buf[:st.blockLen(i)]
+		if _, err = src.ReadAt(data, i*st.Bs); err != nil && err != io.EOF {
+			return fmt.Errorf("Error during src read: %w", err)
+		}
+		if !bytes.Equal(st.Hasher().Sum(data), st.Hash(i)) {
+			j.prn("%")
+			return fmt.Errorf("%w: block %d", ErrChanged, i)
+		}
+		j.prn(".")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "errors"
+
+// Byte range of the source.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// Extents of the source changed since the run that produced the state,
+// if some change tracking is used. nil means that everything has to be
+// read.
+func (j *Job) dirtyExtents(prev *State) ([]Extent, error) {
+	if j.NBDBitmap != "" && j.EraDev != "" {
+		return nil, errors.New("Only one change tracking can be used")
+	}
+	if j.NBDBitmap != "" {
+		return nbdDirtyExtents(j.NBDServer, j.NBDExport, j.NBDBitmap)
+	}
+	if j.EraDev != "" && prev.Meta.Era != 0 {
+		return eraDirtyExtents(j.EraDev, prev.Meta.Era)
+	}
+	return nil, nil
+}
+
+// Mark blocks overlapping any of extents.
+func dirtyBlocks(extents []Extent, bs, blocks int64) []bool {
+	dirty := make([]bool, blocks)
+	for _, e := range extents {
+		if e.Length <= 0 {
+			continue
+		}
+		for i := e.Offset / bs; i <= (e.Offset+e.Length-1)/bs && i < blocks; i++ {
+			dirty[i] = true
+		}
+	}
+	return dirty
+}
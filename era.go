@@ -0,0 +1,121 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// dm-era target's block size in bytes and its metadata device.
+func eraTable(name string) (int64, string, error) {
+	out, err := command("dmsetup", "table", name)
+	if err != nil {
+		return 0, "", err
+	}
+	// 0 LENGTH era METADATA_DEV ORIGIN_DEV BLOCK_SIZE
+	fields := strings.Fields(out)
+	if len(fields) != 6 || fields[2] != "era" {
+		return 0, "", errors.New("Not a dm-era device: " + name)
+	}
+	sectors, err := strconv.ParseInt(fields[5], 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+	dev := fields[3]
+	if !strings.HasPrefix(dev, "/") {
+		dev = "/dev/block/" + dev
+	}
+	return sectors * 512, dev, nil
+}
+
+// Start new era and return its number. Blocks written after that are
+// reported as written since it.
+func eraCheckpoint(name string) (uint64, error) {
+	if _, err := command("dmsetup", "message", name, "0", "checkpoint"); err != nil {
+		return 0, err
+	}
+	out, err := command("dmsetup", "status", name)
+	if err != nil {
+		return 0, err
+	}
+	// 0 LENGTH era METADATA_BLOCK_SIZE USED/TOTAL CURRENT_ERA HELD_ROOT
+	fields := strings.Fields(out)
+	if len(fields) < 6 || fields[2] != "era" {
+		return 0, errors.New("Unexpected dm-era status: " + out)
+	}
+	return strconv.ParseUint(fields[5], 10, 64)
+}
+
+// Start new era of the run before the source snapshot is taken and its
+// changed extents are asked. Writes racing with them are tagged with the
+// new era, so the next run reads them again.
+func (j *Job) startEra() error {
+	if j.EraDev == "" {
+		return nil
+	}
+	era, err := eraCheckpoint(j.EraDev)
+	if err != nil {
+		return err
+	}
+	j.era = era
+	return nil
+}
+
+// Extents written since specified era, taken from era_invalidate output
+// on the metadata snapshot.
+func eraDirtyExtents(name string, since uint64) ([]Extent, error) {
+	bs, metadata, err := eraTable(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = command("dmsetup", "message", name, "0", "take_metadata_snap"); err != nil {
+		return nil, err
+	}
+	out, err := command(
+		"era_invalidate", "--metadata-snapshot",
+		"--written-since", strconv.FormatUint(since, 10), metadata,
+	)
+	command("dmsetup", "message", name, "0", "drop_metadata_snap")
+	if err != nil {
+		return nil, err
+	}
+	var blocks struct {
+		Blocks []struct {
+			Block int64 `xml:"block,attr"`
+		} `xml:"block"`
+		Ranges []struct {
+			Begin int64 `xml:"begin,attr"`
+			End   int64 `xml:"end,attr"`
+		} `xml:"range"`
+	}
+	if err = xml.Unmarshal([]byte(out), &blocks); err != nil {
+		return nil, err
+	}
+	extents := []Extent{}
+	for _, b := range blocks.Blocks {
+		extents = append(extents, Extent{b.Block * bs, bs})
+	}
+	for _, r := range blocks.Ranges {
+		extents = append(extents, Extent{r.Begin * bs, (r.End - r.Begin) * bs})
+	}
+	return extents, nil
+}
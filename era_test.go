@@ -0,0 +1,95 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// dm-era tools logging their calls, era is incremented by checkpoint.
+func stubEra(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires shell")
+	}
+	dir := stubCommands(t, map[string]string{
+		"dmsetup": `echo "dmsetup $*" >> "$(dirname "$0")/log"
+era="$(dirname "$0")/era"
+[ -f "$era" ] || echo 1 > "$era"
+case "$1 $4" in
+"message checkpoint") echo $(($(cat "$era") + 1)) > "$era" ;;
+esac
+case "$1" in
+status) echo "0 2048 era 8 10/100 $(cat "$era") -" ;;
+table) echo "0 2048 era 253:1 253:2 128" ;;
+esac
+`,
+		"era_invalidate": `echo "era_invalidate $*" >> "$(dirname "$0")/log"
+echo '<blocks><range begin="2" end="3"/></blocks>'
+`,
+	})
+	return filepath.Join(dir, "log")
+}
+
+func TestEraOrder(t *testing.T) {
+	logPath := stubEra(t)
+	j := testJob(t, 1<<20)
+	j.EraDev = "era0"
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := ReadStateFileHeader(j.State, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Meta.Era != 2 {
+		t.Fatalf("era %d instead of 2", st.Meta.Era)
+	}
+	ioutil.WriteFile(logPath, nil, 0600)
+	if err = j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(logPath)
+	var calls []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case fields[0] == "era_invalidate":
+			calls = append(calls, "invalidate "+fields[3])
+		case fields[1] == "message":
+			calls = append(calls, fields[4])
+		}
+	}
+	want := []string{"checkpoint", "take_metadata_snap", "invalidate 2", "drop_metadata_snap"}
+	if strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Fatalf("calls %v instead of %v", calls, want)
+	}
+	if st, err = ReadStateFileHeader(j.State, nil); err != nil {
+		t.Fatal(err)
+	}
+	if st.Meta.Era != 3 {
+		t.Fatalf("era %d instead of 3", st.Meta.Era)
+	}
+	if j.Stats.Skipped != 15 {
+		t.Fatalf("%d blocks skipped instead of 15", j.Stats.Skipped)
+	}
+}
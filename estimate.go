@@ -0,0 +1,122 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+// Estimate changes ratio and amount of data to be transferred by
+// hashing random sample of blocks, without writing anything.
+func (j *Job) estimate() error {
+	pct, err := parsePercent(j.Estimate)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(j.Src)
+	if err != nil {
+		return fmt.Errorf("Unable to open src: %w", err)
+	}
+	defer src.Close()
+	size, err := srcSize(src)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(j.State); err != nil {
+		j.log.Println("No state file: all", size, "bytes are to be transferred")
+		return nil
+	}
+	secret, signKey, err := stateSecrets(j.StateKey, j.StatePassphrase, j.SignKey)
+	if err != nil {
+		return err
+	}
+	st, err := ReadStateFile(j.State, secret, signKey)
+	if err != nil {
+		return fmt.Errorf("Unable to read statefile: %w", err)
+	}
+	if size != st.Size {
+		return fmt.Errorf("Size differs with state file: %d instead of %d", st.Size, size)
+	}
+
+	// Only blocks known to be changed are candidates, if tracked
+	extents, err := j.dirtyExtents(st)
+	if err != nil {
+		return fmt.Errorf("Unable to get changed extents: %w", err)
+	}
+	var candidates []int64
+	if extents != nil {
+		for i, d := range dirtyBlocks(extents, st.Bs, st.Blocks()) {
+			if d {
+				candidates = append(candidates, int64(i))
+			}
+		}
+	} else {
+		candidates = make([]int64, st.Blocks())
+		for i := range candidates {
+			candidates[i] = int64(i)
+		}
+	}
+	if len(candidates) == 0 {
+		j.log.Println("No blocks are marked as changed")
+		return nil
+	}
+	n := max(1, int(float64(len(candidates))*pct/100))
+	rand.Shuffle(len(candidates), func(a, b int) {
+		candidates[a], candidates[b] = candidates[b], candidates[a]
+	})
+	sample := candidates[:n]
+	sort.Slice(sample, func(a, b int) bool { return sample[a] < sample[b] })
+
+	j.log.Println("Sampling", n, "of", len(candidates), "blocks")
+	buf := make([]byte, st.Bs)
+	var read, changed int64
+	started := time.Now()
+	j.prn("[")
+	for _, i := range sample {
+		data := buf[:st.blockLen(i)]
+		if _, err = src.ReadAt(data, i*st.Bs); err != nil && err != io.EOF {
+			return fmt.Errorf("Error during src read: %w", err)
+		}
+		read += int64(len(data))
+		if bytes.Equal(st.Hasher().Sum(data), st.Hash(i)) {
+			j.prn(".")
+		} else {
+			changed++
+			j.prn("%")
+		}
+	}
+	j.prn("]\n")
+	elapsed := time.Since(started)
+
+	ratio := float64(changed) / float64(n)
+	total := min(int64(len(candidates))*st.Bs, size)
+	j.log.Printf(
+		"Estimated changes: %.1f%% of blocks, %d bytes to transfer\n",
+		ratio*100, int64(ratio*float64(total)),
+	)
+	eta := time.Duration(float64(elapsed) * float64(total) / float64(read))
+	j.log.Println("Estimated read time at sampled speed:", eta.Round(time.Second))
+	return nil
+}
@@ -0,0 +1,84 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const DefaultConfig = "syncer.toml"
+
+// Environment variable corresponding to the option: -store-key is taken
+// from SYNCER_STORE_KEY.
+func envName(name string) string {
+	return "SYNCER_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Parse command line arguments. Options not specified there are taken
+// from environment variables, then from the named profile of the
+// configuration file.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	if fs.Lookup("config") == nil {
+		fs.String("config", DefaultConfig, "Path to configuration file")
+	}
+	fs.String("profile", "", "Name of profile in configuration file")
+	fs.Parse(args)
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := fs.Set(f.Name, v); err != nil {
+				log.Fatalln("Invalid", envName(f.Name), "value:", err)
+			}
+			set[f.Name] = true
+		}
+	})
+
+	name := fs.Lookup("profile").Value.String()
+	if name == "" {
+		return
+	}
+	cfg, err := LoadConfig(fs.Lookup("config").Value.String())
+	if err != nil {
+		log.Fatalln("Unable to load config:", err)
+	}
+	profile, ok := cfg.Profiles[name]
+	if !ok {
+		log.Fatalln("Unknown profile:", name)
+	}
+	for k, v := range profile {
+		k = strings.Replace(k, "_", "-", -1)
+		if fs.Lookup(k) == nil {
+			log.Fatalln("Unknown option in profile", name+":", k)
+		}
+		if set[k] {
+			continue
+		}
+		if err = fs.Set(k, fmt.Sprint(v)); err != nil {
+			log.Fatalln("Invalid", k, "value in profile", name+":", err)
+		}
+	}
+}
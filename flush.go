@@ -0,0 +1,52 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "fmt"
+
+// Synchronizes destination each time limit bytes are written to it, so
+// crash can lose only that much, instead of everything kept in the
+// volatile cache. Zero limit disables it.
+type flusher struct {
+	dst      Image
+	limit    int64
+	unsynced int64
+}
+
+// Account n written bytes, syncing if over the limit.
+func (f *flusher) written(n int) error {
+	if f.limit <= 0 {
+		return nil
+	}
+	if f.unsynced += int64(n); f.unsynced < f.limit {
+		return nil
+	}
+	return f.flush()
+}
+
+func (f *flusher) flush() error {
+	if f.limit <= 0 || f.unsynced == 0 {
+		return nil
+	}
+	f.unsynced = 0
+	if err := f.dst.Sync(); err != nil {
+		return fmt.Errorf("Unable to sync dst: %w", err)
+	}
+	return nil
+}
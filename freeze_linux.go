@@ -0,0 +1,69 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+const (
+	FIFREEZE = 0xC0045877
+	FITHAW   = 0xC0045878
+)
+
+// Freeze filesystem mounted at path, so it becomes consistent and
+// stops changing. Returned function thaws it. Filesystem is also
+// thawed if we are interrupted, not to leave it frozen forever.
+func freezeFS(path string) (func() error, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd.Fd(), FIFREEZE, 0)
+	if errno != 0 {
+		fd.Close()
+		return nil, errno
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	var once sync.Once
+	thaw := func() (err error) {
+		once.Do(func() {
+			signal.Stop(sigs)
+			close(sigs)
+			_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd.Fd(), FITHAW, 0)
+			if errno != 0 {
+				err = errno
+			}
+			fd.Close()
+		})
+		return
+	}
+	go func() {
+		if sig, ok := <-sigs; ok {
+			thaw()
+			log.Fatalln("Got", sig, "while filesystem is frozen, thawed it")
+		}
+	}()
+	return thaw, nil
+}
@@ -0,0 +1,54 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"log"
+)
+
+// Remove chunks no longer referenced by any generation.
+func gc(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	storePath := fs.String("store", "", "Path to chunk store")
+	storeKey := fs.String("store-key", "", "Path to chunk store key file")
+	dryRun := fs.Bool("n", false, "Dry run: only show reclaimable space")
+	parseFlags(fs, args)
+	if *storePath == "" {
+		log.Fatalln("-store is required")
+	}
+	store, err := OpenStore(*storePath, mustReadKey(*storeKey), StoreConfig{})
+	if err != nil {
+		log.Fatalln("Unable to open store:", err)
+	}
+	unlock, err := store.Lock(!*dryRun)
+	if err != nil {
+		log.Fatalln("Unable to lock store:", err)
+	}
+	count, size, err := store.GC(*dryRun)
+	unlock()
+	if err != nil {
+		log.Fatalln("Unable to collect garbage:", err)
+	}
+	if *dryRun {
+		log.Println(count, "unreferenced chunks,", size, "bytes reclaimable")
+	} else {
+		log.Println(count, "unreferenced chunks removed,", size, "bytes freed")
+	}
+}
@@ -0,0 +1,163 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Average length of clustered changes, blocks.
+const GenClusterLen = 64
+
+// Parse size with optional K, M, G or T binary suffix.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch strings.ToUpper(s[n-1:]) {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		case "T":
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("Invalid size: " + s)
+	}
+	return size * mult, nil
+}
+
+// Parse percentage with optional % suffix.
+func parsePercent(s string) (float64, error) {
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || pct < 0 || pct > 100 {
+		return 0, errors.New("Invalid percentage: " + s)
+	}
+	return pct, nil
+}
+
+// Create test image of random data, or mutate existing one with the
+// specified change rate and pattern.
+func gen(args []string) {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	outPath := fs.String("out", "test.img", "Path to test image")
+	sizeStr := fs.String("size", "1G", "Image size, with K, M, G or T suffix")
+	rateStr := fs.String("change-rate", "1%", "Share of blocks to change in existing image")
+	pattern := fs.String("pattern", "random", "Changes pattern: random, clustered")
+	blk := fs.Int64("blk", 4, "Changes granularity (KiB)")
+	zeroStr := fs.String("zero", "0%", "Share of zero blocks in the new image")
+	seed := fs.Int64("seed", 0, "Random seed, current time if 0")
+	parseFlags(fs, args)
+	size, err := parseSize(*sizeStr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rate, err := parsePercent(*rateStr)
+	if err != nil {
+		log.Fatalln("Invalid change rate:", *rateStr)
+	}
+	zero, err := parsePercent(*zeroStr)
+	if err != nil {
+		log.Fatalln("Invalid zero share:", *zeroStr)
+	}
+	if *pattern != "random" && *pattern != "clustered" {
+		log.Fatalln("Unknown pattern:", *pattern)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	rnd := rand.New(rand.NewSource(*seed))
+	bs := *blk * (1 << 10)
+	blocks := (size + bs - 1) / bs
+	buf := make([]byte, bs)
+	block := func(i int64) []byte {
+		if left := size - i*bs; left < bs {
+			return buf[:left]
+		}
+		return buf
+	}
+
+	fi, err := os.Stat(*outPath)
+	if err != nil || fi.Size() != size {
+		out, err := os.Create(*outPath)
+		if err != nil {
+			log.Fatalln("Unable to create image:", err)
+		}
+		prn("[")
+		for i := int64(0); i < blocks; i++ {
+			if rnd.Float64()*100 < zero {
+				clear(buf)
+			} else {
+				rnd.Read(buf)
+			}
+			if _, err = out.Write(block(i)); err != nil {
+				log.Fatalln("Unable to write image:", err)
+			}
+			if i%(blocks/64+1) == 0 {
+				prn(".")
+			}
+		}
+		prn("]\n")
+		if err = out.Close(); err != nil {
+			log.Fatalln("Unable to write image:", err)
+		}
+		log.Println(blocks, bs, "byte blocks created, seed", *seed)
+		return
+	}
+
+	out, err := os.OpenFile(*outPath, os.O_WRONLY, 0)
+	if err != nil {
+		log.Fatalln("Unable to open image:", err)
+	}
+	defer out.Close()
+	changes := int64(float64(blocks) * rate / 100)
+	changed := make(map[int64]struct{}, changes)
+	for int64(len(changed)) < changes {
+		i := rnd.Int63n(blocks)
+		length := int64(1)
+		if *pattern == "clustered" {
+			length = 1 + rnd.Int63n(2*GenClusterLen)
+		}
+		for ; length > 0 && i < blocks && int64(len(changed)) < changes; length-- {
+			changed[i] = struct{}{}
+			i++
+		}
+	}
+	for i := range changed {
+		rnd.Read(buf)
+		if _, err = out.WriteAt(block(i), i*bs); err != nil {
+			log.Fatalln("Unable to write image:", err)
+		}
+	}
+	log.Println(len(changed), "of", blocks, bs, "byte blocks changed, seed", *seed)
+}
@@ -0,0 +1,271 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dchest/blake2b"
+)
+
+// Configuration keys of the group as a whole, its members can not have
+// them.
+var groupKeys = map[string]bool{
+	"group":                true,
+	"cron":                 true,
+	"interval":             true,
+	"jitter":               true,
+	"scrub_cron":           true,
+	"scrub_interval":       true,
+	"exit_on_first_change": true,
+	"alert_blocks":         true,
+	"pre_cmd":              true,
+	"post_cmd":             true,
+	"notify_url":           true,
+	"notify_ntfy":          true,
+	"notify_email":         true,
+	"smtp_server":          true,
+	"smtp_user":            true,
+	"smtp_password":        true,
+	"smtp_from":            true,
+	"summary_json":         true,
+	"report_html":          true,
+	"map_image":            true,
+}
+
+// Configuration keys of the member only, the group can not have them.
+var memberKeys = map[string]bool{
+	"src":        true,
+	"src_state":  true,
+	"src_peers":  true,
+	"dst":        true,
+	"state":      true,
+	"nbd_server": true,
+	"nbd_export": true,
+	"nbd_bitmap": true,
+	"nbd_node":   true,
+	"era_dev":    true,
+}
+
+// Keys inherited together: member having any of them set inherits none.
+var inheritTogether = [][]string{
+	{"state", "state_dir"},
+	{"dst_mode", "dst_owner"},
+	{"state_mode", "state_owner"},
+	{"state_key", "state_passphrase"},
+	{"keep_last", "keep_daily", "keep_weekly", "keep_monthly"},
+	{"lvm_snapshot", "zfs_snapshot", "vss"},
+}
+
+// Configuration key of Job's field, empty if it has none.
+func fieldKey(f reflect.StructField) string {
+	key := strings.Split(f.Tag.Get("toml"), ",")[0]
+	if key == "-" {
+		return ""
+	}
+	return key
+}
+
+// Fill member's options, which are not set in its configuration table,
+// from its group. Even false and zero values set explicitly by the
+// member are kept.
+func (j *Job) inherit(group *Job, set map[string]interface{}) {
+	skip := make(map[string]bool)
+	for _, keys := range inheritTogether {
+		for _, key := range keys {
+			if _, ok := set[key]; ok {
+				for _, key := range keys {
+					skip[key] = true
+				}
+			}
+		}
+	}
+	dst, src := reflect.ValueOf(j).Elem(), reflect.ValueOf(group).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		key := fieldKey(dst.Type().Field(i))
+		if key == "" || groupKeys[key] || memberKeys[key] || skip[key] {
+			continue
+		}
+		if _, ok := set[key]; ok {
+			continue
+		}
+		if v := src.Field(i); !v.IsZero() {
+			dst.Field(i).Set(v)
+		}
+	}
+}
+
+// Run consistency group: all members' filesystems are frozen and their
+// snapshots are taken at the same moment. If some member has no
+// snapshot, then filesystems stay frozen until all members are synced.
+// Group fails if any of its members failed.
+func (j *Job) runGroup() (err error) {
+	for i, m := range j.Group {
+		m.Name = j.Name + "/" + strconv.Itoa(i)
+		m.log = log.New(j.log.Writer(), m.Name+": ", j.log.Flags())
+		m.quiet = j.quiet
+		m.frozen = true
+		if err = m.resolveState(); err != nil {
+			return err
+		}
+		unlock, err := lockFile(m.State + ".lock")
+		if err != nil {
+			return fmt.Errorf("Unable to lock %s state: %w", m.Name, err)
+		}
+		defer unlock()
+	}
+	if j.dryRun() {
+		// Members are only read, one by one
+		for _, m := range j.Group {
+			m.Estimate, m.ExitOnChange = j.Estimate, j.ExitOnChange
+			if m.Estimate != "" {
+				err = m.estimate()
+			} else {
+				err = m.detectChange()
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", m.Name, err)
+			}
+		}
+		return nil
+	}
+	j.startRun(newRunID())
+	j.log.Println("Run", j.Stats.Run)
+	if j.PreCmd != "" {
+		j.log.Println("Running pre command")
+		if err = j.hook(j.PreCmd, false, nil); err != nil {
+			return fmt.Errorf("Pre command failed: %w", err)
+		}
+	}
+	err = j.syncGroup()
+	j.Stats.Duration = time.Since(j.Stats.Started)
+	if j.PostCmd != "" {
+		j.log.Println("Running post command")
+		if herr := j.hook(j.PostCmd, true, err); herr != nil && err == nil {
+			err = fmt.Errorf("Post command failed: %w", herr)
+		}
+	}
+	return err
+}
+
+func (j *Job) syncGroup() error {
+	// Freeze every distinct filesystem
+	var thaws []func() error
+	thaw := func() {
+		for _, t := range thaws {
+			if err := t(); err != nil {
+				j.log.Println("Unable to thaw filesystem:", err)
+			}
+		}
+		thaws = nil
+	}
+	defer thaw()
+	frozen := make(map[string]struct{})
+	for _, m := range append([]*Job{j}, j.Group...) {
+		if _, ok := frozen[m.Freeze]; ok || m.Freeze == "" {
+			continue
+		}
+		j.log.Println("Freezing", m.Freeze)
+		t, err := freezeFS(m.Freeze)
+		if err != nil {
+			return fmt.Errorf("Unable to freeze filesystem: %w", err)
+		}
+		frozen[m.Freeze] = struct{}{}
+		thaws = append(thaws, t)
+	}
+
+	// Take snapshots
+	defer func() {
+		for _, m := range j.Group {
+			if m.snap == nil {
+				continue
+			}
+			if err := m.snap.Remove(); err != nil {
+				m.log.Println("Unable to remove snapshot:", err)
+			}
+			m.snap = nil
+		}
+	}()
+	defer func() {
+		// Bitmaps of members not synced are dropped
+		for _, m := range j.Group {
+			if err := m.endBitmap(errors.New("Group run failed")); err != nil {
+				m.log.Println("Unable to remove NBD bitmap:", err)
+			}
+		}
+	}()
+	snapped := 0
+	for _, m := range j.Group {
+		if err := m.startEra(); err != nil {
+			return fmt.Errorf("Unable to start %s new era: %w", m.Name, err)
+		}
+		if err := m.startBitmap(); err != nil {
+			return fmt.Errorf("Unable to add %s NBD bitmap: %w", m.Name, err)
+		}
+		var err error
+		if m.snap, err = m.snapshot(); err != nil {
+			return fmt.Errorf("Unable to take %s snapshot: %w", m.Name, err)
+		}
+		if m.snap != nil {
+			m.log.Println("Reading from snapshot", m.snap.Device())
+			snapped++
+		}
+	}
+	if snapped == len(j.Group) {
+		thaw()
+	}
+
+	var errs []error
+	digest := blake2b.New512()
+	for _, m := range j.Group {
+		m.startRun(j.Stats.Run)
+		err := m.sync()
+		if berr := m.endBitmap(err); berr != nil && err == nil {
+			err = fmt.Errorf("Unable to rotate NBD bitmap: %w", berr)
+		}
+		m.Stats.Duration = time.Since(m.Stats.Started)
+		if err != nil {
+			m.log.Println(err)
+			errs = append(errs, fmt.Errorf("%s: %w", m.Name, err))
+		}
+		j.Stats.Blocks += m.Stats.Blocks
+		j.Stats.Changed += m.Stats.Changed
+		j.Stats.Written += m.Stats.Written
+		j.Stats.Skipped += m.Stats.Skipped
+		j.Stats.Failed += m.Stats.Failed
+		sum, _ := hex.DecodeString(m.Stats.Digest)
+		digest.Write(sum)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf(
+			"%d of %d members failed: %w",
+			len(errs), len(j.Group), errors.Join(errs...),
+		)
+	}
+	j.Stats.Digest = hex.EncodeToString(digest.Sum(nil))
+	j.log.Println("Digest:", j.Stats.Digest)
+	return nil
+}
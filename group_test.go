@@ -0,0 +1,179 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testGroup(t *testing.T) *Job {
+	g := &Job{Name: "g", Group: []*Job{testJob(t, 1<<20), testJob(t, 1<<19)}}
+	g.log = log.New(ioutil.Discard, "", 0)
+	for _, m := range g.Group {
+		m.inherit(g, nil)
+	}
+	return g
+}
+
+func TestGroupExitOnChange(t *testing.T) {
+	g := testGroup(t)
+	if err := g.Run(); err != nil {
+		t.Fatal(err)
+	}
+	g.ExitOnChange = true
+	if err := g.Run(); err != nil {
+		t.Fatal(err)
+	}
+	m := g.Group[1]
+	writeRandom(t, m.Src, 1<<19)
+	before, _ := ioutil.ReadFile(m.Dst)
+	if err := g.Run(); !errors.Is(err, ErrChanged) {
+		t.Fatalf("%v instead of ErrChanged", err)
+	}
+	after, _ := ioutil.ReadFile(m.Dst)
+	if string(before) != string(after) {
+		t.Fatal("dst was written")
+	}
+}
+
+// Failed snapshot of the member fails the group run, without removing
+// the snapshot which does not exist.
+func TestGroupSnapshotFailure(t *testing.T) {
+	stubCommands(t, map[string]string{
+		"lvs":      "exit 1\n",
+		"lvcreate": "exit 1\n",
+	})
+	g := testGroup(t)
+	g.Group[1].LVMSnapshot = "1G"
+	err := g.Run()
+	if err == nil || !strings.Contains(err.Error(), "snapshot") {
+		t.Fatalf("%v instead of snapshot failure", err)
+	}
+	if g.Group[1].snap != nil {
+		t.Fatal("snapshot is left")
+	}
+}
+
+// Every option of the member is either inherited from the group, or is
+// group's or member's own.
+func TestInheritFields(t *testing.T) {
+	var g, m Job
+	gv := reflect.ValueOf(&g).Elem()
+	for i := 0; i < gv.NumField(); i++ {
+		f := gv.Field(i)
+		if fieldKey(gv.Type().Field(i)) == "" {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString("x")
+		case reflect.Bool:
+			f.SetBool(true)
+		case reflect.Int, reflect.Int64:
+			f.SetInt(1)
+		case reflect.Map:
+			f.Set(reflect.MakeMap(f.Type()))
+			f.SetMapIndex(reflect.New(f.Type().Key()).Elem(), reflect.New(f.Type().Elem()).Elem())
+		case reflect.Slice:
+			f.Set(reflect.MakeSlice(f.Type(), 1, 1))
+		case reflect.Struct:
+			f.Field(0).SetInt(1)
+		default:
+			t.Fatalf("%s: unexpected kind %s", gv.Type().Field(i).Name, f.Kind())
+		}
+	}
+	m.inherit(&g, nil)
+	mv := reflect.ValueOf(&m).Elem()
+	for i := 0; i < mv.NumField(); i++ {
+		key := fieldKey(mv.Type().Field(i))
+		if key == "" {
+			continue
+		}
+		own := groupKeys[key] || memberKeys[key]
+		if inherited := !mv.Field(i).IsZero(); inherited == own {
+			t.Errorf("%s: inherited %v", key, inherited)
+		}
+	}
+	for key := range groupKeys {
+		if memberKeys[key] {
+			t.Errorf("%s is both group's and member's", key)
+		}
+	}
+}
+
+func TestLoadConfigGroup(t *testing.T) {
+	load := func(data string) (*Config, error) {
+		path := filepath.Join(t.TempDir(), "syncer.toml")
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return LoadConfig(path)
+	}
+	cfg, err := load(`
+[job.g]
+full = true
+blk = 128
+state_key = "key"
+zfs_snapshot = true
+
+[[job.g.group]]
+src = "/dev/a"
+dst = "/dev/b"
+state = "/a.state"
+full = false
+lvm_snapshot = "1G"
+
+[[job.g.group]]
+src = "/dev/c"
+dst = "/dev/d"
+state = "/c.state"
+state_passphrase = "passphrase"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, c := cfg.Jobs["g"].Group[0], cfg.Jobs["g"].Group[1]
+	if a.Full || !c.Full {
+		t.Error("full is not overridden by member")
+	}
+	if a.Blk != 128 || c.Blk != 128 {
+		t.Error("blk is not inherited")
+	}
+	if a.ZFSSnapshot || a.LVMSnapshot != "1G" || !c.ZFSSnapshot {
+		t.Error("snapshot kind is not overridden as a whole")
+	}
+	if a.StateKey != "key" || c.StateKey != "" {
+		t.Error("state key is not overridden by passphrase")
+	}
+
+	for data, want := range map[string]string{
+		"[job.g]\ndst = \"/dev/b\"\n[[job.g.group]]\nsrc = \"/dev/a\"\n":                       "Job g: group has dst",
+		"[job.g]\n[[job.g.group]]\nsrc = \"/dev/a\"\ndst = \"/dev/b\"\ncron = \"0 * * * *\"\n": "Job g: group's member has cron",
+	} {
+		if _, err = load(data); err == nil || err.Error() != want {
+			t.Errorf("%v instead of %q", err, want)
+		}
+	}
+}
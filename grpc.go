@@ -0,0 +1,317 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC service of control API, prefixing its methods' paths.
+const GRPCService = "syncer.control.v1.Control"
+
+// Maximal length of gRPC request message.
+const GRPCMaxMessage = 1 << 16
+
+// gRPC status codes.
+const (
+	GRPCOK                 = 0
+	GRPCInvalidArgument    = 3
+	GRPCNotFound           = 5
+	GRPCFailedPrecondition = 9
+	GRPCUnimplemented      = 12
+	GRPCInternal           = 13
+)
+
+// gRPC definition of control API, served at /v1/control.proto.
+//
+//go:embed control.v1.proto
+var controlProtoDefinition []byte
+
+// Failed gRPC call's status.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+// Protobuf encoding of a message, fields are appended in order. Zero
+// scalars are omitted, as in proto3.
+type protoBuf []byte
+
+func (b *protoBuf) varint(v uint64) {
+	*b = binary.AppendUvarint(*b, v)
+}
+
+func (b *protoBuf) uint(field int, v uint64) {
+	if v != 0 {
+		b.varint(uint64(field)<<3 | 0)
+		b.varint(v)
+	}
+}
+
+func (b *protoBuf) int(field int, v int64) {
+	b.uint(field, uint64(v))
+}
+
+func (b *protoBuf) bool(field int, v bool) {
+	if v {
+		b.uint(field, 1)
+	}
+}
+
+// Length-delimited field, written even if empty: it is repeated
+// message's element.
+func (b *protoBuf) message(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+func (b *protoBuf) string(field int, s string) {
+	if s != "" {
+		b.message(field, []byte(s))
+	}
+}
+
+// Call fn with each field of protobuf message: varint's value or
+// length-delimited field's data. Fixed-size fields are skipped.
+func protoFields(data []byte, fn func(field int, v uint64, b []byte)) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("Invalid protobuf tag")
+		}
+		data = data[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("Invalid protobuf varint")
+			}
+			data = data[n:]
+			fn(field, v, nil)
+		case 1, 5:
+			size := 8
+			if tag&7 == 5 {
+				size = 4
+			}
+			if len(data) < size {
+				return errors.New("Truncated protobuf field")
+			}
+			data = data[size:]
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return errors.New("Truncated protobuf field")
+			}
+			fn(field, 0, data[n:n+int(l)])
+			data = data[n+int(l):]
+		default:
+			return errors.New("Unsupported protobuf wire type")
+		}
+	}
+	return nil
+}
+
+// JobRequest and ThrottleRequest messages.
+type grpcRequest struct {
+	job  string
+	rate int64
+}
+
+// Read the only length-prefixed message of unary or server streaming
+// call's request.
+func readGRPC(r io.Reader) (*grpcRequest, error) {
+	data, err := io.ReadAll(io.LimitReader(r, 5+GRPCMaxMessage+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 5 || int(binary.BigEndian.Uint32(data[1:])) != len(data)-5 {
+		return nil, &grpcError{GRPCInvalidArgument, "Invalid request message"}
+	}
+	if data[0] != 0 {
+		return nil, &grpcError{GRPCUnimplemented, "Compressed messages are not supported"}
+	}
+	var req grpcRequest
+	err = protoFields(data[5:], func(field int, v uint64, b []byte) {
+		switch field {
+		case 1:
+			req.job = string(b)
+		case 2:
+			req.rate = int64(v)
+		}
+	})
+	if err != nil {
+		return nil, &grpcError{GRPCInvalidArgument, err.Error()}
+	}
+	return &req, nil
+}
+
+// Send length-prefixed response message.
+func writeGRPC(w http.ResponseWriter, msg protoBuf) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	if _, err := w.Write(append(frame, msg...)); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (s controlStatus) proto() protoBuf {
+	var b protoBuf
+	b.string(1, s.Name)
+	b.bool(2, s.Paused)
+	b.int(3, s.Rate)
+	b.int(4, s.Done)
+	b.int(5, s.Size)
+	return b
+}
+
+func (n *Notification) proto() protoBuf {
+	var b protoBuf
+	for i, s := range []string{n.Job, n.Kind, n.Run, n.Src, n.Dst, n.Result, n.Error} {
+		b.string(1+i, s)
+	}
+	for i, v := range []int64{
+		n.Started.Unix(), n.Duration, n.Blocks, n.Changed, n.Written, n.Failed,
+	} {
+		b.int(8+i, v)
+	}
+	b.string(14, n.Digest)
+	b.string(15, n.Syncer)
+	return b
+}
+
+// gRPC methods of control API, replying through send.
+type grpcMethod func(job *Job, req *grpcRequest, send func(protoBuf) error, done <-chan struct{}) error
+
+var grpcMethods = map[string]grpcMethod{
+	"StartJob": func(job *Job, _ *grpcRequest, send func(protoBuf) error, _ <-chan struct{}) error {
+		if err := job.Start(); err != nil {
+			return &grpcError{GRPCFailedPrecondition, err.Error()}
+		}
+		return send(nil)
+	},
+	"WatchProgress": func(job *Job, _ *grpcRequest, send func(protoBuf) error, done <-chan struct{}) error {
+		ticker := time.NewTicker(ControlProgressInterval)
+		defer ticker.Stop()
+		for {
+			if err := send(job.controlStatus().proto()); err != nil {
+				return err
+			}
+			select {
+			case <-done:
+				return nil
+			case <-ticker.C:
+			}
+		}
+	},
+	"GetResult": func(job *Job, _ *grpcRequest, send func(protoBuf) error, _ <-chan struct{}) error {
+		n := job.last.Load()
+		if n == nil {
+			return &grpcError{GRPCNotFound, "Job has not finished yet"}
+		}
+		return send(n.proto())
+	},
+	"PauseJob": func(job *Job, _ *grpcRequest, send func(protoBuf) error, _ <-chan struct{}) error {
+		job.Pause()
+		return send(nil)
+	},
+	"ResumeJob": func(job *Job, _ *grpcRequest, send func(protoBuf) error, _ <-chan struct{}) error {
+		job.Resume()
+		return send(nil)
+	},
+	"CancelJob": func(job *Job, _ *grpcRequest, send func(protoBuf) error, _ <-chan struct{}) error {
+		job.Cancel()
+		return send(nil)
+	},
+	"ThrottleJob": func(job *Job, req *grpcRequest, send func(protoBuf) error, _ <-chan struct{}) error {
+		if req.rate < 0 {
+			return &grpcError{GRPCInvalidArgument, "Negative rate"}
+		}
+		job.Throttle(req.rate)
+		return send(nil)
+	},
+}
+
+// Serve gRPC calls of control API for the jobs. Status is sent in
+// trailers, after the replies.
+func grpcHandler(jobs []*Job) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "gRPC requires HTTP/2", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		err := serveGRPC(w, r, jobs)
+		code := GRPCOK
+		var gerr *grpcError
+		if errors.As(err, &gerr) {
+			code = gerr.code
+		} else if err != nil {
+			code = GRPCInternal
+		}
+		w.Header().Set("Grpc-Status", strconv.Itoa(code))
+		if err != nil {
+			w.Header().Set("Grpc-Message", url.PathEscape(err.Error()))
+		}
+	}
+}
+
+func serveGRPC(w http.ResponseWriter, r *http.Request, jobs []*Job) error {
+	name := strings.TrimPrefix(r.URL.Path, "/"+GRPCService+"/")
+	req, err := readGRPC(r.Body)
+	if err != nil {
+		return err
+	}
+	send := func(msg protoBuf) error { return writeGRPC(w, msg) }
+	if name == "ListJobs" {
+		var b protoBuf
+		for _, job := range jobs {
+			b.message(1, job.controlStatus().proto())
+		}
+		return send(b)
+	}
+	method, ok := grpcMethods[name]
+	if !ok {
+		return &grpcError{GRPCUnimplemented, "Unknown method: " + name}
+	}
+	job, err := findJob(jobs, req.job)
+	if err != nil {
+		return &grpcError{GRPCNotFound, err.Error()}
+	}
+	return method(job, req, send, r.Context().Done())
+}
@@ -0,0 +1,126 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"flag"
+	"hash/crc32"
+	"log"
+
+	"github.com/dchest/blake2b"
+	xblake2b "golang.org/x/crypto/blake2b"
+)
+
+// Block hash algorithms. State's algorithm is recorded in its metadata,
+// statefiles without it use BLAKE2b-512.
+const (
+	HashBLAKE2b512 = "blake2b-512"
+	HashBLAKE2b256 = "blake2b-256"
+	HashSHA512     = "sha512"
+	HashSHA256     = "sha256"
+	DefaultHash    = HashBLAKE2b512
+)
+
+// BLAKE2b implementations: x/crypto one uses AVX2/AVX/SSE4 instructions
+// if CPU supports them, pure Go one is the fallback.
+const (
+	BLAKE2bXCrypto = "xcrypto"
+	BLAKE2bGeneric = "generic"
+)
+
+var (
+	blake2bSum512 = xblake2b.Sum512
+	blake2bSum256 = xblake2b.Sum256
+)
+
+// CRC32C pre-filter table: Castagnoli polynomial is computed with
+// SSE4.2 and ARMv8 CRC instructions.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Choose BLAKE2b implementation. Both produce identical hashes.
+func SelectBLAKE2b(impl string) error {
+	switch impl {
+	case BLAKE2bXCrypto:
+		blake2bSum512, blake2bSum256 = xblake2b.Sum512, xblake2b.Sum256
+	case BLAKE2bGeneric:
+		blake2bSum512, blake2bSum256 = blake2b.Sum512, blake2b.Sum256
+	default:
+		return errors.New("Unknown BLAKE2b implementation: " + impl)
+	}
+	return nil
+}
+
+// Add BLAKE2b implementation option, returning function applying it.
+func addBLAKE2bFlag(fs *flag.FlagSet) func() {
+	impl := fs.String("blake2b", BLAKE2bXCrypto, "BLAKE2b implementation: xcrypto, generic")
+	return func() {
+		if err := SelectBLAKE2b(*impl); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+type Hasher struct {
+	Name string
+	Size int
+	Sum  func(data []byte) []byte
+}
+
+var hashers = make(map[string]*Hasher)
+
+func init() {
+	registerHash(HashBLAKE2b512, 64, func(data []byte) []byte {
+		sum := blake2bSum512(data)
+		return sum[:]
+	})
+	registerHash(HashBLAKE2b256, 32, func(data []byte) []byte {
+		sum := blake2bSum256(data)
+		return sum[:]
+	})
+	registerHash(HashSHA512, sha512.Size, func(data []byte) []byte {
+		sum := sha512.Sum512(data)
+		return sum[:]
+	})
+	registerHash(HashSHA256, sha256.Size, func(data []byte) []byte {
+		sum := sha256.Sum256(data)
+		return sum[:]
+	})
+}
+
+// Add block hash algorithm, like HSM-backed one, under the name
+// recorded in statefiles, from init() of syncer's own file. Sum is
+// called concurrently by workers.
+func registerHash(name string, size int, sum func(data []byte) []byte) {
+	hashers[name] = &Hasher{name, size, sum}
+}
+
+// Hash algorithm with that name, default one if it is empty.
+func LookupHash(name string) (*Hasher, error) {
+	if name == "" {
+		name = DefaultHash
+	}
+	h, ok := hashers[name]
+	if !ok {
+		return nil, errors.New("Unknown hash algorithm: " + name)
+	}
+	return h, nil
+}
@@ -0,0 +1,64 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "time"
+
+// Number of the last runs kept in statefile's history.
+const HistoryRuns = 16
+
+// Run kept in statefile's history.
+type RunRecord struct {
+	Run      string
+	Time     time.Time
+	Duration time.Duration
+	Blocks   int64
+	Changed  int64
+	Written  int64
+}
+
+// Record finished run in the history, forgetting the oldest ones.
+func (st *State) recordRun(run RunRecord) {
+	st.Meta.History = append(st.Meta.History, run)
+	if n := len(st.Meta.History); n > HistoryRuns {
+		st.Meta.History = st.Meta.History[n-HistoryRuns:]
+	}
+}
+
+// Log the last run and the duration of this one, estimated by the
+// average of the history.
+func (j *Job) logHistory(st *State) {
+	history := st.Meta.History
+	if len(history) == 0 {
+		return
+	}
+	last := history[len(history)-1]
+	j.log.Printf(
+		"Last run: %s, %.1f%% changed\n", last.Duration.Round(time.Second),
+		100*float64(last.Changed)/float64(max(last.Blocks, 1)),
+	)
+	var total time.Duration
+	for _, run := range history {
+		total += run.Duration
+	}
+	j.log.Printf(
+		"Estimated duration: %s by %d runs\n",
+		(total / time.Duration(len(history))).Round(time.Second), len(history),
+	)
+}
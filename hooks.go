@@ -0,0 +1,68 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// Prefix of hook's environment variables, distinct from "SYNCER_" of
+// options, so syncer run by the hook does not inherit job's ones.
+const HookEnvPrefix = "SYNCER_HOOK_"
+
+// Execute user's command through the shell. Environment carries job's
+// parameters and, for post command, run's result and statistics.
+func (j *Job) hook(command string, post bool, runErr error) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(
+		os.Environ(),
+		HookEnvPrefix+"JOB="+j.Name,
+		HookEnvPrefix+"RUN="+j.Stats.Run,
+		HookEnvPrefix+"SRC="+j.Src,
+		HookEnvPrefix+"DST="+j.Dst,
+		HookEnvPrefix+"STATE="+j.State,
+	)
+	if post {
+		result := "ok"
+		if runErr != nil {
+			result = "failed"
+			cmd.Env = append(cmd.Env, HookEnvPrefix+"ERROR="+runErr.Error())
+		}
+		cmd.Env = append(
+			cmd.Env,
+			HookEnvPrefix+"RESULT="+result,
+			fmt.Sprintf(HookEnvPrefix+"BLOCKS=%d", j.Stats.Blocks),
+			fmt.Sprintf(HookEnvPrefix+"CHANGED=%d", j.Stats.Changed),
+			fmt.Sprintf(HookEnvPrefix+"WRITTEN=%d", j.Stats.Written),
+			fmt.Sprintf(HookEnvPrefix+"DURATION=%d", int64(j.Stats.Duration.Seconds())),
+			HookEnvPrefix+"DIGEST="+j.Stats.Digest,
+		)
+	}
+	return cmd.Run()
+}
@@ -0,0 +1,161 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHookEnv(t *testing.T) {
+	j := testJob(t, 1<<10)
+	j.Name = "test"
+	out := filepath.Join(t.TempDir(), "env")
+	if err := j.hook("env > "+out, true, errors.New("failure")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	for k, v := range map[string]string{
+		"JOB":    "test",
+		"SRC":    j.Src,
+		"DST":    j.Dst,
+		"STATE":  j.State,
+		"RESULT": "failed",
+		"ERROR":  "failure",
+	} {
+		if got := env[HookEnvPrefix+k]; got != v {
+			t.Errorf("%s%s: got %q, want %q", HookEnvPrefix, k, got, v)
+		}
+	}
+	for _, name := range []string{"src", "dst", "state"} {
+		if _, ok := env[envName(name)]; ok {
+			t.Errorf("%s is set for hook", envName(name))
+		}
+	}
+}
+
+// Run's ID tags its log lines, hook environment, notification and audit
+// log records.
+func TestRunID(t *testing.T) {
+	j := testJob(t, 1<<20)
+	j.Name = "test"
+	var logged bytes.Buffer
+	j.log = log.New(&logged, "", 0)
+	dir := t.TempDir()
+	out := filepath.Join(dir, "env")
+	j.PostCmd = "env > " + out
+	j.AuditLog = filepath.Join(dir, "audit.log")
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	run := j.Stats.Run
+	for _, line := range strings.Split(strings.TrimSpace(logged.String()), "\n") {
+		if !strings.HasPrefix(line, "test "+run+": ") {
+			t.Fatal("Log line without run ID:", line)
+		}
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), HookEnvPrefix+"RUN="+run+"\n") {
+		t.Fatal("Hook has no run ID")
+	}
+	if n := j.last.Load(); n == nil || n.Run != run {
+		t.Fatal("Notification has no run ID")
+	}
+	if data, err = ioutil.ReadFile(j.AuditLog); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var r AuditRecord
+		if err = json.Unmarshal([]byte(line), &r); err != nil || r.Run != run {
+			t.Fatal("Audit record without run ID:", line)
+		}
+	}
+}
+
+// Notification is mailed through the SMTP server to every recipient.
+func TestMailNotification(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	rcpts := make(chan string, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 test\r\n")
+		for data := false; ; {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case data && line == ".\r\n":
+				data = false
+				fmt.Fprint(conn, "250 ok\r\n")
+			case data:
+			case strings.HasPrefix(line, "RCPT TO:"):
+				rcpts <- strings.TrimSpace(line[8:])
+				fmt.Fprint(conn, "250 ok\r\n")
+			case strings.HasPrefix(line, "DATA"):
+				data = true
+				fmt.Fprint(conn, "354 go on\r\n")
+			case strings.HasPrefix(line, "QUIT"):
+				fmt.Fprint(conn, "221 bye\r\n")
+				return
+			default:
+				fmt.Fprint(conn, "250 ok\r\n")
+			}
+		}
+	}()
+	j := testJob(t, 0)
+	j.SMTPServer = ln.Addr().String()
+	j.NotifyEmail = "a@example.com, b@example.com"
+	if err = j.mail(&Notification{Job: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := <-rcpts, <-rcpts; a != "<a@example.com>" || b != "<b@example.com>" {
+		t.Fatal("Unexpected recipients:", a, b)
+	}
+}
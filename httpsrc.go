@@ -0,0 +1,186 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Timeout of a single request to HTTP source.
+const HTTPTimeout = 5 * time.Minute
+
+// Source read with HTTP range requests. Its statefile, published next to
+// it, tells which blocks have to be fetched. Responses are compressed
+// if the server agrees, zstd level is asked for unless compress is
+// empty, "none" disables compression.
+type httpSource struct {
+	url      string
+	size     int64
+	client   *http.Client
+	compress string
+	dec      *zstd.Decoder
+}
+
+// Unexpected status of HTTP response. Server errors are transient.
+type httpStatusError struct {
+	status string
+	code   int
+}
+
+func (e *httpStatusError) Error() string {
+	return "Unexpected HTTP status: " + e.status
+}
+
+func (e *httpStatusError) Temporary() bool {
+	return e.code/100 == 5 || e.code == http.StatusTooManyRequests
+}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+func openHTTPSource(client *http.Client, url, compress string) (*httpSource, error) {
+	if _, ok := zstdLevels[compress]; !ok && compress != "" && compress != "none" {
+		return nil, errors.New("Unknown compression: " + compress)
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &httpSource{url: url, client: client, compress: compress, dec: dec}
+	resp, err := s.client.Head(url)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{resp.Status, resp.StatusCode}
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		return nil, errors.New("Server does not support range requests")
+	}
+	if resp.ContentLength < 0 {
+		return nil, errors.New("Server does not tell the size")
+	}
+	s.size = resp.ContentLength
+	return s, nil
+}
+
+// Read the range, resuming it from the received part if the connection
+// breaks during the response. Connections are dialed again after
+// failures, so the retry does not reuse the broken one.
+func (s *httpSource) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), s.size)
+	for int64(n) < end-off {
+		var got int
+		got, err = s.fetch(p[n:end-off], off+int64(n))
+		n += got
+		if err == nil {
+			continue
+		}
+		s.client.CloseIdleConnections()
+		if got == 0 || classifyError(err) != ErrClassNetwork {
+			return n, err
+		}
+		err = nil
+	}
+	if end-off < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Fetch the whole range of p's length at offset, returning how much of
+// it was received.
+func (s *httpSource) fetch(p []byte, off int64) (int, error) {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(off, 10)+"-"+strconv.FormatInt(off+int64(len(p))-1, 10))
+	if s.compress != "none" {
+		req.Header.Set("Accept-Encoding", "zstd")
+		if s.compress != "" {
+			req.Header.Set(ZstdLevelHeader, s.compress)
+		}
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, &httpStatusError{resp.Status, resp.StatusCode}
+	}
+	if resp.Header.Get("Content-Encoding") == "zstd" {
+		packed, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return 0, err
+		}
+		data, err := s.dec.DecodeAll(packed, nil)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to decompress: %w", err)
+		}
+		if len(data) != len(p) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return copy(p, data), nil
+	}
+	return io.ReadFull(resp.Body, p)
+}
+
+func (s *httpSource) Close() error {
+	s.dec.Close()
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Fetch statefile published by the HTTP source.
+func fetchState(client *http.Client, url string) (*State, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected HTTP status: %s", resp.Status)
+	}
+	return ReadState(resp.Body)
+}
+
+// Mark blocks whose hashes differ in two states of the same geometry.
+func differingBlocks(st, other *State) []bool {
+	dirty := make([]bool, st.Blocks())
+	for i := range dirty {
+		dirty[i] = !bytes.Equal(st.Hash(int64(i)), other.Hash(int64(i)))
+	}
+	return dirty
+}
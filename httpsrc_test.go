@@ -0,0 +1,228 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Publish source of size random bytes and its statefile. Range requests
+// fail with 503 while fail returns true.
+func testHTTPSource(t *testing.T, size int, fail func(r *http.Request) bool) (*Job, *httptest.Server) {
+	t.Helper()
+	pub := testJob(t, size)
+	pub.Dst = os.DevNull
+	if err := pub.Run(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/src.state":
+			http.ServeFile(w, r, pub.State)
+		case "/src":
+			if r.Header.Get("Range") != "" && fail(r) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			http.ServeFile(w, r, pub.Src)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return pub, server
+}
+
+// Run failed by unavailable server keeps fetched blocks, the next one
+// fetches only the rest.
+func TestHTTPResumeRun(t *testing.T) {
+	var fetched atomic.Int64
+	pub, server := testHTTPSource(t, 1<<20, func(*http.Request) bool {
+		return fetched.Add(1) > 6
+	})
+	j := testJob(t, 0)
+	j.Src = server.URL + "/src"
+	j.Retry = map[string]RetryPolicy{ErrClassNetwork: {}}
+	if err := j.Run(); err == nil || !strings.Contains(err.Error(), "the next run resumes") {
+		t.Fatal("run is not resumable:", err)
+	}
+	fetched.Store(-1 << 20)
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sameFiles(t, pub.Src, j.Dst)
+	if n := fetched.Load() + 1<<20; n != 16-6 {
+		t.Fatalf("%d blocks fetched by the resumed run instead of 10", n)
+	}
+}
+
+// Response broken in the middle is resumed from the received part.
+func TestHTTPResumeRange(t *testing.T) {
+	var broken atomic.Bool
+	pub, server := testHTTPSource(t, 1<<20, func(*http.Request) bool { return false })
+	data, err := ioutil.ReadFile(pub.Src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ranges []string
+	breaking := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			server.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		if broken.Swap(true) {
+			ranges = append(ranges, r.Header.Get("Range"))
+			server.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 0-99999/1048576")
+		w.Header().Set("Content-Length", "100000")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[:1000])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer breaking.Close()
+	hs, err := openHTTPSource(breaking.Client(), breaking.URL+"/src", "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	buf := make([]byte, 100000)
+	if n, err := hs.ReadAt(buf, 0); err != nil || n != len(buf) {
+		t.Fatal(n, err)
+	}
+	if string(buf) != string(data[:len(buf)]) {
+		t.Fatal("resumed range differs")
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=1000-99999" {
+		t.Fatal("unexpected ranges requested:", ranges)
+	}
+}
+
+// Forged statefile of the source is rejected after the data actually
+// sent, whatever size it claims.
+func TestHTTPForgedState(t *testing.T) {
+	st := NewState(1<<20, 4096, hashers[HashBLAKE2b512])
+	st.Size = 1 << 50
+	var buf bytes.Buffer
+	if err := st.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+	if _, err := fetchState(server.Client(), server.URL+"/src.state"); err != ErrStateCorrupted {
+		t.Fatal("forged statefile is not rejected:", err)
+	}
+}
+
+// Registered transport carries all connections to the HTTP source.
+func TestHTTPRegisteredTransport(t *testing.T) {
+	pub, server := testHTTPSource(t, 1<<20, func(*http.Request) bool { return false })
+	var dials atomic.Int64
+	registerTransport("test", func(addr string) (Dialer, error) {
+		return func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dials.Add(1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}, nil
+	})
+	defer delete(transports, "test")
+	j := testJob(t, 0)
+	j.Src = "http://nowhere.invalid/src"
+	j.Transport = "test:" + server.Listener.Addr().String()
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sameFiles(t, pub.Src, j.Dst)
+	if dials.Load() == 0 {
+		t.Fatal("Registered transport is not used")
+	}
+}
+
+// Each block of the range is compressed on its own: zero blocks shrink,
+// random ones are stored raw, and the client decodes both.
+func TestHTTPCompressedBlocks(t *testing.T) {
+	pub := testJob(t, 1<<20)
+	pub.Dst = os.DevNull
+	data, err := ioutil.ReadFile(pub.Src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := 64 << 10
+	for i := 0; i < len(data); i += 2 * bs {
+		clear(data[i : i+bs])
+	}
+	if err = ioutil.WriteFile(pub.Src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.Run(); err != nil {
+		t.Fatal(err)
+	}
+	mux, err := serveMux(pub.Src, pub.State, "", nil, zstd.SpeedDefault, 16<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/src", nil)
+	req.Header.Set("Range", "bytes=1000-"+strconv.Itoa(len(data)-1))
+	req.Header.Set("Accept-Encoding", "zstd")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Encoding") != "zstd" {
+		t.Fatal("range is not compressed")
+	}
+	if n := rec.Body.Len(); n < len(data)/2 || n > len(data)/2+len(data)/32 {
+		t.Fatalf("range of %d bytes compressed to %d", len(data)-1000, n)
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	got, err := dec.DecodeAll(rec.Body.Bytes(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[1000:]) {
+		t.Fatal("decompressed range differs")
+	}
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	j := testJob(t, 0)
+	j.Src = server.URL + "/src"
+	if err = j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sameFiles(t, pub.Src, j.Dst)
+}
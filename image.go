@@ -0,0 +1,108 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Destination formats.
+const (
+	FormatRaw       = "raw"
+	FormatQCOW2     = "qcow2"
+	FormatVHD       = "vhd"
+	FormatVHDFixed  = "vhd-fixed"
+	FormatVHDX      = "vhdx"
+	FormatVHDXFixed = "vhdx-fixed"
+	FormatTar       = "tar"
+)
+
+// Destination the blocks are written to: either raw file or device, or
+// an image of some format.
+type Image interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+func init() {
+	registerFormat(FormatRaw, func(path string, mode int, _ int64) (Image, error) {
+		fd, err := os.OpenFile(path, mode|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return fd, nil
+	})
+	registerFormat(FormatQCOW2, func(path string, _ int, size int64) (Image, error) {
+		q, err := openQCOW2(path, size)
+		if err != nil {
+			return nil, err
+		}
+		return q, nil
+	})
+	for format, fixed := range map[string]bool{FormatVHD: false, FormatVHDFixed: true} {
+		registerFormat(format, func(path string, _ int, size int64) (Image, error) {
+			v, err := openVHD(path, size, fixed)
+			if err != nil {
+				return nil, err
+			}
+			return v, nil
+		})
+	}
+	for format, fixed := range map[string]bool{FormatVHDX: false, FormatVHDXFixed: true} {
+		registerFormat(format, func(path string, _ int, size int64) (Image, error) {
+			v, err := openVHDX(path, size, fixed)
+			if err != nil {
+				return nil, err
+			}
+			return v, nil
+		})
+	}
+	registerFormat(FormatTar, func(path string, _ int, size int64) (Image, error) {
+		t, err := openTar(path, size)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	})
+}
+
+// Open destination of format, creating new image of virtual size if it
+// does not exist. Raw destination is opened with mode.
+func openImage(path, format string, mode int, size int64) (Image, error) {
+	if format == "" {
+		format = FormatRaw
+	}
+	open, ok := imageFormats[format]
+	if !ok {
+		return nil, errors.New("Unknown dst format: " + format)
+	}
+	return open(path, mode, size)
+}
+
+// Write image's metadata kept in memory, raw files have none.
+func flushImage(img Image) error {
+	if f, ok := img.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Independent readers of the image formats, following their
+// specifications rather than the writers, returning virtual disk's
+// contents.
+
+func be32(b []byte, off int64) int64 { return int64(binary.BigEndian.Uint32(b[off:])) }
+func be64(b []byte, off int64) int64 { return int64(binary.BigEndian.Uint64(b[off:])) }
+func le32(b []byte, off int64) int64 { return int64(binary.LittleEndian.Uint32(b[off:])) }
+func le64(b []byte, off int64) int64 { return int64(binary.LittleEndian.Uint64(b[off:])) }
+
+// qcow2 version 3: L1 and L2 tables map guest clusters, every cluster
+// in use has refcount 1 and its table entry has the copied flag.
+func readQCOW2(t *testing.T, file []byte) []byte {
+	t.Helper()
+	if be32(file, 0) != 0x514649fb || be32(file, 4) != 3 {
+		t.Fatal("not a qcow2 version 3")
+	}
+	cs := int64(1) << be32(file, 20)
+	size := be64(file, 24)
+	l1Size, l1Off := be32(file, 36), be64(file, 40)
+	rtOff, rtClusters := be64(file, 48), be32(file, 56)
+	if be64(file, 8) != 0 || be32(file, 32) != 0 || be32(file, 60) != 0 || be64(file, 72) != 0 {
+		t.Fatal("qcow2 has unexpected features")
+	}
+	if be32(file, 96) != 4 {
+		t.Fatal("qcow2 refcounts are not 16-bit")
+	}
+	const mask = 0x00fffffffffffe00
+	used := map[int64]int{0: 1}
+	use := func(off, n int64) {
+		if off%cs != 0 || off+n > int64(len(file)) {
+			t.Fatalf("qcow2 cluster at %d is out of file", off)
+		}
+		for c := off / cs; c < (off+n+cs-1)/cs; c++ {
+			used[c]++
+		}
+	}
+	use(rtOff, rtClusters*cs)
+	use(l1Off, l1Size*8)
+	refcount := func(c int64) int64 {
+		perBlock := cs / 2
+		if c/perBlock >= rtClusters*cs/8 {
+			return 0
+		}
+		block := be64(file, rtOff+8*(c/perBlock)) & mask
+		if block == 0 {
+			return 0
+		}
+		return int64(binary.BigEndian.Uint16(file[block+2*(c%perBlock):]))
+	}
+	for i := int64(0); i < rtClusters*cs/8; i++ {
+		if block := be64(file, rtOff+8*i) & mask; block != 0 {
+			use(block, cs)
+		}
+	}
+	image := make([]byte, size)
+	perTable := cs / 8
+	for l1 := int64(0); l1 < l1Size; l1++ {
+		l1e := uint64(be64(file, l1Off+8*l1))
+		l2Off := int64(l1e & mask)
+		if l2Off == 0 {
+			continue
+		}
+		if l1e&(1<<63) == 0 {
+			t.Fatalf("qcow2 L1 entry %d has no copied flag", l1)
+		}
+		use(l2Off, cs)
+		for l2 := int64(0); l2 < perTable; l2++ {
+			l2e := uint64(be64(file, l2Off+8*l2))
+			guest := (l1*perTable + l2) * cs
+			switch {
+			case l2e&(1<<62) != 0:
+				t.Fatal("qcow2 has compressed cluster")
+			case l2e&1 != 0 || l2e&mask == 0:
+				continue
+			case l2e&(1<<63) == 0:
+				t.Fatalf("qcow2 L2 entry of %d has no copied flag", guest)
+			case guest >= size:
+				t.Fatalf("qcow2 maps cluster %d beyond the size", guest)
+			}
+			off := int64(l2e & mask)
+			use(off, cs)
+			copy(image[guest:], file[off:off+cs])
+		}
+	}
+	for c := int64(0); c*cs < int64(len(file)); c++ {
+		if ref := refcount(c); ref != int64(used[c]) {
+			t.Fatalf("qcow2 cluster %d has refcount %d, used %d times", c, ref, used[c])
+		}
+	}
+	return image
+}
+
+// Fail unless VHD footer's or dynamic header's checksum at offset is
+// one's complement of the sum of its other bytes.
+func checkVHDSum(t *testing.T, data []byte, at int) {
+	t.Helper()
+	var sum uint32
+	for i, b := range data {
+		if i < at || i >= at+4 {
+			sum += uint32(b)
+		}
+	}
+	if ^sum != binary.BigEndian.Uint32(data[at:]) {
+		t.Fatal("invalid VHD checksum")
+	}
+}
+
+// VHD, fixed or dynamic one, whose blocks are prepended with sector
+// bitmaps.
+func readVHD(t *testing.T, file []byte) []byte {
+	t.Helper()
+	footer := file[len(file)-512:]
+	if string(footer[:8]) != "conectix" {
+		t.Fatal("not a VHD")
+	}
+	checkVHDSum(t, footer, 64)
+	size := be64(footer, 48)
+	switch be32(footer, 60) {
+	case 2:
+		if int64(len(file)) != size+512 {
+			t.Fatal("fixed VHD has wrong length")
+		}
+		return file[:size]
+	case 3:
+	default:
+		t.Fatal("unexpected VHD type")
+	}
+	if !bytes.Equal(file[:512], footer) {
+		t.Fatal("VHD footer's copy differs")
+	}
+	header := file[be64(footer, 16):][:1024]
+	if string(header[:8]) != "cxsparse" {
+		t.Fatal("invalid VHD dynamic header")
+	}
+	checkVHDSum(t, header, 36)
+	batOff, entries, bs := be64(header, 16), be32(header, 28), be32(header, 32)
+	if entries*bs < size {
+		t.Fatal("VHD table does not cover the size")
+	}
+	bitmapLen := (bs/512/8 + 511) &^ 511
+	image := make([]byte, entries*bs)
+	for b := int64(0); b < entries; b++ {
+		sector := be32(file, batOff+4*b)
+		if sector == 0xffffffff {
+			continue
+		}
+		bitmap := file[sector*512:][:bitmapLen]
+		data := file[sector*512+bitmapLen:][:bs]
+		for s := int64(0); s < bs/512; s++ {
+			if bitmap[s/8]&(0x80>>(s%8)) != 0 {
+				copy(image[b*bs+s*512:], data[s*512:(s+1)*512])
+			}
+		}
+	}
+	return image[:size]
+}
+
+// GUID in Microsoft's mixed endian representation, written
+// independently of the writer's one.
+func msGUID(s string) []byte {
+	b, _ := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	for _, r := range [][2]int{{0, 4}, {4, 6}, {6, 8}} {
+		for i, j := r[0], r[1]-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+	}
+	return b
+}
+
+// Fail unless structure's CRC32C, stored at offset 4, is valid.
+func checkVHDXSum(t *testing.T, data []byte) {
+	t.Helper()
+	buf := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(buf[4:], 0)
+	if crc32.Checksum(buf, crc32.MakeTable(crc32.Castagnoli)) != binary.LittleEndian.Uint32(data[4:]) {
+		t.Fatalf("invalid VHDX %q checksum", data[:4])
+	}
+}
+
+// VHDX with empty log: current header, region table, metadata and BAT
+// with sector bitmap entries interleaved after each chunk.
+func readVHDX(t *testing.T, file []byte) []byte {
+	t.Helper()
+	if string(file[:8]) != "vhdxfile" {
+		t.Fatal("not a VHDX")
+	}
+	var header []byte
+	for _, off := range []int64{64 << 10, 128 << 10} {
+		h := file[off:][:4096]
+		if string(h[:4]) != "head" {
+			continue
+		}
+		checkVHDXSum(t, h)
+		if header == nil || le64(h, 8) > le64(header, 8) {
+			header = h
+		}
+	}
+	if header == nil {
+		t.Fatal("VHDX has no header")
+	}
+	if !bytes.Equal(header[48:64], make([]byte, 16)) {
+		t.Fatal("VHDX log is not empty")
+	}
+	if binary.LittleEndian.Uint16(header[66:]) != 1 {
+		t.Fatal("unexpected VHDX version")
+	}
+	regions := file[192<<10:][:64<<10]
+	if string(regions[:4]) != "regi" {
+		t.Fatal("invalid VHDX region table")
+	}
+	checkVHDXSum(t, regions)
+	if !bytes.Equal(regions, file[256<<10:][:64<<10]) {
+		t.Fatal("VHDX region table copies differ")
+	}
+	var batOff, batLen, metaOff int64 = -1, 0, -1
+	for i := int64(0); i < le32(regions, 8); i++ {
+		e := regions[16+32*i:][:32]
+		switch {
+		case bytes.Equal(e[:16], msGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")):
+			batOff, batLen = le64(e, 16), le32(e, 24)
+		case bytes.Equal(e[:16], msGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")):
+			metaOff = le64(e, 16)
+		default:
+			t.Fatal("unknown VHDX region")
+		}
+	}
+	if batOff < 0 || metaOff < 0 {
+		t.Fatal("VHDX has no BAT or metadata")
+	}
+	meta := file[metaOff:]
+	if string(meta[:8]) != "metadata" {
+		t.Fatal("invalid VHDX metadata table")
+	}
+	items := make(map[string][]byte)
+	for i := int64(0); i < int64(binary.LittleEndian.Uint16(meta[10:])); i++ {
+		e := meta[32+32*i:][:32]
+		items[hex.EncodeToString(e[:16])] = meta[le32(e, 16):][:le32(e, 20)]
+	}
+	item := func(guid string) []byte {
+		data, ok := items[hex.EncodeToString(msGUID(guid))]
+		if !ok {
+			t.Fatal("VHDX has no metadata item", guid)
+		}
+		return data
+	}
+	params := item("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	bs := le32(params, 0)
+	if le32(params, 4)&2 != 0 {
+		t.Fatal("VHDX has parent")
+	}
+	size := le64(item("2FA54224-CD1B-4876-B211-5DBED83BF4B8"), 0)
+	logical := le32(item("8141BF1D-A96F-4709-BA47-F233A8FAAB5F"), 0)
+	item("CDA348C7-445D-4471-9CC9-E9885251C556")
+	item("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	ratio := (int64(1) << 23) * logical / bs
+	blocks := (size + bs - 1) / bs
+	if (blocks+(blocks-1)/ratio)*8 > batLen {
+		t.Fatal("VHDX BAT does not cover the size")
+	}
+	image := make([]byte, blocks*bs)
+	for b := int64(0); b < blocks; b++ {
+		e := le64(file, batOff+8*(b+b/ratio))
+		switch e & 7 {
+		case 0, 1, 2, 3:
+			continue
+		case 6:
+		default:
+			t.Fatalf("VHDX block %d has state %d", b, e&7)
+		}
+		off := (e >> 20) << 20
+		copy(image[b*bs:], file[off:off+bs])
+	}
+	return image[:size]
+}
+
+// Writes of 64 KiB blocks land where the reference reader of each
+// format finds them, across reopening the image.
+func TestImageFormats(t *testing.T) {
+	for format, c := range map[string]struct {
+		size int64
+		read func(*testing.T, []byte) []byte
+	}{
+		FormatQCOW2:     {5<<20 + 1000, readQCOW2},
+		FormatVHD:       {5<<20 + 1000, readVHD},
+		FormatVHDFixed:  {5<<20 + 1000, readVHD},
+		FormatVHDX:      {70<<20 + 1000, readVHDX},
+		FormatVHDXFixed: {70<<20 + 1000, readVHDX},
+	} {
+		path := filepath.Join(t.TempDir(), "image")
+		const bs = 64 << 10
+		blocks := (c.size + bs - 1) / bs
+		expected := make([]byte, (c.size+511)&^511)
+		for _, run := range [][]int64{{0, 1, 31, 32, 33, blocks - 1}, {1, 40, 2}} {
+			img, err := openImage(path, format, os.O_RDWR, c.size)
+			if err != nil {
+				t.Fatal(format, err)
+			}
+			for _, i := range run {
+				data := make([]byte, min(bs, c.size-i*bs))
+				rand.Read(data)
+				if _, err = img.WriteAt(data, i*bs); err != nil {
+					t.Fatal(format, err)
+				}
+				copy(expected[i*bs:], data)
+			}
+			if err = img.Close(); err != nil {
+				t.Fatal(format, err)
+			}
+		}
+		file, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		if !bytes.Equal(c.read(t, file), expected) {
+			t.Fatal(format, "image differs from the written data")
+		}
+		qemuCompare(t, format, path, expected)
+	}
+}
+
+// Compare the image with raw data by qemu-img too, if it is installed.
+func qemuCompare(t *testing.T, format, path string, expected []byte) {
+	t.Helper()
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		return
+	}
+	raw := path + ".raw"
+	if err := ioutil.WriteFile(raw, expected, 0600); err != nil {
+		t.Fatal(err)
+	}
+	name := map[string]string{
+		FormatQCOW2: "qcow2", FormatVHD: "vpc", FormatVHDFixed: "vpc",
+		FormatVHDX: "vhdx", FormatVHDXFixed: "vhdx",
+	}[format]
+	out, err := exec.Command("qemu-img", "compare", "-f", name, "-F", "raw", path, raw).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: qemu-img compare: %v: %s", format, err, out)
+	}
+}
@@ -0,0 +1,1552 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Single sync job: either from command line, or from configuration file.
+type Job struct {
+	Name  string `toml:"-"`
+	Src   string `toml:"src"`
+	Dst   string `toml:"dst"`
+	State string `toml:"state"`
+	Blk   int64  `toml:"blk"` // KiB
+
+	// URL of HTTP source's statefile, src with ".state" appended if empty
+	SrcState string `toml:"src_state"`
+
+	// Comma separated URLs of peers publishing HTTP source's blocks they
+	// have already synced
+	SrcPeers string `toml:"src_peers"`
+
+	// zstd level asked from HTTP source: fastest, default, better, best,
+	// none disables compression, server's choice if empty
+	SrcCompress string `toml:"src_compress"`
+
+	// Copy HTTP source's blocks found elsewhere in the destination
+	// instead of fetching them
+	ReuseMoved bool `toml:"reuse_moved"`
+
+	// Fetch HTTP source over QUIC (HTTP/3), https only
+	QUIC bool `toml:"quic"`
+
+	// Transport of HTTP source's connections: unix:PATH, ssh:DEST, or
+	// one added to the source tree
+	Transport string `toml:"transport"`
+
+	// Destination format: raw, qcow2, vhd, vhd-fixed, vhdx, vhdx-fixed, tar
+	DstFormat string `toml:"dst_format"`
+
+	// Keep hashes of that number of sub-blocks of each block, writing
+	// only changed ones
+	SubBlocks int `toml:"sub_blocks"`
+
+	// Do not write zero blocks during the first run, destination is
+	// known to be zero-filled
+	AssumeDstZero bool `toml:"assume_dst_zero"`
+
+	// Write every block, regardless of the state
+	Full bool `toml:"full"`
+
+	// Ask the server tracking receivers to accept any state root, with
+	// a full run
+	Reseed bool `toml:"-"`
+
+	// Overwrite destination's superseded data with random bytes before
+	// writing the new one
+	Shred bool `toml:"shred"`
+
+	// Remove stale data of destination beyond the source's size
+	WipeTail bool `toml:"wipe_tail"`
+
+	// Compress the statefile with zstd
+	StateCompress bool `toml:"state_compress"`
+
+	// Store hashes of non-zero blocks only
+	SparseState bool `toml:"sparse_state"`
+
+	// Write only differing pages of changed blocks, reading them first
+	DeltaWrite bool `toml:"delta_write"`
+
+	// Comma separated chain of NAME:ARG transforms of data written to
+	// destination, like aes-xts:KEYFILE
+	DstTransform string `toml:"dst_transform"`
+
+	// Directory with statefiles named after source, destination and
+	// block size, used if State is not specified
+	StateDir string `toml:"state_dir"`
+
+	// Directory of the temporary statefile, statefile's one if empty
+	TmpDir string `toml:"tmp_dir"`
+
+	// Keep the statefile, or only its digest, in destination file's
+	// extended attributes
+	StateXattr bool `toml:"state_xattr"`
+
+	// Allocate the whole created destination file, or mark it sparse
+	// on Windows
+	Preallocate bool `toml:"preallocate"`
+
+	// Octal mode and "user:group" owner of the created destination
+	// file and of the statefile
+	DstMode    string `toml:"dst_mode"`
+	DstOwner   string `toml:"dst_owner"`
+	StateMode  string `toml:"state_mode"`
+	StateOwner string `toml:"state_owner"`
+
+	// Block hash algorithm of the new statefile
+	Hash string `toml:"hash"`
+
+	// Number of hashing workers, all CPUs if zero
+	Workers int `toml:"workers"`
+
+	// Keep the number of the last run changed each block
+	TrackChanges bool `toml:"track_changes"`
+
+	// CPUs the process is pinned to, like "0-7,16-23", and NUMA node
+	// buffers are allocated on, "auto" for the one of source's HBA.
+	// Without CPUs the process is pinned to the node's ones
+	CPUs     string `toml:"cpus"`
+	NUMANode string `toml:"numa_node"`
+
+	// Number of blocks read ahead of hashing, limited by memory all
+	// block buffers may take
+	Readahead int    `toml:"readahead"`
+	Memory    string `toml:"memory"`
+
+	// Number of source's regions read concurrently, sequential reading
+	// if zero or one
+	Readers int `toml:"readers"`
+
+	// Amount of written data after which destination is synchronized,
+	// like 256M
+	DirtyLimit string `toml:"dirty_limit"`
+
+	// Memory for changed blocks queued to be written to destination
+	// in background, like 1G
+	WriteBehind string `toml:"write_behind"`
+
+	// Move changed blocks from source to destination inside the
+	// kernel. Source must not change during the run
+	ZeroCopy bool `toml:"zero_copy"`
+
+	// Huge pages backing block buffers: thp, hugetlb
+	HugePages string `toml:"huge_pages"`
+
+	// Check CRC32C of each block before its strong hash
+	CRC bool `toml:"crc"`
+
+	// Percentage of unchanged blocks re-read from the destination to
+	// check it still matches the state
+	VerifySample string `toml:"verify_sample"`
+
+	// Check destination block before overwriting it: either only log
+	// that it was modified, or abort
+	Paranoid string `toml:"paranoid"`
+
+	// Only estimate changes by hashing that percentage of blocks
+	Estimate string `toml:"-"`
+
+	// Slow down reading while io or cpu pressure exceeds that
+	// percentage
+	Pressure string `toml:"pressure"`
+
+	// Append-only hash chained log of runs and written extents
+	AuditLog string `toml:"audit_log"`
+
+	// Collect failed blocks and continue the run, instead of stopping
+	// on the first error
+	KeepGoing bool `toml:"keep_going"`
+
+	// Failed blocks count raising corruption alert, 0 to disable
+	AlertBlocks int64 `toml:"alert_blocks"`
+
+	// Retry policies of transient errors' classes, defaults are used
+	// for missing ones
+	Retry map[string]RetryPolicy `toml:"retry"`
+
+	// Show full-screen dashboard instead of progress
+	TUI bool `toml:"-"`
+
+	// Stop at the first changed block, without writing anything
+	ExitOnChange bool `toml:"exit_on_first_change"`
+
+	// Hash everything first, then write changed blocks, optionally
+	// asking for confirmation between passes
+	TwoPass bool `toml:"two_pass"`
+	Confirm bool `toml:"-"`
+
+	// Ed25519 private key seed signing the statefile
+	SignKey string `toml:"sign_key"`
+
+	// Either key or passphrase encrypting the statefile
+	StateKey        string `toml:"state_key"`
+	StatePassphrase string `toml:"state_passphrase"`
+
+	// Chunk store written instead of the destination
+	Store string `toml:"store"`
+
+	// Key file encrypting the chunk store, and cipher and nonces of
+	// the newly created one
+	StoreKey    string `toml:"store_key"`
+	StoreCipher string `toml:"store_cipher"`
+	StoreNonce  string `toml:"store_nonce"`
+
+	// Compress newly stored chunks with zstd
+	StoreCompress bool `toml:"store_compress"`
+
+	// Store generations kept after each run: last ones and the last
+	// ones of each day, week and month
+	KeepLast    int `toml:"keep_last"`
+	KeepDaily   int `toml:"keep_daily"`
+	KeepWeekly  int `toml:"keep_weekly"`
+	KeepMonthly int `toml:"keep_monthly"`
+
+	// Daemon schedule: either fixed interval or cron expression, with
+	// random delay up to jitter added
+	Interval Duration `toml:"interval"`
+	Cron     string   `toml:"cron"`
+	Jitter   Duration `toml:"jitter"`
+
+	// Daemon's schedule of destination's verification against the
+	// statefile, and share of blocks verified, all by default
+	ScrubInterval Duration `toml:"scrub_interval"`
+	ScrubCron     string   `toml:"scrub_cron"`
+	ScrubSample   string   `toml:"scrub_sample"`
+
+	// Mountpoint of the filesystem frozen during the read pass, or
+	// only during snapshot creation
+	Freeze string `toml:"freeze"`
+
+	// Size of LVM snapshot to be taken and read instead of the source
+	LVMSnapshot string `toml:"lvm_snapshot"`
+
+	// Source is ZFS volume, sync from its temporary snapshot
+	ZFSSnapshot bool `toml:"zfs_snapshot"`
+
+	// Source is Windows volume, sync from its shadow copy
+	VSS bool `toml:"vss"`
+
+	// NBD server exporting the source and its dirty bitmap, which
+	// restricts reading to the changed extents
+	NBDServer string `toml:"nbd_server"`
+	NBDExport string `toml:"nbd_export"`
+	NBDBitmap string `toml:"nbd_bitmap"`
+
+	// QMP socket of QEMU and block node having the bitmap, which is
+	// rotated by the run then
+	NBDQMP  string `toml:"nbd_qmp"`
+	NBDNode string `toml:"nbd_node"`
+
+	// dm-era device tracking source's writes
+	EraDev string `toml:"era_dev"`
+
+	// Commands executed before reading and after the state is saved
+	PreCmd  string `toml:"pre_cmd"`
+	PostCmd string `toml:"post_cmd"`
+
+	// URL the run's result is POSTed to as JSON, ntfy topic's URL and
+	// comma separated email addresses the summary is sent to
+	NotifyURL   string `toml:"notify_url"`
+	NotifyNtfy  string `toml:"notify_ntfy"`
+	NotifyEmail string `toml:"notify_email"`
+
+	// Path to write run's summary JSON to
+	SummaryJSON string `toml:"summary_json"`
+
+	// Path to write run's HTML report to
+	ReportHTML string `toml:"report_html"`
+
+	// Path to write PNG image of run's block map to
+	MapImage string `toml:"map_image"`
+
+	// SMTP server as HOST:PORT, its credentials and sender's address
+	SMTPServer   string `toml:"smtp_server"`
+	SMTPUser     string `toml:"smtp_user"`
+	SMTPPassword string `toml:"smtp_password"`
+	SMTPFrom     string `toml:"smtp_from"`
+
+	// Members of consistency group, synced together
+	Group []*Job `toml:"group"`
+
+	Stats Stats `toml:"-"`
+
+	log    *log.Logger
+	quiet  bool
+	snap   Snapshot
+	frozen bool   // filesystem is frozen by the group
+	era    uint64 // dm-era started by the current run
+	// NBD bitmap added by the current run
+	bitmapNext string
+	dash       *dashboard
+
+	// Progress of the running sync: block size, source size and bytes
+	// already processed
+	bs     int64
+	size   atomic.Int64
+	done   atomic.Int64
+	failed atomic.Int64 // failed blocks of the current run
+	beat   atomic.Int64 // unix nanoseconds of the latest progress
+
+	blockErrs blockErrors
+	auditor   *auditWriter // audit log of the running sync
+
+	// States of the run's blocks, if they are reported
+	keepMap bool
+	runMap  []uint32
+
+	ctl   control
+	start chan struct{} // runs daemon's job immediately
+	last  atomic.Pointer[Notification]
+}
+
+// Statistics of the last run.
+type Stats struct {
+	Run      string // UUID of the run
+	Started  time.Time
+	Duration time.Duration
+	Blocks   int64
+	Changed  int64
+	Written  int64
+	Skipped  int64 // blocks not read thanks to change tracking
+	Failed   int64 // blocks failed to be read, written or verified
+	Digest   string
+}
+
+var ErrLocked = errors.New("Job is already running")
+
+// Random UUID identifying the run in logs, notifications and statefile.
+func newRunID() string {
+	var id [16]byte
+	crand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+type SyncEvent struct {
+	i    int64
+	buf  []byte
+	data []byte
+	sum  []byte
+	old  []byte // previous sum, if destination is checked before write
+	same bool   // unchanged block written anyway
+
+	// Differing sub-blocks, the whole block is written if nil
+	parts []Extent
+}
+
+// What to do if destination block to be overwritten differs from the
+// statefile.
+const (
+	ParanoidLog   = "log"
+	ParanoidAbort = "abort"
+)
+
+func prn(s string) {
+	os.Stdout.Write([]byte(s))
+	os.Stdout.Sync()
+}
+
+// Size of either regular file, or the device.
+func fileSize(fd *os.File) (int64, error) {
+	fi, err := fd.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to read src stat: %w", err)
+	}
+	if fi.Mode()&os.ModeDevice == os.ModeDevice {
+		size, err := fd.Seek(0, 2)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to seek src: %w", err)
+		}
+		fd.Seek(0, 0)
+		return size, nil
+	}
+	return fi.Size(), nil
+}
+
+// Print progress, unless disabled.
+func (j *Job) prn(s string) {
+	if !j.quiet && j.dash == nil {
+		prn(s)
+	}
+}
+
+// Create job's logger, unless it is already set.
+func (j *Job) initLog() {
+	if j.log == nil {
+		prefix := ""
+		if j.Name != "" {
+			prefix = j.Name + ": "
+		}
+		j.log = log.New(log.Writer(), prefix, log.Flags()|log.Lmsgprefix)
+	}
+}
+
+// Start the new run, tagging job's log lines with its ID: in the
+// prefix, or in SYNCER_RUN field if they are sent to journald.
+func (j *Job) startRun(id string) {
+	j.Stats = Stats{Run: id, Started: time.Now()}
+	if w, ok := j.log.Writer().(*journalWriter); ok {
+		w.run.Store(&id)
+		return
+	}
+	prefix := id + ": "
+	if j.Name != "" {
+		prefix = j.Name + " " + prefix
+	}
+	j.log.SetPrefix(prefix)
+}
+
+func (j *Job) Run() error {
+	j.initLog()
+	j.beat.Store(time.Now().UnixNano())
+	for _, c := range j.controls() {
+		c.reset()
+	}
+	j.keepMap = j.ReportHTML != "" || j.MapImage != ""
+	for _, m := range j.Group {
+		m.keepMap = j.keepMap
+	}
+	var err error
+	if len(j.Group) > 0 {
+		err = j.runGroup()
+	} else {
+		err = j.runOnce()
+	}
+	if aerr := j.alert(j.Stats.Failed); aerr != nil {
+		j.log.Println(aerr)
+		err = errors.Join(err, aerr)
+	}
+	if !j.dryRun() {
+		j.notify(err)
+	}
+	if !j.dryRun() && j.SummaryJSON != "" {
+		if serr := j.writeSummary(j.last.Load(), err); serr != nil {
+			j.log.Println("Unable to write summary:", serr)
+		}
+	}
+	if !j.dryRun() && j.ReportHTML != "" {
+		if rerr := j.writeReport(j.last.Load(), err); rerr != nil {
+			j.log.Println("Unable to write report:", rerr)
+		}
+	}
+	if !j.dryRun() && j.MapImage != "" {
+		if merr := j.writeMapImage(); merr != nil {
+			j.log.Println("Unable to write map image:", merr)
+		}
+	}
+	return err
+}
+
+// Job only checks the source, without writing anything.
+func (j *Job) dryRun() bool {
+	return j.Estimate != "" || j.ExitOnChange
+}
+
+func (j *Job) runOnce() error {
+	if err := j.resolveState(); err != nil {
+		return err
+	}
+	unlock, err := lockFile(j.State + ".lock")
+	if err != nil {
+		return fmt.Errorf("Unable to lock state: %w", err)
+	}
+	defer unlock()
+	if j.Estimate != "" {
+		return j.estimate()
+	}
+	if j.ExitOnChange {
+		return j.detectChange()
+	}
+	j.startRun(newRunID())
+	j.log.Println("Run", j.Stats.Run)
+	if j.PreCmd != "" {
+		j.log.Println("Running pre command")
+		if err = j.hook(j.PreCmd, false, nil); err != nil {
+			return fmt.Errorf("Pre command failed: %w", err)
+		}
+	}
+	if err = j.startEra(); err != nil {
+		err = fmt.Errorf("Unable to start new era: %w", err)
+	} else if err = j.startBitmap(); err != nil {
+		err = fmt.Errorf("Unable to add NBD bitmap: %w", err)
+	} else if j.snap, err = j.snapshot(); err != nil {
+		err = fmt.Errorf("Unable to take snapshot: %w", err)
+	} else {
+		if j.snap != nil {
+			j.log.Println("Reading from snapshot", j.snap.Device())
+		}
+		err = j.sync()
+		if j.snap != nil {
+			if serr := j.snap.Remove(); serr != nil {
+				j.log.Println("Unable to remove snapshot:", serr)
+			}
+			j.snap = nil
+		}
+	}
+	if berr := j.endBitmap(err); berr != nil {
+		berr = fmt.Errorf("Unable to rotate NBD bitmap: %w", berr)
+		if err == nil {
+			err = berr
+		} else {
+			j.log.Println(berr)
+		}
+	}
+	j.Stats.Duration = time.Since(j.Stats.Started)
+	if j.PostCmd != "" {
+		j.log.Println("Running post command")
+		if herr := j.hook(j.PostCmd, true, err); herr != nil && err == nil {
+			err = fmt.Errorf("Post command failed: %w", herr)
+		}
+	}
+	return err
+}
+
+func (j *Job) sync() (err error) {
+	defer func() { j.Stats.Failed = j.failed.Swap(0) }()
+	j.blockErrs = blockErrors{}
+	bs := j.Blk * int64(1<<10)
+	if j.AuditLog != "" {
+		if err = j.auditStart(); err != nil {
+			return fmt.Errorf("Unable to write audit log: %w", err)
+		}
+		defer func() { j.auditFinish(err) }()
+	}
+
+	secret, signKey, err := stateSecrets(j.StateKey, j.StatePassphrase, j.SignKey)
+	if err != nil {
+		return err
+	}
+
+	// Open source, calculate number of blocks
+	srcPath := j.Src
+	if j.snap != nil {
+		srcPath = j.snap.Device()
+	}
+	var src io.ReaderAt
+	var size int64
+	var remote *State
+	var report func(root string, size, bs int64) error // to the server tracking receivers
+	var swarm *swarmSource
+	var moved *movedSource
+	var weak []uint32 // HTTP source's weak checksums
+	var patch *patchSource
+	if isURL(srcPath) {
+		// Block size and hashes come from the state published with it
+		client, err := j.httpClient()
+		if err != nil {
+			return err
+		}
+		hs, err := openHTTPSource(client, srcPath, j.SrcCompress)
+		if err != nil {
+			return fmt.Errorf("Unable to open src: %w", err)
+		}
+		defer hs.Close()
+		stateURL := j.SrcState
+		if stateURL == "" {
+			stateURL = srcPath + ".state"
+		}
+		var tracked bool
+		if remote, tracked, err = j.handshake(client, stateURL, secret); err != nil {
+			return fmt.Errorf("Unable to fetch src statefile: %w", err)
+		}
+		if tracked {
+			report = func(root string, size, bs int64) error {
+				return j.reportRoot(client, stateURL, root, size, bs, signKey)
+			}
+		}
+		if remote.Size != hs.size {
+			return fmt.Errorf(
+				"Size differs with src statefile: %d instead of %d",
+				remote.Size, hs.size,
+			)
+		}
+		src, size, bs = hs, hs.size, remote.Bs
+		if j.ReuseMoved {
+			if weak, err = fetchWeakSums(client, srcPath+".weak", remote); err != nil {
+				return fmt.Errorf("Unable to fetch src weak checksums: %w", err)
+			}
+		}
+		if j.SrcPeers != "" {
+			swarm = j.openSwarm(hs, remote)
+			defer swarm.Close()
+			src = swarm
+		} else if j.DeltaWrite {
+			// Destination is known after it is opened
+			patch = &patchSource{ReaderAt: hs, hs: hs}
+			src = patch
+		}
+	} else if open := sourceBackend(srcPath); open != nil {
+		bsrc, err := open(srcPath)
+		if err != nil {
+			return fmt.Errorf("Unable to open src: %w", err)
+		}
+		defer bsrc.Close()
+		src, size = bsrc, bsrc.Size()
+	} else {
+		fd, err := os.Open(srcPath)
+		if err != nil {
+			return fmt.Errorf("Unable to open src: %w", err)
+		}
+		defer fd.Close()
+		if size, err = srcSize(fd); err != nil {
+			return err
+		}
+		src = fd
+	}
+	if report != nil {
+		// Once the new state is saved, even if the run failed after
+		defer func() {
+			if j.Stats.Digest == "" {
+				return
+			}
+			if rerr := report(j.Stats.Digest, size, bs); rerr != nil {
+				err = errors.Join(err, fmt.Errorf("Unable to report state root to src: %w", rerr))
+			}
+		}()
+	}
+	blocks := size / bs
+	if size%bs != 0 {
+		blocks++
+	}
+	j.log.Println(blocks, bs, "byte blocks")
+	j.Stats.Blocks = blocks
+	j.bs = bs
+	j.size.Store(size)
+	j.done.Store(0)
+	j.runMap = nil
+	if j.keepMap {
+		j.runMap = make([]uint32, blocks)
+	}
+
+	// Share of unchanged blocks checked in destination
+	var sample float64
+	if j.VerifySample != "" {
+		if sample, err = parsePercent(j.VerifySample); err != nil {
+			return err
+		}
+		sample /= 100
+	}
+	var sampled, drifted, zeroSkipped, skipped atomic.Int64
+	if j.Paranoid != "" && j.Paranoid != ParanoidLog && j.Paranoid != ParanoidAbort {
+		return errors.New("Unknown paranoid mode: " + j.Paranoid)
+	}
+
+	if j.DstFormat == FormatTar && (sample > 0 || j.Paranoid != "") {
+		return errors.New("Tar dst can not be verified")
+	}
+	if j.DstFormat == FormatTar && j.DeltaWrite {
+		return errors.New("Delta write requires readable dst")
+	}
+	if j.AssumeDstZero && (j.Store != "" || j.DstTransform != "") {
+		return errors.New("Only untransformed dst can be assumed zero")
+	}
+	if j.Shred && (j.Store != "" || j.DstFormat == FormatTar) {
+		return errors.New("Only overwritable dst can be shredded")
+	}
+	if j.WipeTail && (j.Store != "" || (j.DstFormat != "" && j.DstFormat != FormatRaw)) {
+		return errors.New("Only raw dst tail can be wiped")
+	}
+	if j.StateXattr && j.Store != "" {
+		return errors.New("Statefile can not be kept in store's xattr")
+	}
+	if j.Preallocate && (j.Store != "" || (j.DstFormat != "" && j.DstFormat != FormatRaw)) {
+		return errors.New("Only raw dst can be preallocated")
+	}
+
+	dstPerm, err := parsePerm(j.DstMode, j.DstOwner)
+	if err != nil {
+		return err
+	}
+	statePerm, err := parsePerm(j.StateMode, j.StateOwner)
+	if err != nil {
+		return err
+	}
+
+	// Open destination
+	var dst Image
+	var dstFile *os.File
+	var delta *deltaImage
+	var shred *shredImage
+	var store *Store
+	unlockStore := func() {}
+	if j.Store == "" {
+		mode := os.O_WRONLY
+		if sample > 0 || j.Paranoid != "" || j.DeltaWrite || j.ReuseMoved || j.WipeTail {
+			mode = os.O_RDWR
+		}
+		dstPath := j.Dst
+		if j.DstFormat == FormatTar {
+			dstPath = tarPath(j.Dst, j.Stats.Started)
+			j.log.Println("Archive:", dstPath)
+		}
+		_, serr := os.Stat(dstPath)
+		dst, err = openImage(dstPath, j.DstFormat, mode, size)
+		if err != nil {
+			return fmt.Errorf("Unable to open dst: %w", err)
+		}
+		defer dst.Close()
+		dstFile, _ = dst.(*os.File)
+		if os.IsNotExist(serr) {
+			if err = dstPerm.apply(dstPath); err != nil {
+				return fmt.Errorf("Unable to set dst permissions: %w", err)
+			}
+			if j.Preallocate {
+				if err = preallocate(dstFile, size); err != nil {
+					return fmt.Errorf("Unable to preallocate dst: %w", err)
+				}
+				j.log.Println("Preallocated", size, "bytes of dst")
+			}
+		}
+		if j.Shred {
+			shred = &shredImage{Image: dst}
+			dst = shred
+		}
+		if j.DstTransform != "" {
+			chain, err := openTransforms(j.DstTransform)
+			if err != nil {
+				return err
+			}
+			dst = &transformedImage{dst, chain}
+		}
+		if j.DeltaWrite {
+			delta = &deltaImage{Image: dst}
+			dst = delta
+		}
+		if patch != nil {
+			patch.dst = dst
+		}
+	} else {
+		var key []byte
+		if j.StoreKey != "" {
+			if key, err = ReadKey(j.StoreKey); err != nil {
+				return fmt.Errorf("Unable to read key: %w", err)
+			}
+		}
+		store, err = OpenStore(j.Store, key, StoreConfig{
+			Cipher:   j.StoreCipher,
+			Nonce:    j.StoreNonce,
+			Compress: j.StoreCompress,
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to open store: %w", err)
+		}
+		if unlockStore, err = store.Lock(false); err != nil {
+			return fmt.Errorf("Unable to lock store: %w", err)
+		}
+		defer func() { unlockStore() }()
+	}
+
+	hash, err := LookupHash(j.Hash)
+	if err != nil {
+		return err
+	}
+	if remote != nil {
+		if j.Hash != "" && hash != remote.Hasher() {
+			return fmt.Errorf(
+				"Hash differs with src statefile: %s instead of %s",
+				remote.Hasher().Name, hash.Name,
+			)
+		}
+		hash = remote.Hasher()
+	}
+
+	// Statefile torn by the crash during its update is not trusted
+	torn, err := recoverStateUpdate(j.State, signKey)
+	if err != nil {
+		return fmt.Errorf("Unable to recover statefile update: %w", err)
+	}
+	if torn {
+		j.log.Println("Statefile was torn during its update, moved to", j.State+".torn")
+	}
+
+	if j.StateXattr {
+		if err = j.checkStateXattr(); err != nil {
+			return fmt.Errorf("Unable to check dst xattr: %w", err)
+		}
+	}
+
+	// Check if we already have statefile and read the state
+	st := NewState(size, bs, hash)
+	serial := deviceSerial(j.Src)
+	var dirty []bool
+	paranoid := false
+	zeroDst := j.AssumeDstZero
+	if _, err := os.Stat(j.State); err == nil {
+		j.log.Println("State file found")
+		zeroDst = false
+		prev, err := ReadStateFile(j.State, secret, signKey)
+		if err != nil {
+			return fmt.Errorf("Unable to read statefile: %w", err)
+		}
+		if prev.Meta.Runs > 0 {
+			j.log.Printf(
+				"Previous run %d by syncer %s at %s from %s\n",
+				prev.Meta.Runs, prev.Meta.Syncer,
+				prev.Meta.Time.Format(time.RFC3339), prev.Meta.Src,
+			)
+		}
+		j.logHistory(prev)
+
+		// Check that it is the same source disk
+		if prev.Meta.Serial != "" && serial != "" && serial != prev.Meta.Serial {
+			return fmt.Errorf(
+				"Source differs with state file: %s instead of %s",
+				prev.Meta.Serial, serial,
+			)
+		}
+
+		// Check previously used size and block size
+		if size != prev.Size {
+			return fmt.Errorf(
+				"Size differs with state file: %d instead of %d",
+				prev.Size, size,
+			)
+		}
+		if bs != prev.Bs {
+			return fmt.Errorf(
+				"Blocksize differs with state file: %d instead of %d",
+				prev.Bs, bs,
+			)
+		}
+		if (j.Hash != "" || remote != nil) && hash != prev.Hasher() {
+			return fmt.Errorf(
+				"Hash differs with state file: %s instead of %s",
+				prev.Hasher().Name, hash.Name,
+			)
+		}
+		hash = prev.Hasher()
+		st = prev
+		paranoid = j.Paranoid != "" && dst != nil
+
+		// Only blocks known to be changed since the previous run are read
+		var extents []Extent
+		if !j.Full {
+			if extents, err = j.dirtyExtents(prev); err != nil {
+				return fmt.Errorf("Unable to get changed extents: %w", err)
+			}
+		}
+		if extents != nil {
+			dirty = dirtyBlocks(extents, bs, blocks)
+		} else if remote != nil && !j.Full {
+			dirty = differingBlocks(prev, remote)
+			if j.ReuseMoved && dst != nil {
+				moved = newMovedSource(src, dst, prev, remote)
+				src = moved
+				if weak == nil {
+					j.log.Println("Server has no weak checksums, only aligned moved blocks are found")
+				} else if err = moved.scan(weak, dirty, prev.Size); err != nil {
+					return fmt.Errorf("Unable to scan dst for moved blocks: %w", err)
+				} else {
+					j.log.Println(len(moved.found), "moved blocks found in dst")
+				}
+			}
+		}
+		if dirty != nil {
+			var n int64
+			for _, d := range dirty {
+				if d {
+					n++
+				}
+			}
+			j.log.Println(n, "blocks are marked as changed")
+		}
+	}
+	st.Meta.Src, st.Meta.Dst = identity(j.Src), identity(j.Dst)
+	if store != nil {
+		st.Meta.Dst = identity(j.Store)
+	}
+	st.Meta.Time = j.Stats.Started
+	st.Meta.Syncer = Version
+	st.Meta.Serial = serial
+	st.Meta.Runs++
+	if !j.TrackChanges {
+		st.Changes, st.Counts = nil, nil
+		st.Meta.TrackedSince = 0
+	} else if st.Changes == nil || st.Counts == nil {
+		st.Changes = make([]uint32, blocks)
+		st.Counts = make([]uint32, blocks)
+		st.Meta.TrackedSince = st.Meta.Runs
+	}
+	if err = checkSubBlocks(bs, j.SubBlocks); err != nil {
+		return err
+	}
+	if j.SubBlocks == 0 || store != nil {
+		st.Subs, st.SubRuns = nil, nil
+	} else {
+		st.keepSubs(j.SubBlocks, st.Meta.Runs)
+	}
+	// Previous CRCs are only trusted if they were saved with the state
+	crcs := j.CRC && st.CRCs != nil
+	if !j.CRC {
+		st.CRCs = nil
+	} else if st.CRCs == nil {
+		st.CRCs = make([]uint32, blocks)
+	}
+	st.Meta.Sparse = j.SparseState
+	st.Compressed = j.StateCompress
+	st.Meta.Snapshot = ""
+	if j.snap != nil {
+		st.Meta.Snapshot = j.snap.Name()
+	}
+	if j.EraDev != "" {
+		st.Meta.Era = j.era
+	}
+	node, cpus, err := j.pin(srcPath)
+	if err != nil {
+		return err
+	}
+	workers := j.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+		if cpus > 0 {
+			workers = cpus
+		}
+	}
+	j.log.Println(workers, "workers")
+	if j.Pressure != "" {
+		threshold, err := parsePercent(j.Pressure)
+		if err != nil {
+			return err
+		}
+		stop, err := j.watchPressure(threshold)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+	if j.TUI {
+		j.startDashboard(blocks, size, workers)
+		defer j.stopDashboard()
+	}
+
+	// Zero blocks of zero-filled destination are only hashed
+	var zeroSum, zeroTail []byte
+	if zeroDst && blocks > 0 {
+		j.log.Println("Dst is assumed to be zero-filled")
+		zeroSum = st.zeroHash(bs)
+		zeroTail = st.zeroHash(st.blockLen(blocks - 1))
+	}
+
+	// Two-pass run: only blocks found changed by the first pass are read
+	// again, so the amount of data to write is known in advance
+	var toWrite int64
+	if j.TwoPass && j.Full {
+		return errors.New("Full run can not be two-pass")
+	}
+	if j.Full {
+		j.log.Println("Full run: every block is written")
+	}
+	if j.TwoPass {
+		j.log.Println("Pass 1: hashing")
+		if dirty, err = j.scan(src, st, store, dirty, crcs, workers); err != nil {
+			return err
+		}
+		var n int64
+		for i, d := range dirty {
+			if d {
+				n++
+				toWrite += st.blockLen(int64(i))
+			}
+		}
+		j.log.Println("Pass 2:", n, "blocks,", toWrite, "bytes to write")
+		if j.Confirm && toWrite > 0 && !confirm(fmt.Sprintf("Write %d bytes?", toWrite)) {
+			return errors.New("Aborted before writing")
+		}
+	}
+
+	var i int64
+	stateFile, err := j.tempState()
+	if err != nil {
+		return fmt.Errorf("Unable to create temporary file: %w", err)
+	}
+	keepTemp := false
+	defer func() {
+		if err != nil && !keepTemp {
+			stateFile.Close()
+			os.Remove(stateFile.Name())
+		}
+	}()
+
+	// Statefile is replaced atomically: journaled, written to the
+	// temporary file, renamed over it and signed
+	saveState := func() error {
+		data, err := st.Encode(secret)
+		if err != nil {
+			return fmt.Errorf("Unable to encode statefile: %w", err)
+		}
+		if err = beginStateUpdate(j.State, data); err != nil {
+			return fmt.Errorf("Unable to journal statefile update: %w", err)
+		}
+		if _, err = stateFile.Write(data); err == nil {
+			err = stateFile.Sync()
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to write statefile: %w", err)
+		}
+		stateFile.Close()
+		if err = statePerm.apply(stateFile.Name()); err != nil {
+			return fmt.Errorf("Unable to set statefile permissions: %w", err)
+		}
+		if err = os.Rename(stateFile.Name(), j.State); err != nil {
+			keepTemp = true
+			return fmt.Errorf(
+				"Unable to overwrite statefile: %w, saved state is in: %s",
+				err, stateFile.Name(),
+			)
+		}
+		// Signature is replaced only with the statefile, journal is kept
+		// until then
+		if signKey != nil {
+			if err = signState(signKey, j.State, data); err != nil {
+				return fmt.Errorf("Unable to sign statefile: %w", err)
+			}
+		}
+		if err = endStateUpdate(j.State); err != nil {
+			return fmt.Errorf("Unable to remove statefile journal: %w", err)
+		}
+		if j.StateXattr {
+			if err = j.saveStateXattr(data); err != nil {
+				return fmt.Errorf("Unable to keep statefile in dst xattr: %w", err)
+			}
+		}
+		return nil
+	}
+
+	// Create buffers and event channel. Blocks read ahead wait for a
+	// free hashing worker.
+	ahead := int64(j.Readahead)
+	if j.Memory != "" {
+		limit, err := parseSize(j.Memory)
+		if err != nil {
+			return err
+		}
+		if n := max(limit/bs-int64(workers), 0); ahead > n {
+			ahead = n
+			j.log.Println("Readahead is limited to", ahead, "blocks by memory")
+		}
+	}
+	depth := workers + int(ahead)
+	pool, free, err := allocBuffers(depth, int(bs), node, j.HugePages)
+	if err != nil {
+		return err
+	}
+	defer free()
+	bufs := make(chan []byte, depth)
+	for _, buf := range pool {
+		bufs <- buf
+	}
+	hashing := make(chan struct{}, workers)
+	syncs := make(chan chan SyncEvent, depth)
+	var splice *splicer
+	if j.ZeroCopy {
+		if store != nil || j.WriteBehind != "" {
+			return errors.New("Zero-copy can not be used with store or write-behind")
+		}
+		if _, ok := dst.(*os.File); !ok {
+			return errors.New("Zero-copy requires raw dst")
+		}
+		if _, ok := src.(*os.File); !ok {
+			return errors.New("Zero-copy requires local src")
+		}
+		if splice, err = newSplicer(); err != nil {
+			return err
+		}
+		defer splice.close()
+	}
+	flush := &flusher{dst: dst}
+	if j.DirtyLimit != "" {
+		if flush.limit, err = parseSize(j.DirtyLimit); err != nil {
+			return err
+		}
+	}
+	var behind *writeBehind
+	if j.WriteBehind != "" && dst != nil {
+		limit, err := parseSize(j.WriteBehind)
+		if err != nil {
+			return err
+		}
+		if behind, err = j.startWriteBehind(dst, flush, max(int(limit/bs), 1), int(bs), node); err != nil {
+			return err
+		}
+	}
+
+	// Writer. After the first error it only drains events.
+	j.prn("[")
+	finished := make(chan struct{})
+	var chunksNew, chunksDup, conflicts, subWritten int64
+	var werr error
+	go func() {
+		var event SyncEvent
+		var written Extent // not yet audited
+		writeStarted := time.Now()
+		reported := writeStarted
+		for sync := range syncs {
+			event = <-sync
+			failed := false
+			if event.data != nil {
+				if !event.same {
+					j.Stats.Changed++
+				}
+				j.Stats.Written += int64(len(event.data))
+				if toWrite > 0 && time.Since(reported) >= ProgressInterval {
+					reported = time.Now()
+					left := max(toWrite-j.Stats.Written, 0)
+					eta := time.Duration(float64(reported.Sub(writeStarted)) *
+						float64(left) / float64(j.Stats.Written))
+					j.log.Printf(
+						"Written %d of %d bytes, ETA %s\n",
+						j.Stats.Written, toWrite, eta.Round(time.Second),
+					)
+				}
+				if st.Changes != nil && !event.same {
+					st.Changes[event.i] = uint32(st.Meta.Runs)
+					st.Counts[event.i]++
+				}
+			}
+			if event.data != nil && werr == nil && store != nil {
+				var stored bool
+				err := j.retry("chunk store", func() (err error) {
+					stored, err = store.Put(event.sum, event.data)
+					return err
+				})
+				if err != nil {
+					werr, failed = j.blockFailed(st, event.i, "store", fmt.Errorf("Unable to store chunk: %w", err)), true
+				} else if stored {
+					chunksNew++
+				} else {
+					chunksDup++
+				}
+			} else if event.data != nil && werr == nil {
+				// Block could be already written by the failed run
+				if event.old != nil {
+					cur := dstSum(dst, event.i*bs, len(event.data), hash)
+					if !bytes.Equal(cur, event.old) && !bytes.Equal(cur, event.sum) {
+						j.log.Println("Destination block", event.i, "was modified since the previous run")
+						conflicts++
+						j.failed.Add(1)
+						j.blockErrs.add("verify", event.i, errors.New("Modified since the previous run"))
+						if j.Paranoid == ParanoidAbort {
+							werr = fmt.Errorf("Destination block %d was modified since the previous run", event.i)
+						}
+					}
+				}
+				if werr == nil && behind != nil {
+					werr = behind.write(event.i, event.data)
+				} else if werr == nil && splice != nil {
+					if err := j.retry("dst splice", func() error {
+						return splice.copy(dst.(*os.File), src.(*os.File), event.i*bs, len(event.data))
+					}); err != nil {
+						werr, failed = j.blockFailed(st, event.i, "write", fmt.Errorf("Error during dst splice: %w", err)), true
+					} else {
+						werr = flush.written(len(event.data))
+					}
+				} else if werr == nil {
+					var n int
+					if err := j.retry("dst write", func() (err error) {
+						n, err = writeParts(dst, event, bs)
+						return err
+					}); err != nil {
+						werr, failed = j.blockFailed(st, event.i, "write", fmt.Errorf("Error during dst write: %w", err)), true
+					} else {
+						subWritten += int64(n)
+						werr = flush.written(n)
+					}
+				}
+			}
+			if j.AuditLog != "" && event.data != nil && werr == nil && !failed {
+				if written.Length > 0 && written.Offset+written.Length != event.i*bs {
+					j.auditWrite(written)
+					written.Length = 0
+				}
+				if written.Length == 0 {
+					written.Offset = event.i * bs
+				}
+				written.Length += int64(len(event.data))
+			}
+			bufs <- event.buf
+			<-sync
+		}
+		if behind != nil {
+			if err := behind.close(); err != nil && werr == nil {
+				werr = err
+			}
+		}
+		if werr == nil && dst != nil {
+			werr = flushImage(dst)
+		}
+		if werr == nil && dst != nil {
+			werr = flush.flush()
+		}
+		if written.Length > 0 {
+			j.auditWrite(written)
+		}
+		if j.AuditLog != "" {
+			j.auditCommit()
+		}
+		close(finished)
+	}()
+
+	// Reader, either sequential or of several regions. The frozen
+	// filesystem is thawed as soon as everything is read, or we failed.
+	var rerr error
+	var stopped atomic.Bool
+	thaw := func() error { return nil }
+	if j.Freeze != "" && j.snap == nil && !j.frozen {
+		j.log.Println("Freezing", j.Freeze)
+		if thaw, err = freezeFS(j.Freeze); err != nil {
+			close(syncs)
+			<-finished
+			return fmt.Errorf("Unable to freeze filesystem: %w", err)
+		}
+	}
+	// Blocks moved forward are read backwards, so their old places are
+	// not overwritten before being copied
+	descending := moved != nil && j.Readers <= 1 && moved.forward(dirty)
+	read := func(from, to int64) error {
+		for step := from; step < to; step++ {
+			i := step
+			if descending {
+				i = from + to - 1 - step
+			}
+			if dirty != nil && !dirty[i] {
+				j.block(i, blockSkipped)
+				skipped.Add(1)
+				continue
+			}
+			if err := j.ctl.wait(); err != nil {
+				return err
+			}
+			if stopped.Load() {
+				return nil
+			}
+			buf := <-bufs
+			n, err := j.readAt(src, buf, i*bs)
+			if err != nil && (err != io.EOF || n == 0) {
+				if err != io.EOF {
+					err = j.blockFailed(st, i, "read", fmt.Errorf("Error during src read: %w", err))
+					if err != nil {
+						return err
+					}
+					bufs <- buf
+					continue
+				}
+				return nil
+			}
+			j.ctl.limit(n)
+			sync := make(chan SyncEvent)
+			syncs <- sync
+			go func(i int64) {
+				hashing <- struct{}{}
+				j.busy(1)
+				var sum []byte
+				sumState := st.Hash(i)
+				changed := true
+				if st.CRCs != nil {
+					crc := crc32.Checksum(buf[:n], castagnoli)
+					changed = !crcs || crc != st.CRCs[i]
+					st.CRCs[i] = crc
+				}
+				if changed || j.Full {
+					sum = hash.Sum(buf[:n])
+					changed = bytes.Compare(sumState, sum) != 0 ||
+						(store != nil && !store.Has(sum))
+				}
+				if !changed && dst != nil && sample > 0 && rand.Float64() < sample {
+					sampled.Add(1)
+					if !bytes.Equal(dstSum(dst, i*bs, n, hash), sumState) {
+						j.log.Println("Destination block", i, "differs from statefile")
+						drifted.Add(1)
+						j.failed.Add(1)
+						j.blockErrs.add("verify", i, errors.New("Differs from statefile"))
+						changed = true
+						sum = hash.Sum(buf[:n])
+					}
+				}
+				same := !changed && j.Full
+				j.busy(-1)
+				<-hashing
+				if changed && zeroSum != nil &&
+					(bytes.Equal(sum, zeroSum) || int64(n) < bs && bytes.Equal(sum, zeroTail)) {
+					// Only recorded in the state
+					zeroSkipped.Add(1)
+					copy(sumState, sum)
+					changed = false
+				}
+				if changed || same {
+					var old []byte
+					if paranoid {
+						old = append(old, sumState...)
+					}
+					var parts []Extent
+					if st.Subs != nil {
+						// Drifted block is written whole
+						parts = st.updateSubs(i, buf[:n], st.Meta.Runs)
+						if bytes.Equal(sumState, sum) {
+							parts = nil
+						}
+					}
+					// Recorded before the writer might invalidate it
+					copy(sumState, sum)
+					sync <- SyncEvent{i, buf, buf[:n], sum, old, same, parts}
+					if same {
+						j.block(i, blockSame)
+					} else {
+						j.block(i, blockChanged)
+					}
+				} else {
+					sync <- SyncEvent{i, buf, nil, nil, nil, false, nil}
+					j.block(i, blockSame)
+				}
+				close(sync)
+			}(i)
+		}
+		return nil
+	}
+	if j.Readers <= 1 {
+		rerr = read(0, blocks)
+	} else {
+		// Regions are read concurrently, the first failed stops others
+		region := (blocks + int64(j.Readers) - 1) / int64(j.Readers)
+		errs := make(chan error, j.Readers)
+		for from := int64(0); from < blocks; from += region {
+			go func(from int64) {
+				err := read(from, min(from+region, blocks))
+				if err != nil {
+					stopped.Store(true)
+				}
+				errs <- err
+			}(from)
+		}
+		for from := int64(0); from < blocks; from += region {
+			if err := <-errs; err != nil && rerr == nil {
+				rerr = err
+			}
+		}
+	}
+	close(syncs)
+	<-finished
+	j.prn("]\n")
+	j.Stats.Skipped = skipped.Load()
+	if err = thaw(); err != nil && rerr == nil {
+		rerr = fmt.Errorf("Unable to thaw filesystem: %w", err)
+	}
+	if rerr != nil && remote != nil && werr == nil && store == nil &&
+		classifyError(rerr) == ErrClassNetwork {
+		// Fetched blocks are written and recorded, so the next run
+		// resumes fetching the rest instead of starting again
+		j.log.Println("Saving state of fetched blocks")
+		if err = saveState(); err != nil {
+			return errors.Join(rerr, err)
+		}
+		return fmt.Errorf("%w, the next run resumes", rerr)
+	}
+	if rerr != nil {
+		return rerr
+	}
+	if werr != nil {
+		return werr
+	}
+	if conflicts > 0 {
+		j.log.Println(conflicts, "modified destination blocks overwritten")
+	}
+	if zeroSum != nil {
+		j.log.Println(zeroSkipped.Load(), "zero blocks skipped")
+		if dstFile != nil {
+			if err = extendFile(dstFile, size); err != nil {
+				return fmt.Errorf("Unable to extend dst: %w", err)
+			}
+		}
+	}
+	if j.WipeTail {
+		wiped, err := wipeTail(dstFile, size)
+		if err != nil {
+			return fmt.Errorf("Unable to wipe dst tail: %w", err)
+		}
+		if wiped > 0 {
+			j.log.Println(wiped, "bytes of dst tail wiped")
+		}
+	}
+	if st.Subs != nil {
+		j.log.Println("Sub-blocks:", subWritten, "of", j.Stats.Written, "changed bytes written")
+	}
+	if shred != nil {
+		j.log.Println("Shred:", shred.shredded.Load(), "bytes overwritten with random data")
+	}
+	if delta != nil {
+		j.log.Println(
+			"Delta:", delta.written.Load(), "bytes written,",
+			delta.skipped.Load(), "unchanged bytes skipped",
+		)
+	}
+	if patch != nil && !patch.noPatch.Load() {
+		j.log.Println(
+			"Patches:", patch.received.Load(), "bytes received,",
+			patch.skipped.Load(), "unchanged bytes not transferred",
+		)
+	}
+	if remote != nil {
+		var n int64
+		for _, d := range differingBlocks(st, remote) {
+			if d {
+				n++
+			}
+		}
+		if n > 0 {
+			j.log.Println(n, "blocks differ from src statefile, source changed during the run")
+		}
+	}
+	if moved != nil {
+		j.log.Println(moved.reused.Load(), "moved blocks copied within destination")
+	}
+	if swarm != nil {
+		j.swarmReport(swarm)
+	}
+
+	if store != nil {
+		// Count how many distinct blocks the source consists of
+		uniq := make(map[string]struct{})
+		for i = 0; i < blocks; i++ {
+			uniq[string(st.Hash(i))] = struct{}{}
+		}
+		j.log.Println(
+			"Chunks:", chunksNew, "stored,",
+			chunksDup, "already in store",
+		)
+		j.log.Printf(
+			"Dedup: %d blocks, %d unique, ratio %.2f\n",
+			blocks, len(uniq), float64(blocks)/float64(len(uniq)),
+		)
+	}
+
+	if store != nil {
+		gen, err := store.AddGeneration(st)
+		if err != nil {
+			return fmt.Errorf("Unable to save generation: %w", err)
+		}
+		j.log.Println("Generation", gen, "saved")
+
+		// Chunks are referenced by the generation now, others' runs
+		// are waited for before pruning
+		unlockStore()
+		unlockStore = func() {}
+		retention := Retention{j.KeepLast, j.KeepDaily, j.KeepWeekly, j.KeepMonthly}
+		if !retention.IsZero() {
+			if unlockStore, err = store.Lock(true); err != nil {
+				return fmt.Errorf("Unable to lock store: %w", err)
+			}
+		}
+		removed, err := store.Prune(retention)
+		if err != nil {
+			return fmt.Errorf("Unable to prune generations: %w", err)
+		}
+		if len(removed) > 0 {
+			j.log.Println("Generations pruned:", removed)
+			count, size, err := store.GC(false)
+			if err != nil {
+				return fmt.Errorf("Unable to collect garbage: %w", err)
+			}
+			j.log.Println(count, "unreferenced chunks removed,", size, "bytes freed")
+		}
+	}
+
+	st.Meta.Changed = j.Stats.Changed
+	st.recordRun(RunRecord{
+		Run:      j.Stats.Run,
+		Time:     j.Stats.Started,
+		Duration: time.Since(j.Stats.Started),
+		Blocks:   blocks,
+		Changed:  j.Stats.Changed,
+		Written:  j.Stats.Written,
+	})
+	j.log.Println("Saving state")
+	if err = saveState(); err != nil {
+		return err
+	}
+	j.Stats.Digest = st.Meta.Digest
+	j.log.Println("Digest:", j.Stats.Digest)
+	if sample > 0 {
+		j.log.Println(sampled.Load(), "unchanged blocks verified in destination")
+	}
+	var errs []error
+	if drifted.Load() > 0 {
+		errs = append(errs, fmt.Errorf(
+			"Destination was modified: %d of %d verified blocks differed and were rewritten",
+			drifted.Load(), sampled.Load(),
+		))
+	}
+	if err = j.reportErrors(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Create temporary statefile in TmpDir, or next to the statefile, so it
+// can be atomically renamed over it. Leftovers of the crashed runs are
+// removed, as the statefile is locked.
+func (j *Job) tempState() (*os.File, error) {
+	dir := j.TmpDir
+	if dir == "" {
+		dir = filepath.Dir(j.State)
+	}
+	pattern := filepath.Base(j.State) + ".tmp"
+	leftovers, _ := filepath.Glob(filepath.Join(dir, pattern+"*"))
+	for _, p := range leftovers {
+		j.log.Println("Removing leftover temporary statefile", p)
+		os.Remove(p)
+	}
+	return ioutil.TempFile(dir, pattern)
+}
+
+// Extend regular file to size, if trailing zero blocks were skipped.
+func extendFile(fd *os.File, size int64) error {
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() || fi.Size() >= size {
+		return nil
+	}
+	return fd.Truncate(size)
+}
+
+// Hash destination's n bytes at offset, nil if they can not be read.
+func dstSum(dst Image, offset int64, n int, hash *Hasher) []byte {
+	buf := make([]byte, n)
+	if _, err := dst.ReadAt(buf, offset); err != nil {
+		return nil
+	}
+	return hash.Sum(buf)
+}
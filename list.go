@@ -0,0 +1,73 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// Show pairs tracked by statefiles in the state directory, reading only
+// their headers.
+func list(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	stateDir := fs.String("state-dir", "", "Directory with statefiles")
+	key := fs.String("state-key", "", "Path to key file encrypting the statefiles")
+	pass := fs.String("state-passphrase", "", "Passphrase encrypting the statefiles")
+	parseFlags(fs, args)
+	if *stateDir == "" {
+		log.Fatalln("-state-dir is required")
+	}
+	secret, _, err := stateSecrets(*key, *pass, "")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	paths, err := filepath.Glob(filepath.Join(*stateDir, "*.bin"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "STATE\tSRC\tDST\tBLK\tLAST RUN\tCHANGED")
+	for _, path := range paths {
+		st, err := ReadStateFileHeader(path, secret)
+		if err != nil {
+			log.Println("Unable to read", path+":", err)
+			continue
+		}
+		last := "-"
+		if !st.Meta.Time.IsZero() {
+			last = st.Meta.Time.Local().Format(time.RFC3339)
+		}
+		changed := 0.0
+		if blocks := st.Blocks(); blocks > 0 {
+			changed = 100 * float64(st.Meta.Changed) / float64(blocks)
+		}
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%d\t%s\t%.2f%%\n",
+			filepath.Base(path), st.Meta.Src, st.Meta.Dst,
+			st.Bs>>10, last, changed,
+		)
+	}
+	w.Flush()
+}
@@ -0,0 +1,51 @@
+//go:build !unix
+
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Take exclusive lock by creating the file. Lock file is left after
+// the crash and has to be removed manually.
+func lockFile(path string) (func(), error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	fd.Close()
+	return func() { os.Remove(path) }, nil
+}
+
+// Wait for the lock of the file. Shared lock is exclusive too.
+func waitLock(path string, shared bool) (func(), error) {
+	for {
+		unlock, err := lockFile(path)
+		if err != ErrLocked {
+			return unlock, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
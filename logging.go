@@ -0,0 +1,75 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+)
+
+// Logging options: messages go either to stderr, to syslog, or to the
+// rotated file.
+type logFlags struct {
+	syslog   *string
+	facility *string
+	file     *string
+	maxSize  *string
+	maxAge   *time.Duration
+	keep     *int
+}
+
+func addLogFlags(fs *flag.FlagSet) *logFlags {
+	return &logFlags{
+		syslog:   fs.String("log-syslog", "", "Log to syslog: local, udp:HOST:PORT, tcp:HOST:PORT"),
+		facility: fs.String("syslog-facility", "daemon", "Syslog facility"),
+		file:     fs.String("log-file", "", "Path to log file"),
+		maxSize:  fs.String("log-max-size", "10M", "Rotate log file exceeding that size, 0 disables"),
+		maxAge:   fs.Duration("log-max-age", 0, "Rotate log file older than that, like 24h"),
+		keep:     fs.Int("log-keep", 5, "Number of rotated log files to keep"),
+	}
+}
+
+// Redirect the standard logger, returning logger of errors.
+func (l *logFlags) setup() *log.Logger {
+	if *l.syslog != "" && *l.file != "" {
+		log.Fatalln("Either -log-syslog or -log-file can be used")
+	}
+	if *l.file != "" {
+		maxSize, err := parseSize(*l.maxSize)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		w, err := openRotatingFile(*l.file, maxSize, *l.maxAge, *l.keep)
+		if err != nil {
+			log.Fatalln("Unable to open log file:", err)
+		}
+		log.SetOutput(w)
+	}
+	if *l.syslog == "" {
+		return log.New(log.Writer(), "", log.Flags())
+	}
+	info, errs, err := newSyslogWriters(*l.syslog, *l.facility)
+	if err != nil {
+		log.Fatalln("Unable to connect to syslog:", err)
+	}
+	log.SetOutput(info)
+	log.SetFlags(0)
+	return log.New(errs, "", 0)
+}
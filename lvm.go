@@ -0,0 +1,116 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+type LVMSnapshot struct {
+	vg   string
+	name string
+}
+
+// Sequence number of snapshots created by this process
+var lvmSnapshotSeq uint32
+
+// Prefix of snapshot names of the logical volume:
+// ORIGIN-syncer-PID-SEQ, so group's members and daemon's jobs do not
+// collide, and snapshots left by dead processes can be found.
+func lvmSnapshotPrefix(lv string) string {
+	return lv + "-syncer-"
+}
+
+// Remove origin's snapshots left by syncer processes which are not
+// running anymore.
+func lvmRemoveStale(vg, lv string) error {
+	out, err := command("lvs", "--noheadings", "-o", "lv_name,origin", vg)
+	if err != nil {
+		return err
+	}
+	prefix := lvmSnapshotPrefix(lv)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[1] != lv || !strings.HasPrefix(fields[0], prefix) {
+			continue
+		}
+		cols := strings.Split(strings.TrimPrefix(fields[0], prefix), "-")
+		pid, err := strconv.Atoi(cols[0])
+		if len(cols) != 2 || err != nil {
+			continue
+		}
+		if _, err = os.Stat(fmt.Sprintf("/proc/%d", pid)); err == nil {
+			continue
+		}
+		stale := &LVMSnapshot{vg: vg, name: fields[0]}
+		if err = stale.Remove(); err != nil {
+			return fmt.Errorf("Unable to remove stale snapshot %s: %w", stale.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Create snapshot of the logical volume with specified size of copy on
+// write area.
+func lvmSnapshot(lv, size string) (*LVMSnapshot, error) {
+	out, err := command("lvs", "--noheadings", "-o", "vg_name,lv_name", lv)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return nil, errors.New("Unable to determine volume group of " + lv)
+	}
+	if err = lvmRemoveStale(fields[0], fields[1]); err != nil {
+		return nil, err
+	}
+	snap := &LVMSnapshot{
+		vg: fields[0],
+		name: fmt.Sprintf(
+			"%s%d-%d", lvmSnapshotPrefix(fields[1]),
+			os.Getpid(), atomic.AddUint32(&lvmSnapshotSeq, 1),
+		),
+	}
+	_, err = command(
+		"lvcreate", "--snapshot", "--size", size, "--name", snap.name, lv,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (s *LVMSnapshot) Device() string {
+	return path.Join("/dev", s.vg, s.name)
+}
+
+func (s *LVMSnapshot) Name() string {
+	return s.vg + "/" + s.name
+}
+
+func (s *LVMSnapshot) Remove() error {
+	_, err := command("lvremove", "--force", s.Name())
+	return err
+}
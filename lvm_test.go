@@ -0,0 +1,80 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLVMSnapshotNames(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("requires /proc")
+	}
+	// Snapshots of another run alive, of dead process and of another
+	// origin with the same prefix
+	alive := fmt.Sprintf("db-syncer-%d-1", os.Getppid())
+	dir := stubCommands(t, map[string]string{
+		"lvs": `case "$*" in
+*vg_name,lv_name*) echo "  vg0 db" ;;
+*) echo "  db vg0"
+   echo "  ` + alive + ` db"
+   echo "  db-syncer-999999999-3 db"
+   echo "  db-syncer-999999999-4 db-syncer" ;;
+esac
+`,
+		"lvcreate": `echo "lvcreate $*" >> "$(dirname "$0")/log"`,
+		"lvremove": `echo "lvremove $*" >> "$(dirname "$0")/log"`,
+	})
+	var names []string
+	for i := 0; i < 2; i++ {
+		snap, err := lvmSnapshot("/dev/vg0/db", "1G")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, snap.Name())
+	}
+	if names[0] == names[1] {
+		t.Fatal("same snapshot name", names[0])
+	}
+	prefix := fmt.Sprintf("vg0/db-syncer-%d-", os.Getpid())
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			t.Fatal("unexpected snapshot name", name)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var removed []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "lvremove ") {
+			removed = append(removed, strings.Fields(line)[2])
+		}
+	}
+	if len(removed) != 2 || removed[0] != "vg0/db-syncer-999999999-3" || removed[1] != removed[0] {
+		t.Fatal("unexpected removals", removed)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+)
+
+// Geometry of the block map image: cells in a row, their maximal number
+// and size in pixels. Several blocks share the cell on large sources.
+const (
+	MapColumns  = 256
+	MapMaxCells = MapColumns * 256
+	MapCellSize = 4
+)
+
+// Colors of block states, in the order of their priority.
+var mapColors = []color.RGBA{
+	blockUnread:  {0xff, 0xff, 0xff, 0xff},
+	blockSkipped: {0xdd, 0xdd, 0xdd, 0xff},
+	blockSame:    {0x44, 0xaa, 0x44, 0xff},
+	blockChanged: {0xee, 0x99, 0x00, 0xff},
+	blockFailed:  {0xcc, 0x00, 0x00, 0xff},
+}
+
+// Cells of the run's block map, each of the highest state of its blocks.
+func (j *Job) mapCells() []uint32 {
+	blocks := int64(len(j.runMap))
+	per := max((blocks+MapMaxCells-1)/MapMaxCells, 1)
+	cells := make([]uint32, (blocks+per-1)/per)
+	for i, state := range j.runMap {
+		cells[int64(i)/per] = max(cells[int64(i)/per], state)
+	}
+	return cells
+}
+
+// Write PNG image of the run's block map, group's members one after
+// another with a blank row between them.
+func (j *Job) writeMapImage() error {
+	var rows [][]uint32
+	members := j.Group
+	if len(members) == 0 {
+		members = []*Job{j}
+	}
+	for n, m := range members {
+		if n > 0 {
+			rows = append(rows, nil)
+		}
+		cells := m.mapCells()
+		for first := 0; first < len(cells); first += MapColumns {
+			rows = append(rows, cells[first:min(first+MapColumns, len(cells))])
+		}
+	}
+	img := image.NewRGBA(image.Rect(0, 0, MapColumns*MapCellSize, max(len(rows), 1)*MapCellSize))
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			img.SetRGBA(x, y, mapColors[blockUnread])
+		}
+	}
+	for row, cells := range rows {
+		for col, state := range cells {
+			// One pixel wide gaps separate cells
+			for y := 0; y < MapCellSize-1; y++ {
+				for x := 0; x < MapCellSize-1; x++ {
+					img.SetRGBA(col*MapCellSize+x, row*MapCellSize+y, mapColors[state])
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(j.MapImage, buf.Bytes(), 0644)
+}
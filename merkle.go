@@ -0,0 +1,143 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Number of children of each Merkle tree node.
+const TreeFanout = 16
+
+// Domain separation tags prepended to the hashed data: of the lowest
+// level nodes over the block hashes, of the upper level nodes and of
+// the digest.
+const (
+	TreeLeafTag   = 0
+	TreeNodeTag   = 1
+	TreeDigestTag = 2
+)
+
+var (
+	ErrStateMismatch = errors.New("States have different size or blocksize")
+	ErrStateHash     = errors.New("States have different hash algorithms")
+)
+
+// Upper levels of Merkle tree over the blocks hashes, lowest first. Each
+// node is the hash (of the same algorithm as the blocks) of its level's
+// tag and up to TreeFanout concatenated children. The last level
+// consists of the single root node.
+type Tree [][]byte
+
+// Number of nodes on each tree level over that number of blocks.
+func treeSizes(blocks int64) []int64 {
+	var sizes []int64
+	for n := blocks; n > 1; {
+		n = (n + TreeFanout - 1) / TreeFanout
+		sizes = append(sizes, n)
+	}
+	return sizes
+}
+
+func BuildTree(hashes []byte, hash *Hasher) Tree {
+	var tree Tree
+	lower := hashes
+	tag := byte(TreeLeafTag)
+	node := make([]byte, 1+TreeFanout*hash.Size)
+	for _, n := range treeSizes(int64(len(hashes) / hash.Size)) {
+		level := make([]byte, 0, n*int64(hash.Size))
+		node[0] = tag
+		for i := 0; i < len(lower); i += TreeFanout * hash.Size {
+			end := i + TreeFanout*hash.Size
+			if end > len(lower) {
+				end = len(lower)
+			}
+			k := copy(node[1:], lower[i:end])
+			level = append(level, hash.Sum(node[:1+k])...)
+		}
+		tree = append(tree, level)
+		lower = level
+		tag = TreeNodeTag
+	}
+	return tree
+}
+
+// Whole source digest: hash of the Merkle tree's root (or the only
+// block's hash) bound to the source size, blocksize and hash algorithm.
+func (st *State) Root() []byte {
+	var root []byte
+	if len(st.Tree) > 0 {
+		root = st.Tree[len(st.Tree)-1]
+	} else if st.Blocks() == 1 {
+		root = st.Hash(0)
+	}
+	data := make([]byte, 1+8+8, 1+8+8+len(st.hash.Name)+len(root))
+	data[0] = TreeDigestTag
+	binary.BigEndian.PutUint64(data[1:], uint64(st.Size))
+	binary.BigEndian.PutUint64(data[9:], uint64(st.Bs))
+	data = append(data, st.hash.Name...)
+	return st.hash.Sum(append(data, root...))
+}
+
+// Indexes of the blocks differing between two states. Identical subtrees
+// are skipped entirely.
+func (st *State) Diff(other *State) ([]int64, error) {
+	if st.Size != other.Size || st.Bs != other.Bs {
+		return nil, ErrStateMismatch
+	}
+	if st.hash != other.hash {
+		return nil, ErrStateHash
+	}
+	if st.Tree == nil {
+		st.Tree = BuildTree(st.Hashes, st.hash)
+	}
+	if other.Tree == nil {
+		other.Tree = BuildTree(other.Hashes, other.hash)
+	}
+	size := int64(st.hash.Size)
+	var changed []int64
+	blocks := st.Blocks()
+	var walk func(level int, i int64)
+	walk = func(level int, i int64) {
+		if level < 0 {
+			if !bytes.Equal(st.Hash(i), other.Hash(i)) {
+				changed = append(changed, i)
+			}
+			return
+		}
+		a := st.Tree[level][i*size : (i+1)*size]
+		b := other.Tree[level][i*size : (i+1)*size]
+		if bytes.Equal(a, b) {
+			return
+		}
+		lower := blocks
+		if level > 0 {
+			lower = int64(len(st.Tree[level-1])) / size
+		}
+		for c := i * TreeFanout; c < (i+1)*TreeFanout && c < lower; c++ {
+			walk(level-1, c)
+		}
+	}
+	if blocks > 0 {
+		walk(len(st.Tree)-1, 0)
+	}
+	return changed, nil
+}
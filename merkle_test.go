@@ -0,0 +1,120 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// Digest is bound to the size, blocksize and tree level of the hashes.
+func TestStateDigest(t *testing.T) {
+	st := randomState(t, 100*4096)
+	root := st.Root()
+	other := *st
+	other.Size--
+	if bytes.Equal(other.Root(), root) {
+		t.Fatal("Digest does not depend on size")
+	}
+	other = *st
+	other.Bs, other.Size = 2*st.Bs, 2*st.Size
+	if bytes.Equal(other.Root(), root) {
+		t.Fatal("Digest does not depend on blocksize")
+	}
+
+	// State of the lowest tree level nodes as block hashes
+	st.Tree = BuildTree(st.Hashes, st.hash)
+	nodes := int64(len(st.Tree[0]) / st.hash.Size)
+	upper := NewState(nodes*st.Bs, st.Bs, st.hash)
+	copy(upper.Hashes, st.Tree[0])
+	upper.Tree = BuildTree(upper.Hashes, upper.hash)
+	if bytes.Equal(upper.Tree[len(upper.Tree)-1], st.Tree[len(st.Tree)-1]) {
+		t.Fatal("Tree nodes are not separated from block hashes")
+	}
+}
+
+// Version 3 statefile's tree and digest are rebuilt with tags.
+func TestStateV3(t *testing.T) {
+	st := randomState(t, 100*4096)
+	var buf bytes.Buffer
+	if err := st.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	copy(data, StateMagicV3)
+	tree := 0
+	for _, level := range st.Tree {
+		tree += len(level)
+	}
+	copy(data[len(data)-tree:], bytes.Repeat([]byte{0xAA}, tree))
+	got, err := ReadState(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 3 {
+		t.Fatal("Read as version", got.Version)
+	}
+	if !reflect.DeepEqual(got.Tree, st.Tree) || got.Meta.Digest != hex.EncodeToString(st.Root()) {
+		t.Fatal("Tree is not rebuilt")
+	}
+}
+
+// Diff descending the trees finds exactly the changed blocks, whatever
+// the number of the tree levels.
+func TestStateDiff(t *testing.T) {
+	for _, blocks := range []int64{1, 2, 16, 17, 256, 257, 5000} {
+		st := randomState(t, blocks*4096-100)
+		other := randomState(t, blocks*4096-100)
+		copy(other.Hashes, st.Hashes)
+		var want []int64
+		for i := int64(0); i < blocks; i += 1 + blocks/7 {
+			other.Hash(i)[0] ^= 1
+			want = append(want, i)
+		}
+		if got, err := st.Diff(other); err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("%d blocks: %v differ instead of %v: %v", blocks, got, want, err)
+		}
+		copy(other.Hashes, st.Hashes)
+		other.Tree = nil
+		if got, err := st.Diff(other); err != nil || len(got) != 0 {
+			t.Fatalf("%d blocks: identical states differ in %v: %v", blocks, got, err)
+		}
+	}
+}
+
+// Tree kept in the statefile is the one built over its hashes.
+func TestStateTree(t *testing.T) {
+	st := randomState(t, 5000*4096)
+	var buf bytes.Buffer
+	if err := st.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadState(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Tree, BuildTree(st.Hashes, st.hash)) || len(got.Tree) != 4 {
+		t.Fatal("Tree differs from the built one")
+	}
+	if got.Meta.Digest != hex.EncodeToString(st.Root()) {
+		t.Fatal("Digest is not tree's root")
+	}
+}
@@ -0,0 +1,122 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log"
+	"os"
+)
+
+// Exit codes of mirror subcommand, if the replica is not in sync.
+const (
+	ExitSrcChanged = 2
+	ExitDstDrifted = 3
+)
+
+// Read-only check of the source, the destination and the statefile
+// against each other. Nothing is ever written.
+func mirror(args []string) {
+	fs := flag.NewFlagSet("mirror", flag.ExitOnError)
+	srcPath := fs.String("src", "", "Path to source disk")
+	dstPath := fs.String("dst", "", "Path to destination disk")
+	statePath := fs.String("state", "state.bin", "Path to statefile")
+	opts := addStateFlags(fs)
+	parseFlags(fs, args)
+	if *srcPath == "" || *dstPath == "" {
+		log.Fatalln("-src and -dst are required")
+	}
+	st := opts.Read(*statePath)
+	hash := st.Hasher()
+
+	src, err := os.Open(*srcPath)
+	if err != nil {
+		log.Fatalln("Unable to open src:", err)
+	}
+	defer src.Close()
+	size, err := srcSize(src)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if size != st.Size {
+		log.Fatalf("Size differs with state file: %d instead of %d\n", st.Size, size)
+	}
+	dst, err := os.Open(*dstPath)
+	if err != nil {
+		log.Fatalln("Unable to open dst:", err)
+	}
+	defer dst.Close()
+
+	// Blocks are categorized by what differs from the statefile
+	var srcChanged, dstDrifted, stale, diverged int64
+	buf := make([]byte, st.Bs)
+	prn("[")
+	for i := int64(0); i < st.Blocks(); i++ {
+		data := buf[:st.blockLen(i)]
+		if _, err = src.ReadAt(data, i*st.Bs); err != nil && err != io.EOF {
+			log.Fatalln("Error during src read:", err)
+		}
+		srcSum := hash.Sum(data)
+
+		// Destination may be shorter, its missing part differs
+		n, err := dst.ReadAt(data, i*st.Bs)
+		if err != nil && err != io.EOF {
+			log.Fatalln("Error during dst read:", err)
+		}
+		var dstSum []byte
+		if n == len(data) {
+			dstSum = hash.Sum(data)
+		}
+		srcOK := bytes.Equal(srcSum, st.Hash(i))
+		dstOK := bytes.Equal(dstSum, st.Hash(i))
+		switch {
+		case srcOK && dstOK:
+			prn(".")
+			continue
+		case !srcOK && dstOK:
+			srcChanged++
+			prn("%")
+			continue
+		case srcOK:
+			dstDrifted++
+			prn("!")
+		case bytes.Equal(srcSum, dstSum):
+			stale++
+			prn("%")
+			continue
+		default:
+			diverged++
+			prn("!")
+		}
+		log.Println("Destination block", i, "differs from statefile")
+	}
+	prn("]\n")
+	log.Println(srcChanged, "blocks changed in source only")
+	log.Println(stale, "blocks changed in both source and destination identically")
+	log.Println(dstDrifted, "blocks drifted in destination only")
+	log.Println(diverged, "blocks differ in all of source, destination and statefile")
+	if dstDrifted+diverged > 0 {
+		os.Exit(ExitDstDrifted)
+	}
+	if srcChanged+stale > 0 {
+		os.Exit(ExitSrcChanged)
+	}
+}
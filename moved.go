@@ -0,0 +1,233 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// HTTP source whose blocks already present elsewhere in the destination,
+// like after the partition was shifted, are copied from there instead of
+// being fetched. Copied data is checked against the source's hash, as
+// that place may be already overwritten.
+type movedSource struct {
+	io.ReaderAt
+	dst    Image
+	remote *State
+	old    map[string]int64 // hash of destination's block to its index
+	found  map[int64]int64  // source's block to destination's offset
+	reused atomic.Int64
+}
+
+// Index destination's blocks by their hashes in the local state.
+func newMovedSource(src io.ReaderAt, dst Image, prev, remote *State) *movedSource {
+	m := &movedSource{ReaderAt: src, dst: dst, remote: remote}
+	m.old = make(map[string]int64, prev.Blocks())
+	for i := prev.Blocks() - 1; i >= 0; i-- {
+		m.old[string(prev.Hash(i))] = i
+	}
+	m.found = make(map[int64]int64)
+	return m
+}
+
+// Offset in the destination where the source's block may be found.
+func (m *movedSource) offset(i int64) (int64, bool) {
+	if off, ok := m.found[i]; ok {
+		return off, true
+	}
+	k, ok := m.old[string(m.remote.Hash(i))]
+	return k * m.remote.Bs, ok
+}
+
+func (m *movedSource) ReadAt(p []byte, off int64) (int, error) {
+	i := off / m.remote.Bs
+	want := m.remote.Hash(i)
+	if k, ok := m.offset(i); ok && k != off {
+		size := int(m.remote.blockLen(i))
+		n, err := m.dst.ReadAt(p[:size], k)
+		if n == size && (err == nil || err == io.EOF) &&
+			bytes.Equal(m.remote.Hasher().Sum(p[:n]), want) {
+			m.reused.Add(1)
+			if size < len(p) {
+				return n, io.EOF
+			}
+			return n, nil
+		}
+	}
+	return m.ReaderAt.ReadAt(p, off)
+}
+
+// Whether more of dirty blocks are found at lower offsets than higher.
+func (m *movedSource) forward(dirty []bool) bool {
+	var balance int
+	for i, d := range dirty {
+		if k, ok := m.offset(int64(i)); d && ok {
+			if k < int64(i)*m.remote.Bs {
+				balance++
+			} else if k > int64(i)*m.remote.Bs {
+				balance--
+			}
+		}
+	}
+	return balance > 0
+}
+
+// rsync's weak checksum of the window, rolled byte by byte.
+type weakSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newWeakSum(data []byte) weakSum {
+	s := weakSum{n: uint32(len(data))}
+	for i, c := range data {
+		s.a += uint32(c)
+		s.b += uint32(len(data)-i) * uint32(c)
+	}
+	return s
+}
+
+func (s *weakSum) roll(out, in byte) {
+	s.a += uint32(in) - uint32(out)
+	s.b += s.a - s.n*uint32(out)
+}
+
+func (s weakSum) Sum32() uint32 {
+	return s.a&0xFFFF | s.b<<16
+}
+
+// Weak checksums of the image's blocks.
+func weakSums(r io.ReaderAt, size, bs int64) ([]uint32, error) {
+	st := &State{Size: size, Bs: bs}
+	sums := make([]uint32, st.Blocks())
+	buf := make([]byte, bs)
+	for i := range sums {
+		data := buf[:st.blockLen(int64(i))]
+		if _, err := r.ReadAt(data, int64(i)*bs); err != nil && err != io.EOF {
+			return nil, err
+		}
+		sums[i] = newWeakSum(data).Sum32()
+	}
+	return sums, nil
+}
+
+// Fetch weak checksums of HTTP source's blocks, published by serve next
+// to it. Nil is returned if the server has none.
+func fetchWeakSums(client *http.Client, url string, remote *State) ([]uint32, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{resp.Status, resp.StatusCode}
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4*remote.Blocks()+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != 4*remote.Blocks() {
+		return nil, errors.New("Weak checksums do not match src statefile")
+	}
+	sums := make([]uint32, remote.Blocks())
+	for i := range sums {
+		sums[i] = binary.BigEndian.Uint32(data[4*i:])
+	}
+	return sums, nil
+}
+
+// Size of destination's part read at once while scanning.
+const MovedScanBuf = 4 << 20
+
+// Find dirty full blocks of the source at any offset of the first size
+// bytes of the destination: window of the block size is rolled over it
+// byte by byte, and its strong hash is checked only if its weak checksum
+// equals one of the blocks'. Window skips the found block.
+func (m *movedSource) scan(weak []uint32, dirty []bool, size int64) error {
+	bs := m.remote.Bs
+	want := make(map[uint32][]int64)
+	for i, d := range dirty {
+		if d && m.remote.blockLen(int64(i)) == bs {
+			want[weak[i]] = append(want[weak[i]], int64(i))
+		}
+	}
+	if len(want) == 0 {
+		return nil
+	}
+	buf := make([]byte, 0, max(MovedScanBuf, 2*bs))
+	var base, pos int64 // offset of buf and window's position in it
+	var sum weakSum
+	rolled := false
+	for {
+		if int64(len(buf))-pos <= bs && base+int64(len(buf)) < size {
+			n := copy(buf[:cap(buf)], buf[pos:])
+			base, pos = base+pos, 0
+			end := min(int64(cap(buf)), size-base)
+			got, err := m.dst.ReadAt(buf[n:end], base+int64(n))
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("Unable to read dst: %w", err)
+			}
+			buf = buf[:n+got]
+			if got == 0 {
+				size = base + int64(len(buf))
+			}
+		}
+		if int64(len(buf))-pos < bs {
+			return nil
+		}
+		window := buf[pos : pos+bs]
+		if !rolled {
+			sum, rolled = newWeakSum(window), true
+		}
+		if blocks, ok := want[sum.Sum32()]; ok {
+			strong := m.remote.Hasher().Sum(window)
+			var rest []int64
+			for _, i := range blocks {
+				if bytes.Equal(strong, m.remote.Hash(i)) {
+					m.found[i] = base + pos
+				} else {
+					rest = append(rest, i)
+				}
+			}
+			if len(rest) < len(blocks) {
+				if len(rest) > 0 {
+					want[sum.Sum32()] = rest
+				} else {
+					delete(want, sum.Sum32())
+				}
+				pos, rolled = pos+bs, false
+				continue
+			}
+		}
+		if pos+bs == int64(len(buf)) {
+			return nil
+		}
+		sum.roll(buf[pos], buf[pos+bs])
+		pos++
+	}
+}
@@ -0,0 +1,141 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// State of data with 4 KiB blocks.
+func testState(t *testing.T, data []byte) *State {
+	t.Helper()
+	hash, err := LookupHash("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := NewState(int64(len(data)), 4096, hash)
+	for i := int64(0); i < st.Blocks(); i++ {
+		copy(st.Hash(i), hash.Sum(data[i*st.Bs:i*st.Bs+st.blockLen(i)]))
+	}
+	return st
+}
+
+func TestWeakSumRoll(t *testing.T) {
+	data := make([]byte, 300)
+	rand.Read(data)
+	sum := newWeakSum(data[:100])
+	for i := 0; i+100 < len(data); i++ {
+		sum.roll(data[i], data[i+100])
+		if want := newWeakSum(data[i+1 : i+101]).Sum32(); sum.Sum32() != want {
+			t.Fatalf("offset %d: rolled %x instead of %x", i+1, sum.Sum32(), want)
+		}
+	}
+}
+
+// Source is the old destination shifted by unaligned offset, with one
+// block changed, and served with its weak checksums.
+func TestMovedUnaligned(t *testing.T) {
+	dir := t.TempDir()
+	src := make([]byte, 64*4096+1000)
+	rand.Read(src)
+	src[10*4096] ^= 1
+	old := append(make([]byte, 0, len(src)), src[1234:]...)
+	old = append(old, make([]byte, 1234)...)
+	old[10*4096-1234] ^= 1
+	srcPath, statePath := filepath.Join(dir, "src"), filepath.Join(dir, "src.state")
+	if err := ioutil.WriteFile(srcPath, src, 0600); err != nil {
+		t.Fatal(err)
+	}
+	remote, prev := testState(t, src), testState(t, old)
+	fd, err := os.Create(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = remote.Write(fd); err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+
+	var cache weakCache
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := cache.get(srcPath, statePath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+	weak, err := fetchWeakSums(server.Client(), server.URL, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := os.Create(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if _, err = dst.Write(old); err != nil {
+		t.Fatal(err)
+	}
+	dirty := differingBlocks(prev, remote)
+	m := newMovedSource(bytes.NewReader(src), dst, prev, remote)
+	if err = m.scan(weak, dirty, prev.Size); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first block, starting before the shift, the changed one
+	// and the last partial one are not found
+	if got, want := len(m.found), int(remote.Blocks())-3; got != want {
+		t.Fatalf("%d moved blocks found instead of %d", got, want)
+	}
+	if !m.forward(dirty) {
+		t.Fatal("blocks are not considered moved forward")
+	}
+	buf := make([]byte, remote.Bs)
+	for i := int64(0); i < remote.Blocks(); i++ {
+		n, err := m.ReadAt(buf, i*remote.Bs)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], src[i*remote.Bs:i*remote.Bs+remote.blockLen(i)]) {
+			t.Fatalf("block %d differs", i)
+		}
+	}
+	if m.reused.Load() != int64(len(m.found)) {
+		t.Fatalf("%d blocks reused instead of %d", m.reused.Load(), len(m.found))
+	}
+}
+
+func TestMovedNoWeakSums(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	weak, err := fetchWeakSums(server.Client(), server.URL, testState(t, make([]byte, 4096)))
+	if err != nil || weak != nil {
+		t.Fatal(weak, err)
+	}
+}
@@ -0,0 +1,197 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Suffix of the bitmap tracking writes since the run started.
+const NBDNextSuffix = "-syncer-next"
+
+const QMPTimeout = 30 * time.Second
+
+// Query NBD server for the extents marked in the dirty bitmap. qemu-img
+// reports bitmap's dirty areas as having no data when the bitmap is
+// asked for instead of the allocation status. server is either
+// "unix:/path/to/socket" or "host:port".
+func nbdDirtyExtents(server, export, bitmap string) ([]Extent, error) {
+	if server == "" {
+		return nil, errors.New("NBD server is not specified")
+	}
+	opts := []string{"driver=nbd"}
+	if export != "" {
+		opts = append(opts, "export="+export)
+	}
+	if strings.HasPrefix(server, "unix:") {
+		opts = append(opts, "server.type=unix", "server.path="+server[5:])
+	} else {
+		i := strings.LastIndex(server, ":")
+		if i == -1 {
+			return nil, errors.New("NBD server must be unix:PATH or HOST:PORT")
+		}
+		opts = append(
+			opts, "server.type=inet",
+			"server.host="+server[:i], "server.port="+server[i+1:],
+		)
+	}
+	opts = append(opts, "x-dirty-bitmap=qemu:dirty-bitmap:"+bitmap)
+	out, err := command(
+		"qemu-img", "map", "--output=json",
+		"--image-opts", strings.Join(opts, ","),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		Start  int64
+		Length int64
+		Data   bool
+	}
+	if err = json.Unmarshal([]byte(out), &entries); err != nil {
+		return nil, err
+	}
+	extents := []Extent{}
+	for _, e := range entries {
+		if !e.Data {
+			extents = append(extents, Extent{e.Start, e.Length})
+		}
+	}
+	return extents, nil
+}
+
+// QMP command with its arguments.
+type qmpCmd struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type qmpBitmap struct {
+	Node       string `json:"node"`
+	Name       string `json:"name"`
+	Persistent bool   `json:"persistent,omitempty"`
+}
+
+// Execute commands one by one through QMP socket, failing on the first
+// error. Asynchronous events are skipped.
+func qmpExecute(socket string, cmds ...qmpCmd) error {
+	conn, err := net.DialTimeout("unix", socket, QMPTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(QMPTimeout))
+	r := bufio.NewReader(conn)
+	enc := json.NewEncoder(conn)
+	var reply struct {
+		QMP   json.RawMessage `json:"QMP"`
+		Event string          `json:"event"`
+		Error *struct {
+			Desc string `json:"desc"`
+		} `json:"error"`
+	}
+	read := func() error {
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				return err
+			}
+			reply.QMP, reply.Event, reply.Error = nil, "", nil
+			if err = json.Unmarshal(line, &reply); err != nil {
+				return err
+			}
+			if reply.Event == "" {
+				return nil
+			}
+		}
+	}
+	if err = read(); err != nil {
+		return fmt.Errorf("Unable to read QMP greeting: %w", err)
+	}
+	for _, cmd := range append([]qmpCmd{{Execute: "qmp_capabilities"}}, cmds...) {
+		if err = enc.Encode(cmd); err != nil {
+			return err
+		}
+		if err = read(); err != nil {
+			return err
+		}
+		if reply.Error != nil {
+			return fmt.Errorf("%s: %s", cmd.Execute, reply.Error.Desc)
+		}
+	}
+	return nil
+}
+
+// Add new bitmap before the source is read, tracking writes made during
+// the run. Exported bitmap keeps tracking everything since the previous
+// run, so writes to already copied blocks are not lost.
+func (j *Job) startBitmap() error {
+	if j.NBDQMP == "" || j.NBDBitmap == "" {
+		return nil
+	}
+	if j.NBDNode == "" {
+		return errors.New("NBD bitmap's node is not specified")
+	}
+	next := j.NBDBitmap + NBDNextSuffix
+	// Left by the failed run
+	qmpExecute(j.NBDQMP, qmpCmd{"block-dirty-bitmap-remove", qmpBitmap{Node: j.NBDNode, Name: next}})
+	err := qmpExecute(j.NBDQMP, qmpCmd{
+		"block-dirty-bitmap-add",
+		qmpBitmap{Node: j.NBDNode, Name: next, Persistent: true},
+	})
+	if err != nil {
+		return err
+	}
+	j.bitmapNext = next
+	return nil
+}
+
+// Once the state is saved, atomically replace exported bitmap's
+// contents with the new one's and drop it. Failed run only drops it, so
+// the exported one still covers everything.
+func (j *Job) endBitmap(failed error) error {
+	if j.bitmapNext == "" {
+		return nil
+	}
+	next := qmpBitmap{Node: j.NBDNode, Name: j.bitmapNext}
+	j.bitmapNext = ""
+	if failed != nil {
+		return qmpExecute(j.NBDQMP, qmpCmd{"block-dirty-bitmap-remove", next})
+	}
+	type action struct {
+		Type string      `json:"type"`
+		Data interface{} `json:"data"`
+	}
+	exported := qmpBitmap{Node: j.NBDNode, Name: j.NBDBitmap}
+	return qmpExecute(j.NBDQMP, qmpCmd{"transaction", map[string]interface{}{
+		"actions": []action{
+			{"block-dirty-bitmap-clear", exported},
+			{"block-dirty-bitmap-merge", map[string]interface{}{
+				"node": j.NBDNode, "target": j.NBDBitmap, "bitmaps": []string{next.Name},
+			}},
+			{"block-dirty-bitmap-remove", next},
+		},
+	}})
+}
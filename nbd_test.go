@@ -0,0 +1,126 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// Fake QEMU's QMP socket recording executed commands, transaction's
+// actions after colon.
+func testQMP(t *testing.T) (string, func() []string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "qmp")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	var cmds []string
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintln(conn, `{"QMP": {"version": {}}}`)
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				var cmd struct {
+					Execute   string
+					Arguments struct {
+						Actions []struct{ Type string }
+					}
+				}
+				json.Unmarshal(scanner.Bytes(), &cmd)
+				name := cmd.Execute
+				for i, a := range cmd.Arguments.Actions {
+					if i == 0 {
+						name += ":"
+					} else {
+						name += ","
+					}
+					name += a.Type
+				}
+				if name != "qmp_capabilities" {
+					mu.Lock()
+					cmds = append(cmds, name)
+					mu.Unlock()
+				}
+				fmt.Fprintln(conn, `{"event": "JOB_STATUS_CHANGE"}`)
+				fmt.Fprintln(conn, `{"return": {}}`)
+			}
+			conn.Close()
+		}
+	}()
+	return path, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		done := cmds
+		cmds = nil
+		return done
+	}
+}
+
+// Bitmap is rotated around the run: the new one is added before the
+// source is read and replaces the old one only after success.
+func TestNBDBitmapRotation(t *testing.T) {
+	j := testJob(t, 1<<20)
+	stubCommands(t, map[string]string{
+		"qemu-img": `echo '[{"start": 0, "length": 1048576, "data": false}]'` + "\n",
+	})
+	qmp, executed := testQMP(t)
+	j.NBDServer, j.NBDBitmap = "unix:/nonexistent", "backup0"
+	j.NBDQMP, j.NBDNode = qmp, "drive0"
+	for run := 0; run < 2; run++ {
+		if err := j.Run(); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{
+			"block-dirty-bitmap-remove",
+			"block-dirty-bitmap-add",
+			"transaction:block-dirty-bitmap-clear,block-dirty-bitmap-merge,block-dirty-bitmap-remove",
+		}
+		if got := executed(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("run %d executed %v", run, got)
+		}
+	}
+	sameFiles(t, j.Src, j.Dst)
+
+	os.Remove(j.Src)
+	if err := j.Run(); err == nil {
+		t.Fatal("run without src succeeded")
+	}
+	got := executed()
+	if len(got) != 3 || got[2] != "block-dirty-bitmap-remove" {
+		t.Fatalf("failed run executed %v", got)
+	}
+	if j.bitmapNext != "" {
+		t.Fatal("new bitmap is left pending")
+	}
+}
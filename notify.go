@@ -0,0 +1,297 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// How long to wait for the notification to be delivered.
+const NotifyTimeout = 30 * time.Second
+
+// Notification sent when the run is finished.
+type Notification struct {
+	Job      string    `json:"job"`
+	Kind     string    `json:"kind,omitempty"` // scrub, sync if empty
+	Run      string    `json:"run"`
+	Src      string    `json:"src"`
+	Dst      string    `json:"dst"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Duration int64     `json:"duration"` // seconds
+	Blocks   int64     `json:"blocks"`
+	Changed  int64     `json:"changed"`
+	Written  int64     `json:"written"`
+	Failed   int64     `json:"failed,omitempty"`
+	Digest   string    `json:"digest,omitempty"`
+	Syncer   string    `json:"syncer"`
+}
+
+func (j *Job) notification(runErr error) *Notification {
+	n := Notification{
+		Job:      j.Name,
+		Run:      j.Stats.Run,
+		Src:      j.Src,
+		Dst:      j.Dst,
+		Result:   "ok",
+		Started:  j.Stats.Started,
+		Duration: int64(j.Stats.Duration.Seconds()),
+		Blocks:   j.Stats.Blocks,
+		Changed:  j.Stats.Changed,
+		Written:  j.Stats.Written,
+		Failed:   j.Stats.Failed,
+		Digest:   j.Stats.Digest,
+		Syncer:   Version,
+	}
+	if j.Store != "" {
+		n.Dst = j.Store
+	}
+	if runErr != nil {
+		n.Result, n.Error = "failed", runErr.Error()
+	}
+	if errors.Is(runErr, ErrCorrupt) {
+		n.Result = "alert"
+	}
+	return &n
+}
+
+// Short title and human readable summary of the run.
+func (n *Notification) Title() string {
+	name := n.Job
+	if name == "" {
+		name = n.Src
+	}
+	if n.Kind != "" {
+		name += " " + n.Kind
+	}
+	return "syncer " + name + ": " + n.Result
+}
+
+func (n *Notification) Summary() string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(w, "Source:\t"+n.Src)
+	fmt.Fprintln(w, "Destination:\t"+n.Dst)
+	fmt.Fprintln(w, "Run:\t"+n.Run)
+	fmt.Fprintln(w, "Result:\t"+n.Result)
+	if n.Error != "" {
+		fmt.Fprintln(w, "Error:\t"+n.Error)
+	}
+	fmt.Fprintln(w, "Started:\t"+n.Started.Format(time.RFC3339))
+	fmt.Fprintf(w, "Duration:\t%ds\n", n.Duration)
+	fmt.Fprintf(w, "Blocks:\t%d\n", n.Blocks)
+	if n.Kind == NotifyScrub {
+		fmt.Fprintf(w, "Differ:\t%d\n", n.Changed)
+	} else {
+		fmt.Fprintf(w, "Changed:\t%d\n", n.Changed)
+	}
+	fmt.Fprintf(w, "Written:\t%d bytes\n", n.Written)
+	if n.Failed > 0 {
+		fmt.Fprintf(w, "Failed:\t%d\n", n.Failed)
+	}
+	if n.Digest != "" {
+		fmt.Fprintln(w, "Digest:\t"+n.Digest)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// Send the run's result to every configured notification target.
+// Failed deliveries are only logged.
+func (j *Job) notify(runErr error) {
+	n := j.notification(runErr)
+	j.last.Store(n)
+	j.send(n)
+}
+
+func (j *Job) send(n *Notification) {
+	if j.NotifyURL != "" {
+		if err := webhook(j.NotifyURL, n); err != nil {
+			j.log.Println("Unable to notify:", err)
+		}
+	}
+	if j.NotifyNtfy != "" {
+		if err := ntfy(j.NotifyNtfy, n); err != nil {
+			j.log.Println("Unable to notify through ntfy:", err)
+		}
+	}
+	if j.NotifyEmail != "" {
+		if err := j.mail(n); err != nil {
+			j.log.Println("Unable to send email:", err)
+		}
+	}
+}
+
+func post(req *http.Request) error {
+	client := http.Client{Timeout: NotifyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Unexpected HTTP status: %s", resp.Status)
+	}
+	return nil
+}
+
+// POST run's result and statistics as JSON to the URL.
+func webhook(url string, n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return post(req)
+}
+
+// Publish the summary to ntfy topic's URL, failures with high priority.
+func ntfy(url string, n *Notification) error {
+	req, err := http.NewRequest("POST", url, strings.NewReader(n.Summary()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", n.Title())
+	if n.Result == "alert" {
+		req.Header.Set("Priority", "urgent")
+		req.Header.Set("Tags", "rotating_light")
+	} else if n.Error != "" {
+		req.Header.Set("Priority", "high")
+		req.Header.Set("Tags", "warning")
+	} else {
+		req.Header.Set("Tags", "floppy_disk")
+	}
+	return post(req)
+}
+
+// Mail the summary with JSON result attached.
+func (j *Job) mail(n *Notification) error {
+	if j.SMTPServer == "" {
+		return errors.New("SMTP server is not set")
+	}
+	from := j.SMTPFrom
+	if from == "" {
+		host, _ := os.Hostname()
+		from = "syncer@" + host
+	}
+	to := strings.Split(j.NotifyEmail, ",")
+	for i := range to {
+		to[i] = strings.TrimSpace(to[i])
+	}
+	data, err := json.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return err
+	}
+	boundary := fmt.Sprintf("syncer-%d", time.Now().UnixNano())
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", n.Title())
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+	fmt.Fprintf(&msg, "--%s\r\n", boundary)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(n.Summary(), "\n", "\r\n"))
+	fmt.Fprintf(&msg, "\r\n--%s\r\n", boundary)
+	fmt.Fprintf(&msg, "Content-Type: application/json\r\n")
+	fmt.Fprintf(&msg, "Content-Disposition: attachment; filename=\"summary.json\"\r\n")
+	fmt.Fprintf(&msg, "Content-Transfer-Encoding: base64\r\n\r\n")
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		msg.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	msg.WriteString(enc + "\r\n")
+	fmt.Fprintf(&msg, "--%s--\r\n", boundary)
+
+	host := j.SMTPServer
+	if i := strings.LastIndexByte(host, ':'); i != -1 {
+		host = host[:i]
+	}
+	var auth smtp.Auth
+	if j.SMTPUser != "" {
+		auth = smtp.PlainAuth("", j.SMTPUser, j.SMTPPassword, host)
+	}
+	return sendMail(j.SMTPServer, host, auth, from, to, msg.Bytes())
+}
+
+// Same as smtp.SendMail, but the whole exchange with the server has to
+// finish in NotifyTimeout.
+func sendMail(addr, host string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, NotifyTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(NotifyTimeout)); err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if err = c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,98 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Huge pages backing block buffers: either transparent ones, or
+// explicitly reserved in hugetlbfs.
+const (
+	HugePagesTHP = "thp"
+	HugePagesTLB = "hugetlb"
+)
+
+// Pin the process to configured CPUs, or to the CPUs of configured
+// NUMA node, returning the node (-1 if none) and the number of CPUs
+// (zero if not pinned).
+func (j *Job) pin(srcPath string) (node, cpus int, err error) {
+	node = -1
+	switch j.NUMANode {
+	case "":
+	case "auto":
+		if node, err = numaNode(srcPath); err != nil {
+			return -1, 0, fmt.Errorf("Unable to find NUMA node of src: %w", err)
+		}
+		if node == -1 {
+			j.log.Println("No NUMA node for", srcPath)
+		}
+	default:
+		if node, err = strconv.Atoi(j.NUMANode); err != nil || node < 0 {
+			return -1, 0, fmt.Errorf("Invalid NUMA node: %s", j.NUMANode)
+		}
+	}
+	list := j.CPUs
+	if list == "" && node >= 0 {
+		if list, err = numaCPUs(node); err != nil {
+			return -1, 0, fmt.Errorf("Unable to get CPUs of NUMA node: %w", err)
+		}
+	}
+	if list != "" {
+		if cpus, err = setAffinity(list); err != nil {
+			return -1, 0, fmt.Errorf("Unable to set CPU affinity: %w", err)
+		}
+		j.log.Println("Pinned to CPUs", list)
+	}
+	if node >= 0 {
+		j.log.Println("Allocating buffers on NUMA node", node)
+	}
+	return node, cpus, nil
+}
+
+// Allocate n block buffers, on NUMA node if it is not -1, optionally
+// backed by huge pages. Returned function frees them.
+func allocBuffers(n, size, node int, huge string) ([][]byte, func(), error) {
+	if huge != "" && huge != HugePagesTHP && huge != HugePagesTLB {
+		return nil, nil, errors.New("Unknown huge pages: " + huge)
+	}
+	bufs := make([][]byte, 0, n)
+	if node < 0 && huge == "" {
+		for i := 0; i < n; i++ {
+			bufs = append(bufs, make([]byte, size))
+		}
+		return bufs, func() {}, nil
+	}
+	free := func() {
+		for _, buf := range bufs {
+			freeBuffer(buf)
+		}
+	}
+	for i := 0; i < n; i++ {
+		buf, err := allocBuffer(size, node, huge)
+		if err != nil {
+			free()
+			return nil, nil, fmt.Errorf("Unable to allocate buffer: %w", err)
+		}
+		bufs = append(bufs, buf)
+	}
+	return bufs, free, nil
+}
@@ -0,0 +1,169 @@
+//go:build linux
+
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	MPOL_PREFERRED = 1
+	HugePageSize   = 2 << 20
+)
+
+// NUMA node the device holding path is attached to, -1 if unknown. It
+// is found by walking up device's sysfs directories to its controller.
+func numaNode(path string) (int, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return -1, err
+	}
+	stat := fi.Sys().(*syscall.Stat_t)
+	dev := stat.Dev
+	if fi.Mode()&os.ModeDevice != 0 {
+		dev = uint64(stat.Rdev)
+	}
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	dir, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+	if err != nil {
+		return -1, err
+	}
+	for ; dir != "/sys" && dir != "/"; dir = filepath.Dir(dir) {
+		data, err := os.ReadFile(filepath.Join(dir, "numa_node"))
+		if err == nil {
+			return strconv.Atoi(strings.TrimSpace(string(data)))
+		}
+	}
+	return -1, nil
+}
+
+// CPU list of NUMA node, like "0-7,16-23".
+func numaCPUs(node int) (string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/sys/devices/system/node/node%d/cpulist", node))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(list, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(from)
+		if err != nil || first < 0 {
+			return nil, errors.New("Invalid CPU list: " + list)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(to); err != nil || last < first {
+				return nil, errors.New("Invalid CPU list: " + list)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// Pin all threads of the process to the CPUs, returning their number.
+// Threads created later inherit the affinity.
+func setAffinity(list string) (int, error) {
+	cpus, err := parseCPUList(list)
+	if err != nil {
+		return 0, err
+	}
+	var mask [16]uint64
+	for _, cpu := range cpus {
+		if cpu >= len(mask)*64 {
+			return 0, fmt.Errorf("CPU %d is out of range", cpu)
+		}
+		mask[cpu/64] |= 1 << (cpu % 64)
+	}
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return 0, err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		_, _, errno := syscall.RawSyscall(
+			syscall.SYS_SCHED_SETAFFINITY, uintptr(tid),
+			unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask[0])),
+		)
+		if errno != 0 && errno != syscall.ESRCH {
+			return 0, errno
+		}
+	}
+	return len(cpus), nil
+}
+
+// Allocate buffer preferably with the memory of NUMA node, unless it
+// is -1, optionally backed by huge pages.
+func allocBuffer(size, node int, huge string) ([]byte, error) {
+	length, flags := size, syscall.MAP_PRIVATE|syscall.MAP_ANON
+	if huge == HugePagesTLB {
+		length = (size + HugePageSize - 1) / HugePageSize * HugePageSize
+		flags |= syscall.MAP_HUGETLB
+	}
+	buf, err := syscall.Mmap(-1, 0, length, syscall.PROT_READ|syscall.PROT_WRITE, flags)
+	if err != nil {
+		return nil, err
+	}
+	if huge == HugePagesTHP {
+		if err = syscall.Madvise(buf, syscall.MADV_HUGEPAGE); err != nil {
+			syscall.Munmap(buf)
+			return nil, err
+		}
+	}
+	if node >= 64 {
+		syscall.Munmap(buf)
+		return nil, fmt.Errorf("NUMA node %d is out of range", node)
+	}
+	if node >= 0 {
+		nodemask := uint64(1) << node
+		_, _, errno := syscall.Syscall6(
+			syscall.SYS_MBIND, uintptr(unsafe.Pointer(&buf[0])), uintptr(length),
+			MPOL_PREFERRED, uintptr(unsafe.Pointer(&nodemask)), 64+1, 0,
+		)
+		if errno != 0 {
+			syscall.Munmap(buf)
+			return nil, errno
+		}
+	}
+	return buf[:size], nil
+}
+
+// Free buffer, possibly shortened from mapped huge pages.
+func freeBuffer(buf []byte) {
+	syscall.Munmap(buf[:cap(buf)])
+}
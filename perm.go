@@ -0,0 +1,82 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Permissions and ownership given to the created file. Zero mode and
+// negative ids are left untouched.
+type filePerm struct {
+	mode     os.FileMode
+	uid, gid int
+}
+
+// Parse octal mode, like 0640, and "user:group" owner, either part of
+// which may be omitted, names or numeric ids.
+func parsePerm(mode, owner string) (*filePerm, error) {
+	p := filePerm{uid: -1, gid: -1}
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0777 {
+			return nil, errors.New("Invalid file mode: " + mode)
+		}
+		p.mode = os.FileMode(m)
+	}
+	if owner == "" {
+		return &p, nil
+	}
+	name, group, _ := strings.Cut(owner, ":")
+	if name != "" {
+		if id, err := strconv.Atoi(name); err == nil {
+			p.uid = id
+		} else if u, err := user.Lookup(name); err == nil {
+			p.uid, _ = strconv.Atoi(u.Uid)
+		} else {
+			return nil, errors.New("Unknown user: " + name)
+		}
+	}
+	if group != "" {
+		if id, err := strconv.Atoi(group); err == nil {
+			p.gid = id
+		} else if g, err := user.LookupGroup(group); err == nil {
+			p.gid, _ = strconv.Atoi(g.Gid)
+		} else {
+			return nil, errors.New("Unknown group: " + group)
+		}
+	}
+	return &p, nil
+}
+
+func (p *filePerm) apply(path string) error {
+	if p.uid >= 0 || p.gid >= 0 {
+		if err := os.Chown(path, p.uid, p.gid); err != nil {
+			return err
+		}
+	}
+	if p.mode != 0 {
+		return os.Chmod(path, p.mode)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+//go:build windows
+
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const FSCTL_SET_SPARSE = 0x900C4
+
+// Mark the created destination file sparse, so never written ranges
+// take no space, and extend it to size.
+func preallocate(fd *os.File, size int64) error {
+	var n uint32
+	err := syscall.DeviceIoControl(
+		syscall.Handle(fd.Fd()), FSCTL_SET_SPARSE,
+		nil, 0, nil, 0, &n, nil,
+	)
+	if err != nil {
+		return err
+	}
+	return fd.Truncate(size)
+}
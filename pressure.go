@@ -0,0 +1,101 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PressureInterval = 2 * time.Second
+	PressureMaxDelay = time.Second
+)
+
+// Share of time (percents) some tasks were stalled on the resource
+// during the last ten seconds, from Linux pressure stall information.
+func psi(resource string) (float64, error) {
+	data, err := os.ReadFile("/proc/pressure/" + resource)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+		if avg, ok := strings.CutPrefix(fields[1], "avg10="); ok {
+			return strconv.ParseFloat(avg, 64)
+		}
+	}
+	return 0, fmt.Errorf("Unable to parse %s pressure", resource)
+}
+
+// Watch io and cpu pressure in background, delaying each read while
+// any of them exceeds threshold: delay is doubled while pressure stays
+// high and halved when it drops below half of threshold. Returned
+// function stops watching and removes the delay.
+func (j *Job) watchPressure(threshold float64) (func(), error) {
+	for _, resource := range []string{"io", "cpu"} {
+		if _, err := psi(resource); err != nil {
+			return nil, fmt.Errorf("Unable to read pressure stall information: %w", err)
+		}
+	}
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tick := time.NewTicker(PressureInterval)
+		defer tick.Stop()
+		var delay time.Duration
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+			}
+			var highest float64
+			for _, resource := range []string{"io", "cpu"} {
+				if p, err := psi(resource); err == nil && p > highest {
+					highest = p
+				}
+			}
+			prev := delay
+			switch {
+			case highest > threshold:
+				delay = min(max(delay*2, time.Millisecond), PressureMaxDelay)
+			case highest < threshold/2:
+				if delay /= 2; delay < time.Millisecond {
+					delay = 0
+				}
+			}
+			if delay != prev {
+				j.log.Printf("Pressure %.1f%%, delaying reads by %s", highest, delay)
+				j.ctl.backoff(delay)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		j.ctl.backoff(0)
+	}, nil
+}
@@ -0,0 +1,89 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// Profiling options: pprof HTTP endpoint, CPU and heap profiles saved
+// at the end of the run.
+type profileFlags struct {
+	addr *string
+	cpu  *string
+	mem  *string
+}
+
+func addProfileFlags(fs *flag.FlagSet) *profileFlags {
+	return &profileFlags{
+		addr: fs.String("pprof", "", "Address to serve net/http/pprof endpoints on, like :6060"),
+		cpu:  fs.String("cpu-profile", "", "Path to CPU profile written at the end"),
+		mem:  fs.String("mem-profile", "", "Path to heap profile written at the end"),
+	}
+}
+
+// Serve pprof endpoints in background.
+func servePprof(addr string) {
+	if addr == "" {
+		return
+	}
+	go func() {
+		log.Println("Unable to serve pprof:", http.ListenAndServe(addr, nil))
+	}()
+}
+
+// Start profiling, returning function finishing it and saving profiles.
+func (p *profileFlags) start() func() {
+	servePprof(*p.addr)
+	var cpu *os.File
+	if *p.cpu != "" {
+		var err error
+		if cpu, err = os.Create(*p.cpu); err != nil {
+			log.Fatalln("Unable to create CPU profile:", err)
+		}
+		if err = pprof.StartCPUProfile(cpu); err != nil {
+			log.Fatalln("Unable to start CPU profile:", err)
+		}
+	}
+	return func() {
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			cpu.Close()
+		}
+		if *p.mem == "" {
+			return
+		}
+		fd, err := os.Create(*p.mem)
+		if err != nil {
+			log.Println("Unable to create heap profile:", err)
+			return
+		}
+		defer fd.Close()
+		runtime.GC()
+		if err = pprof.WriteHeapProfile(fd); err != nil {
+			log.Println("Unable to write heap profile:", err)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	QCOW2Magic       = 0x514649fb
+	QCOW2ClusterBits = 16
+	QCOW2CachedL2    = 64
+
+	qcow2Copied     = 1 << 63
+	qcow2Compressed = 1 << 62
+	qcow2Zero       = 1
+	qcow2Offset     = 0x00fffffffffffe00
+)
+
+// Version 3 header.
+type qcow2Header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+	IncompatibleFeatures  uint64
+	CompatibleFeatures    uint64
+	AutoclearFeatures     uint64
+	RefcountOrder         uint32
+	HeaderLength          uint32
+}
+
+// Minimal qcow2 image writer: new clusters are always appended to the
+// end of the file. Images with backing files, snapshots, encryption or
+// compressed clusters are not supported. Tables and refcounts are kept
+// in memory and written on Flush: refcounts first, then tables
+// referencing new clusters, so crash can only leak clusters.
+type qcow2 struct {
+	mu   sync.Mutex
+	fd   *os.File
+	hdr  qcow2Header
+	cs   int64 // cluster size
+	next int64 // next cluster to allocate
+
+	l1      []uint64
+	l1Dirty bool
+	l2      map[int64][]uint64 // cached tables by L1 index
+	l2Dirty map[int64]bool
+
+	refs     []uint16 // refcounts of clusters
+	refTable []uint64
+	refDirty map[int64]bool // refcount blocks to be written
+	rtDirty  bool
+}
+
+func openQCOW2(path string, size int64) (*qcow2, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	q := &qcow2{
+		fd:       fd,
+		l2:       make(map[int64][]uint64),
+		l2Dirty:  make(map[int64]bool),
+		refDirty: make(map[int64]bool),
+	}
+	fi, err := fd.Stat()
+	if err == nil {
+		if fi.Size() == 0 {
+			err = q.create(size)
+		} else {
+			err = q.open(fi.Size(), size)
+		}
+	}
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Refcounts per refcount block and entries per table.
+func (q *qcow2) refsPerBlock() int64 { return q.cs / 2 }
+func (q *qcow2) perTable() int64     { return q.cs / 8 }
+
+func (q *qcow2) clusters(n int64) int64 {
+	return (n + q.cs - 1) / q.cs
+}
+
+// Lay out header, refcount table and L1 table of new image.
+func (q *qcow2) create(size int64) error {
+	q.cs = 1 << QCOW2ClusterBits
+	size = (size + 511) &^ 511
+	l1Size := (size + q.cs*q.perTable() - 1) / (q.cs * q.perTable())
+	l1Clusters := q.clusters(l1Size * 8)
+	// Upper bound of clusters the whole image can take
+	max := q.clusters(size) + l1Size + l1Clusters + 2
+	max += max/q.refsPerBlock() + 1
+	rtClusters := q.clusters((max/q.refsPerBlock() + 1) * 8)
+	q.hdr = qcow2Header{
+		Magic:                 QCOW2Magic,
+		Version:               3,
+		ClusterBits:           QCOW2ClusterBits,
+		Size:                  uint64(size),
+		L1Size:                uint32(l1Size),
+		RefcountTableOffset:   uint64(q.cs),
+		RefcountTableClusters: uint32(rtClusters),
+		L1TableOffset:         uint64((1 + rtClusters) * q.cs),
+		RefcountOrder:         4,
+		HeaderLength:          uint32(binary.Size(qcow2Header{})),
+	}
+	q.l1 = make([]uint64, l1Size)
+	q.refTable = make([]uint64, rtClusters*q.perTable())
+	q.l1Dirty, q.rtDirty = true, true
+	q.next = 1 + rtClusters + l1Clusters
+	for c := int64(0); c < q.next; c++ {
+		if err := q.ref(c); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(io.NewOffsetWriter(q.fd, 0), binary.BigEndian, &q.hdr); err != nil {
+		return err
+	}
+	return q.Flush()
+}
+
+// Read header, L1 table and refcounts of existing image.
+func (q *qcow2) open(fileSize, size int64) error {
+	if err := binary.Read(io.NewSectionReader(q.fd, 0, fileSize), binary.BigEndian, &q.hdr); err != nil {
+		return fmt.Errorf("Unable to read qcow2 header: %w", err)
+	}
+	switch {
+	case q.hdr.Magic != QCOW2Magic:
+		return errors.New("Not a qcow2 image")
+	case q.hdr.Version != 3:
+		return fmt.Errorf("Unsupported qcow2 version: %d", q.hdr.Version)
+	case q.hdr.BackingFileOffset != 0:
+		return errors.New("qcow2 backing files are not supported")
+	case q.hdr.CryptMethod != 0:
+		return errors.New("Encrypted qcow2 images are not supported")
+	case q.hdr.NbSnapshots != 0:
+		return errors.New("qcow2 images with snapshots are not supported")
+	case q.hdr.IncompatibleFeatures != 0:
+		return fmt.Errorf("Unsupported qcow2 features: %#x", q.hdr.IncompatibleFeatures)
+	case q.hdr.RefcountOrder != 4:
+		return fmt.Errorf("Unsupported qcow2 refcount order: %d", q.hdr.RefcountOrder)
+	case q.hdr.ClusterBits < 9 || q.hdr.ClusterBits > 21:
+		return fmt.Errorf("Invalid qcow2 cluster bits: %d", q.hdr.ClusterBits)
+	case int64(q.hdr.Size) < size:
+		return fmt.Errorf("qcow2 image is smaller than src: %d < %d", q.hdr.Size, size)
+	}
+	q.cs = 1 << q.hdr.ClusterBits
+	q.next = q.clusters(fileSize)
+	var err error
+	if q.l1, err = q.readTable(int64(q.hdr.L1TableOffset), int64(q.hdr.L1Size)); err != nil {
+		return fmt.Errorf("Unable to read qcow2 L1 table: %w", err)
+	}
+	q.refTable, err = q.readTable(
+		int64(q.hdr.RefcountTableOffset),
+		int64(q.hdr.RefcountTableClusters)*q.perTable(),
+	)
+	if err != nil {
+		return fmt.Errorf("Unable to read qcow2 refcount table: %w", err)
+	}
+	n := q.refsPerBlock()
+	q.refs = make([]uint16, int64(len(q.refTable))*n)
+	buf := make([]byte, q.cs)
+	for i, off := range q.refTable {
+		if off &= qcow2Offset; off == 0 {
+			continue
+		}
+		if _, err = q.fd.ReadAt(buf, int64(off)); err != nil {
+			return fmt.Errorf("Unable to read qcow2 refcount block: %w", err)
+		}
+		for j := int64(0); j < n; j++ {
+			q.refs[int64(i)*n+j] = binary.BigEndian.Uint16(buf[j*2:])
+		}
+	}
+	return nil
+}
+
+func (q *qcow2) readTable(offset, entries int64) ([]uint64, error) {
+	buf := make([]byte, entries*8)
+	if _, err := q.fd.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	table := make([]uint64, entries)
+	for i := range table {
+		table[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	return table, nil
+}
+
+func (q *qcow2) writeTable(table []uint64, offset int64) error {
+	buf := make([]byte, len(table)*8)
+	for i, e := range table {
+		binary.BigEndian.PutUint64(buf[i*8:], e)
+	}
+	_, err := q.fd.WriteAt(buf, offset)
+	return err
+}
+
+// Allocate cluster at the end of the file, without its refcount.
+func (q *qcow2) alloc() int64 {
+	q.next++
+	return q.next - 1
+}
+
+// Set cluster's refcount to one, allocating refcount block if needed.
+func (q *qcow2) ref(c int64) error {
+	n := q.refsPerBlock()
+	i := c / n
+	if i >= int64(len(q.refTable)) {
+		return errors.New("qcow2 refcount table is full")
+	}
+	if need := (i + 1) * n; int64(len(q.refs)) < need {
+		q.refs = append(q.refs, make([]uint16, need-int64(len(q.refs)))...)
+	}
+	q.refs[c] = 1
+	q.refDirty[i] = true
+	if q.refTable[i] == 0 {
+		rb := q.alloc()
+		q.refTable[i] = uint64(rb * q.cs)
+		q.rtDirty = true
+		return q.ref(rb)
+	}
+	return nil
+}
+
+// Allocate cluster with refcount, returning its offset.
+func (q *qcow2) allocRef() (int64, error) {
+	c := q.alloc()
+	return c * q.cs, q.ref(c)
+}
+
+// L2 table of L1 index, nil if it is not allocated and create is false.
+func (q *qcow2) table(i int64, create bool) ([]uint64, error) {
+	if t, ok := q.l2[i]; ok {
+		return t, nil
+	}
+	if len(q.l2) >= QCOW2CachedL2 {
+		if err := q.flush(); err != nil {
+			return nil, err
+		}
+		clear(q.l2)
+	}
+	e := q.l1[i]
+	if e != 0 && e&qcow2Copied == 0 {
+		return nil, errors.New("Shared qcow2 tables are not supported")
+	}
+	var t []uint64
+	if off := int64(e & qcow2Offset); off != 0 {
+		var err error
+		if t, err = q.readTable(off, q.perTable()); err != nil {
+			return nil, fmt.Errorf("Unable to read qcow2 L2 table: %w", err)
+		}
+	} else if !create {
+		return nil, nil
+	} else {
+		off, err := q.allocRef()
+		if err != nil {
+			return nil, err
+		}
+		q.l1[i] = uint64(off) | qcow2Copied
+		q.l1Dirty = true
+		t = make([]uint64, q.perTable())
+		q.l2Dirty[i] = true
+	}
+	q.l2[i] = t
+	return t, nil
+}
+
+// Call fn for each cluster's piece of n bytes at offset.
+func (q *qcow2) pieces(offset int64, n int, fn func(l1, l2, within int64, from, to int) error) error {
+	if offset < 0 || offset+int64(n) > int64(q.hdr.Size) {
+		return io.ErrUnexpectedEOF
+	}
+	for from := 0; from < n; {
+		off := offset + int64(from)
+		cluster := off / q.cs
+		within := off % q.cs
+		to := from + int(min(q.cs-within, int64(n-from)))
+		if err := fn(cluster/q.perTable(), cluster%q.perTable(), within, from, to); err != nil {
+			return err
+		}
+		from = to
+	}
+	return nil
+}
+
+func (q *qcow2) ReadAt(p []byte, offset int64) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.pieces(offset, len(p), func(l1, l2, within int64, from, to int) error {
+		t, err := q.table(l1, false)
+		if err != nil {
+			return err
+		}
+		var e uint64
+		if t != nil {
+			e = t[l2]
+		}
+		switch {
+		case e&qcow2Compressed != 0:
+			return errors.New("Compressed qcow2 clusters are not supported")
+		case e&qcow2Offset == 0 || e&qcow2Zero != 0:
+			clear(p[from:to])
+			return nil
+		}
+		_, err = q.fd.ReadAt(p[from:to], int64(e&qcow2Offset)+within)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (q *qcow2) WriteAt(p []byte, offset int64) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.pieces(offset, len(p), func(l1, l2, within int64, from, to int) error {
+		t, err := q.table(l1, true)
+		if err != nil {
+			return err
+		}
+		e := t[l2]
+		host := int64(e & qcow2Offset)
+		switch {
+		case e&qcow2Compressed != 0:
+			return errors.New("Compressed qcow2 clusters are not supported")
+		case host == 0:
+			// New cluster beyond the end of file reads as zeros
+			if host, err = q.allocRef(); err != nil {
+				return err
+			}
+		case e&qcow2Zero != 0:
+			if _, err = q.fd.WriteAt(make([]byte, q.cs), host); err != nil {
+				return err
+			}
+		case e&qcow2Copied == 0:
+			return errors.New("Shared qcow2 clusters are not supported")
+		}
+		if entry := uint64(host) | qcow2Copied; entry != e {
+			t[l2] = entry
+			q.l2Dirty[l1] = true
+		}
+		_, err = q.fd.WriteAt(p[from:to], host+within)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Write refcount blocks, refcount table, L2 tables and L1 table.
+func (q *qcow2) flush() error {
+	n := q.refsPerBlock()
+	buf := make([]byte, q.cs)
+	for i := range q.refDirty {
+		for j := int64(0); j < n; j++ {
+			binary.BigEndian.PutUint16(buf[j*2:], q.refs[i*n+j])
+		}
+		if _, err := q.fd.WriteAt(buf, int64(q.refTable[i])); err != nil {
+			return err
+		}
+	}
+	clear(q.refDirty)
+	if q.rtDirty {
+		if err := q.writeTable(q.refTable, int64(q.hdr.RefcountTableOffset)); err != nil {
+			return err
+		}
+		q.rtDirty = false
+	}
+	for i := range q.l2Dirty {
+		if err := q.writeTable(q.l2[i], int64(q.l1[i]&qcow2Offset)); err != nil {
+			return err
+		}
+	}
+	clear(q.l2Dirty)
+	if q.l1Dirty {
+		if err := q.writeTable(q.l1, int64(q.hdr.L1TableOffset)); err != nil {
+			return err
+		}
+		q.l1Dirty = false
+	}
+	return nil
+}
+
+func (q *qcow2) Flush() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.flush(); err != nil {
+		return fmt.Errorf("Unable to write qcow2 metadata: %w", err)
+	}
+	return nil
+}
+
+func (q *qcow2) Sync() error {
+	if err := q.Flush(); err != nil {
+		return err
+	}
+	return q.fd.Sync()
+}
+
+func (q *qcow2) Close() error {
+	err := q.Flush()
+	if cerr := q.fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
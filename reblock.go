@@ -0,0 +1,91 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "bytes"
+
+// Hash of zero-filled block of that length.
+func (st *State) zeroHash(length int64) []byte {
+	return st.hash.Sum(make([]byte, length))
+}
+
+// Length of i-th block.
+func (st *State) blockLen(i int64) int64 {
+	if end := (i + 1) * st.Bs; end > st.Size {
+		return st.Size - i*st.Bs
+	}
+	return st.Bs
+}
+
+// Convert the state to another blocksize. Block's last change and
+// changes counter are the largest ones of the blocks it overlaps. Hash
+// of the whole block can not be derived from its parts hashes, or vice
+// versa, so only blocks covering exactly the same bytes, or consisting
+// only of zeroes, keep their known hashes. All others are returned
+// zeroed and their number: they are considered changed during the next
+// sync.
+func (st *State) Convert(bs int64) (*State, int64) {
+	conv := NewState(st.Size, bs, st.hash)
+	conv.Meta = st.Meta
+	conv.Compressed = st.Compressed
+	zeroFull, zeroConv := st.zeroHash(st.Bs), st.zeroHash(bs)
+	isZero := func(i int64) bool {
+		if st.blockLen(i) == st.Bs {
+			return bytes.Equal(st.Hash(i), zeroFull)
+		}
+		return bytes.Equal(st.Hash(i), st.zeroHash(st.blockLen(i)))
+	}
+	if st.Changes != nil {
+		conv.Changes = make([]uint32, conv.Blocks())
+	}
+	if st.Counts != nil {
+		conv.Counts = make([]uint32, conv.Blocks())
+	}
+	var unknown int64
+	for i := int64(0); i < conv.Blocks(); i++ {
+		begin, length := i*bs, conv.blockLen(i)
+		first, last := begin/st.Bs, (begin+length-1)/st.Bs
+		for k := first; conv.Changes != nil && k <= last; k++ {
+			if st.Changes[k] > conv.Changes[i] {
+				conv.Changes[i] = st.Changes[k]
+			}
+		}
+		for k := first; conv.Counts != nil && k <= last; k++ {
+			if st.Counts[k] > conv.Counts[i] {
+				conv.Counts[i] = st.Counts[k]
+			}
+		}
+		if first == last && first*st.Bs == begin && st.blockLen(first) == length {
+			copy(conv.Hash(i), st.Hash(first))
+			continue
+		}
+		zero := true
+		for k := first; k <= last && zero; k++ {
+			zero = isZero(k)
+		}
+		if zero && length == bs {
+			copy(conv.Hash(i), zeroConv)
+		} else if zero {
+			copy(conv.Hash(i), st.zeroHash(length))
+		} else {
+			unknown++
+		}
+	}
+	return conv, unknown
+}
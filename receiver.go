@@ -0,0 +1,289 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dchest/blake2b"
+)
+
+// Headers of HTTP source's statefile requests: identity of the
+// receiving destination and the root of its statefile. Server tracking
+// receivers echoes the root it expects. Receiver asking for reseed is
+// accepted whatever its root is. Receiver's report is signed.
+const (
+	ReceiverHeader  = "Syncer-Receiver"
+	RootHeader      = "Syncer-Root"
+	ReseedHeader    = "Syncer-Reseed"
+	SignatureHeader = "Syncer-Signature"
+)
+
+// Largest receiver's report accepted.
+const MaxReportSize = 4 << 10
+
+// Receiver's report of its statefile after the run, signed with its
+// sign key.
+type receiverReport struct {
+	ID   string `json:"id"`
+	Root string `json:"root"`
+	Size int64  `json:"size"`
+	Bs   int64  `json:"bs"`
+	Time int64  `json:"time"` // UnixNano, growing with each report
+	Key  string `json:"key"`  // hexadecimal Ed25519 public key
+}
+
+// Identity of the receiving host and destination.
+func (j *Job) receiverID() string {
+	host, _ := os.Hostname()
+	dst := j.Dst
+	if j.Store != "" {
+		dst = j.Store
+	}
+	sum := blake2b.Sum256([]byte(host + "\x00" + identity(dst)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Root of the receiver's statefile, empty if there is none yet.
+func (j *Job) receiverRoot(secret *StateSecret) (string, error) {
+	if _, err := os.Stat(j.State); os.IsNotExist(err) {
+		return "", nil
+	}
+	st, err := ReadStateFileHeader(j.State, secret)
+	if err != nil {
+		return "", err
+	}
+	return st.Meta.Digest, nil
+}
+
+// Fetch HTTP source's statefile, presenting receiver's state root. Stale
+// or mismatched receiver is refused before anything is transferred.
+// Returns whether the server tracks receivers.
+func (j *Job) handshake(client *http.Client, url string, secret *StateSecret) (*State, bool, error) {
+	root, err := j.receiverRoot(secret)
+	if err != nil {
+		return nil, false, fmt.Errorf("Unable to read statefile: %w", err)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set(ReceiverHeader, j.receiverID())
+	req.Header.Set(RootHeader, root)
+	if j.Reseed {
+		req.Header.Set(ReseedHeader, "1")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, false, errors.New("Receiver is refused: " + strings.TrimSpace(string(msg)))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("Unexpected HTTP status: %s", resp.Status)
+	}
+	st, err := ReadState(resp.Body)
+	return st, resp.Header.Get(ReceiverHeader) != "", err
+}
+
+// Report receiver's new state root, with its size and block size, to
+// the server after the run, signed with the key.
+func (j *Job) reportRoot(client *http.Client, url, root string, size, bs int64, key ed25519.PrivateKey) error {
+	if key == nil {
+		return errors.New("Sign key is required to report to the server tracking receivers")
+	}
+	body, err := json.Marshal(receiverReport{
+		ID:   j.receiverID(),
+		Root: root,
+		Size: size,
+		Bs:   bs,
+		Time: time.Now().UnixNano(),
+		Key:  hex.EncodeToString(key.Public().(ed25519.PublicKey)),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, hex.EncodeToString(ed25519.Sign(key, body)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Unexpected HTTP status: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Read hexadecimal Ed25519 public keys, one per line, allowed to report
+// receivers' roots.
+func readReceiverKeys(path string) (map[string]bool, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	keys := make(map[string]bool)
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, err := hex.DecodeString(line); err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid receiver key: " + line)
+		}
+		keys[strings.ToLower(line)] = true
+	}
+	return keys, scanner.Err()
+}
+
+// Error of receiver's report: invalid one, or not authenticated.
+type reportError struct {
+	error
+	auth bool
+}
+
+// Check report's signature by one of the keys, its key is the same as
+// receiver's previous one and its time is later. Its size and block
+// size have to match the published state, zero block size matches any.
+func (dir receivers) verify(body, sig []byte, keys map[string]bool, size, bs int64) (*receiverReport, error) {
+	var rep receiverReport
+	if err := json.Unmarshal(body, &rep); err != nil {
+		return nil, reportError{fmt.Errorf("Invalid report: %w", err), false}
+	}
+	key, err := hex.DecodeString(rep.Key)
+	if err != nil || !keys[strings.ToLower(rep.Key)] {
+		return nil, reportError{errors.New("Unknown receiver key: " + rep.Key), true}
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), body, sig) {
+		return nil, reportError{errors.New("Invalid report signature"), true}
+	}
+	last, err := dir.last(rep.ID)
+	if err != nil {
+		return nil, reportError{err, false}
+	}
+	if last.Key != "" && !strings.EqualFold(last.Key, rep.Key) {
+		return nil, reportError{errors.New("Receiver reported with another key"), true}
+	}
+	if rep.Time <= last.Time {
+		return nil, reportError{errors.New("Report is older than the last one"), false}
+	}
+	if root, err := hex.DecodeString(rep.Root); err != nil || len(root) == 0 || len(root) > 64 {
+		return nil, reportError{errors.New("Invalid state root: " + rep.Root), false}
+	}
+	if rep.Size != size || rep.Bs <= 0 || bs != 0 && rep.Bs != bs {
+		return nil, reportError{fmt.Errorf(
+			"Receiver's state of %d bytes with %d blocksize differs from published one",
+			rep.Size, rep.Bs,
+		), false}
+	}
+	return &rep, nil
+}
+
+// Server's record of receivers' state roots after their last runs, one
+// file per receiver.
+type receivers string
+
+func (dir receivers) path(id string) (string, error) {
+	if len(id) != 32 {
+		return "", errors.New("Invalid receiver: " + id)
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", errors.New("Invalid receiver: " + id)
+	}
+	return filepath.Join(string(dir), id), nil
+}
+
+// The last accepted report of the receiver, empty if it is not known
+// yet. Old records keep the root only.
+func (dir receivers) last(id string) (*receiverReport, error) {
+	path, err := dir.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &receiverReport{ID: id}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rep := receiverReport{ID: id}
+	if err = json.Unmarshal(data, &rep); err != nil {
+		rep.Root = strings.TrimSpace(string(data))
+	}
+	return &rep, nil
+}
+
+// Expected state root of the receiver, empty if it is not known yet.
+func (dir receivers) expected(id string) (string, error) {
+	rep, err := dir.last(id)
+	if err != nil {
+		return "", err
+	}
+	return rep.Root, nil
+}
+
+func (dir receivers) record(rep *receiverReport) error {
+	path, err := dir.path(rep.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(string(dir), rep.ID)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(append(data, '\n')); err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
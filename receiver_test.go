@@ -0,0 +1,154 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Published image served to receivers tracked in returned directory,
+// reporting with the key.
+func testReceivers(t *testing.T, key ed25519.PrivateKey) (*Job, *httptest.Server, receivers) {
+	pub := testJob(t, 1<<18)
+	pub.Dst = os.DevNull
+	if err := pub.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dir := receivers(t.TempDir())
+	keys := map[string]bool{hex.EncodeToString(key.Public().(ed25519.PublicKey)): true}
+	mux, err := serveMux(pub.Src, pub.State, string(dir), keys, zstd.SpeedDefault, 16<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return pub, server, dir
+}
+
+func testSignKey(t *testing.T) (ed25519.PrivateKey, string) {
+	seed := make([]byte, ed25519.SeedSize)
+	rand.Read(seed)
+	path := filepath.Join(t.TempDir(), "sign.key")
+	if err := ioutil.WriteFile(path, seed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return ed25519.NewKeyFromSeed(seed), path
+}
+
+// Receiver losing its statefile is refused until it reseeds.
+func TestReceiverReseed(t *testing.T) {
+	key, keyPath := testSignKey(t)
+	pub, server, dir := testReceivers(t, key)
+	j := testJob(t, 0)
+	j.Src = server.URL + "/" + filepath.Base(pub.Src)
+	j.SignKey = keyPath
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sameFiles(t, pub.Src, j.Dst)
+	rep, err := dir.last(j.receiverID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Root != j.Stats.Digest || rep.Size != 1<<18 || rep.Bs != j.Blk<<10 {
+		t.Fatalf("recorded %+v", rep)
+	}
+
+	os.Remove(j.State)
+	os.Remove(sigPath(j.State))
+	if err = j.Run(); err == nil || !strings.Contains(err.Error(), "-reseed") {
+		t.Fatalf("receiver without statefile is accepted: %v", err)
+	}
+	j.Reseed, j.Full = true, true
+	if err = j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if rep, _ = dir.last(j.receiverID()); rep.Root != j.Stats.Digest {
+		t.Fatal("reseeded root is not recorded")
+	}
+}
+
+// Reports are refused unless signed by allowed key and matching the
+// published state.
+func TestReceiverReport(t *testing.T) {
+	key, _ := testSignKey(t)
+	pub, server, dir := testReceivers(t, key)
+	other, _ := testSignKey(t)
+	url := server.URL + "/" + filepath.Base(pub.Src) + ".state"
+	post := func(key ed25519.PrivateKey, rep receiverReport) int {
+		body, _ := json.Marshal(rep)
+		req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
+		req.Header.Set(SignatureHeader, hex.EncodeToString(ed25519.Sign(key, body)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	rep := receiverReport{
+		ID:   strings.Repeat("ab", 16),
+		Root: "00ff",
+		Size: 1 << 18,
+		Bs:   pub.Blk << 10,
+		Time: time.Now().UnixNano(),
+		Key:  hex.EncodeToString(key.Public().(ed25519.PublicKey)),
+	}
+	unknown := rep
+	unknown.Key = hex.EncodeToString(other.Public().(ed25519.PublicKey))
+	if code := post(other, unknown); code != http.StatusForbidden {
+		t.Fatalf("report of unknown key: %d", code)
+	}
+	if code := post(other, rep); code != http.StatusForbidden {
+		t.Fatalf("report with invalid signature: %d", code)
+	}
+	wrong := rep
+	wrong.Bs *= 2
+	if code := post(key, wrong); code != http.StatusBadRequest {
+		t.Fatalf("report of other block size: %d", code)
+	}
+	wrong = rep
+	wrong.Root = ""
+	if code := post(key, wrong); code != http.StatusBadRequest {
+		t.Fatalf("report of empty root: %d", code)
+	}
+	if code := post(key, rep); code != http.StatusNoContent {
+		t.Fatalf("valid report: %d", code)
+	}
+	if code := post(key, rep); code != http.StatusBadRequest {
+		t.Fatalf("replayed report: %d", code)
+	}
+	if expected, _ := dir.expected(rep.ID); expected != "00ff" {
+		t.Fatal("report is not recorded")
+	}
+}
@@ -0,0 +1,121 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io/ioutil"
+	"time"
+)
+
+// Number of source's regions report's change histogram consists of.
+const ReportRegions = 64
+
+type reportRegion struct {
+	Offset  float64 // MiB
+	Blocks  int64
+	Changed int64
+	Pct     float64
+}
+
+type reportMap struct {
+	Name    string
+	Regions []reportRegion
+}
+
+type runReport struct {
+	*Notification
+	Errors []string
+	Maps   []reportMap
+}
+
+// Changes histogram of the run's block map.
+func (j *Job) changesMap() reportMap {
+	m := reportMap{Name: j.Name}
+	blocks := int64(len(j.runMap))
+	if blocks == 0 {
+		return m
+	}
+	per := (blocks + ReportRegions - 1) / ReportRegions
+	for first := int64(0); first < blocks; first += per {
+		r := reportRegion{Offset: float64(first*j.bs) / (1 << 20)}
+		for _, state := range j.runMap[first:min(first+per, blocks)] {
+			r.Blocks++
+			if state == blockChanged {
+				r.Changed++
+			}
+		}
+		r.Pct = 100 * float64(r.Changed) / float64(r.Blocks)
+		m.Regions = append(m.Regions, r)
+	}
+	return m
+}
+
+var reportPage = template.Must(template.New("report").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+	"mib":  func(n int64) int64 { return n >> 20 },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8">
+<title>syncer {{.Job}} {{.Run}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+.failed { color: #b00; }
+.bar { background: #e90; height: 0.8em; }
+</style></head><body>
+<h1>syncer {{.Job}}: <span class="{{.Result}}">{{.Result}}</span></h1>
+<table>
+<tr><th>Run</th><td>{{.Run}}</td></tr>
+<tr><th>Source</th><td>{{.Src}}</td></tr>
+<tr><th>Destination</th><td>{{.Dst}}</td></tr>
+<tr><th>Started</th><td>{{time .Started}}</td></tr>
+<tr><th>Duration, s</th><td>{{.Duration}}</td></tr>
+<tr><th>Blocks</th><td>{{.Blocks}}</td></tr>
+<tr><th>Changed</th><td>{{.Changed}}</td></tr>
+<tr><th>Written, MiB</th><td>{{mib .Written}}</td></tr>
+<tr><th>Digest</th><td>{{.Digest}}</td></tr>
+<tr><th>Syncer</th><td>{{.Syncer}}</td></tr>
+</table>
+{{if .Errors}}<h2>Errors</h2>
+<ul>{{range .Errors}}<li class="failed">{{.}}</li>{{end}}</ul>{{end}}
+{{range .Maps}}<h2>Changes{{if .Name}} of {{.Name}}{{end}}</h2>
+<table>
+<tr><th>Offset, MiB</th><th>Blocks</th><th>Changed</th><th style="width: 20em"></th></tr>
+{{range .Regions}}<tr><td>{{printf "%.1f" .Offset}}</td><td>{{.Blocks}}</td><td>{{.Changed}}</td><td><div class="bar" style="width: {{printf "%.1f" .Pct}}%"></div></td></tr>
+{{end}}</table>{{end}}
+</body></html>
+`))
+
+// Write standalone HTML report of the run.
+func (j *Job) writeReport(n *Notification, runErr error) error {
+	r := runReport{Notification: n, Errors: errorList(runErr)}
+	if len(j.Group) == 0 {
+		r.Maps = append(r.Maps, j.changesMap())
+	}
+	for _, m := range j.Group {
+		r.Maps = append(r.Maps, m.changesMap())
+	}
+	var buf bytes.Buffer
+	if err := reportPage.Execute(&buf, &r); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(j.ReportHTML, buf.Bytes(), 0644)
+}
@@ -0,0 +1,150 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+)
+
+// Materialize chunk store generation back to raw device or image.
+func restore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	storePath := fs.String("store", "", "Path to chunk store")
+	storeKey := fs.String("store-key", "", "Path to chunk store key file")
+	gen := fs.Int("generation", 0, "Generation to restore, latest if 0")
+	inPath := fs.String("in", "", "Path to transformed dst, used instead of store")
+	transform := fs.String("dst-transform", "", "Transforms of dst to invert, as used during sync")
+	outPath := fs.String("out", "", "Path to destination disk or image")
+	parseFlags(fs, args)
+	if *inPath != "" {
+		if *storePath != "" || *transform == "" || *outPath == "" {
+			log.Fatalln("-in requires -dst-transform and -out, without -store")
+		}
+		untransform(*inPath, *transform, *outPath)
+		return
+	}
+	if *storePath == "" || *outPath == "" {
+		log.Fatalln("-store and -out are required")
+	}
+
+	store, err := OpenStore(*storePath, mustReadKey(*storeKey), StoreConfig{})
+	if err != nil {
+		log.Fatalln("Unable to open store:", err)
+	}
+	unlock, err := store.Lock(false)
+	if err != nil {
+		log.Fatalln("Unable to lock store:", err)
+	}
+	defer unlock()
+	if *gen == 0 {
+		gens, err := store.Generations()
+		if err != nil {
+			log.Fatalln("Unable to list generations:", err)
+		}
+		if len(gens) == 0 {
+			log.Fatalln("Store has no generations")
+		}
+		*gen = gens[len(gens)-1]
+	}
+	st, err := store.ReadGeneration(*gen)
+	if err != nil {
+		log.Fatalln("Unable to read generation:", err)
+	}
+	log.Println("Restoring generation", *gen, "of", st.Size, "bytes")
+
+	out, err := os.OpenFile(*outPath, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		log.Fatalln("Unable to open out:", err)
+	}
+
+	prn("[")
+	blocks := st.Blocks()
+	var i int64
+	for i = 0; i < blocks; i++ {
+		sum := st.Hash(i)
+		data, err := store.Get(sum)
+		if err != nil {
+			log.Fatalln("Unable to read chunk:", err)
+		}
+		size := st.Bs
+		if left := st.Size - i*st.Bs; left < size {
+			size = left
+		}
+		computed := st.Hasher().Sum(data)
+		if int64(len(data)) != size || !bytes.Equal(computed, sum) {
+			log.Fatalln("Corrupted chunk for block", i)
+		}
+		if _, err = out.WriteAt(data, i*st.Bs); err != nil {
+			log.Fatalln("Error during out write:", err)
+		}
+		prn(".")
+	}
+	prn("]\n")
+	if err = syncClose(out); err != nil {
+		log.Fatalln("Unable to sync out:", err)
+	}
+}
+
+// Sync written file to the disk and close it, returning errors of both.
+func syncClose(fd *os.File) error {
+	return errors.Join(fd.Sync(), fd.Close())
+}
+
+// Copy destination written with transforms to out, inverting them.
+func untransform(inPath, spec, outPath string) {
+	chain, err := openTransforms(spec)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	in, err := os.Open(inPath)
+	if err != nil {
+		log.Fatalln("Unable to open in:", err)
+	}
+	defer in.Close()
+	size, err := srcSize(in)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	out, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		log.Fatalln("Unable to open out:", err)
+	}
+	src := &transformedImage{in, chain}
+	buf := make([]byte, DefaultBlk<<10)
+	prn("[")
+	for off := int64(0); off < size; off += int64(len(buf)) {
+		n, err := src.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			log.Fatalln("Error during in read:", err)
+		}
+		if _, err = out.WriteAt(buf[:n], off); err != nil {
+			log.Fatalln("Error during out write:", err)
+		}
+		prn(".")
+	}
+	prn("]\n")
+	if err = syncClose(out); err != nil {
+		log.Fatalln("Unable to sync out:", err)
+	}
+}
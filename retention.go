@@ -0,0 +1,122 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// How many generations to keep: last N of them and the newest one in
+// each of N last days, weeks and months. Zero policy keeps everything.
+type Retention struct {
+	Last    int
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+func (r Retention) IsZero() bool {
+	return r == Retention{}
+}
+
+// Time of the run which saved the generation, recorded in its state.
+// Old generations without it have modification time of the file.
+func (s *Store) GenerationTime(n int) (time.Time, error) {
+	data, err := ioutil.ReadFile(s.genPath(n))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if data, err = s.open(data, s.genAD(n)); err != nil {
+		return time.Time{}, err
+	}
+	st, err := ReadStateHeader(bytes.NewReader(data))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !st.Meta.Time.IsZero() {
+		return st.Meta.Time.Local(), nil
+	}
+	fi, err := os.Stat(s.genPath(n))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// Prune removes generations not kept by the retention policy, store has
+// to be locked exclusively. The newest generation is always kept. It
+// returns the numbers of removed ones.
+func (s *Store) Prune(r Retention) ([]int, error) {
+	if r.IsZero() {
+		return nil, nil
+	}
+	gens, err := s.Generations()
+	if err != nil {
+		return nil, err
+	}
+	times := make([]time.Time, len(gens))
+	for i, n := range gens {
+		if times[i], err = s.GenerationTime(n); err != nil {
+			return nil, err
+		}
+	}
+	keep := make(map[int]bool)
+	for i := len(gens) - r.Last; i < len(gens); i++ {
+		if i >= 0 {
+			keep[gens[i]] = true
+		}
+	}
+	buckets := []struct {
+		count  int
+		bucket func(t time.Time) string
+	}{
+		{r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+		{r.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, b := range buckets {
+		prev := ""
+		kept := 0
+		for i := len(gens) - 1; i >= 0 && kept < b.count; i-- {
+			if key := b.bucket(times[i]); key != prev {
+				keep[gens[i]] = true
+				prev = key
+				kept++
+			}
+		}
+	}
+	var removed []int
+	for i, n := range gens {
+		if keep[n] || i == len(gens)-1 {
+			continue
+		}
+		if err = os.Remove(s.genPath(n)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, n)
+	}
+	return removed, nil
+}
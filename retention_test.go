@@ -0,0 +1,86 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Store with generations of runs at the times, their files modified
+// just now, like after copying the store.
+func testGenerations(t *testing.T, times []time.Time) *Store {
+	t.Helper()
+	s := testStore(t)
+	hash, _ := LookupHash("")
+	for _, when := range times {
+		st := NewState(16, 16, hash)
+		st.Meta.Time = when
+		if _, err := s.AddGeneration(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestPrune(t *testing.T) {
+	day := func(d, h int) time.Time {
+		return time.Date(2024, 1, d, h, 0, 0, 0, time.Local)
+	}
+	// Generations 1-7: two runs on January 1st, 2nd and 3rd, one on 10th
+	times := []time.Time{day(1, 1), day(1, 2), day(2, 1), day(2, 2), day(3, 1), day(3, 2), day(10, 1)}
+	for _, c := range []struct {
+		r    Retention
+		kept []int
+	}{
+		{Retention{Last: 2}, []int{6, 7}},
+		{Retention{Daily: 3}, []int{4, 6, 7}},
+		{Retention{Weekly: 2}, []int{6, 7}},
+		{Retention{Monthly: 1}, []int{7}},
+		{Retention{Last: 1, Daily: 2}, []int{6, 7}},
+	} {
+		s := testGenerations(t, times)
+		if _, err := s.Prune(c.r); err != nil {
+			t.Fatal(err)
+		}
+		if gens, _ := s.Generations(); !reflect.DeepEqual(gens, c.kept) {
+			t.Fatalf("%+v: kept %v instead of %v", c.r, gens, c.kept)
+		}
+	}
+}
+
+// Generations saved without run's time are dated by their files.
+func TestPruneModTime(t *testing.T) {
+	var zero time.Time
+	s := testGenerations(t, []time.Time{zero, zero, zero})
+	for n, d := range map[int]int{1: 1, 2: 1, 3: 2} {
+		when := time.Date(2024, 1, d, 12, 0, 0, 0, time.Local)
+		if err := os.Chtimes(s.genPath(n), when, when); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Prune(Retention{Daily: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if gens, _ := s.Generations(); !reflect.DeepEqual(gens, []int{2, 3}) {
+		t.Fatalf("kept %v", gens)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Error classes with their own retry policies. Fatal errors are never
+// retried.
+const (
+	ErrClassIO      = "io"      // EIO: bad sector may be read next time
+	ErrClassBusy    = "busy"    // EBUSY, EAGAIN, EINTR
+	ErrClassNetwork = "network" // connection reset, timeouts
+	ErrClassFatal   = "fatal"
+)
+
+// How many times to retry failed operation, waiting for backoff before
+// the first retry, doubling it each time.
+type RetryPolicy struct {
+	Attempts int      `toml:"attempts"`
+	Backoff  Duration `toml:"backoff"`
+}
+
+var DefaultRetry = map[string]RetryPolicy{
+	ErrClassIO:      {1, Duration{time.Second}},
+	ErrClassBusy:    {5, Duration{100 * time.Millisecond}},
+	ErrClassNetwork: {5, Duration{time.Second}},
+}
+
+func classifyError(err error) string {
+	switch {
+	case errors.Is(err, syscall.EIO):
+		return ErrClassIO
+	case errors.Is(err, syscall.EBUSY), errors.Is(err, syscall.EAGAIN),
+		errors.Is(err, syscall.EINTR):
+		return ErrClassBusy
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ETIMEDOUT),
+		errors.Is(err, syscall.EPIPE), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, os.ErrDeadlineExceeded):
+		return ErrClassNetwork
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return ErrClassNetwork
+	}
+	var herr *httpStatusError
+	if errors.As(err, &herr) && herr.Temporary() {
+		return ErrClassNetwork
+	}
+	return ErrClassFatal
+}
+
+// Parse comma separated CLASS=ATTEMPTS:BACKOFF policies, like
+// "io=3:1s,network=10:5s".
+func ParseRetry(s string) (map[string]RetryPolicy, error) {
+	policies := make(map[string]RetryPolicy)
+	if s == "" {
+		return policies, nil
+	}
+	for _, spec := range strings.Split(s, ",") {
+		class, rest, _ := strings.Cut(spec, "=")
+		attempts, backoff, _ := strings.Cut(rest, ":")
+		var p RetryPolicy
+		var err error
+		if p.Attempts, err = strconv.Atoi(attempts); err != nil || p.Attempts < 0 {
+			return nil, errors.New("Invalid retry attempts: " + spec)
+		}
+		if backoff != "" {
+			if p.Backoff.Duration, err = time.ParseDuration(backoff); err != nil {
+				return nil, errors.New("Invalid retry backoff: " + spec)
+			}
+		}
+		policies[class] = p
+	}
+	return policies, checkRetry(policies)
+}
+
+func checkRetry(policies map[string]RetryPolicy) error {
+	for class := range policies {
+		if _, ok := DefaultRetry[class]; !ok {
+			return errors.New("Unknown error class: " + class)
+		}
+	}
+	return nil
+}
+
+func (j *Job) retryPolicy(class string) RetryPolicy {
+	if p, ok := j.Retry[class]; ok {
+		return p
+	}
+	return DefaultRetry[class]
+}
+
+// Execute operation, retrying it according to the policy of its error's
+// class.
+func (j *Job) retry(what string, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		class := classifyError(err)
+		p := j.retryPolicy(class)
+		if attempt >= p.Attempts {
+			return err
+		}
+		delay := p.Backoff.Duration << attempt
+		j.log.Printf(
+			"Transient %s error during %s, retry %d of %d in %s: %s\n",
+			class, what, attempt+1, p.Attempts, delay, err,
+		)
+		time.Sleep(delay)
+	}
+}
+
+// ReadAt with retries. io.EOF is not an error to retry.
+func (j *Job) readAt(fd io.ReaderAt, buf []byte, offset int64) (n int, err error) {
+	var eof bool
+	err = j.retry("src read", func() (err error) {
+		n, err = fd.ReadAt(buf, offset)
+		if eof = err == io.EOF; eof {
+			return nil
+		}
+		return err
+	})
+	if err == nil && eof {
+		err = io.EOF
+	}
+	return n, err
+}
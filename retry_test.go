@@ -0,0 +1,121 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	for err, want := range map[error]string{
+		&os.PathError{Op: "read", Path: "/dev/ada0", Err: syscall.EIO}: ErrClassIO,
+		fmt.Errorf("Unable to lock: %w", syscall.EAGAIN):               ErrClassBusy,
+		syscall.ECONNRESET:                               ErrClassNetwork,
+		os.ErrDeadlineExceeded:                           ErrClassNetwork,
+		&httpStatusError{"503 Service Unavailable", 503}: ErrClassNetwork,
+		&httpStatusError{"404 Not Found", 404}:           ErrClassFatal,
+		syscall.ENOSPC:                                   ErrClassFatal,
+		errors.New("corrupted"):                          ErrClassFatal,
+	} {
+		if got := classifyError(err); got != want {
+			t.Errorf("%v: class %s instead of %s", err, got, want)
+		}
+	}
+}
+
+func TestParseRetry(t *testing.T) {
+	got, err := ParseRetry("io=3:1s,network=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]RetryPolicy{
+		ErrClassIO:      {3, Duration{time.Second}},
+		ErrClassNetwork: {0, Duration{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("Unexpected policies:", got)
+	}
+	for _, s := range []string{"io", "io=-1", "io=1:soon", "fatal=3", "disk=3"} {
+		if _, err = ParseRetry(s); err == nil {
+			t.Errorf("%q is parsed", s)
+		}
+	}
+}
+
+// Operation is retried as many times as its error class policy allows,
+// doubling the backoff. Fatal errors are returned at once.
+func TestRetry(t *testing.T) {
+	j := &Job{
+		log:   log.New(ioutil.Discard, "", 0),
+		Retry: map[string]RetryPolicy{ErrClassIO: {3, Duration{10 * time.Millisecond}}},
+	}
+	for _, c := range []struct {
+		err      error
+		fails    int
+		calls    int
+		failed   bool
+		duration time.Duration
+	}{
+		{syscall.EIO, 2, 3, false, 30 * time.Millisecond},
+		{syscall.EIO, 5, 4, true, 70 * time.Millisecond},
+		{syscall.ENOSPC, 5, 1, true, 0},
+	} {
+		calls := 0
+		started := time.Now()
+		err := j.retry("test", func() error {
+			if calls++; calls <= c.fails {
+				return c.err
+			}
+			return nil
+		})
+		if calls != c.calls || (err != nil) != c.failed || time.Since(started) < c.duration {
+			t.Errorf("%v failing %d times: %d calls in %s: %v",
+				c.err, c.fails, calls, time.Since(started), err)
+		}
+	}
+}
+
+// End of the source is returned, not retried.
+func TestRetryReadAtEOF(t *testing.T) {
+	j := &Job{log: log.New(ioutil.Discard, "", 0)}
+	calls := 0
+	fd := readerAtFunc(func(p []byte, off int64) (int, error) {
+		calls++
+		return copy(p, "tail"), io.EOF
+	})
+	n, err := j.readAt(fd, make([]byte, 10), 0)
+	if n != 4 || err != io.EOF || calls != 1 {
+		t.Fatal(n, err, calls)
+	}
+}
+
+type readerAtFunc func(p []byte, off int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, off int64) (int, error) {
+	return f(p, off)
+}
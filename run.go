@@ -0,0 +1,84 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+)
+
+// Run jobs from configuration file one by one. Failure of one job does
+// not prevent others from running.
+func run(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	cfgPath := fs.String("config", DefaultConfig, "Path to configuration file")
+	names := fs.String("job", "", "Comma separated names of jobs to run")
+	all := fs.Bool("all", false, "Run all jobs")
+	controlAddr := fs.String("control", "", "Serve control API on unix:PATH or HOST:PORT")
+	controlToken := fs.String("control-token", "", "Bearer token required by control API, mandatory on non-loopback HOST:PORT")
+	profile := addProfileFlags(fs)
+	logging := addLogFlags(fs)
+	blake2bImpl := addBLAKE2bFlag(fs)
+	parseFlags(fs, args)
+	errlog := logging.setup()
+	blake2bImpl()
+	if (*names == "") == !*all {
+		log.Fatalln("Either -job or -all is required")
+	}
+
+	cfg, err := LoadConfig(*cfgPath)
+	if err != nil {
+		log.Fatalln("Unable to load config:", err)
+	}
+	var jobs []*Job
+	if *all {
+		for _, name := range cfg.Names() {
+			jobs = append(jobs, cfg.Jobs[name])
+		}
+	} else if jobs, err = cfg.Select(*names); err != nil {
+		log.Fatalln(err)
+	}
+
+	handleSignals(jobs)
+	if *controlAddr != "" {
+		if err = serveControl(*controlAddr, *controlToken, jobs); err != nil {
+			log.Fatalln("Unable to serve control API:", err)
+		}
+	}
+	stop := profile.start()
+	failed, corrupt := 0, false
+	for _, job := range jobs {
+		log.Println("Running job", job.Name)
+		if err = job.Run(); err != nil {
+			errlog.Println("Job", job.Name, "failed:", err)
+			failed++
+			corrupt = corrupt || errors.Is(err, ErrCorrupt)
+		}
+	}
+	stop()
+	if failed > 0 {
+		log.Println(failed, "of", len(jobs), "jobs failed")
+		if corrupt {
+			os.Exit(ExitCorrupt)
+		}
+		os.Exit(1)
+	}
+}
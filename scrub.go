@@ -0,0 +1,156 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// Kind of scrub's notifications.
+const NotifyScrub = "scrub"
+
+// Whether destination's block matches the statefile. Missing part of
+// shorter destination differs.
+func checkBlock(dst io.ReaderAt, st *State, i int64, buf []byte) (bool, error) {
+	data := buf[:st.blockLen(i)]
+	n, err := dst.ReadAt(data, i*st.Bs)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return n == len(data) && bytes.Equal(st.Hasher().Sum(data), st.Hash(i)), nil
+}
+
+// Verify destination of the job, or of each group's member, against
+// the statefile.
+func (j *Job) scrub() *Notification {
+	n := &Notification{
+		Job:     j.Name,
+		Kind:    NotifyScrub,
+		Run:     newRunID(),
+		Src:     j.Src,
+		Dst:     j.Dst,
+		Result:  "ok",
+		Started: time.Now(),
+		Syncer:  Version,
+	}
+	var errs []error
+	members := j.Group
+	if len(members) == 0 {
+		members = []*Job{j}
+	}
+	for _, m := range members {
+		logger := j.log
+		if m != j {
+			logger = log.New(j.log.Writer(), m.Name+": ", j.log.Flags())
+		}
+		blocks, differ, err := m.scrubOnce(logger)
+		n.Blocks += blocks
+		n.Changed += differ
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	n.Duration = int64(time.Since(n.Started).Seconds())
+	n.Failed = n.Changed
+	aerr := j.alert(n.Failed)
+	if err := errors.Join(append(errs, aerr)...); err != nil {
+		n.Result, n.Error = "failed", err.Error()
+	}
+	if aerr != nil {
+		n.Result = "alert"
+	}
+	return n
+}
+
+// Verify scrub_sample share of destination's blocks, all of them by
+// default, returning the numbers of verified and differing ones.
+func (j *Job) scrubOnce(logger *log.Logger) (blocks, differ int64, err error) {
+	if j.Store != "" {
+		return 0, 0, errors.New("Chunk store can not be scrubbed")
+	}
+	sample := 100.0
+	if j.ScrubSample != "" {
+		if sample, err = parsePercent(j.ScrubSample); err != nil {
+			return 0, 0, err
+		}
+	}
+	// Running sync may be resolving the same job's state concurrently
+	var state string
+	if j.StateDir != "" {
+		state = j.dirState()
+	} else {
+		state = j.State
+	}
+	unlock, err := lockFile(state + ".lock")
+	if err != nil {
+		return 0, 0, fmt.Errorf("Unable to lock state: %w", err)
+	}
+	defer unlock()
+	secret, signKey, err := stateSecrets(j.StateKey, j.StatePassphrase, j.SignKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	st, err := ReadStateFile(state, secret, signKey)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Unable to read statefile: %w", err)
+	}
+	var dst Image
+	if j.DstFormat == "" || j.DstFormat == FormatRaw {
+		dst, err = os.Open(j.Dst)
+	} else {
+		dst, err = openImage(j.Dst, j.DstFormat, os.O_RDONLY, st.Size)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("Unable to open dst: %w", err)
+	}
+	defer dst.Close()
+	if j.DstTransform != "" {
+		chain, err := openTransforms(j.DstTransform)
+		if err != nil {
+			return 0, 0, err
+		}
+		dst = &transformedImage{dst, chain}
+	}
+	buf := make([]byte, st.Bs)
+	for i := int64(0); i < st.Blocks(); i++ {
+		if sample < 100 && rand.Float64()*100 >= sample {
+			continue
+		}
+		blocks++
+		ok, err := checkBlock(dst, st, i, buf)
+		if err != nil {
+			return blocks, differ, fmt.Errorf("Error during dst read: %w", err)
+		}
+		if !ok {
+			logger.Println("Destination block", i, "differs from statefile")
+			differ++
+		}
+	}
+	if differ > 0 {
+		err = fmt.Errorf("%d of %d verified dst blocks differ from statefile", differ, blocks)
+	}
+	return blocks, differ, err
+}
@@ -0,0 +1,58 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Directory with symbolic links named after device's model and serial
+// number.
+const DiskByID = "/dev/disk/by-id"
+
+// Identifier of the disk independent of its path: name of its link in
+// /dev/disk/by-id. Empty if it is not found (regular file, for example).
+func deviceSerial(path string) string {
+	target := identity(path)
+	entries, err := ioutil.ReadDir(DiskByID)
+	if err != nil {
+		return ""
+	}
+	var ids []string
+	for _, e := range entries {
+		if identity(filepath.Join(DiskByID, e.Name())) == target {
+			ids = append(ids, e.Name())
+		}
+	}
+	if len(ids) == 0 {
+		return ""
+	}
+	// World wide names are not human readable, prefer model_serial ones
+	sort.Slice(ids, func(a, b int) bool {
+		wwnA, wwnB := strings.HasPrefix(ids[a], "wwn-"), strings.HasPrefix(ids[b], "wwn-")
+		if wwnA != wwnB {
+			return wwnB
+		}
+		return ids[a] < ids[b]
+	})
+	return ids[0]
+}
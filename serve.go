@@ -0,0 +1,427 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Request header with zstd level preferred by the client.
+const ZstdLevelHeader = "Syncer-Zstd-Level"
+
+// Compression levels of HTTP source's responses, by name.
+var zstdLevels = map[string]zstd.EncoderLevel{
+	"fastest": zstd.SpeedFastest,
+	"default": zstd.SpeedDefault,
+	"better":  zstd.SpeedBetterCompression,
+	"best":    zstd.SpeedBestCompression,
+}
+
+// Publish image and its statefile for pulling with -src URL. Ranges are
+// compressed with zstd if client accepts it, at the level it asks for,
+// but not above the server's one, each block as a separate frame.
+// Incompressible blocks are stored raw, ranges exceeding the limit are
+// sent as is, streamed from the file.
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "Address to listen on")
+	srcPath := fs.String("src", "", "Path to published image")
+	statePath := fs.String("state", "", "Path to its statefile")
+	maxLevel := fs.String("compress", "default", "Highest zstd level: fastest, default, better, best, none")
+	recvDir := fs.String("receivers", "", "Directory tracking receivers' state roots, refusing stale ones")
+	recvKeys := fs.String("receiver-keys", "", "File of receivers' public sign keys allowed to report their roots")
+	maxRangeArg := fs.String("max-range", "16M", "Largest range compressed in memory, bigger ones are sent as is")
+	parseFlags(fs, args)
+	if *srcPath == "" || *statePath == "" {
+		log.Fatalln("-src and -state are required")
+	}
+	if *recvDir != "" && *recvKeys == "" {
+		log.Fatalln("-receivers requires -receiver-keys")
+	}
+	var keys map[string]bool
+	if *recvDir != "" {
+		var err error
+		if keys, err = readReceiverKeys(*recvKeys); err != nil {
+			log.Fatalln("Unable to read receiver keys:", err)
+		}
+	}
+	maxRange, err := parseSize(*maxRangeArg)
+	if err != nil {
+		log.Fatalln("Invalid -max-range:", err)
+	}
+	var highest zstd.EncoderLevel
+	if *maxLevel != "none" {
+		var ok bool
+		if highest, ok = zstdLevels[*maxLevel]; !ok {
+			log.Fatalln("Unknown compression:", *maxLevel)
+		}
+	}
+	mux, err := serveMux(*srcPath, *statePath, *recvDir, keys, highest, maxRange)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Serving", *srcPath, "as", "/"+filepath.Base(*srcPath), "on", *addr)
+	log.Fatalln(http.ListenAndServe(*addr, mux))
+}
+
+// Handler publishing the image and its statefile, with zstd levels up
+// to the highest one. Receivers' reports are accepted signed by the keys.
+func serveMux(srcPath, statePath, recvDir string, recvKeys map[string]bool, highest zstd.EncoderLevel, maxRange int64) (*http.ServeMux, error) {
+	// Ranges are compressed by at most that number of requests at once,
+	// limiting the memory their buffers take
+	compressing := make(chan struct{}, runtime.GOMAXPROCS(0))
+	encs := make(map[zstd.EncoderLevel]*zstd.Encoder)
+	for _, level := range zstdLevels {
+		if level > highest {
+			continue
+		}
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+		if err != nil {
+			return nil, err
+		}
+		encs[level] = enc
+	}
+	name := "/" + filepath.Base(srcPath)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+name+".state", func(w http.ResponseWriter, r *http.Request) {
+		if id := r.Header.Get(ReceiverHeader); recvDir != "" && id != "" {
+			root, reseed := r.Header.Get(RootHeader), r.Header.Get(ReseedHeader) != ""
+			expected, err := checkReceiver(receivers(recvDir), id, root, statePath)
+			switch {
+			case err != nil && reseed:
+				log.Println("Receiver", id, "reseeds:", err)
+			case err != nil:
+				log.Println("Receiver", id, "refused:", err)
+				http.Error(w, err.Error()+", run it with -reseed to resync from scratch", http.StatusConflict)
+				return
+			}
+			w.Header().Set(ReceiverHeader, id)
+			w.Header().Set(RootHeader, expected)
+		}
+		http.ServeFile(w, r, statePath)
+	})
+	if recvDir != "" {
+		var reports sync.Mutex // verified and recorded one at a time
+		mux.HandleFunc("POST "+name+".state", func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxReportSize))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			sig, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+			if err != nil {
+				http.Error(w, "Invalid report signature", http.StatusForbidden)
+				return
+			}
+			size, bs, err := publishedShape(srcPath, statePath)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			dir := receivers(recvDir)
+			reports.Lock()
+			defer reports.Unlock()
+			rep, err := dir.verify(body, sig, recvKeys, size, bs)
+			if err == nil {
+				err = dir.record(rep)
+			}
+			var rerr reportError
+			switch {
+			case errors.As(err, &rerr) && rerr.auth:
+				log.Println("Receiver's report refused:", err)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Println("Receiver", rep.ID, "synced to", rep.Root)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	mux.HandleFunc("POST "+name+".patch", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		off, err := strconv.ParseInt(q.Get("off"), 10, 64)
+		length, lerr := strconv.ParseInt(q.Get("len"), 10, 64)
+		if err != nil || lerr != nil || off < 0 || length <= 0 {
+			http.Error(w, "Invalid range", http.StatusBadRequest)
+			return
+		}
+		fd, err := os.Open(srcPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer fd.Close()
+		fi, err := fd.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if off+length > fi.Size() || length > maxRange {
+			http.Error(w, "Invalid range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		expected := (length + DeltaUnit - 1) / DeltaUnit * DeltaHashLen
+		hashes, err := io.ReadAll(io.LimitReader(r.Body, expected+1))
+		if err != nil || int64(len(hashes)) != expected {
+			http.Error(w, "Invalid page hashes", http.StatusBadRequest)
+			return
+		}
+		compressing <- struct{}{}
+		defer func() { <-compressing }()
+		data := make([]byte, length)
+		if _, err = fd.ReadAt(data, off); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		patch := makePatch(data, hashes)
+		w.Header().Set("Vary", "Accept-Encoding")
+		if enc := encs[negotiateLevel(r, highest)]; enc != nil {
+			if packed := enc.EncodeAll(patch, nil); len(packed) < len(patch) {
+				w.Header().Set("Content-Encoding", "zstd")
+				patch = packed
+			}
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(patch)))
+		w.Write(patch)
+	})
+	var weak weakCache
+	mux.HandleFunc("GET "+name+".weak", func(w http.ResponseWriter, r *http.Request) {
+		data, err := weak.get(srcPath, statePath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	})
+	mux.HandleFunc("GET "+name, func(w http.ResponseWriter, r *http.Request) {
+		fd, err := os.Open(srcPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer fd.Close()
+		fi, err := fd.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Vary", "Accept-Encoding")
+		enc := encs[negotiateLevel(r, highest)]
+		from, to, ok := singleRange(r.Header.Get("Range"), fi.Size())
+		if enc == nil || !ok || r.Method != "GET" || to-from > maxRange {
+			http.ServeContent(w, r, name, fi.ModTime(), fd)
+			return
+		}
+		compressing <- struct{}{}
+		defer func() { <-compressing }()
+		data := make([]byte, to-from)
+		if _, err = fd.ReadAt(data, from); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, bs, err := publishedShape(srcPath, statePath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if packed := packBlocks(enc, data, from, bs); len(packed) < len(data) {
+			w.Header().Set("Content-Encoding", "zstd")
+			data = packed
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, to-1, fi.Size()))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data)
+	})
+	return mux, nil
+}
+
+// Weak checksums of published image's blocks, for clients looking for
+// moved blocks. They are calculated again after the image or its
+// statefile is changed.
+type weakCache struct {
+	sync.Mutex
+	key  string
+	data []byte
+}
+
+func (c *weakCache) get(srcPath, statePath string) ([]byte, error) {
+	fi, err := os.Stat(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	sfi, err := os.Stat(statePath)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprint(fi.Size(), fi.ModTime().UnixNano(), sfi.ModTime().UnixNano())
+	c.Lock()
+	defer c.Unlock()
+	if key == c.key {
+		return c.data, nil
+	}
+	st, err := ReadStateFileHeader(statePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.Open(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	sums, err := weakSums(fd, fi.Size(), st.Bs)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 4*len(sums))
+	for i, sum := range sums {
+		binary.BigEndian.PutUint32(data[4*i:], sum)
+	}
+	c.key, c.data = key, data
+	return data, nil
+}
+
+// Check that receiver's state root is the one it reported after its
+// last run, or the published one: receiver is already in sync. Unknown
+// receivers are accepted. Returns the expected root.
+func checkReceiver(dir receivers, id, root, statePath string) (string, error) {
+	expected, err := dir.expected(id)
+	if err != nil || expected == "" || root == expected {
+		return expected, err
+	}
+	if st, err := ReadStateFileHeader(statePath, nil); err == nil && root == st.Meta.Digest {
+		return expected, nil
+	}
+	if root == "" {
+		return expected, fmt.Errorf("Receiver has no statefile, expected root %s", expected)
+	}
+	return expected, fmt.Errorf("Receiver's state root %s is stale, expected %s", root, expected)
+}
+
+// Size and block size of the published state. Block size of encrypted
+// statefile is not known, zero is returned.
+func publishedShape(srcPath, statePath string) (size, bs int64, err error) {
+	if st, err := ReadStateFileHeader(statePath, nil); err == nil {
+		return st.Size, st.Bs, nil
+	}
+	fi, err := os.Stat(srcPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	return fi.Size(), 0, nil
+}
+
+// Compress range of data at offset block by block, each block being a
+// separate zstd frame. Blocks not becoming smaller are stored in raw
+// frames, so they do not disable compression of the others. Zero block
+// size compresses the whole range at once.
+func packBlocks(enc *zstd.Encoder, data []byte, off, bs int64) []byte {
+	if bs == 0 {
+		bs = int64(len(data))
+	}
+	var packed []byte
+	for len(data) > 0 {
+		n := min(bs-off%bs, int64(len(data)))
+		frame := enc.EncodeAll(data[:n], nil)
+		if len(frame) < int(n) {
+			packed = append(packed, frame...)
+		} else {
+			packed = appendRawFrame(packed, data[:n])
+		}
+		data, off = data[n:], off+n
+	}
+	return packed
+}
+
+// Append zstd frame storing data in raw blocks.
+func appendRawFrame(dst, data []byte) []byte {
+	const maxBlock = 128 << 10
+	// Magic, single segment with 8-byte content size
+	dst = binary.LittleEndian.AppendUint32(dst, 0xFD2FB528)
+	dst = append(dst, 0xE0)
+	dst = binary.LittleEndian.AppendUint64(dst, uint64(len(data)))
+	for {
+		n := min(len(data), maxBlock)
+		hdr := uint32(n) << 3 // raw block type is zero
+		if n == len(data) {
+			hdr |= 1
+		}
+		dst = append(dst, byte(hdr), byte(hdr>>8), byte(hdr>>16))
+		dst = append(dst, data[:n]...)
+		if data = data[n:]; len(data) == 0 {
+			return dst
+		}
+	}
+}
+
+// Level of zstd accepted by the client, zero if it does not.
+func negotiateLevel(r *http.Request, highest zstd.EncoderLevel) zstd.EncoderLevel {
+	accepted := false
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, _, _ = strings.Cut(coding, ";")
+		accepted = accepted || strings.TrimSpace(coding) == "zstd"
+	}
+	if !accepted {
+		return 0
+	}
+	level, ok := zstdLevels[r.Header.Get(ZstdLevelHeader)]
+	if !ok || level > highest {
+		return highest
+	}
+	return level
+}
+
+// Parse "bytes=FROM-TO" range, returning half-open interval.
+func singleRange(s string, size int64) (from, to int64, ok bool) {
+	spec, ok := strings.CutPrefix(s, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	a, b, _ := strings.Cut(spec, "-")
+	from, err := strconv.ParseInt(a, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if to, err = strconv.ParseInt(b, 10, 64); err != nil {
+		return 0, 0, false
+	}
+	to = min(to+1, size)
+	return from, to, from < to
+}
@@ -0,0 +1,51 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"sync/atomic"
+)
+
+// Destination whose superseded data is overwritten with random bytes
+// and synchronized to the media before the new content is written, so
+// the old one can not be recovered from it.
+type shredImage struct {
+	Image
+	shredded atomic.Int64
+}
+
+func (s *shredImage) WriteAt(p []byte, off int64) (int, error) {
+	noise := make([]byte, len(p))
+	if _, err := rand.Read(noise); err != nil {
+		return 0, err
+	}
+	if _, err := s.Image.WriteAt(noise, off); err != nil {
+		return 0, err
+	}
+	if err := s.Image.Sync(); err != nil {
+		return 0, err
+	}
+	s.shredded.Add(int64(len(p)))
+	return s.Image.WriteAt(p, off)
+}
+
+func (s *shredImage) Flush() error {
+	return flushImage(s.Image)
+}
@@ -0,0 +1,77 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var ErrStateSignature = errors.New("Invalid statefile signature")
+
+// Detached statefile's signature is kept next to it.
+func sigPath(state string) string {
+	return state + ".sig"
+}
+
+// Read Ed25519 private key seed, either raw or hexadecimal.
+func ReadSignKey(path string) (ed25519.PrivateKey, error) {
+	seed, err := ReadKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Check statefile's contents against its detached signature.
+func verifyState(key ed25519.PrivateKey, state string, data []byte) error {
+	sig, err := ioutil.ReadFile(sigPath(state))
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key.Public().(ed25519.PublicKey), data, sig) {
+		return ErrStateSignature
+	}
+	return nil
+}
+
+// Atomically save statefile's contents detached signature.
+func signState(key ed25519.PrivateKey, state string, data []byte) error {
+	path := sigPath(state)
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "syncer")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(ed25519.Sign(key, data)); err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
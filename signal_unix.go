@@ -0,0 +1,51 @@
+//go:build unix
+
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Pause jobs' reading on SIGTSTP, resume on SIGCONT or SIGUSR2. Process
+// itself is not stopped, so locks and state stay intact.
+func handleSignals(jobs []*Job) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTSTP, syscall.SIGCONT, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigs {
+			for _, job := range jobs {
+				if sig == syscall.SIGTSTP {
+					job.Pause()
+				} else {
+					job.Resume()
+				}
+			}
+			if sig == syscall.SIGTSTP {
+				log.Println("Paused, send SIGCONT or SIGUSR2 to resume")
+			} else {
+				log.Println("Resumed")
+			}
+		}
+	}()
+}
@@ -0,0 +1,47 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const IOCTL_DISK_GET_LENGTH_INFO = 0x7405C
+
+// Volumes and disks (\\.\C:, \\?\GLOBALROOT\Device\...) can not be
+// stat-ed, so their length is asked directly.
+func srcSize(fd *os.File) (int64, error) {
+	if !strings.HasPrefix(fd.Name(), `\\.\`) && !strings.HasPrefix(fd.Name(), `\\?\`) {
+		return fileSize(fd)
+	}
+	buf := make([]byte, 8)
+	var n uint32
+	err := syscall.DeviceIoControl(
+		syscall.Handle(fd.Fd()), IOCTL_DISK_GET_LENGTH_INFO,
+		nil, 0, &buf[0], uint32(len(buf)), &n, nil,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to get src length: %w", err)
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
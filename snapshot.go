@@ -0,0 +1,99 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Snapshot of the source, taken before the read pass, so source is
+// stable for the whole run.
+type Snapshot interface {
+	// Path to read snapshot's data from
+	Device() string
+	// Name identifying the snapshot, recorded in the state
+	Name() string
+	Remove() error
+}
+
+// Execute command, returning its standard output. Its standard error
+// output is included into error.
+func command(name string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf(
+			"%s failed: %w: %s",
+			name, err, strings.TrimSpace(stderr.String()),
+		)
+	}
+	return string(out), nil
+}
+
+// Take source's snapshot if it was asked for, or return nil. If
+// filesystem freezing is enabled, then it is frozen only while the
+// snapshot is taken.
+func (j *Job) snapshot() (Snapshot, error) {
+	kinds := 0
+	for _, enabled := range []bool{j.LVMSnapshot != "", j.ZFSSnapshot, j.VSS} {
+		if enabled {
+			kinds++
+		}
+	}
+	if kinds == 0 {
+		return nil, nil
+	}
+	if kinds > 1 {
+		return nil, errors.New("Only one snapshot kind can be used")
+	}
+	if j.Freeze != "" && !j.frozen {
+		j.log.Println("Freezing", j.Freeze)
+		thaw, err := freezeFS(j.Freeze)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to freeze filesystem: %w", err)
+		}
+		defer thaw()
+	}
+	// Concrete results are checked, so failure is not typed nil Snapshot
+	if j.ZFSSnapshot {
+		s, err := zfsSnapshot(j.Src)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	if j.VSS {
+		s, err := vssSnapshot(j.Src)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	s, err := lvmSnapshot(j.Src, j.LVMSnapshot)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
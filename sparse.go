@@ -0,0 +1,77 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+// Read hashes of sparse statefile: bitmap of blocks whose hashes are
+// stored (bit i of byte i/8), then their hashes. All other blocks are
+// zero-filled.
+func (st *State) readSparse(r io.Reader) error {
+	bitmap, err := readBounded(r, (st.Blocks()+7)/8)
+	if err != nil {
+		return err
+	}
+	st.Hashes = make([]byte, int64(st.hash.Size)*st.Blocks())
+	zeroFull := st.zeroHash(st.Bs)
+	for i := int64(0); i < st.Blocks(); i++ {
+		h := st.Hash(i)
+		if bitmap[i/8]&(1<<(i%8)) != 0 {
+			if _, err := io.ReadFull(r, h); err != nil {
+				return err
+			}
+		} else if st.blockLen(i) == st.Bs {
+			copy(h, zeroFull)
+		} else {
+			copy(h, st.zeroHash(st.blockLen(i)))
+		}
+	}
+	return nil
+}
+
+func (st *State) writeSparse(w io.Writer) error {
+	bitmap := make([]byte, (st.Blocks()+7)/8)
+	zeroFull := st.zeroHash(st.Bs)
+	isZero := func(i int64) bool {
+		if st.blockLen(i) == st.Bs {
+			return bytes.Equal(st.Hash(i), zeroFull)
+		}
+		return bytes.Equal(st.Hash(i), st.zeroHash(st.blockLen(i)))
+	}
+	for i := int64(0); i < st.Blocks(); i++ {
+		if !isZero(i) {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	if _, err := w.Write(bitmap); err != nil {
+		return err
+	}
+	for i := int64(0); i < st.Blocks(); i++ {
+		if bitmap[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		if _, err := w.Write(st.Hash(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
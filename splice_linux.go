@@ -0,0 +1,93 @@
+//go:build linux
+
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	F_SETPIPE_SZ   = 1031
+	F_GETPIPE_SZ   = 1032
+	SPLICE_F_MOVE  = 1
+	SplicePipeSize = 1 << 20
+)
+
+// Pipe moving data from source to destination inside the kernel.
+type splicer struct {
+	r, w int
+	size int
+}
+
+func newSplicer() (*splicer, error) {
+	var fds [2]int
+	if err := syscall.Pipe2(fds[:], syscall.O_CLOEXEC); err != nil {
+		return nil, err
+	}
+	s := &splicer{r: fds[0], w: fds[1]}
+	syscall.Syscall(syscall.SYS_FCNTL, uintptr(s.w), F_SETPIPE_SZ, SplicePipeSize)
+	size, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(s.w), F_GETPIPE_SZ, 0)
+	if errno != 0 {
+		s.close()
+		return nil, errno
+	}
+	s.size = int(size)
+	return s, nil
+}
+
+// Copy n bytes at offset of src to the same offset of dst. After
+// failure the pipe may hold unwritten data, so it is replaced.
+func (s *splicer) copy(dst, src *os.File, offset int64, n int) (err error) {
+	defer func() {
+		if err != nil {
+			s.close()
+			if fresh, e := newSplicer(); e == nil {
+				*s = *fresh
+			}
+		}
+	}()
+	roff, woff := offset, offset
+	for n > 0 {
+		got, err := syscall.Splice(int(src.Fd()), &roff, s.w, nil, min(n, s.size), SPLICE_F_MOVE)
+		if err != nil {
+			return err
+		}
+		if got == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		n -= int(got)
+		for got > 0 {
+			put, err := syscall.Splice(s.r, nil, int(dst.Fd()), &woff, int(got), SPLICE_F_MOVE)
+			if err != nil {
+				return err
+			}
+			got -= put
+		}
+	}
+	return nil
+}
+
+func (s *splicer) close() {
+	syscall.Close(s.r)
+	syscall.Close(s.w)
+}
@@ -0,0 +1,431 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"time"
+)
+
+// Magic number of current statefile format. Version 3 has Merkle tree
+// without domain separation, version 2 has no tree, the oldest one has
+// no magic and no metadata at all.
+var (
+	StateMagic   = []byte("SYNCERS4")
+	StateMagicV3 = []byte("SYNCERS3")
+	StateMagicV2 = []byte("SYNCERS2")
+)
+
+const StateVersion = 4
+
+// Maximal length of statefile's META.
+const StateMetaMax = 1 << 20
+
+var (
+	ErrStateInvalid   = errors.New("Invalid statefile")
+	ErrStateCorrupted = errors.New("Corrupted statefile")
+)
+
+// Statefile contents: source size, block size, metadata, hashes of all
+// blocks and Merkle tree over them.
+type State struct {
+	// Format version the state was read in
+	Version int
+
+	// Statefile is zstd compressed
+	Compressed bool
+
+	Size   int64
+	Bs     int64
+	Meta   StateMeta
+	Hashes []byte
+	Tree   Tree
+
+	// Number of the run which found each block changed and how many
+	// times it was changed, if tracked
+	Changes []uint32
+	Counts  []uint32
+
+	// CRC32C of each block, if the pre-filter is used
+	CRCs []uint32
+
+	// Hashes of sub-blocks of recently changed blocks, nil for others,
+	// and the run each block was changed last, if sub-blocks are kept
+	Subs    [][]byte
+	SubRuns []uint32
+
+	hash *Hasher
+}
+
+// Additional information about the run that produced the state.
+type StateMeta struct {
+	// Source and destination (or store) paths
+	Src string `json:",omitempty"`
+	Dst string `json:",omitempty"`
+
+	// Source disk's model and serial number, if known
+	Serial string `json:",omitempty"`
+
+	// When the run started and how many blocks it found changed
+	Time    time.Time `json:",omitempty"`
+	Changed int64     `json:",omitempty"`
+
+	// Syncer's version and the number of runs, including that one
+	Syncer string `json:",omitempty"`
+	Runs   int64  `json:",omitempty"`
+
+	// Statefile has got per-block changes run numbers and counters,
+	// tracked since that run
+	Tracked      bool  `json:",omitempty"`
+	Counted      bool  `json:",omitempty"`
+	TrackedSince int64 `json:",omitempty"`
+
+	// Statefile has got per-block CRC32C
+	CRC bool `json:",omitempty"`
+
+	// Statefile has got hashes of non-zero blocks only, without TREE
+	Sparse bool `json:",omitempty"`
+
+	// Number of sub-blocks of each block whose hashes statefile has got
+	SubBlocks int `json:",omitempty"`
+
+	// Snapshot of the source the data was read from
+	Snapshot string `json:",omitempty"`
+
+	// dm-era's era started just before the source was read
+	Era uint64 `json:",omitempty"`
+
+	// Hexadecimal Merkle tree root: whole source digest
+	Digest string `json:",omitempty"`
+
+	// Block hash algorithm
+	Hash string `json:",omitempty"`
+
+	// The last runs, estimating the next one
+	History []RunRecord `json:",omitempty"`
+}
+
+func NewState(size, bs int64, hash *Hasher) *State {
+	st := &State{Version: StateVersion, Size: size, Bs: bs, hash: hash}
+	st.Meta.Hash = hash.Name
+	st.Hashes = make([]byte, int64(hash.Size)*st.Blocks())
+	return st
+}
+
+// Block hash algorithm of the state.
+func (st *State) Hasher() *Hasher {
+	return st.hash
+}
+
+func (st *State) Blocks() int64 {
+	blocks := st.Size / st.Bs
+	if st.Size%st.Bs != 0 {
+		blocks++
+	}
+	return blocks
+}
+
+// Hash of i-th block. Returned slice refers to the state itself.
+func (st *State) Hash(i int64) []byte {
+	size := int64(st.hash.Size)
+	return st.Hashes[i*size : i*size+size]
+}
+
+// Read statefile's header and metadata only, leaving the hashes unread.
+func ReadStateHeader(r io.Reader) (*State, error) {
+	r, compressed, done, err := stateReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	st, err := readStateHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	st.Compressed = compressed
+	return st, nil
+}
+
+func readStateHeader(r io.Reader) (*State, error) {
+	tmp := make([]byte, 16)
+	if _, err := io.ReadFull(r, tmp[:8]); err != nil {
+		return nil, ErrStateInvalid
+	}
+	version := 1
+	if bytes.Equal(tmp[:8], StateMagic) {
+		version = StateVersion
+	} else if bytes.Equal(tmp[:8], StateMagicV3) {
+		version = 3
+	} else if bytes.Equal(tmp[:8], StateMagicV2) {
+		version = 2
+	}
+	if version > 1 {
+		if _, err := io.ReadFull(r, tmp[:8]); err != nil {
+			return nil, ErrStateInvalid
+		}
+	}
+	if _, err := io.ReadFull(r, tmp[8:]); err != nil {
+		return nil, ErrStateInvalid
+	}
+	st := &State{
+		Version: version,
+		Size:    int64(binary.BigEndian.Uint64(tmp[:8])),
+		Bs:      int64(binary.BigEndian.Uint64(tmp[8:])),
+	}
+	if st.Size < 0 || st.Bs <= 0 {
+		return nil, ErrStateInvalid
+	}
+	if version > 1 {
+		if _, err := io.ReadFull(r, tmp[:4]); err != nil {
+			return nil, ErrStateInvalid
+		}
+		n := binary.BigEndian.Uint32(tmp[:4])
+		if n > StateMetaMax {
+			return nil, ErrStateInvalid
+		}
+		raw, err := readBounded(r, int64(n))
+		if err != nil {
+			return nil, ErrStateInvalid
+		}
+		if err := json.Unmarshal(raw, &st.Meta); err != nil {
+			return nil, ErrStateInvalid
+		}
+	}
+	var err error
+	if st.hash, err = LookupHash(st.Meta.Hash); err != nil {
+		return nil, err
+	}
+	st.Meta.Hash = st.hash.Name
+	if st.Blocks() > math.MaxInt/int64(st.hash.Size) {
+		return nil, ErrStateInvalid
+	}
+	if checkSubBlocks(st.Bs, st.Meta.SubBlocks) != nil {
+		return nil, ErrStateInvalid
+	}
+	return st, nil
+}
+
+// Read exactly n bytes, growing the buffer only as they arrive, so
+// forged sizes can not make us allocate more than was actually sent.
+func readBounded(r io.Reader, n int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, n))
+	if err == nil && int64(len(data)) != n {
+		err = io.ErrUnexpectedEOF
+	}
+	return data, err
+}
+
+func ReadState(r io.Reader) (*State, error) {
+	r, compressed, done, err := stateReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	st, err := readStateHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	st.Compressed = compressed
+	hash := st.hash
+	if st.Meta.Sparse {
+		if err := st.readSparse(r); err != nil {
+			return nil, ErrStateCorrupted
+		}
+	} else if st.Hashes, err = readBounded(r, int64(hash.Size)*st.Blocks()); err != nil {
+		return nil, ErrStateCorrupted
+	}
+	if st.Version < 3 {
+		st.Tree = BuildTree(st.Hashes, hash)
+		return st, nil
+	}
+	if st.Meta.Sparse {
+		st.Tree = BuildTree(st.Hashes, hash)
+	} else {
+		for _, n := range treeSizes(st.Blocks()) {
+			level, err := readBounded(r, n*int64(hash.Size))
+			if err != nil {
+				return nil, ErrStateCorrupted
+			}
+			st.Tree = append(st.Tree, level)
+		}
+	}
+	// Version 3 tree and digest are hashed without domain separation
+	if st.Version < StateVersion {
+		st.Tree = BuildTree(st.Hashes, hash)
+		st.Meta.Digest = hex.EncodeToString(st.Root())
+	}
+	if st.Meta.Tracked {
+		st.Changes = make([]uint32, st.Blocks())
+		if err := binary.Read(r, binary.BigEndian, st.Changes); err != nil {
+			return nil, ErrStateCorrupted
+		}
+	}
+	if st.Meta.Counted {
+		st.Counts = make([]uint32, st.Blocks())
+		if err := binary.Read(r, binary.BigEndian, st.Counts); err != nil {
+			return nil, ErrStateCorrupted
+		}
+	}
+	if st.Meta.CRC {
+		st.CRCs = make([]uint32, st.Blocks())
+		if err := binary.Read(r, binary.BigEndian, st.CRCs); err != nil {
+			return nil, ErrStateCorrupted
+		}
+	}
+	if st.Meta.SubBlocks > 0 {
+		if err := st.readSubs(r); err != nil {
+			return nil, ErrStateCorrupted
+		}
+	}
+	return st, nil
+}
+
+// Read statefile, verifying its signature if the key is specified and
+// decrypting it if it is encrypted.
+func ReadStateFile(path string, secret *StateSecret, signKey ed25519.PrivateKey) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if signKey != nil {
+		if err = verifyState(signKey, path, data); err != nil {
+			return nil, fmt.Errorf("Unable to verify signature: %w", err)
+		}
+	}
+	if data, err = secret.Decrypt(data); err != nil {
+		return nil, fmt.Errorf("Unable to decrypt: %w", err)
+	}
+	return ReadState(bytes.NewReader(data))
+}
+
+// Read statefile's header only. Encrypted statefile has to be decrypted
+// entirely for that.
+func ReadStateFileHeader(path string, secret *StateSecret) (*State, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	magic := make([]byte, len(StateCryptMagic))
+	if _, err = io.ReadFull(fd, magic); err != nil {
+		return nil, ErrStateInvalid
+	}
+	if !bytes.Equal(magic, StateCryptMagic) {
+		return ReadStateHeader(io.MultiReader(bytes.NewReader(magic), fd))
+	}
+	data, err := ioutil.ReadAll(io.MultiReader(bytes.NewReader(magic), fd))
+	if err != nil {
+		return nil, err
+	}
+	if data, err = secret.Decrypt(data); err != nil {
+		return nil, fmt.Errorf("Unable to decrypt: %w", err)
+	}
+	return ReadStateHeader(bytes.NewReader(data))
+}
+
+// Statefile contents, compressed if it has to be, and encrypted if
+// secret is not empty.
+func (st *State) Encode(secret *StateSecret) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := st.Write(&buf); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	if st.Compressed {
+		var err error
+		if data, err = compressState(data); err != nil {
+			return nil, err
+		}
+	}
+	if secret.IsZero() {
+		return data, nil
+	}
+	return secret.Encrypt(data)
+}
+
+// Write the state, rebuilding its Merkle tree and digest over the
+// current hashes.
+func (st *State) Write(w io.Writer) error {
+	st.Tree = BuildTree(st.Hashes, st.hash)
+	st.Meta.Digest = hex.EncodeToString(st.Root())
+	st.Meta.Tracked = st.Changes != nil
+	st.Meta.Counted = st.Counts != nil
+	st.Meta.CRC = st.CRCs != nil
+	if st.Subs == nil {
+		st.Meta.SubBlocks = 0
+	}
+	meta, err := json.Marshal(&st.Meta)
+	if err != nil {
+		return err
+	}
+	tmp := make([]byte, 8+8+8+4)
+	copy(tmp, StateMagic)
+	binary.BigEndian.PutUint64(tmp[8:], uint64(st.Size))
+	binary.BigEndian.PutUint64(tmp[16:], uint64(st.Bs))
+	binary.BigEndian.PutUint32(tmp[24:], uint32(len(meta)))
+	if _, err = w.Write(tmp); err != nil {
+		return err
+	}
+	if _, err = w.Write(meta); err != nil {
+		return err
+	}
+	if st.Meta.Sparse {
+		if err = st.writeSparse(w); err != nil {
+			return err
+		}
+	} else {
+		if _, err = w.Write(st.Hashes); err != nil {
+			return err
+		}
+		for _, level := range st.Tree {
+			if _, err = w.Write(level); err != nil {
+				return err
+			}
+		}
+	}
+	if st.Changes != nil {
+		if err = binary.Write(w, binary.BigEndian, st.Changes); err != nil {
+			return err
+		}
+	}
+	if st.Counts != nil {
+		if err = binary.Write(w, binary.BigEndian, st.Counts); err != nil {
+			return err
+		}
+	}
+	if st.CRCs != nil {
+		if err = binary.Write(w, binary.BigEndian, st.CRCs); err != nil {
+			return err
+		}
+	}
+	if st.Subs != nil {
+		err = st.writeSubs(w)
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// State of size bytes with 4 KiB blocks and random hashes, every third
+// block being zero.
+func randomState(t *testing.T, size int64) *State {
+	t.Helper()
+	hash, err := LookupHash("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := NewState(size, 4096, hash)
+	rand.Read(st.Hashes)
+	for i := int64(0); i < st.Blocks(); i += 3 {
+		copy(st.Hash(i), st.zeroHash(st.blockLen(i)))
+	}
+	st.Meta.Src, st.Meta.Runs = "/dev/ada0", 7
+	st.Meta.Time = time.Unix(1700000000, 0).UTC()
+	return st
+}
+
+// Every optional part of the statefile survives its writing and reading.
+func TestStateRoundTrip(t *testing.T) {
+	for name, prepare := range map[string]func(st *State, s *StateSecret){
+		"plain":      func(st *State, s *StateSecret) {},
+		"compressed": func(st *State, s *StateSecret) { st.Compressed = true },
+		"sparse":     func(st *State, s *StateSecret) { st.Meta.Sparse = true },
+		"tracked": func(st *State, s *StateSecret) {
+			st.Changes = make([]uint32, st.Blocks())
+			st.Counts = make([]uint32, st.Blocks())
+			st.CRCs = make([]uint32, st.Blocks())
+			for i := range st.Changes {
+				st.Changes[i], st.Counts[i], st.CRCs[i] = rand.Uint32(), rand.Uint32(), rand.Uint32()
+			}
+		},
+		"subblocks": func(st *State, s *StateSecret) {
+			st.Meta.SubBlocks = 4
+			st.Subs = make([][]byte, st.Blocks())
+			st.SubRuns = make([]uint32, st.Blocks())
+			st.Subs[1] = make([]byte, 4*SubHashSize)
+			rand.Read(st.Subs[1])
+			st.SubRuns[1] = 5
+		},
+		"key":        func(st *State, s *StateSecret) { s.Key = bytes.Repeat([]byte{7}, 32) },
+		"passphrase": func(st *State, s *StateSecret) { s.Passphrase = "secret" },
+	} {
+		st := randomState(t, 100*4096+123)
+		secret := &StateSecret{}
+		prepare(st, secret)
+		data, err := st.Encode(secret)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		path := filepath.Join(t.TempDir(), "state")
+		if err = ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(name, err)
+		}
+		got, err := ReadStateFile(path, secret, nil)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		got.hash = st.hash
+		if !reflect.DeepEqual(got, st) {
+			t.Fatalf("%s: state differs after reading", name)
+		}
+		header, err := ReadStateFileHeader(path, secret)
+		if err != nil || header.Size != st.Size || header.Bs != st.Bs || header.Meta.Digest != st.Meta.Digest {
+			t.Fatalf("%s: header differs: %v", name, err)
+		}
+		if _, err = ReadState(bytes.NewReader(data[:len(data)-1])); err == nil && secret.IsZero() && !st.Compressed {
+			t.Fatalf("%s: truncated statefile is read", name)
+		}
+	}
+}
+
+// Encrypted statefile is not read without the right secret.
+func TestStateWrongSecret(t *testing.T) {
+	st := randomState(t, 10*4096)
+	data, err := st.Encode(&StateSecret{Passphrase: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "state")
+	ioutil.WriteFile(path, data, 0600)
+	if _, err = ReadStateFile(path, &StateSecret{Passphrase: "other"}, nil); err == nil {
+		t.Fatal("statefile is decrypted with wrong passphrase")
+	}
+	if _, err = ReadStateFile(path, &StateSecret{}, nil); err == nil {
+		t.Fatal("encrypted statefile is read without secret")
+	}
+}
+
+// Forged header fails reading without allocating what it claims.
+func TestStateForged(t *testing.T) {
+	header := func(size, bs uint64, metaLen uint32, meta string) []byte {
+		data := make([]byte, 8+8+8+4)
+		copy(data, StateMagic)
+		binary.BigEndian.PutUint64(data[8:], size)
+		binary.BigEndian.PutUint64(data[16:], bs)
+		binary.BigEndian.PutUint32(data[24:], metaLen)
+		return append(data, meta...)
+	}
+	for name, data := range map[string][]byte{
+		"zero blocksize": header(4096, 0, 2, "{}"),
+		"negative size":  header(1<<63, 4096, 2, "{}"),
+		"overflow":       header(1<<62, 1, 2, "{}"),
+		"huge meta":      header(4096, 4096, 1<<31, "{}"),
+		"huge hashes":    header(1<<50, 1, 2, "{}"),
+		"subblocks":      header(4096, 4096, 17, `{"SubBlocks":3}`),
+	} {
+		if _, err := ReadState(bytes.NewReader(data)); err == nil {
+			t.Fatalf("%s: forged statefile is read", name)
+		}
+	}
+}
+
+// Run after the crash tearing the statefile update does not trust it.
+func TestStateCrashRecovery(t *testing.T) {
+	j := testJob(t, 1<<20)
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(j.State)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = beginStateUpdate(j.State, append(data, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(j.State, data[:len(data)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.OpenFile(j.Src, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte("changed"), 300000)
+	fd.Close()
+	if err = j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sameFiles(t, j.Src, j.Dst)
+	if j.Stats.Written != 1<<20 {
+		t.Fatalf("%d bytes written instead of everything", j.Stats.Written)
+	}
+	if _, err = os.Stat(j.State + ".torn"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(walPath(j.State)); !os.IsNotExist(err) {
+		t.Fatal("journal is left")
+	}
+	if _, err = ReadStateFile(j.State, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,361 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Statefile inspection and manipulation subcommands.
+func stateCmd(args []string) {
+	if len(args) == 0 {
+		log.Fatalln("Usage: syncer state diff|dump|convert|migrate|changed|pubkey [options] STATE...")
+	}
+	switch args[0] {
+	case "changed":
+		stateChanged(args[1:])
+	case "migrate":
+		stateMigrate(args[1:])
+	case "convert":
+		stateConvert(args[1:])
+	case "diff":
+		stateDiff(args[1:])
+	case "dump":
+		stateDump(args[1:])
+	case "pubkey":
+		statePubkey(args[1:])
+	default:
+		log.Fatalln("Unknown state command:", args[0])
+	}
+}
+
+// Options needed to read and write encrypted or signed statefiles.
+type stateOpts struct {
+	key  *string
+	pass *string
+	sign *string
+}
+
+func addStateFlags(fs *flag.FlagSet) *stateOpts {
+	return &stateOpts{
+		key:  fs.String("state-key", "", "Path to key file encrypting the statefile"),
+		pass: fs.String("state-passphrase", "", "Passphrase encrypting the statefile"),
+		sign: fs.String("sign-key", "", "Path to Ed25519 key seed signing the statefile"),
+	}
+}
+
+func (o *stateOpts) secrets() (*StateSecret, ed25519.PrivateKey) {
+	secret, signKey, err := stateSecrets(*o.key, *o.pass, *o.sign)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return secret, signKey
+}
+
+func (o *stateOpts) Read(path string) *State {
+	secret, signKey := o.secrets()
+	if _, err := recoverStateUpdate(path, signKey); err != nil {
+		log.Fatalln("Unable to recover statefile update:", err)
+	}
+	st, err := ReadStateFile(path, secret, signKey)
+	if err != nil {
+		log.Fatalln("Unable to read statefile", path+":", err)
+	}
+	return st
+}
+
+// Atomically save the statefile.
+func (o *stateOpts) Write(path string, st *State) {
+	secret, signKey := o.secrets()
+	data, err := st.Encode(secret)
+	if err != nil {
+		log.Fatalln("Unable to encode statefile:", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "syncer")
+	if err != nil {
+		log.Fatalln("Unable to create temporary file:", err)
+	}
+	if err = beginStateUpdate(path, data); err != nil {
+		os.Remove(tmp.Name())
+		log.Fatalln("Unable to journal statefile update:", err)
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Fatalln("Unable to write statefile:", err)
+	}
+	tmp.Close()
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		log.Fatalln("Unable to write statefile:", err)
+	}
+	if signKey != nil {
+		if err = signState(signKey, path, data); err != nil {
+			log.Fatalln("Unable to sign statefile:", err)
+		}
+	}
+	if err = endStateUpdate(path); err != nil {
+		log.Fatalln("Unable to remove statefile journal:", err)
+	}
+}
+
+// Range of block indexes, inclusive.
+type BlockRange struct {
+	First int64
+	Last  int64
+}
+
+// Join sorted block indexes to ranges.
+func blockRanges(blocks []int64) []BlockRange {
+	ranges := []BlockRange{}
+	for _, i := range blocks {
+		if n := len(ranges); n > 0 && ranges[n-1].Last+1 == i {
+			ranges[n-1].Last = i
+			continue
+		}
+		ranges = append(ranges, BlockRange{i, i})
+	}
+	return ranges
+}
+
+// Report blocks differing between two statefiles.
+func stateDiff(args []string) {
+	fs := flag.NewFlagSet("state diff", flag.ExitOnError)
+	opts := addStateFlags(fs)
+	asJSON := fs.Bool("json", false, "Output in JSON")
+	parseFlags(fs, args)
+	if fs.NArg() != 2 {
+		log.Fatalln("Usage: syncer state diff [options] OLD NEW")
+	}
+	st := opts.Read(fs.Arg(1))
+	changed, err := opts.Read(fs.Arg(0)).Diff(st)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	printBlocks(st, changed, "differ", *asJSON)
+}
+
+// Print blocks as ranges, or JSON object with them.
+func printBlocks(st *State, blocks []int64, what string, asJSON bool) {
+	out := struct {
+		Blocks  int64
+		Bs      int64
+		Changed int
+		Ranges  []BlockRange
+	}{st.Blocks(), st.Bs, len(blocks), blockRanges(blocks)}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(&out); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	fmt.Printf("%d of %d %d byte blocks %s\n", out.Changed, out.Blocks, out.Bs, what)
+	for _, r := range out.Ranges {
+		if r.First == r.Last {
+			fmt.Println(r.First)
+		} else {
+			fmt.Printf("%d-%d\n", r.First, r.Last)
+		}
+	}
+}
+
+// Print statefile's header fields and metadata, optionally with hashes
+// of all blocks.
+func stateDump(args []string) {
+	fs := flag.NewFlagSet("state dump", flag.ExitOnError)
+	opts := addStateFlags(fs)
+	asJSON := fs.Bool("json", false, "Output in JSON")
+	withHashes := fs.Bool("hashes", false, "Include blocks hashes")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		log.Fatalln("Usage: syncer state dump [options] STATE")
+	}
+	st := opts.Read(fs.Arg(0))
+	dump := struct {
+		Version int
+		Size    int64
+		Bs      int64
+		Blocks  int64
+		Meta    StateMeta
+		Hashes  []string `json:",omitempty"`
+	}{Version: st.Version, Size: st.Size, Bs: st.Bs, Blocks: st.Blocks(), Meta: st.Meta}
+	if *withHashes {
+		dump.Hashes = make([]string, 0, dump.Blocks)
+		for i := int64(0); i < dump.Blocks; i++ {
+			dump.Hashes = append(dump.Hashes, hex.EncodeToString(st.Hash(i)))
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(&dump); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	fmt.Println("Version:", dump.Version)
+	fmt.Println("Size:", dump.Size)
+	fmt.Println("Blocksize:", dump.Bs)
+	fmt.Println("Blocks:", dump.Blocks)
+
+	// Metadata fields are printed in name order
+	raw, _ := json.Marshal(&dump.Meta)
+	var meta map[string]interface{}
+	json.Unmarshal(raw, &meta)
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%s: %v\n", k, meta[k])
+	}
+	for i, h := range dump.Hashes {
+		fmt.Println(i, h)
+	}
+}
+
+// Convert statefile to another blocksize.
+func stateConvert(args []string) {
+	fs := flag.NewFlagSet("state convert", flag.ExitOnError)
+	opts := addStateFlags(fs)
+	blk := fs.Int64("blk", DefaultBlk, "New block size (KiB)")
+	parseFlags(fs, args)
+	if fs.NArg() != 2 {
+		log.Fatalln("Usage: syncer state convert -blk N [options] OLD NEW")
+	}
+	st, unknown := opts.Read(fs.Arg(0)).Convert(*blk * int64(1<<10))
+	opts.Write(fs.Arg(1), st)
+	log.Println(
+		st.Blocks(), st.Bs, "byte blocks,",
+		st.Blocks()-unknown, "converted,", unknown, "marked as changed",
+	)
+}
+
+// Read the source once, verifying it against the old statefile and
+// producing the new one with another hash algorithm. Blocks differing
+// from the old statefile are marked as changed in the new one, because
+// destination has not got them yet.
+func stateMigrate(args []string) {
+	fs := flag.NewFlagSet("state migrate", flag.ExitOnError)
+	opts := addStateFlags(fs)
+	srcPath := fs.String("src", "", "Path to source disk")
+	hashName := fs.String("hash", DefaultHash, "New block hash algorithm")
+	parseFlags(fs, args)
+	if fs.NArg() != 2 || *srcPath == "" {
+		log.Fatalln("Usage: syncer state migrate -src SRC -hash NAME [options] OLD NEW")
+	}
+	hash, err := LookupHash(*hashName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	old := opts.Read(fs.Arg(0))
+	src, err := os.Open(*srcPath)
+	if err != nil {
+		log.Fatalln("Unable to open src:", err)
+	}
+	defer src.Close()
+	size, err := srcSize(src)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if size != old.Size {
+		log.Fatalf("Size differs with state file: %d instead of %d\n", old.Size, size)
+	}
+
+	st := NewState(old.Size, old.Bs, hash)
+	st.Meta = old.Meta
+	st.Meta.Hash = hash.Name
+	st.Changes, st.Counts = old.Changes, old.Counts
+	buf := make([]byte, old.Bs)
+	var changed int64
+	prn("[")
+	for i := int64(0); i < st.Blocks(); i++ {
+		data := buf[:old.blockLen(i)]
+		if _, err = src.ReadAt(data, i*old.Bs); err != nil {
+			log.Fatalln("Error during src read:", err)
+		}
+		if bytes.Equal(old.Hasher().Sum(data), old.Hash(i)) {
+			copy(st.Hash(i), hash.Sum(data))
+			prn(".")
+		} else {
+			changed++
+			prn("%")
+		}
+	}
+	prn("]\n")
+	opts.Write(fs.Arg(1), st)
+	log.Println(
+		st.Blocks(), "blocks verified,", changed,
+		"differ from old statefile and are marked as changed",
+	)
+}
+
+// Report blocks changed during the last runs, if statefile tracks that.
+func stateChanged(args []string) {
+	fs := flag.NewFlagSet("state changed", flag.ExitOnError)
+	opts := addStateFlags(fs)
+	last := fs.Int64("last", 1, "Number of the last runs")
+	asJSON := fs.Bool("json", false, "Output in JSON")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		log.Fatalln("Usage: syncer state changed -last N [options] STATE")
+	}
+	st := opts.Read(fs.Arg(0))
+	if st.Changes == nil {
+		log.Fatalln("Statefile does not track changes")
+	}
+	var blocks []int64
+	for i, run := range st.Changes {
+		if run != 0 && int64(run) > st.Meta.Runs-*last {
+			blocks = append(blocks, int64(i))
+		}
+	}
+	printBlocks(st, blocks, "changed during the last "+strconv.FormatInt(*last, 10)+" runs", *asJSON)
+}
+
+// Print public key of the sign key, as listed in server's -receiver-keys.
+func statePubkey(args []string) {
+	fs := flag.NewFlagSet("state pubkey", flag.ExitOnError)
+	signKey := fs.String("sign-key", "", "Path to Ed25519 private key seed")
+	parseFlags(fs, args)
+	if *signKey == "" || fs.NArg() != 0 {
+		log.Fatalln("Usage: syncer state pubkey -sign-key FILE")
+	}
+	key, err := ReadSignKey(*signKey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(hex.EncodeToString(key.Public().(ed25519.PublicKey)))
+}
@@ -0,0 +1,103 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestBlockRanges(t *testing.T) {
+	for _, c := range []struct {
+		blocks []int64
+		want   []BlockRange
+	}{
+		{nil, []BlockRange{}},
+		{[]int64{5}, []BlockRange{{5, 5}}},
+		{[]int64{0, 1, 2, 4, 7, 8}, []BlockRange{{0, 2}, {4, 4}, {7, 8}}},
+	} {
+		if got := blockRanges(c.blocks); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: %v instead of %v", c.blocks, got, c.want)
+		}
+	}
+}
+
+// States of different geometry or hash algorithms are not compared.
+func TestStateDiffMismatch(t *testing.T) {
+	st := randomState(t, 100*4096)
+	other := randomState(t, 101*4096)
+	if _, err := st.Diff(other); err != ErrStateMismatch {
+		t.Fatal("States of different size are compared:", err)
+	}
+	sha, err := LookupHash(HashSHA512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other = NewState(st.Size, st.Bs, sha)
+	if _, err = st.Diff(other); err != ErrStateHash {
+		t.Fatal("States of different hashes are compared:", err)
+	}
+}
+
+// State of the data with that blocksize.
+func stateOf(t *testing.T, data []byte, bs int64) *State {
+	t.Helper()
+	hash, err := LookupHash("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := NewState(int64(len(data)), bs, hash)
+	for i := int64(0); i < st.Blocks(); i++ {
+		copy(st.Hash(i), hash.Sum(data[i*bs:i*bs+st.blockLen(i)]))
+	}
+	return st
+}
+
+// Converted state keeps only hashes it can know, all of them right.
+func TestStateConvert(t *testing.T) {
+	data := make([]byte, 100*4096+1000)
+	for i := 0; i < len(data); i += 4096 {
+		if i/4096%3 != 0 {
+			rand.Read(data[i:min(i+4096, len(data))])
+		}
+	}
+	st := stateOf(t, data, 4096)
+	st.Changes, st.Counts = make([]uint32, st.Blocks()), make([]uint32, st.Blocks())
+	st.Changes[4], st.Counts[5] = 7, 3
+	for _, bs := range []int64{4096, 2048, 8192, 12288} {
+		conv, unknown := st.Convert(bs)
+		want := stateOf(t, data, bs)
+		var zeroed int64
+		for i := int64(0); i < conv.Blocks(); i++ {
+			if bytes.Equal(conv.Hash(i), make([]byte, st.hash.Size)) {
+				zeroed++
+			} else if !bytes.Equal(conv.Hash(i), want.Hash(i)) {
+				t.Fatalf("%d: block %d has wrong hash", bs, i)
+			}
+		}
+		if zeroed != unknown || bs == 4096 && unknown != 0 || bs != 4096 && unknown == 0 {
+			t.Fatalf("%d: %d blocks unknown, %d zeroed", bs, unknown, zeroed)
+		}
+		if i := 4 * 4096 / bs; conv.Changes[i] != 7 || conv.Counts[5*4096/bs] != 3 {
+			t.Fatalf("%d: changes are not kept", bs)
+		}
+	}
+}
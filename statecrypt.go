@@ -0,0 +1,148 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Magic number of encrypted statefile: MAGIC || KDF || SALT || NONCE ||
+// CIPHERTEXT, where header before ciphertext is authenticated too.
+var StateCryptMagic = []byte("SYNCERSE")
+
+const (
+	StateKDFKey        = 0
+	StateKDFPassphrase = 1
+	StateSaltSize      = 16
+)
+
+var ErrStateKey = errors.New("Statefile is encrypted, key is required")
+
+// Read statefile's encryption secret and signing key, if their paths are
+// specified.
+func stateSecrets(keyPath, passphrase, signKeyPath string) (*StateSecret, ed25519.PrivateKey, error) {
+	secret := &StateSecret{Passphrase: passphrase}
+	if keyPath != "" && passphrase != "" {
+		return nil, nil, errors.New("Either state key or passphrase can be used")
+	}
+	var err error
+	if keyPath != "" {
+		if secret.Key, err = ReadKey(keyPath); err != nil {
+			return nil, nil, fmt.Errorf("Unable to read state key: %w", err)
+		}
+	}
+	var signKey ed25519.PrivateKey
+	if signKeyPath != "" {
+		if signKey, err = ReadSignKey(signKeyPath); err != nil {
+			return nil, nil, fmt.Errorf("Unable to read sign key: %w", err)
+		}
+	}
+	return secret, signKey, nil
+}
+
+// Either key or passphrase encrypting the statefile.
+type StateSecret struct {
+	Key        []byte
+	Passphrase string
+}
+
+func (s *StateSecret) IsZero() bool {
+	return s.Key == nil && s.Passphrase == ""
+}
+
+// Key derived from passphrase with Argon2id and the salt, or the
+// state's subkey.
+func (s *StateSecret) derive(kdf byte, salt []byte) ([]byte, error) {
+	switch kdf {
+	case StateKDFKey:
+		if s.Key == nil {
+			return nil, errors.New("Statefile requires key, not passphrase")
+		}
+		return subKey(s.Key, "state"), nil
+	case StateKDFPassphrase:
+		if s.Passphrase == "" {
+			return nil, errors.New("Statefile requires passphrase, not key")
+		}
+		return argon2.IDKey([]byte(s.Passphrase), salt, 3, 64*1024, 4, KeySize), nil
+	}
+	return nil, ErrStateInvalid
+}
+
+func (s *StateSecret) Encrypt(data []byte) ([]byte, error) {
+	header := make([]byte, len(StateCryptMagic)+1+StateSaltSize+chacha20poly1305.NonceSizeX)
+	copy(header, StateCryptMagic)
+	kdf := byte(StateKDFKey)
+	if s.Key == nil {
+		kdf = StateKDFPassphrase
+	}
+	header[len(StateCryptMagic)] = kdf
+	if _, err := io.ReadFull(rand.Reader, header[len(StateCryptMagic)+1:]); err != nil {
+		return nil, err
+	}
+	salt := header[len(StateCryptMagic)+1 : len(StateCryptMagic)+1+StateSaltSize]
+	key, err := s.derive(kdf, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := header[len(header)-chacha20poly1305.NonceSizeX:]
+	return aead.Seal(header, nonce, data, header), nil
+}
+
+// Decrypt the statefile. Unencrypted one is returned as is, so it can be
+// encrypted during the next save.
+func (s *StateSecret) Decrypt(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, StateCryptMagic) {
+		return data, nil
+	}
+	if s.IsZero() {
+		return nil, ErrStateKey
+	}
+	headerLen := len(StateCryptMagic) + 1 + StateSaltSize + chacha20poly1305.NonceSizeX
+	if len(data) < headerLen {
+		return nil, ErrStateInvalid
+	}
+	header := data[:headerLen]
+	salt := header[len(StateCryptMagic)+1 : len(StateCryptMagic)+1+StateSaltSize]
+	key, err := s.derive(header[len(StateCryptMagic)], salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := header[headerLen-chacha20poly1305.NonceSizeX:]
+	plain, err := aead.Open(nil, nonce, data[headerLen:], header)
+	if err != nil {
+		return nil, ErrStateCorrupted
+	}
+	return plain, nil
+}
@@ -0,0 +1,82 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/dchest/blake2b"
+)
+
+// Absolute path with symbolic links resolved, so the same disk is
+// identified the same way independently of how it is specified. URLs
+// are kept as they are.
+func identity(path string) string {
+	if hasScheme(path) {
+		return path
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path
+}
+
+// Name of the statefile in the state directory: hash of source's and
+// destination's identities and the block size.
+func stateName(src, dst string, blk int64) string {
+	sum := blake2b.Sum256([]byte(
+		identity(src) + "\x00" + identity(dst) + "\x00" +
+			strconv.FormatInt(blk, 10),
+	))
+	return hex.EncodeToString(sum[:16]) + ".bin"
+}
+
+// Choose statefile in the state directory, if it is used, creating
+// the directory. Daemon's job is resolved again on each run.
+func (j *Job) resolveState() error {
+	if j.StateDir == "" {
+		return nil
+	}
+	state := j.dirState()
+	if j.State != "" && j.State != state {
+		return errors.New("Either state or state directory can be used")
+	}
+	if err := os.MkdirAll(j.StateDir, 0700); err != nil {
+		return fmt.Errorf("Unable to create state directory: %w", err)
+	}
+	j.State = state
+	return nil
+}
+
+// Path to the statefile in the state directory.
+func (j *Job) dirState() string {
+	dst := j.Dst
+	if j.Store != "" {
+		dst = j.Store
+	}
+	return filepath.Join(j.StateDir, stateName(j.Src, dst, j.Blk))
+}
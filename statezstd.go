@@ -0,0 +1,53 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstd frame's magic number compressed statefile begins with.
+var StateZstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Statefile's reader, decompressing it if it is compressed, and the
+// function releasing the decompressor.
+func stateReader(r io.Reader) (io.Reader, bool, func(), error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(StateZstdMagic))
+	if err != nil || !bytes.Equal(magic, StateZstdMagic) {
+		return br, false, func() {}, nil
+	}
+	dec, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, false, nil, err
+	}
+	return dec, true, dec.Close, nil
+}
+
+func compressState(data []byte) ([]byte, error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(data, nil), nil
+}
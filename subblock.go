@@ -0,0 +1,150 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Sub-block hashes are block hash algorithm's output truncated to that
+// size: they only narrow down writes of blocks already known changed.
+const SubHashSize = 16
+
+// Sub-block hashes are kept for blocks changed during that number of
+// the last runs: hot regions are subdivided, cold ones stay coarse.
+const SubBlocksKeep = 8
+
+func checkSubBlocks(bs int64, k int) error {
+	if k < 0 || (k > 0 && (bs%int64(k) != 0 || (bs/int64(k))%512 != 0)) {
+		return errors.New("Block size must be divisible into 512 byte aligned sub-blocks")
+	}
+	return nil
+}
+
+// Start keeping k sub-blocks, forgetting ones of blocks that became cold
+// by the run. All are forgotten if k differs with the state's.
+func (st *State) keepSubs(k int, run int64) {
+	if st.Subs == nil || st.Meta.SubBlocks != k {
+		st.Meta.SubBlocks = k
+		st.Subs = make([][]byte, st.Blocks())
+		st.SubRuns = make([]uint32, st.Blocks())
+		return
+	}
+	for i, subs := range st.Subs {
+		if subs != nil && run-int64(st.SubRuns[i]) >= SubBlocksKeep {
+			st.Subs[i] = nil
+		}
+	}
+}
+
+// Update sub-block hashes of block's data changed during the run,
+// returning extents (relative to the block) of sub-blocks that differ.
+// Block without them differs whole.
+func (st *State) updateSubs(i int64, data []byte, run int64) []Extent {
+	sub := int(st.Bs) / st.Meta.SubBlocks
+	if st.Subs[i] == nil {
+		st.Subs[i] = make([]byte, st.Meta.SubBlocks*SubHashSize)
+	}
+	st.SubRuns[i] = uint32(run)
+	var parts []Extent
+	for k := 0; k*sub < len(data); k++ {
+		end := min((k+1)*sub, len(data))
+		sum := st.hash.Sum(data[k*sub : end])[:SubHashSize]
+		if old := st.Subs[i][k*SubHashSize : (k+1)*SubHashSize]; !bytes.Equal(old, sum) {
+			copy(old, sum)
+			last := len(parts) - 1
+			if last >= 0 && parts[last].Offset+parts[last].Length == int64(k*sub) {
+				parts[last].Length += int64(end - k*sub)
+			} else {
+				parts = append(parts, Extent{int64(k * sub), int64(end - k*sub)})
+			}
+		}
+	}
+	return parts
+}
+
+// Sub-blocks are stored as bitmap of blocks having them, followed by
+// each one's last change run and hashes.
+func (st *State) readSubs(r io.Reader) error {
+	bitmap, err := readBounded(r, (st.Blocks()+7)/8)
+	if err != nil {
+		return err
+	}
+	st.Subs = make([][]byte, st.Blocks())
+	st.SubRuns = make([]uint32, st.Blocks())
+	var run [4]byte
+	for i := range st.Subs {
+		if bitmap[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		if _, err := io.ReadFull(r, run[:]); err != nil {
+			return err
+		}
+		st.SubRuns[i] = binary.BigEndian.Uint32(run[:])
+		st.Subs[i] = make([]byte, st.Meta.SubBlocks*SubHashSize)
+		if _, err := io.ReadFull(r, st.Subs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *State) writeSubs(w io.Writer) error {
+	bitmap := make([]byte, (st.Blocks()+7)/8)
+	for i, subs := range st.Subs {
+		if subs != nil {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	if _, err := w.Write(bitmap); err != nil {
+		return err
+	}
+	var run [4]byte
+	for i, subs := range st.Subs {
+		if subs == nil {
+			continue
+		}
+		binary.BigEndian.PutUint32(run[:], st.SubRuns[i])
+		if _, err := w.Write(run[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(subs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write changed block, only its differing parts if they are known.
+func writeParts(dst Image, event SyncEvent, bs int64) (written int, err error) {
+	if event.parts == nil {
+		return dst.WriteAt(event.data, event.i*bs)
+	}
+	for _, p := range event.parts {
+		n, err := dst.WriteAt(event.data[p.Offset:p.Offset+p.Length], event.i*bs+p.Offset)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,86 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Machine readable end-of-run document, archived by backup verification
+// tooling.
+type Summary struct {
+	*Notification
+	Finished time.Time      `json:"finished"`
+	Skipped  int64          `json:"skipped"` // blocks not read by change tracking
+	Errors   []string       `json:"errors,omitempty"`
+	Config   map[string]any `json:"config"`
+}
+
+// Job's configuration in terms of configuration file's keys, without
+// secrets and group's members.
+func (j *Job) config() map[string]any {
+	cfg := make(map[string]any)
+	v := reflect.ValueOf(j).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("toml")
+		if key == "" || key == "-" || key == "group" ||
+			strings.HasSuffix(key, "_password") || strings.HasSuffix(key, "_passphrase") {
+			continue
+		}
+		if f := v.Field(i); !f.IsZero() {
+			cfg[key] = f.Interface()
+		}
+	}
+	return cfg
+}
+
+// Messages of each error the run failed with.
+func errorList(err error) []string {
+	if err == nil {
+		return nil
+	}
+	var multi interface{ Unwrap() []error }
+	if !errors.As(err, &multi) {
+		return []string{err.Error()}
+	}
+	var list []string
+	for _, e := range multi.Unwrap() {
+		list = append(list, e.Error())
+	}
+	return list
+}
+
+func (j *Job) writeSummary(n *Notification, runErr error) error {
+	data, err := json.MarshalIndent(&Summary{
+		Notification: n,
+		Finished:     time.Now(),
+		Skipped:      j.Stats.Skipped,
+		Errors:       errorList(runErr),
+		Config:       j.config(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(j.SummaryJSON, append(data, '\n'), 0644)
+}
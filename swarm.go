@@ -0,0 +1,112 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// HTTP source whose blocks are fetched from peers already having them,
+// so the origin serves only blocks no peer has yet. Peers publish their
+// synced destination and its statefile the same way as the origin.
+type swarmSource struct {
+	origin *httpSource
+	remote *State
+	peers  []swarmPeer
+	next   atomic.Uint64
+
+	fromPeers  atomic.Int64
+	fromOrigin atomic.Int64
+	mismatched atomic.Int64
+}
+
+type swarmPeer struct {
+	src   *httpSource
+	state *State
+}
+
+// Open comma separated peers' URLs. Unreachable peers and ones with
+// different geometry are skipped.
+func (j *Job) openSwarm(origin *httpSource, remote *State) *swarmSource {
+	s := &swarmSource{origin: origin, remote: remote}
+	for _, url := range strings.Split(j.SrcPeers, ",") {
+		src, err := openHTTPSource(origin.client, url, origin.compress)
+		if err != nil {
+			j.log.Println("Skipping peer", url+":", err)
+			continue
+		}
+		st, err := fetchState(origin.client, url+".state")
+		if err != nil {
+			j.log.Println("Skipping peer", url+":", err)
+			src.Close()
+			continue
+		}
+		if src.size != remote.Size || st.Size != remote.Size ||
+			st.Bs != remote.Bs || st.Hasher() != remote.Hasher() {
+			j.log.Println("Skipping peer", url+": differs with src statefile")
+			src.Close()
+			continue
+		}
+		s.peers = append(s.peers, swarmPeer{src, st})
+	}
+	j.log.Println(len(s.peers), "peers")
+	return s
+}
+
+// Read block from one of peers having it, taking them in turn. Data is
+// checked against the origin's hash, falling back to the origin.
+func (s *swarmSource) ReadAt(p []byte, off int64) (int, error) {
+	i := off / s.remote.Bs
+	want := s.remote.Hash(i)
+	var having []*swarmPeer
+	for k := range s.peers {
+		if bytes.Equal(s.peers[k].state.Hash(i), want) {
+			having = append(having, &s.peers[k])
+		}
+	}
+	if len(having) > 0 {
+		peer := having[s.next.Add(1)%uint64(len(having))]
+		n, err := peer.src.ReadAt(p, off)
+		if (err == nil || err == io.EOF) && bytes.Equal(s.remote.Hasher().Sum(p[:n]), want) {
+			s.fromPeers.Add(1)
+			return n, err
+		}
+		s.mismatched.Add(1)
+	}
+	s.fromOrigin.Add(1)
+	return s.origin.ReadAt(p, off)
+}
+
+func (s *swarmSource) Close() error {
+	for _, peer := range s.peers {
+		peer.src.Close()
+	}
+	return nil
+}
+
+func (j *Job) swarmReport(s *swarmSource) {
+	j.log.Println(
+		"Blocks:", s.fromPeers.Load(), "from peers,",
+		s.fromOrigin.Load(), "from origin,",
+		s.mismatched.Load(), "failed peer fetches",
+	)
+}
@@ -20,190 +20,285 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"errors"
 	"flag"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
-	"runtime"
-
-	"github.com/dchest/blake2b"
 )
 
+// Version of syncer, set during the build with -ldflags "-X main.Version=V".
+var Version = "dev"
+
 var (
-	blkSize   = flag.Int64("blk", 2*1<<10, "Block size (KiB)")
-	statePath = flag.String("state", "state.bin", "Path to statefile")
-	dstPath   = flag.String("dst", "/dev/ada0", "Path to destination disk")
-	srcPath   = flag.String("src", "/dev/da0", "Path to source disk")
-)
+	blkSize     = flag.Int64("blk", DefaultBlk, "Block size (KiB)")
+	statePath   = flag.String("state", "state.bin", "Path to statefile")
+	stateDir    = flag.String("state-dir", "", "Directory with automatically named statefiles, used instead of state")
+	stateXattr  = flag.Bool("state-xattr", false, "Keep statefile (or its digest) in dst file's xattrs")
+	prealloc    = flag.Bool("preallocate", false, "Allocate the whole created dst file (mark it sparse on Windows)")
+	dstMode     = flag.String("dst-mode", "", "Octal mode of the created dst file, like 0640")
+	dstOwner    = flag.String("dst-owner", "", "Owner of the created dst file: user:group")
+	stateMode   = flag.String("state-mode", "", "Octal mode of the statefile, 0600 by default")
+	stateOwner  = flag.String("state-owner", "", "Owner of the statefile: user:group")
+	tmpDir      = flag.String("tmp-dir", "", "Directory of temporary statefile, statefile's one by default")
+	dstPath     = flag.String("dst", "/dev/ada0", "Path to destination disk")
+	dstFormat   = flag.String("dst-format", "", "Destination format: raw, qcow2, vhd, vhd-fixed, vhdx, vhdx-fixed, tar")
+	subBlocks   = flag.Int("sub-blocks", 0, "Keep hashes of that number of sub-blocks of each block, writing only changed ones")
+	deltaWrite  = flag.Bool("delta-write", false, "Write only differing pages of changed blocks")
+	sparseState = flag.Bool("sparse-state", false, "Store hashes of non-zero blocks only")
+	stateZstd   = flag.Bool("state-compress", false, "Compress the statefile with zstd")
+	assumeZero  = flag.Bool("assume-dst-zero", false, "Do not write zero blocks during the first run to zero-filled dst")
+	full        = flag.Bool("full", false, "Write every block regardless of the state, still updating it")
+	reseed      = flag.Bool("reseed", false, "Resync from scratch, accepted by server tracking receivers")
+	shred       = flag.Bool("shred", false, "Overwrite dst blocks with random data before writing new content")
+	wipeDst     = flag.Bool("wipe-tail", false, "Truncate or zero dst beyond the source size")
+	dstTrans    = flag.String("dst-transform", "", "Transform data written to dst: aes-xts:KEYFILE, comma separated")
+	srcPath     = flag.String("src", "/dev/da0", "Path to source disk, or its http(s) URL")
+	srcState    = flag.String("src-state", "", "URL of HTTP source's statefile, src.state by default")
+	srcPeers    = flag.String("src-peers", "", "Comma separated URLs of peers to fetch HTTP source's blocks from")
+	srcZstd     = flag.String("src-compress", "", "zstd level asked from HTTP source: fastest, default, better, best, none")
+	reuseMoved  = flag.Bool("reuse-moved", false, "Copy HTTP source's blocks found elsewhere in dst instead of fetching")
+	quic        = flag.Bool("quic", false, "Fetch HTTP source over QUIC")
+	transport   = flag.String("transport", "", "Connect to HTTP source through unix:PATH socket or ssh:DEST tunnel")
+	hashName    = flag.String("hash", "", "Block hash algorithm of new statefile: blake2b-512, blake2b-256, sha512, sha256")
+	workers     = flag.Int("workers", 0, "Number of hashing workers, all CPUs if 0")
+	cpuList     = flag.String("cpus", "", "Pin to CPUs, like 0-7,16-23")
+	numaSel     = flag.String("numa-node", "", "Allocate buffers on NUMA node, auto for source's one")
+	hugePages   = flag.String("huge-pages", "", "Back block buffers with huge pages: thp, hugetlb")
+	readahead   = flag.Int("readahead", 0, "Number of blocks read ahead of hashing")
+	memory      = flag.String("memory", "", "Limit memory of block buffers, like 2G")
+	readers     = flag.Int("readers", 0, "Number of source's regions read concurrently")
+	zeroCopy    = flag.Bool("zero-copy", false, "Splice changed blocks from src to dst inside the kernel")
+	dirtyLimit  = flag.String("dirty-limit", "", "Sync dst after that size of written data, like 256M")
+	writeBehd   = flag.String("write-behind", "", "Queue up to that size of changed blocks to write in background, like 1G")
+	trackChgs   = flag.Bool("track-changes", false, "Keep the number of the last run changed each block")
+	crcFilter   = flag.Bool("crc", false, "Hash only blocks whose CRC32C differs")
+	verifySmpl  = flag.String("verify-sample", "", "Percentage of unchanged blocks to verify in dst, like 1%")
+	paranoid    = flag.String("paranoid", "", "Check dst blocks before overwriting, if modified: log, abort")
+	exitChange  = flag.Bool("exit-on-first-change", false, "Only check if the source changed, exiting with code 2 at the first changed block")
+	estimate    = flag.String("estimate", "", "Only estimate changes by hashing that percentage of blocks, like 1%")
+	twoPass     = flag.Bool("two-pass", false, "Hash everything first, then write changed blocks")
+	confirmWr   = flag.Bool("confirm", false, "Ask before writing phase of two-pass run")
+	tui         = flag.Bool("tui", false, "Show full-screen dashboard instead of progress")
+	pressure    = flag.String("pressure", "", "Slow down while io or cpu pressure exceeds that percentage, like 20%")
+	auditLog    = flag.String("audit-log", "", "Path to append-only audit log of runs and written extents")
+	keepGoing   = flag.Bool("keep-going", false, "Continue after block read/write errors, report them at the end")
+	alertBlocks = flag.Int64("alert-blocks", 0, "Raise corruption alert if that many blocks failed to be read, written or verified")
+	retry       = flag.String("retry", "", "Retry policies of error classes, like io=3:1s,busy=5:100ms,network=5:1s")
+	signKey     = flag.String("sign-key", "", "Path to Ed25519 key seed signing the statefile")
+	stateKey    = flag.String("state-key", "", "Path to key file encrypting the statefile")
+	statePass   = flag.String("state-passphrase", "", "Passphrase encrypting the statefile")
+	storePath   = flag.String("store", "", "Path to chunk store, used instead of dst")
+	storeKey    = flag.String("store-key", "", "Path to chunk store key file, enables encryption")
+	storeCipher = flag.String("store-cipher", "", "New store cipher: aes-gcm, xchacha20-poly1305")
+	storeNonce  = flag.String("store-nonce", "", "New store nonces: random, convergent")
+	storeZstd   = flag.Bool("store-compress", false, "Compress stored chunks with zstd")
 
-type SyncEvent struct {
-	i    int64
-	buf  []byte
-	data []byte
-}
+	keepLast    = flag.Int("keep-last", 0, "Keep last N store generations")
+	keepDaily   = flag.Int("keep-daily", 0, "Keep N daily store generations")
+	keepWeekly  = flag.Int("keep-weekly", 0, "Keep N weekly store generations")
+	keepMonthly = flag.Int("keep-monthly", 0, "Keep N monthly store generations")
 
-func prn(s string) {
-	os.Stdout.Write([]byte(s))
-	os.Stdout.Sync()
-}
+	freeze  = flag.String("freeze", "", "Mountpoint of filesystem to freeze while reading")
+	lvmSnap = flag.String("lvm-snapshot", "", "Sync from LVM snapshot with that size of the source")
+	zfsSnap = flag.Bool("zfs-snapshot", false, "Sync from ZFS snapshot of the source volume")
+	vss     = flag.Bool("vss", false, "Sync from Volume Shadow Copy of the source volume")
 
-func main() {
-	flag.Parse()
-	bs := *blkSize * int64(1<<10)
-
-	// Open source, calculate number of blocks
-	var size int64
-	src, err := os.Open(*srcPath)
-	if err != nil {
-		log.Fatalln("Unable to open src:", err)
-	}
-	defer src.Close()
-	fi, err := src.Stat()
-	if err != nil {
-		log.Fatalln("Unable to read src stat:", err)
-	}
-	if fi.Mode()&os.ModeDevice == os.ModeDevice {
-		size, err = src.Seek(0, 2)
-		if err != nil {
-			log.Fatalln("Unable to seek src:", err)
-		}
-		src.Seek(0, 0)
-	} else {
-		size = fi.Size()
-	}
-	blocks := size / bs
-	if size%bs != 0 {
-		blocks++
-	}
-	log.Println(blocks, bs, "byte blocks")
+	nbdServer = flag.String("nbd-server", "", "NBD server with source's dirty bitmap: unix:PATH, HOST:PORT")
+	nbdExport = flag.String("nbd-export", "", "NBD export name")
+	nbdBitmap = flag.String("nbd-bitmap", "", "Read only extents dirty in that NBD bitmap")
+	nbdQMP    = flag.String("nbd-qmp", "", "QMP socket of QEMU, rotating the NBD bitmap")
+	nbdNode   = flag.String("nbd-node", "", "Block node having the NBD bitmap")
+	eraDev    = flag.String("era-dev", "", "Read only blocks written since the last run in that dm-era device")
 
-	// Open destination
-	dst, err := os.OpenFile(*dstPath, os.O_WRONLY|os.O_CREATE, 0600)
-	if err != nil {
-		log.Fatalln("Unable to open dst:", err)
-	}
-	defer dst.Close()
+	preCmd  = flag.String("pre-cmd", "", "Command to execute before reading")
+	postCmd = flag.String("post-cmd", "", "Command to execute after the state is saved")
 
-	// Check if we already have statefile and read the state
-	state := make([]byte, blake2b.Size*blocks)
-	var i int64
-	var tmp []byte
-	if _, err := os.Stat(*statePath); err == nil {
-		log.Println("State file found")
-		stateFile, err := os.Open(*statePath)
-		if err != nil {
-			log.Fatalln("Unable to read statefile:", err)
-		}
+	notifyURL    = flag.String("notify-url", "", "URL to POST run's result as JSON to")
+	notifyNtfy   = flag.String("notify-ntfy", "", "ntfy topic's URL to publish run's summary to")
+	notifyEmail  = flag.String("notify-email", "", "Comma separated addresses to mail run's summary to")
+	summaryJSON  = flag.String("summary-json", "", "Path to write run's summary JSON to")
+	reportHTML   = flag.String("report-html", "", "Path to write run's HTML report to")
+	mapImage     = flag.String("map-image", "", "Path to write PNG image of run's block map to")
+	smtpServer   = flag.String("smtp-server", "", "SMTP server to send mail through: HOST:PORT")
+	smtpUser     = flag.String("smtp-user", "", "SMTP user")
+	smtpPassword = flag.String("smtp-password", "", "SMTP password")
+	smtpFrom     = flag.String("smtp-from", "", "Mail sender address")
 
-		// Check previously used size and block size
-		tmp = make([]byte, 8)
-		n, err := stateFile.Read(tmp)
-		if err != nil || n != 8 {
-			log.Fatalln("Invalid statefile")
-		}
-		prevSize := int64(binary.BigEndian.Uint64(tmp))
-		if size != prevSize {
-			log.Fatalln(
-				"Size differs with state file:",
-				prevSize, "instead of", size,
-			)
-		}
-		tmp = make([]byte, 8)
-		n, err = stateFile.Read(tmp)
-		if err != nil || n != 8 {
-			log.Fatalln("Invalid statefile")
-		}
-		prevBs := int64(binary.BigEndian.Uint64(tmp))
-		if bs != prevBs {
-			log.Fatalln(
-				"Blocksize differs with state file:",
-				prevBs, "instead of", bs,
-			)
-		}
+	controlAddr  = flag.String("control", "", "Serve control API on unix:PATH or HOST:PORT")
+	controlToken = flag.String("control-token", "", "Bearer token required by control API, mandatory on non-loopback HOST:PORT")
+	profiling    = addProfileFlags(flag.CommandLine)
+	logging      = addLogFlags(flag.CommandLine)
+	blake2bImpl  = addBLAKE2bFlag(flag.CommandLine)
+)
 
-		n, err = stateFile.Read(state)
-		if err != nil || n != len(state) {
-			log.Fatalln("Corrupted statefile")
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			restore(os.Args[2:])
+			return
+		case "gc":
+			gc(os.Args[2:])
+			return
+		case "run":
+			run(os.Args[2:])
+			return
+		case "daemon":
+			daemon(os.Args[2:])
+			return
+		case "state":
+			stateCmd(os.Args[2:])
+			return
+		case "list":
+			list(os.Args[2:])
+			return
+		case "analyze":
+			analyze(os.Args[2:])
+			return
+		case "bench":
+			bench(os.Args[2:])
+			return
+		case "gen":
+			gen(os.Args[2:])
+			return
+		case "compare":
+			compare(os.Args[2:])
+			return
+		case "audit":
+			audit(os.Args[2:])
+			return
+		case "serve":
+			serve(os.Args[2:])
+			return
+		case "mirror":
+			mirror(os.Args[2:])
+			return
+		case "verify":
+			verify(os.Args[2:])
+			return
 		}
-		stateFile.Close()
 	}
-	stateFile, err := ioutil.TempFile(".", "syncer")
-	if err != nil {
-		log.Fatalln("Unable to create temporary file:", err)
+	parseFlags(flag.CommandLine, os.Args[1:])
+	errlog := logging.setup()
+	blake2bImpl()
+	job := Job{
+		Src:             *srcPath,
+		SrcState:        *srcState,
+		SrcPeers:        *srcPeers,
+		SrcCompress:     *srcZstd,
+		ReuseMoved:      *reuseMoved,
+		QUIC:            *quic,
+		Transport:       *transport,
+		Dst:             *dstPath,
+		DstFormat:       *dstFormat,
+		DstTransform:    *dstTrans,
+		DeltaWrite:      *deltaWrite,
+		SubBlocks:       *subBlocks,
+		SparseState:     *sparseState,
+		StateCompress:   *stateZstd,
+		AssumeDstZero:   *assumeZero,
+		WipeTail:        *wipeDst,
+		Shred:           *shred,
+		Full:            *full || *reseed,
+		Reseed:          *reseed,
+		State:           *statePath,
+		Blk:             *blkSize,
+		Hash:            *hashName,
+		Workers:         *workers,
+		CPUs:            *cpuList,
+		NUMANode:        *numaSel,
+		HugePages:       *hugePages,
+		Readahead:       *readahead,
+		Memory:          *memory,
+		Readers:         *readers,
+		ZeroCopy:        *zeroCopy,
+		DirtyLimit:      *dirtyLimit,
+		WriteBehind:     *writeBehd,
+		TrackChanges:    *trackChgs,
+		CRC:             *crcFilter,
+		VerifySample:    *verifySmpl,
+		Paranoid:        *paranoid,
+		Estimate:        *estimate,
+		ExitOnChange:    *exitChange,
+		TwoPass:         *twoPass,
+		Confirm:         *confirmWr,
+		TUI:             *tui,
+		Pressure:        *pressure,
+		AuditLog:        *auditLog,
+		TmpDir:          *tmpDir,
+		StateXattr:      *stateXattr,
+		Preallocate:     *prealloc,
+		DstMode:         *dstMode,
+		DstOwner:        *dstOwner,
+		StateMode:       *stateMode,
+		StateOwner:      *stateOwner,
+		KeepGoing:       *keepGoing,
+		AlertBlocks:     *alertBlocks,
+		SignKey:         *signKey,
+		StateKey:        *stateKey,
+		StatePassphrase: *statePass,
+		Store:           *storePath,
+		StoreKey:        *storeKey,
+		StoreCipher:     *storeCipher,
+		StoreNonce:      *storeNonce,
+		StoreCompress:   *storeZstd,
+		KeepLast:        *keepLast,
+		KeepDaily:       *keepDaily,
+		KeepWeekly:      *keepWeekly,
+		KeepMonthly:     *keepMonthly,
+		Freeze:          *freeze,
+		LVMSnapshot:     *lvmSnap,
+		ZFSSnapshot:     *zfsSnap,
+		VSS:             *vss,
+		NBDServer:       *nbdServer,
+		NBDExport:       *nbdExport,
+		NBDBitmap:       *nbdBitmap,
+		NBDQMP:          *nbdQMP,
+		NBDNode:         *nbdNode,
+		EraDev:          *eraDev,
+		PreCmd:          *preCmd,
+		PostCmd:         *postCmd,
+		NotifyURL:       *notifyURL,
+		NotifyNtfy:      *notifyNtfy,
+		NotifyEmail:     *notifyEmail,
+		SummaryJSON:     *summaryJSON,
+		ReportHTML:      *reportHTML,
+		MapImage:        *mapImage,
+		SMTPServer:      *smtpServer,
+		SMTPUser:        *smtpUser,
+		SMTPPassword:    *smtpPassword,
+		SMTPFrom:        *smtpFrom,
 	}
-	tmp = make([]byte, 8)
-	binary.BigEndian.PutUint64(tmp, uint64(size))
-	stateFile.Write(tmp)
-	tmp = make([]byte, 8)
-	binary.BigEndian.PutUint64(tmp, uint64(bs))
-	stateFile.Write(tmp)
-
-	// Create buffers and event channel
-	workers := runtime.NumCPU()
-	log.Println(workers, "workers")
-	bufs := make(chan []byte, workers)
-	for i := 0; i < workers; i++ {
-		bufs <- make([]byte, int(bs))
+	var err error
+	if job.Retry, err = ParseRetry(*retry); err != nil {
+		log.Fatalln(err)
 	}
-	syncs := make(chan chan SyncEvent, workers)
-
-	// Writer
-	prn("[")
-	finished := make(chan struct{})
-	go func() {
-		var event SyncEvent
-		for sync := range syncs {
-			event = <-sync
-			if event.data != nil {
-				dst.Seek(event.i*bs, 0)
-				dst.Write(event.data)
+	if job.StateDir = *stateDir; job.StateDir != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "state" {
+				log.Fatalln("Either -state or -state-dir can be used")
 			}
-			bufs <- event.buf
-			<-sync
-		}
-		close(finished)
-	}()
-
-	// Reader
-	for i = 0; i < blocks; i++ {
-		buf := <-bufs
-		n, err := src.Read(buf)
-		if err != nil {
-			if err != io.EOF {
-				log.Fatalln("Error during src read:", err)
-			}
-			break
+		})
+		job.State = ""
+	}
+	handleSignals([]*Job{&job})
+	if *controlAddr != "" {
+		if err := serveControl(*controlAddr, *controlToken, []*Job{&job}); err != nil {
+			log.Fatalln("Unable to serve control API:", err)
 		}
-		sync := make(chan SyncEvent)
-		syncs <- sync
-		go func(i int64) {
-			sum := blake2b.Sum512(buf[:n])
-			sumState := state[i*blake2b.Size : i*blake2b.Size+blake2b.Size]
-			if bytes.Compare(sumState, sum[:]) != 0 {
-				sync <- SyncEvent{i, buf, buf[:n]}
-				prn("%")
-			} else {
-				sync <- SyncEvent{i, buf, nil}
-				prn(".")
-			}
-			copy(sumState, sum[:])
-			close(sync)
-		}(i)
 	}
-	close(syncs)
-	<-finished
-	prn("]\n")
-
-	log.Println("Saving state")
-	stateFile.Write(state)
-	stateFile.Close()
-	if err = os.Rename(stateFile.Name(), *statePath); err != nil {
-		log.Fatalln(
-			"Unable to overwrite statefile:", err,
-			"saved state is in:", stateFile.Name(),
-		)
+	stop := profiling.start()
+	err = job.Run()
+	stop()
+	if errors.Is(err, ErrCorrupt) {
+		errlog.Println(err)
+		os.Exit(ExitCorrupt)
+	}
+	if errors.Is(err, ErrChanged) {
+		log.Println(err)
+		os.Exit(ExitSrcChanged)
+	}
+	if err != nil {
+		errlog.Fatalln(err)
 	}
 }
@@ -0,0 +1,262 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Job syncing src file of size random bytes to dst in temporary
+// directory, with 64 KiB blocks.
+func testJob(t *testing.T, size int) *Job {
+	t.Helper()
+	dir := t.TempDir()
+	j := &Job{
+		Src:   filepath.Join(dir, "src"),
+		Dst:   filepath.Join(dir, "dst"),
+		State: filepath.Join(dir, "state"),
+		Blk:   64,
+		quiet: true,
+	}
+	j.log = log.New(ioutil.Discard, "", 0)
+	if testing.Verbose() {
+		j.log = log.New(os.Stderr, t.Name()+": ", 0)
+	}
+	writeRandom(t, j.Src, size)
+	return j
+}
+
+func writeRandom(t *testing.T, path string, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Fail unless both files have the same contents.
+func sameFiles(t *testing.T, a, b string) {
+	t.Helper()
+	da, err := ioutil.ReadFile(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := ioutil.ReadFile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(da, db) {
+		t.Fatalf("%s and %s differ", a, b)
+	}
+}
+
+// Put executable stub scripts in front of PATH.
+func stubCommands(t *testing.T, scripts map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, script := range scripts {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return dir
+}
+
+func TestSync(t *testing.T) {
+	j := testJob(t, 1<<20+123)
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sameFiles(t, j.Src, j.Dst)
+	fd, err := os.OpenFile(j.Src, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte("changed"), 300000)
+	fd.Close()
+	if err = j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sameFiles(t, j.Src, j.Dst)
+	if j.Stats.Changed != 1 {
+		t.Fatalf("%d blocks changed instead of 1", j.Stats.Changed)
+	}
+}
+
+func TestAuditShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	var jobs []*Job
+	for i := 0; i < 3; i++ {
+		j := testJob(t, 1<<20)
+		j.Name, j.AuditLog = string(rune('a'+i)), path
+		jobs = append(jobs, j)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(jobs))
+	for _, j := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 2; n++ {
+				writeRandom(t, j.Src, 1<<20)
+				if err := j.Run(); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	n, runs, _, err := verifyAudit(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each run writes contiguous 1 MiB as a single extent
+	if runs != 6 || n != 18 {
+		t.Fatalf("%d records of %d runs instead of 18 of 6", n, runs)
+	}
+}
+
+// Change inside hot block writes only its changed sub-block, the first
+// change of the block gone cold writes it whole.
+func TestSubBlocks(t *testing.T) {
+	j := testJob(t, 1<<20)
+	j.SubBlocks = 16
+	var logged bytes.Buffer
+	j.log = log.New(&logged, "", 0)
+	modify := func(offset int64) {
+		fd, err := os.OpenFile(j.Src, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		data := make([]byte, 100)
+		rand.Read(data)
+		if _, err = fd.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		idle    int // unchanged runs before it
+		offset  int64
+		written string
+	}{
+		{0, -1, ""},
+		{0, 3*65536 + 10000, "Sub-blocks: 4096 of 65536 changed bytes written"},
+		{SubBlocksKeep, 3*65536 + 30000, "Sub-blocks: 65536 of 65536 changed bytes written"},
+		{0, 3*65536 + 50000, "Sub-blocks: 4096 of 65536 changed bytes written"},
+	} {
+		for n := 0; n < c.idle; n++ {
+			if err := j.Run(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c.offset >= 0 {
+			modify(c.offset)
+		}
+		logged.Reset()
+		if err := j.Run(); err != nil {
+			t.Fatal(err)
+		}
+		sameFiles(t, j.Src, j.Dst)
+		if c.written != "" && !bytes.Contains(logged.Bytes(), []byte(c.written)) {
+			t.Fatalf("%d: %s expected:\n%s", c.offset, c.written, logged.String())
+		}
+	}
+}
+
+// Sparse statefile of mostly zero source keeps only non-zero blocks'
+// hashes, zero ones are still known unchanged.
+func TestSparseState(t *testing.T) {
+	j := testJob(t, 0)
+	j.SparseState = true
+	data := make([]byte, 4<<20)
+	rand.Read(data[5*65536 : 6*65536])
+	if err := ioutil.WriteFile(j.Src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for run := 0; run < 2; run++ {
+		if err := j.Run(); err != nil {
+			t.Fatal(err)
+		}
+		sameFiles(t, j.Src, j.Dst)
+	}
+	if j.Stats.Changed != 0 {
+		t.Fatalf("%d blocks changed by the second run", j.Stats.Changed)
+	}
+	fi, err := os.Stat(j.State)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 64 blocks bitmap and a single hash, besides header and META
+	if fi.Size() > 8+8+8+4+1024+8+64 {
+		t.Fatalf("Sparse statefile is %d bytes", fi.Size())
+	}
+}
+
+// Compressed statefile is smaller, and turning compression off or on
+// keeps it read by the next run.
+func TestStateCompress(t *testing.T) {
+	j := testJob(t, 0)
+	data := make([]byte, 4<<20)
+	rand.Read(data[:65536])
+	if err := ioutil.WriteFile(j.Src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int64
+	for _, compress := range []bool{false, true, false} {
+		j.StateCompress = compress
+		if err := j.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if len(sizes) > 0 && j.Stats.Changed != 0 {
+			t.Fatalf("%d blocks changed after compression is switched", j.Stats.Changed)
+		}
+		state, err := ioutil.ReadFile(j.State)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.HasPrefix(state, StateZstdMagic) != compress {
+			t.Fatal("Statefile compression is not", compress)
+		}
+		sizes = append(sizes, int64(len(state)))
+	}
+	if sizes[1] >= sizes[0]/2 {
+		t.Fatalf("Compressed statefile is %d bytes of %d", sizes[1], sizes[0])
+	}
+}
@@ -0,0 +1,72 @@
+//go:build !windows && !plan9
+
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER,
+	"mail": syslog.LOG_MAIL, "daemon": syslog.LOG_DAEMON,
+	"auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS,
+	"uucp": syslog.LOG_UUCP, "cron": syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2, "local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// Connect to either local syslog, or remote one at udp:HOST:PORT or
+// tcp:HOST:PORT, returning writers of informational and error messages.
+func newSyslogWriters(addr, facility string) (info, errs io.Writer, err error) {
+	fac, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, nil, errors.New("Unknown syslog facility: " + facility)
+	}
+	network, raddr := "", ""
+	if addr != "local" {
+		var found bool
+		if network, raddr, found = strings.Cut(addr, ":"); !found ||
+			(network != "udp" && network != "tcp") {
+			return nil, nil, errors.New("Syslog must be local, udp:HOST:PORT or tcp:HOST:PORT")
+		}
+	}
+	w, err := syslog.Dial(network, raddr, fac|syslog.LOG_INFO, "syncer")
+	if err != nil {
+		return nil, nil, err
+	}
+	return w, syslogErr{w}, nil
+}
+
+// Writer of error priority messages.
+type syslogErr struct {
+	w *syslog.Writer
+}
+
+func (e syslogErr) Write(p []byte) (int, error) {
+	return len(p), e.w.Err(strings.TrimSuffix(string(p), "\n"))
+}
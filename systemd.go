@@ -0,0 +1,137 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Send sd_notify(3) state to the service manager, if it asked for.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Service manager's watchdog interval, zero unless it is enabled for
+// us.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Report daemon's status twice per watchdog interval, pinging the
+// watchdog only while the scheduler loops and running jobs keep beating
+// within the interval.
+func sdWatchdog(interval time.Duration, status *Status) {
+	if interval == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval / 2) {
+			state := "STATUS=" + status.Summary()
+			if status.Healthy(interval) {
+				state += "\nWATCHDOG=1"
+			}
+			sdNotify(state)
+		}
+	}()
+}
+
+const (
+	JournalSocket = "/run/systemd/journal/socket"
+
+	JournalErr  = 3
+	JournalInfo = 6
+)
+
+// Writer sending each log record as structured entry to journald using
+// its native protocol. Job's name is recorded in SYNCER_JOB field, its
+// current run's ID in SYNCER_RUN.
+type journalWriter struct {
+	conn     *net.UnixConn
+	job      string
+	priority int
+	run      atomic.Pointer[string]
+}
+
+func newJournalWriter(job string, priority int) (*journalWriter, error) {
+	conn, err := net.DialUnix(
+		"unixgram", nil,
+		&net.UnixAddr{Name: JournalSocket, Net: "unixgram"},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &journalWriter{conn: conn, job: job, priority: priority}, nil
+}
+
+func journalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if strings.IndexByte(value, '\n') == -1 {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+	} else {
+		buf.WriteByte('\n')
+		binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+		buf.WriteString(value)
+	}
+	buf.WriteByte('\n')
+}
+
+func (w *journalWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	journalField(&buf, "MESSAGE", strings.TrimSuffix(string(p), "\n"))
+	journalField(&buf, "PRIORITY", strconv.Itoa(w.priority))
+	journalField(&buf, "SYSLOG_IDENTIFIER", "syncer")
+	if w.job != "" {
+		journalField(&buf, "SYNCER_JOB", w.job)
+	}
+	if run := w.run.Load(); run != nil {
+		journalField(&buf, "SYNCER_RUN", *run)
+	}
+	if _, err := w.conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
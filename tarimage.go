@@ -0,0 +1,153 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TarMaxMember = 64 << 20
+
+// Placeholder of tar dst's path replaced with run's start time.
+const TarTimePlaceholder = "{time}"
+
+// Destination being the tar archive of changed blocks. Contiguous
+// writes are joined into extents, each stored as a member with its
+// offset in SYNCER.offset PAX record. First member, syncer.json,
+// describes the source.
+type tarImage struct {
+	mu     sync.Mutex
+	fd     *os.File
+	tw     *tar.Writer
+	offset int64
+	data   []byte // extent being collected
+}
+
+// Path of the run's archive.
+func tarPath(path string, started time.Time) string {
+	return strings.ReplaceAll(path, TarTimePlaceholder, started.UTC().Format("20060102T150405Z"))
+}
+
+// Create new archive. Existing one, holding the delta of the previous
+// run, is never overwritten.
+func openTar(path string, size int64) (*tarImage, error) {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, errors.New("Tar dst already exists, name archives per run: " + path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &tarImage{fd: fd, tw: tar.NewWriter(fd)}
+	info, err := json.Marshal(struct {
+		Size   int64  `json:"size"`
+		Syncer string `json:"syncer"`
+	}{size, Version})
+	if err == nil {
+		err = t.member("syncer.json", info, nil)
+	}
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *tarImage) member(name string, data []byte, records map[string]string) error {
+	err := t.tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       name,
+		Size:       int64(len(data)),
+		Mode:       0600,
+		ModTime:    time.Now(),
+		Format:     tar.FormatPAX,
+		PAXRecords: records,
+	})
+	if err == nil {
+		_, err = t.tw.Write(data)
+	}
+	return err
+}
+
+// Store collected extent as the member.
+func (t *tarImage) flush() error {
+	if len(t.data) == 0 {
+		return nil
+	}
+	err := t.member(
+		fmt.Sprintf("%020d", t.offset), t.data,
+		map[string]string{"SYNCER.offset": strconv.FormatInt(t.offset, 10)},
+	)
+	t.offset += int64(len(t.data))
+	t.data = t.data[:0]
+	return err
+}
+
+func (t *tarImage) ReadAt(p []byte, offset int64) (int, error) {
+	return 0, errors.New("Tar dst can not be read")
+}
+
+func (t *tarImage) WriteAt(p []byte, offset int64) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if offset != t.offset+int64(len(t.data)) || len(t.data)+len(p) > TarMaxMember {
+		if err := t.flush(); err != nil {
+			return 0, err
+		}
+		t.offset = offset
+	}
+	t.data = append(t.data, p...)
+	return len(p), nil
+}
+
+func (t *tarImage) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.flush(); err != nil {
+		return err
+	}
+	return t.tw.Flush()
+}
+
+func (t *tarImage) Sync() error {
+	if err := t.Flush(); err != nil {
+		return err
+	}
+	return t.fd.Sync()
+}
+
+// Finish the archive.
+func (t *tarImage) Close() error {
+	err := t.Flush()
+	if err == nil {
+		err = t.tw.Close()
+	}
+	if cerr := t.fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
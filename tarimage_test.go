@@ -0,0 +1,124 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Apply archive's extents onto the image, as stock tar would extract
+// them, returning source size from syncer.json.
+func applyTar(t *testing.T, path string, image []byte) int64 {
+	t.Helper()
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	tr := tar.NewReader(fd)
+	var size int64 = -1
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "syncer.json" {
+			var info struct {
+				Size int64 `json:"size"`
+			}
+			if err = json.Unmarshal(data, &info); err != nil {
+				t.Fatal(err)
+			}
+			size = info.Size
+			continue
+		}
+		offset, err := strconv.ParseInt(hdr.PAXRecords["SYNCER.offset"], 10, 64)
+		if err != nil || fmt.Sprintf("%020d", offset) != hdr.Name {
+			t.Fatalf("member %s has offset %q", hdr.Name, hdr.PAXRecords["SYNCER.offset"])
+		}
+		copy(image[offset:], data)
+	}
+	if size < 0 {
+		t.Fatal("no syncer.json")
+	}
+	return size
+}
+
+// Each run's delta goes to its own archive, existing one is kept.
+func TestTarPerRun(t *testing.T) {
+	j := testJob(t, 1<<20)
+	j.DstFormat = FormatTar
+	j.Dst = filepath.Join(filepath.Dir(j.Dst), "delta.tar")
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	src, err := ioutil.ReadFile(j.Src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := make([]byte, len(src))
+	if size := applyTar(t, j.Dst, image); size != int64(len(src)) || !bytes.Equal(image, src) {
+		t.Fatal("first archive differs from src")
+	}
+
+	fd, err := os.OpenFile(j.Src, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte("changed"), 300000)
+	fd.Close()
+	if err = j.Run(); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("existing archive is overwritten: %v", err)
+	}
+	j.Dst = filepath.Join(filepath.Dir(j.Dst), "delta-{time}.tar")
+	if err = j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if j.Stats.Written != j.Blk<<10 {
+		t.Fatalf("%d bytes archived instead of one block", j.Stats.Written)
+	}
+	if size := applyTar(t, filepath.Join(filepath.Dir(j.Dst), "delta.tar"), make([]byte, len(src))); size != int64(len(src)) {
+		t.Fatal("first archive is damaged")
+	}
+	second := tarPath(j.Dst, j.Stats.Started)
+	if src, err = ioutil.ReadFile(j.Src); err != nil {
+		t.Fatal(err)
+	}
+	applyTar(t, second, image)
+	if !bytes.Equal(image, src) {
+		t.Fatal("archives applied differ from src")
+	}
+}
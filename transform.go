@@ -0,0 +1,148 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/aes"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/xts"
+)
+
+// Sector of AES-XTS: its number tweaks the encryption.
+const XTSSectorSize = 512
+
+// Length preserving transformation of data at offset, applied before
+// writing to destination and inverted after reading from it.
+type Transform interface {
+	Encode(data []byte, offset int64) error
+	Decode(data []byte, offset int64) error
+}
+
+var transforms = make(map[string]func(arg string) (Transform, error))
+
+func init() {
+	registerTransform("aes-xts", newXTSTransform)
+}
+
+// Add transform used with -dst-transform name:arg, from init() of
+// syncer's own file.
+func registerTransform(name string, open func(arg string) (Transform, error)) {
+	transforms[name] = open
+}
+
+// Parse comma separated chain of NAME:ARG transforms, applied in order.
+func openTransforms(spec string) ([]Transform, error) {
+	var chain []Transform
+	for _, s := range strings.Split(spec, ",") {
+		name, arg, _ := strings.Cut(s, ":")
+		open, ok := transforms[name]
+		if !ok {
+			return nil, errors.New("Unknown transform: " + name)
+		}
+		t, err := open(arg)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, t)
+	}
+	return chain, nil
+}
+
+func encode(chain []Transform, data []byte, offset int64) error {
+	for _, t := range chain {
+		if err := t.Encode(data, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decode(chain []Transform, data []byte, offset int64) error {
+	for i := len(chain) - 1; i >= 0; i-- {
+		if err := chain[i].Decode(data, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Destination holding transformed data, like ciphertext only.
+type transformedImage struct {
+	Image
+	chain []Transform
+}
+
+func (t *transformedImage) WriteAt(p []byte, off int64) (int, error) {
+	buf := append([]byte(nil), p...)
+	if err := encode(t.chain, buf, off); err != nil {
+		return 0, err
+	}
+	return t.Image.WriteAt(buf, off)
+}
+
+func (t *transformedImage) ReadAt(p []byte, off int64) (int, error) {
+	n, err := t.Image.ReadAt(p, off)
+	if derr := decode(t.chain, p[:n], off); derr != nil {
+		return 0, derr
+	}
+	return n, err
+}
+
+func (t *transformedImage) Flush() error {
+	return flushImage(t.Image)
+}
+
+// AES-256-XTS with subkeys derived from 256-bit key file and sector
+// number as the tweak, like dm-crypt's aes-xts-plain64.
+type xtsTransform struct {
+	c *xts.Cipher
+}
+
+func newXTSTransform(keyPath string) (Transform, error) {
+	key, err := ReadKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	c, err := xts.NewCipher(aes.NewCipher, append(subKey(key, "xts-data"), subKey(key, "xts-tweak")...))
+	if err != nil {
+		return nil, err
+	}
+	return &xtsTransform{c}, nil
+}
+
+func (x *xtsTransform) sectors(data []byte, offset int64, do func(dst, src []byte, sector uint64)) error {
+	if offset%XTSSectorSize != 0 || len(data)%aes.BlockSize != 0 {
+		return errors.New("AES-XTS requires 512 byte aligned offset and 16 byte aligned length")
+	}
+	for i := 0; i < len(data); i += XTSSectorSize {
+		s := data[i:min(i+XTSSectorSize, len(data))]
+		do(s, s, uint64(offset+int64(i))/XTSSectorSize)
+	}
+	return nil
+}
+
+func (x *xtsTransform) Encode(data []byte, offset int64) error {
+	return x.sectors(data, offset, x.c.Encrypt)
+}
+
+func (x *xtsTransform) Decode(data []byte, offset int64) error {
+	return x.sectors(data, offset, x.c.Decrypt)
+}
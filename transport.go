@@ -0,0 +1,126 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Dials connections to HTTP source's servers, TLS of https is done on
+// top of them. addr is the server's HOST:PORT.
+type Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Transports by name, creating dialer from the argument after colon.
+var transports = make(map[string]func(arg string) (Dialer, error))
+
+func init() {
+	registerTransport("unix", unixDialer)
+	registerTransport("ssh", sshDialer)
+}
+
+// Add transport used with -transport name:arg, like "vpn:tun0", from
+// init() of syncer's own file.
+func registerTransport(name string, dialer func(arg string) (Dialer, error)) {
+	transports[name] = dialer
+}
+
+// Connect to unix socket at path instead of the server.
+func unixDialer(path string) (Dialer, error) {
+	if path == "" {
+		return nil, errors.New("Unix transport requires socket path")
+	}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}, nil
+}
+
+// Tunnel connections through ssh to the destination, like user@host,
+// with its -W forwarding.
+func sshDialer(dest string) (Dialer, error) {
+	if dest == "" {
+		return nil, errors.New("SSH transport requires destination")
+	}
+	return func(_ context.Context, _, addr string) (net.Conn, error) {
+		cmd := exec.Command("ssh", "-W", addr, dest)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, err
+		}
+		conn, remote := net.Pipe()
+		go func() {
+			io.Copy(stdin, remote)
+			stdin.Close()
+		}()
+		go func() {
+			io.Copy(remote, stdout)
+			cmd.Wait()
+			remote.Close()
+		}()
+		return conn, nil
+	}, nil
+}
+
+// Client of HTTP sources, speaking HTTP/3 over QUIC if asked or going
+// through the chosen transport. QUIC copes with lossy links better than
+// a single TCP connection.
+func (j *Job) httpClient() (*http.Client, error) {
+	client := &http.Client{Timeout: HTTPTimeout}
+	if j.QUIC {
+		if j.Transport != "" {
+			return nil, errors.New("Either QUIC or transport can be used")
+		}
+		if !strings.HasPrefix(j.Src, "https://") {
+			return nil, errors.New("QUIC requires https src")
+		}
+		client.Transport = &http3.Transport{}
+		return client, nil
+	}
+	if j.Transport == "" {
+		return client, nil
+	}
+	name, arg, _ := strings.Cut(j.Transport, ":")
+	open, ok := transports[name]
+	if !ok {
+		return nil, errors.New("Unknown transport: " + name)
+	}
+	dial, err := open(arg)
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dial
+	client.Transport = t
+	return client, nil
+}
@@ -0,0 +1,309 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Block states shown on the dashboard's map, in increasing priority.
+const (
+	blockUnread uint32 = iota
+	blockSkipped
+	blockSame
+	blockChanged
+	blockFailed
+)
+
+const (
+	TUIRefresh  = 500 * time.Millisecond
+	TUILogLines = 6
+	TUIMaxLog   = 1000
+)
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// Full-screen terminal dashboard of the running sync: block map,
+// read throughput history, workers utilization and recent log.
+type dashboard struct {
+	title   string
+	size    int64
+	workers int
+	states  []uint32
+	started time.Time
+
+	read    atomic.Int64
+	skipped atomic.Int64
+	written atomic.Int64
+	busy    atomic.Int64
+
+	speeds   []float64 // MiB/s
+	lastRead int64
+	lastTime time.Time
+
+	mu     sync.Mutex
+	lines  []string
+	out    *os.File
+	logOut io.Writer
+	done   chan struct{}
+	exited chan struct{}
+}
+
+// Show the dashboard instead of progress, capturing the job's log.
+func (j *Job) startDashboard(blocks, size int64, workers int) {
+	title := "syncer "
+	if j.Name != "" {
+		title += j.Name + ": "
+	}
+	if j.Store == "" {
+		title += j.Src + " -> " + j.Dst
+	} else {
+		title += j.Src + " -> " + j.Store
+	}
+	d := &dashboard{
+		title:   title,
+		size:    size,
+		workers: workers,
+		states:  make([]uint32, blocks),
+		started: time.Now(),
+		out:     os.Stdout,
+		logOut:  j.log.Writer(),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	d.lastTime = d.started
+	j.log.SetOutput(d)
+	d.out.WriteString("\x1b[?1049h\x1b[?25l")
+	go func() {
+		ticker := time.NewTicker(TUIRefresh)
+		defer ticker.Stop()
+		for {
+			d.render()
+			select {
+			case <-ticker.C:
+			case <-d.done:
+				close(d.exited)
+				return
+			}
+		}
+	}()
+	j.dash = d
+}
+
+// Restore the terminal and replay captured log.
+func (j *Job) stopDashboard() {
+	d := j.dash
+	if d == nil {
+		return
+	}
+	close(d.done)
+	<-d.exited
+	d.out.WriteString("\x1b[?25h\x1b[?1049l")
+	j.log.SetOutput(d.logOut)
+	d.mu.Lock()
+	for _, line := range d.lines {
+		io.WriteString(d.logOut, line+"\n")
+	}
+	d.mu.Unlock()
+	j.dash = nil
+}
+
+// Raise block's state, failed one is never lowered by the writer and
+// the hasher racing.
+func raiseState(states []uint32, i int64, state uint32) {
+	for {
+		old := atomic.LoadUint32(&states[i])
+		if old >= state || atomic.CompareAndSwapUint32(&states[i], old, state) {
+			return
+		}
+	}
+}
+
+// Mark the block failed to be read or written.
+func (j *Job) fail(i int64) {
+	j.failed.Add(1)
+	if j.runMap != nil {
+		raiseState(j.runMap, i, blockFailed)
+	}
+	if d := j.dash; d != nil {
+		raiseState(d.states, i, blockFailed)
+	}
+}
+
+// Report block's state to the dashboard, or as progress character.
+func (j *Job) block(i int64, state uint32) {
+	n := min(j.bs, j.size.Load()-i*j.bs)
+	j.done.Add(n)
+	j.beat.Store(time.Now().UnixNano())
+	if j.runMap != nil {
+		raiseState(j.runMap, i, state)
+	}
+	if d := j.dash; d != nil {
+		raiseState(d.states, i, state)
+		switch state {
+		case blockSkipped:
+			d.skipped.Add(n)
+		case blockChanged:
+			d.written.Add(n)
+			fallthrough
+		case blockSame:
+			d.read.Add(n)
+		}
+		return
+	}
+	if state == blockChanged {
+		j.prn("%")
+	} else {
+		j.prn(".")
+	}
+}
+
+// Account hashing worker becoming busy or idle.
+func (j *Job) busy(delta int64) {
+	if j.dash != nil {
+		j.dash.busy.Add(delta)
+	}
+}
+
+// Captured log output.
+func (d *dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		d.lines = append(d.lines, line)
+	}
+	if len(d.lines) > TUIMaxLog {
+		d.lines = d.lines[len(d.lines)-TUIMaxLog:]
+	}
+	d.mu.Unlock()
+	return len(p), nil
+}
+
+func cut(s string, width int) string {
+	if r := []rune(s); len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}
+
+func (d *dashboard) render() {
+	width, height := termSize(d.out)
+	if width == 0 || height == 0 {
+		width, height = 80, 24
+	}
+	now := time.Now()
+	read := d.read.Load()
+	done := read + d.skipped.Load()
+	if dt := now.Sub(d.lastTime).Seconds(); dt > 0 {
+		d.speeds = append(d.speeds, float64(read-d.lastRead)/(1<<20)/dt)
+		d.lastRead, d.lastTime = read, now
+	}
+	if len(d.speeds) > width {
+		d.speeds = d.speeds[len(d.speeds)-width:]
+	}
+
+	var b bytes.Buffer
+	b.WriteString("\x1b[H\x1b[2J")
+	line := func(format string, args ...interface{}) {
+		b.WriteString(cut(fmt.Sprintf(format, args...), width) + "\r\n")
+	}
+	line("%s", d.title)
+	elapsed := now.Sub(d.started)
+	eta := "?"
+	if done > 0 {
+		left := time.Duration(float64(elapsed) * float64(d.size-done) / float64(done))
+		eta = left.Round(time.Second).String()
+	}
+	line(
+		"Done %d/%d MiB (%.1f%%), written %d MiB, elapsed %s, ETA %s",
+		done>>20, d.size>>20, 100*float64(done)/float64(max(d.size, 1)),
+		d.written.Load()>>20, elapsed.Round(time.Second), eta,
+	)
+	busy := int(min(max(d.busy.Load(), 0), int64(d.workers)))
+	barLen := min(d.workers, max(width-24, 1))
+	bar := strings.Repeat("#", busy*barLen/d.workers) +
+		strings.Repeat("-", barLen-busy*barLen/d.workers)
+	line("Workers [%s] %d/%d busy", bar, busy, d.workers)
+	var peak float64
+	for _, s := range d.speeds {
+		peak = max(peak, s)
+	}
+	var graph []rune
+	for _, s := range d.speeds[max(len(d.speeds)-(width-24), 0):] {
+		n := 0
+		if peak > 0 {
+			n = int(s / peak * float64(len(sparks)-1))
+		}
+		graph = append(graph, sparks[n])
+	}
+	current := 0.0
+	if len(d.speeds) > 0 {
+		current = d.speeds[len(d.speeds)-1]
+	}
+	line("Read %7.1f MiB/s %s", current, string(graph))
+	line("Blocks: \x1b[32m.\x1b[0m same  \x1b[33m%%\x1b[0m changed  - skipped")
+
+	// Each map cell aggregates several blocks, showing the most
+	// important state among them
+	rows := max(height-7-TUILogLines, 1)
+	blocks := int64(len(d.states))
+	per := max((blocks+int64(width*rows)-1)/int64(width*rows), 1)
+	for row := 0; row < rows; row++ {
+		for col := 0; col < width; col++ {
+			first := (int64(row*width) + int64(col)) * per
+			if first >= blocks {
+				break
+			}
+			var state uint32
+			for i := first; i < min(first+per, blocks); i++ {
+				state = max(state, atomic.LoadUint32(&d.states[i]))
+			}
+			switch state {
+			case blockUnread:
+				b.WriteByte(' ')
+			case blockSkipped:
+				b.WriteByte('-')
+			case blockSame:
+				b.WriteString("\x1b[32m.\x1b[0m")
+			case blockChanged:
+				b.WriteString("\x1b[33m%\x1b[0m")
+			case blockFailed:
+				b.WriteString("\x1b[31m!\x1b[0m")
+			}
+		}
+		b.WriteString("\r\n")
+		if int64((row+1)*width)*per >= blocks {
+			break
+		}
+	}
+
+	line("Log:")
+	d.mu.Lock()
+	for _, l := range d.lines[max(len(d.lines)-TUILogLines, 0):] {
+		line("%s", l)
+	}
+	d.mu.Unlock()
+	d.out.Write(b.Bytes())
+}
@@ -0,0 +1,108 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the write phase of two-pass run reports its progress.
+const ProgressInterval = 10 * time.Second
+
+// First pass of two-pass run: hash all blocks not excluded by dirty
+// and return ones differing from the state. Only CRCs of unchanged
+// blocks are updated, so the second pass hashes changed ones again.
+func (j *Job) scan(
+	src io.ReaderAt, st *State, store *Store,
+	dirty []bool, crcs bool, workers int,
+) ([]bool, error) {
+	changed := make([]bool, st.Blocks())
+	idx := make(chan int64)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var rerr error
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, st.Bs)
+			for i := range idx {
+				n, err := j.readAt(src, buf, i*st.Bs)
+				if err != nil && (err != io.EOF || n == 0) {
+					mu.Lock()
+					if rerr == nil {
+						rerr = fmt.Errorf("Error during src read: %w", err)
+					}
+					mu.Unlock()
+					continue
+				}
+				j.ctl.limit(n)
+				var crc uint32
+				if st.CRCs != nil {
+					crc = crc32.Checksum(buf[:n], castagnoli)
+					if crcs && crc == st.CRCs[i] {
+						continue
+					}
+				}
+				sum := st.Hasher().Sum(buf[:n])
+				if !bytes.Equal(sum, st.Hash(i)) || (store != nil && !store.Has(sum)) {
+					changed[i] = true
+				} else if st.CRCs != nil {
+					st.CRCs[i] = crc
+				}
+			}
+		}()
+	}
+	j.prn("[")
+	var cerr error
+	for i := int64(0); i < st.Blocks(); i++ {
+		if dirty != nil && !dirty[i] {
+			continue
+		}
+		if cerr = j.ctl.wait(); cerr != nil {
+			break
+		}
+		idx <- i
+		if i%64 == 63 {
+			j.prn("#")
+		}
+	}
+	close(idx)
+	wg.Wait()
+	j.prn("]\n")
+	if cerr != nil {
+		return nil, cerr
+	}
+	return changed, rerr
+}
+
+// Ask the question on stdin.
+func confirm(question string) bool {
+	fmt.Fprint(os.Stderr, question, " [y/N] ")
+	var answer string
+	fmt.Scanln(&answer)
+	return strings.EqualFold(answer, "y")
+}
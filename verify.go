@@ -0,0 +1,127 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// Upper bound of the share of diverged blocks, if k of n sampled ones
+// differ, with the confidence: Clopper-Pearson's one, found by bisection
+// of binomial distribution's function.
+func divergenceBound(n, k int64, confidence float64) float64 {
+	if k >= n {
+		return 1
+	}
+	lc, _ := math.Lgamma(float64(n + 1))
+	cdf := func(p float64) float64 {
+		var sum float64
+		for i := int64(0); i <= k; i++ {
+			li, _ := math.Lgamma(float64(i + 1))
+			lr, _ := math.Lgamma(float64(n - i + 1))
+			sum += math.Exp(lc - li - lr + float64(i)*math.Log(p) + float64(n-i)*math.Log1p(-p))
+		}
+		return sum
+	}
+	lo, hi := float64(k)/float64(n), 1.0
+	for step := 0; step < 64; step++ {
+		mid := (lo + hi) / 2
+		if cdf(mid) > 1-confidence {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi
+}
+
+// Check random sample of destination's blocks against the statefile,
+// bounding the share of diverged ones statistically.
+func verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dstPath := fs.String("dst", "", "Path to destination disk")
+	statePath := fs.String("state", "state.bin", "Path to statefile")
+	sampleStr := fs.String("sample", "1%", "Share of blocks to verify")
+	confStr := fs.String("confidence", "99%", "Confidence of divergence bound")
+	opts := addStateFlags(fs)
+	parseFlags(fs, args)
+	if *dstPath == "" {
+		log.Fatalln("-dst is required")
+	}
+	sample, err := parsePercent(*sampleStr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	confidence, err := parsePercent(*confStr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if confidence == 0 || confidence == 100 {
+		log.Fatalln("Confidence must be between 0% and 100%")
+	}
+	st := opts.Read(*statePath)
+	dst, err := os.Open(*dstPath)
+	if err != nil {
+		log.Fatalln("Unable to open dst:", err)
+	}
+	defer dst.Close()
+
+	blocks := make([]int64, st.Blocks())
+	for i := range blocks {
+		blocks[i] = int64(i)
+	}
+	n := min(max(1, int(float64(len(blocks))*sample/100)), len(blocks))
+	rand.Shuffle(len(blocks), func(a, b int) {
+		blocks[a], blocks[b] = blocks[b], blocks[a]
+	})
+	blocks = blocks[:n]
+	sort.Slice(blocks, func(a, b int) bool { return blocks[a] < blocks[b] })
+
+	log.Println("Verifying", n, "of", st.Blocks(), "blocks")
+	buf := make([]byte, st.Bs)
+	var differ int64
+	prn("[")
+	for _, i := range blocks {
+		ok, err := checkBlock(dst, st, i, buf)
+		if err != nil {
+			log.Fatalln("Error during dst read:", err)
+		}
+		if ok {
+			prn(".")
+			continue
+		}
+		differ++
+		prn("!")
+		log.Println("Destination block", i, "differs from statefile")
+	}
+	prn("]\n")
+	bound := divergenceBound(int64(n), differ, confidence/100)
+	log.Printf(
+		"%d of %d verified blocks differ: at most %.3f%% (%d blocks) diverged with %s confidence\n",
+		differ, n, 100*bound, int64(math.Ceil(bound*float64(st.Blocks()))), *confStr,
+	)
+	if differ > 0 {
+		os.Exit(ExitDstDrifted)
+	}
+}
@@ -0,0 +1,369 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	VHDBlockSize = 2 << 20
+	VHDSector    = 512
+
+	vhdFixed   = 2
+	vhdDynamic = 3
+	vhdUnused  = 0xffffffff
+)
+
+var vhdEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+type vhdHeader struct {
+	Cookie          [8]byte
+	DataOffset      uint64
+	TableOffset     uint64
+	HeaderVersion   uint32
+	MaxTableEntries uint32
+	BlockSize       uint32
+	Checksum        uint32
+	ParentUniqueID  [16]byte
+	ParentTimeStamp uint32
+	Reserved        uint32
+	ParentName      [512]byte
+	ParentLocators  [8 * 24]byte
+	Reserved2       [256]byte
+}
+
+// One's complement of the sum of structure's bytes, with checksum
+// field being zero.
+func vhdChecksum(v any) uint32 {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, v)
+	var sum uint32
+	for _, b := range buf.Bytes() {
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+// Cylinders, heads and sectors per track as VHD specification says.
+func vhdGeometry(size int64) (uint16, uint8, uint8) {
+	sectors := size / VHDSector
+	sectors = min(sectors, 65535*16*255)
+	var spt, heads, cth int64
+	if sectors >= 65535*16*63 {
+		spt, heads = 255, 16
+		cth = sectors / spt
+	} else {
+		spt = 17
+		cth = sectors / spt
+		heads = max((cth+1023)/1024, 4)
+		if cth >= heads*1024 || heads > 16 {
+			spt, heads = 31, 16
+			cth = sectors / spt
+		}
+		if cth >= heads*1024 {
+			spt, heads = 63, 16
+			cth = sectors / spt
+		}
+	}
+	return uint16(cth / heads), uint8(heads), uint8(spt)
+}
+
+// Fixed VHD is raw data followed by the footer. Dynamic one consists
+// of footer's copy, dynamic header, block allocation table and blocks,
+// each prepended with sector bitmap. Like qemu, bitmaps of new blocks
+// are filled and they are ignored during reading. Differencing images
+// are not supported.
+type vhd struct {
+	mu     sync.Mutex
+	fd     *os.File
+	footer vhdFooter
+	header vhdHeader
+	bat    []uint32
+	end    int64 // offset of the footer
+}
+
+func openVHD(path string, size int64, fixed bool) (*vhd, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	v := &vhd{fd: fd}
+	fi, err := fd.Stat()
+	if err == nil {
+		if fi.Size() == 0 {
+			err = v.create(size, fixed)
+		} else {
+			err = v.open(fi.Size(), size)
+		}
+	}
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *vhd) create(size int64, fixed bool) error {
+	size = (size + VHDSector - 1) &^ (VHDSector - 1)
+	f := &v.footer
+	copy(f.Cookie[:], "conectix")
+	f.Features = 2
+	f.FileFormatVersion = 0x00010000
+	f.DataOffset = 0xffffffffffffffff
+	f.TimeStamp = uint32(time.Since(vhdEpoch) / time.Second)
+	copy(f.CreatorApplication[:], "sync")
+	f.CreatorVersion = 0x00010000
+	copy(f.CreatorHostOS[:], "Wi2k")
+	f.OriginalSize, f.CurrentSize = uint64(size), uint64(size)
+	f.Cylinders, f.Heads, f.SectorsPerTrack = vhdGeometry(size)
+	if _, err := rand.Read(f.UniqueID[:]); err != nil {
+		return err
+	}
+	if fixed {
+		f.DiskType = vhdFixed
+		v.end = size
+		return v.writeFooter()
+	}
+	f.DiskType = vhdDynamic
+	f.DataOffset = VHDSector
+	h := &v.header
+	copy(h.Cookie[:], "cxsparse")
+	h.DataOffset = 0xffffffffffffffff
+	h.TableOffset = 3 * VHDSector
+	h.HeaderVersion = 0x00010000
+	h.MaxTableEntries = uint32((size + VHDBlockSize - 1) / VHDBlockSize)
+	h.BlockSize = VHDBlockSize
+	h.Checksum = vhdChecksum(h)
+	v.bat = make([]uint32, h.MaxTableEntries)
+	for i := range v.bat {
+		v.bat[i] = vhdUnused
+	}
+	batSize := (int64(len(v.bat))*4 + VHDSector - 1) &^ (VHDSector - 1)
+	v.end = int64(h.TableOffset) + batSize
+	batBuf := bytes.Repeat([]byte{0xff}, int(batSize))
+	if _, err := v.fd.WriteAt(batBuf, int64(h.TableOffset)); err != nil {
+		return err
+	}
+	if err := binary.Write(io.NewOffsetWriter(v.fd, VHDSector), binary.BigEndian, h); err != nil {
+		return err
+	}
+	return v.writeFooter()
+}
+
+func (v *vhd) open(fileSize, size int64) error {
+	if fileSize < VHDSector {
+		return errors.New("Not a VHD image")
+	}
+	r := io.NewSectionReader(v.fd, 0, fileSize)
+	if _, err := r.Seek(fileSize-VHDSector, io.SeekStart); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &v.footer); err != nil {
+		return fmt.Errorf("Unable to read VHD footer: %w", err)
+	}
+	f := &v.footer
+	sum := f.Checksum
+	f.Checksum = 0
+	switch {
+	case string(f.Cookie[:]) != "conectix":
+		return errors.New("Not a VHD image")
+	case vhdChecksum(f) != sum:
+		return errors.New("Invalid VHD footer checksum")
+	case f.DiskType != vhdFixed && f.DiskType != vhdDynamic:
+		return fmt.Errorf("Unsupported VHD disk type: %d", f.DiskType)
+	case int64(f.CurrentSize) < size:
+		return fmt.Errorf("VHD image is smaller than src: %d < %d", f.CurrentSize, size)
+	}
+	v.end = fileSize - VHDSector
+	if f.DiskType == vhdFixed {
+		return nil
+	}
+	if _, err := r.Seek(int64(f.DataOffset), io.SeekStart); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &v.header); err != nil {
+		return fmt.Errorf("Unable to read VHD header: %w", err)
+	}
+	h := &v.header
+	if string(h.Cookie[:]) != "cxsparse" {
+		return errors.New("Invalid VHD dynamic header")
+	}
+	if h.BlockSize == 0 || h.BlockSize%VHDSector != 0 {
+		return fmt.Errorf("Invalid VHD block size: %d", h.BlockSize)
+	}
+	buf := make([]byte, int64(h.MaxTableEntries)*4)
+	if _, err := v.fd.ReadAt(buf, int64(h.TableOffset)); err != nil {
+		return fmt.Errorf("Unable to read VHD block allocation table: %w", err)
+	}
+	v.bat = make([]uint32, h.MaxTableEntries)
+	for i := range v.bat {
+		v.bat[i] = binary.BigEndian.Uint32(buf[i*4:])
+	}
+	return nil
+}
+
+// Write footer at the end and, for dynamic image, its copy at the
+// beginning.
+func (v *vhd) writeFooter() error {
+	v.footer.Checksum = 0
+	v.footer.Checksum = vhdChecksum(&v.footer)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &v.footer)
+	if _, err := v.fd.WriteAt(buf.Bytes(), v.end); err != nil {
+		return err
+	}
+	if v.footer.DiskType == vhdDynamic {
+		if _, err := v.fd.WriteAt(buf.Bytes(), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size of sector bitmap preceding each block's data.
+func (v *vhd) bitmapSize() int64 {
+	bits := int64(v.header.BlockSize) / VHDSector
+	return ((bits+7)/8 + VHDSector - 1) &^ (VHDSector - 1)
+}
+
+// Append new block in place of the footer. Footer is written first, so
+// crash can only leak the block.
+func (v *vhd) alloc(i int64) (int64, error) {
+	off := v.end
+	v.end = off + v.bitmapSize() + int64(v.header.BlockSize)
+	if err := v.writeFooter(); err != nil {
+		return 0, err
+	}
+	bitmap := bytes.Repeat([]byte{0xff}, int(v.bitmapSize()))
+	if _, err := v.fd.WriteAt(bitmap, off); err != nil {
+		return 0, err
+	}
+	v.bat[i] = uint32(off / VHDSector)
+	var entry [4]byte
+	binary.BigEndian.PutUint32(entry[:], v.bat[i])
+	if _, err := v.fd.WriteAt(entry[:], int64(v.header.TableOffset)+i*4); err != nil {
+		return 0, err
+	}
+	return off, nil
+}
+
+// Call fn for each block's piece of n bytes at offset.
+func (v *vhd) pieces(offset int64, n int, fn func(block, within int64, from, to int) error) error {
+	if offset < 0 || offset+int64(n) > int64(v.footer.CurrentSize) {
+		return io.ErrUnexpectedEOF
+	}
+	bs := int64(v.header.BlockSize)
+	for from := 0; from < n; {
+		off := offset + int64(from)
+		to := from + int(min(bs-off%bs, int64(n-from)))
+		if err := fn(off/bs, off%bs, from, to); err != nil {
+			return err
+		}
+		from = to
+	}
+	return nil
+}
+
+func (v *vhd) ReadAt(p []byte, offset int64) (int, error) {
+	if v.footer.DiskType == vhdFixed {
+		if offset+int64(len(p)) > int64(v.footer.CurrentSize) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return v.fd.ReadAt(p, offset)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	err := v.pieces(offset, len(p), func(block, within int64, from, to int) error {
+		if v.bat[block] == vhdUnused {
+			clear(p[from:to])
+			return nil
+		}
+		off := int64(v.bat[block])*VHDSector + v.bitmapSize() + within
+		_, err := v.fd.ReadAt(p[from:to], off)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (v *vhd) WriteAt(p []byte, offset int64) (int, error) {
+	if v.footer.DiskType == vhdFixed {
+		if offset+int64(len(p)) > int64(v.footer.CurrentSize) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return v.fd.WriteAt(p, offset)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	err := v.pieces(offset, len(p), func(block, within int64, from, to int) error {
+		off := int64(v.bat[block]) * VHDSector
+		if v.bat[block] == vhdUnused {
+			var err error
+			if off, err = v.alloc(block); err != nil {
+				return err
+			}
+		}
+		_, err := v.fd.WriteAt(p[from:to], off+v.bitmapSize()+within)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (v *vhd) Sync() error {
+	return v.fd.Sync()
+}
+
+func (v *vhd) Close() error {
+	return v.fd.Close()
+}
@@ -0,0 +1,515 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+const (
+	VHDXBlockSize      = 32 << 20
+	VHDXLogicalSector  = 512
+	VHDXPhysicalSector = 4096
+
+	vhdxMB          = 1 << 20
+	vhdxHeader1     = 64 << 10
+	vhdxHeader2     = 128 << 10
+	vhdxRegion1     = 192 << 10
+	vhdxRegion2     = 256 << 10
+	vhdxRegionSize  = 64 << 10
+	vhdxLogOffset   = 1 * vhdxMB
+	vhdxLogLength   = 1 * vhdxMB
+	vhdxMetaOffset  = 2 * vhdxMB
+	vhdxMetaLength  = 1 * vhdxMB
+	vhdxBATOffset   = 3 * vhdxMB
+	vhdxFullPresent = 6
+	vhdxLeaveAlloc  = 1
+	vhdxHasParent   = 2
+	vhdxVirtualDisk = 2
+	vhdxRequired    = 4
+)
+
+var (
+	vhdxBAT        = vhdxGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetadata   = vhdxGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	vhdxFileParams = vhdxGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxDiskSize   = vhdxGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxPage83     = vhdxGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	vhdxLogical    = vhdxGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	vhdxPhysical   = vhdxGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+)
+
+// GUID in Microsoft's mixed endian representation.
+func vhdxGUID(s string) (guid [16]byte) {
+	raw, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(raw) != 16 {
+		panic("invalid GUID: " + s)
+	}
+	binary.LittleEndian.PutUint32(guid[0:], binary.BigEndian.Uint32(raw[0:]))
+	binary.LittleEndian.PutUint16(guid[4:], binary.BigEndian.Uint16(raw[4:]))
+	binary.LittleEndian.PutUint16(guid[6:], binary.BigEndian.Uint16(raw[6:]))
+	copy(guid[8:], raw[8:])
+	return
+}
+
+func randomGUID() (guid [16]byte, err error) {
+	if _, err = rand.Read(guid[:]); err != nil {
+		return
+	}
+	guid[7] = guid[7]&0x0f | 0x40
+	guid[8] = guid[8]&0x3f | 0x80
+	return
+}
+
+type vhdxHeader struct {
+	Signature      uint32
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  [16]byte
+	DataWriteGUID  [16]byte
+	LogGUID        [16]byte
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+	Reserved       [4016]byte
+}
+
+// Store CRC32C of buf, with zeroed checksum field, at its offset 4.
+func vhdxSum(buf []byte) {
+	binary.LittleEndian.PutUint32(buf[4:], 0)
+	binary.LittleEndian.PutUint32(buf[4:], crc32.Checksum(buf, castagnoli))
+}
+
+func vhdxValid(buf []byte) bool {
+	sum := binary.LittleEndian.Uint32(buf[4:])
+	tmp := append([]byte{}, buf...)
+	vhdxSum(tmp)
+	return binary.LittleEndian.Uint32(tmp[4:]) == sum
+}
+
+// Minimal VHDX image writer: payload blocks are appended to the end of
+// the file, block allocation table is updated in place, without the
+// log. Fixed images have all blocks allocated in advance. Differencing
+// images and ones with log to be replayed are not supported.
+type vhdx struct {
+	mu     sync.Mutex
+	fd     *os.File
+	header vhdxHeader
+	slot   int64 // offset of the current header
+	size   int64 // virtual disk size
+	bs     int64 // block size
+	ratio  int64 // payload blocks per sector bitmap block
+	batOff int64
+	bat    []uint64
+	end    int64 // where the next block is allocated
+}
+
+func openVHDX(path string, size int64, fixed bool) (*vhdx, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	v := &vhdx{fd: fd}
+	fi, err := fd.Stat()
+	if err == nil {
+		if fi.Size() == 0 {
+			err = v.create(size, fixed)
+		} else {
+			err = v.open(size)
+		}
+	}
+	if err == nil {
+		// Header must be updated with new write GUIDs before modification
+		err = v.writeHeader()
+	}
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+// BAT index of payload block, sector bitmap entries are interleaved.
+func (v *vhdx) index(block int64) int64 {
+	return block + block/v.ratio
+}
+
+func (v *vhdx) create(size int64, fixed bool) error {
+	v.size = (size + VHDXLogicalSector - 1) &^ (VHDXLogicalSector - 1)
+	v.bs = VHDXBlockSize
+	v.ratio = (1 << 23) * VHDXLogicalSector / v.bs
+	blocks := (v.size + v.bs - 1) / v.bs
+	entries := blocks + (blocks-1)/v.ratio
+	batLen := (entries*8 + vhdxMB - 1) &^ (vhdxMB - 1)
+	v.batOff = vhdxBATOffset
+	v.bat = make([]uint64, entries)
+	v.end = v.batOff + batLen
+
+	// File type identifier
+	ident := make([]byte, vhdxHeader1)
+	copy(ident, "vhdxfile")
+	for i, c := range utf16.Encode([]rune("syncer " + Version)) {
+		binary.LittleEndian.PutUint16(ident[8+i*2:], c)
+	}
+	if _, err := v.fd.WriteAt(ident, 0); err != nil {
+		return err
+	}
+
+	// Region tables
+	region := make([]byte, vhdxRegionSize)
+	copy(region, "regi")
+	binary.LittleEndian.PutUint32(region[8:], 2)
+	for i, r := range []struct {
+		guid   [16]byte
+		offset int64
+		length int64
+	}{
+		{vhdxBAT, v.batOff, batLen},
+		{vhdxMetadata, vhdxMetaOffset, vhdxMetaLength},
+	} {
+		entry := region[16+i*32:]
+		copy(entry, r.guid[:])
+		binary.LittleEndian.PutUint64(entry[16:], uint64(r.offset))
+		binary.LittleEndian.PutUint32(entry[24:], uint32(r.length))
+		binary.LittleEndian.PutUint32(entry[28:], 1)
+	}
+	vhdxSum(region)
+	for _, off := range []int64{vhdxRegion1, vhdxRegion2} {
+		if _, err := v.fd.WriteAt(region, off); err != nil {
+			return err
+		}
+	}
+
+	// Metadata table with items following it
+	meta := make([]byte, vhdxMetaLength)
+	copy(meta, "metadata")
+	page83, err := randomGUID()
+	if err != nil {
+		return err
+	}
+	var flags uint32
+	if fixed {
+		flags = vhdxLeaveAlloc
+	}
+	items := []struct {
+		guid  [16]byte
+		flags uint32
+		data  []byte
+	}{
+		{vhdxFileParams, vhdxRequired, binary.LittleEndian.AppendUint32(
+			binary.LittleEndian.AppendUint32(nil, uint32(v.bs)), flags,
+		)},
+		{vhdxDiskSize, vhdxVirtualDisk | vhdxRequired, binary.LittleEndian.AppendUint64(nil, uint64(v.size))},
+		{vhdxPage83, vhdxVirtualDisk | vhdxRequired, page83[:]},
+		{vhdxLogical, vhdxVirtualDisk | vhdxRequired, binary.LittleEndian.AppendUint32(nil, VHDXLogicalSector)},
+		{vhdxPhysical, vhdxVirtualDisk | vhdxRequired, binary.LittleEndian.AppendUint32(nil, VHDXPhysicalSector)},
+	}
+	binary.LittleEndian.PutUint16(meta[10:], uint16(len(items)))
+	off := vhdxRegionSize
+	for i, item := range items {
+		entry := meta[32+i*32:]
+		copy(entry, item.guid[:])
+		binary.LittleEndian.PutUint32(entry[16:], uint32(off))
+		binary.LittleEndian.PutUint32(entry[20:], uint32(len(item.data)))
+		binary.LittleEndian.PutUint32(entry[24:], item.flags)
+		off += copy(meta[off:], item.data)
+	}
+	if _, err := v.fd.WriteAt(meta, vhdxMetaOffset); err != nil {
+		return err
+	}
+
+	// Empty log and blocks allocation table
+	if err := v.fd.Truncate(v.end); err != nil {
+		return err
+	}
+	if fixed {
+		for i := int64(0); i < blocks; i++ {
+			v.bat[v.index(i)] = uint64(v.end+i*v.bs) | vhdxFullPresent
+		}
+		v.end += blocks * v.bs
+		if err := v.fd.Truncate(v.end); err != nil {
+			return err
+		}
+	}
+	if err := v.writeBAT(0, int64(len(v.bat))); err != nil {
+		return err
+	}
+	v.header = vhdxHeader{
+		Signature: 0x64616568, // "head"
+		Version:   1,
+		LogLength: vhdxLogLength,
+		LogOffset: vhdxLogOffset,
+	}
+	v.slot = vhdxHeader2
+	return v.writeHeader()
+}
+
+func (v *vhdx) open(size int64) error {
+	ident := make([]byte, 8)
+	if _, err := v.fd.ReadAt(ident, 0); err != nil || string(ident) != "vhdxfile" {
+		return errors.New("Not a VHDX image")
+	}
+
+	// Current header is the valid one with the greater sequence number
+	buf := make([]byte, binary.Size(vhdxHeader{}))
+	found := false
+	for _, off := range []int64{vhdxHeader1, vhdxHeader2} {
+		if _, err := v.fd.ReadAt(buf, off); err != nil {
+			return fmt.Errorf("Unable to read VHDX header: %w", err)
+		}
+		if string(buf[:4]) != "head" || !vhdxValid(buf) {
+			continue
+		}
+		var h vhdxHeader
+		binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h)
+		if !found || h.SequenceNumber > v.header.SequenceNumber {
+			v.header, v.slot, found = h, off, true
+		}
+	}
+	switch {
+	case !found:
+		return errors.New("No valid VHDX header")
+	case v.header.Version != 1:
+		return fmt.Errorf("Unsupported VHDX version: %d", v.header.Version)
+	case v.header.LogGUID != [16]byte{}:
+		return errors.New("VHDX log has to be replayed, open the image with Hyper-V or qemu first")
+	}
+
+	// Regions
+	region := make([]byte, vhdxRegionSize)
+	if _, err := v.fd.ReadAt(region, vhdxRegion1); err != nil {
+		return fmt.Errorf("Unable to read VHDX region table: %w", err)
+	}
+	if string(region[:4]) != "regi" || !vhdxValid(region) {
+		if _, err := v.fd.ReadAt(region, vhdxRegion2); err != nil {
+			return fmt.Errorf("Unable to read VHDX region table: %w", err)
+		}
+		if string(region[:4]) != "regi" || !vhdxValid(region) {
+			return errors.New("No valid VHDX region table")
+		}
+	}
+	var batLen, metaOff int64
+	for i := 0; i < int(binary.LittleEndian.Uint32(region[8:])) && 16+i*32+32 <= len(region); i++ {
+		entry := region[16+i*32:]
+		switch [16]byte(entry[:16]) {
+		case vhdxBAT:
+			v.batOff = int64(binary.LittleEndian.Uint64(entry[16:]))
+			batLen = int64(binary.LittleEndian.Uint32(entry[24:]))
+		case vhdxMetadata:
+			metaOff = int64(binary.LittleEndian.Uint64(entry[16:]))
+		default:
+			if binary.LittleEndian.Uint32(entry[28:])&1 != 0 {
+				return errors.New("Unknown required VHDX region")
+			}
+		}
+	}
+	if v.batOff == 0 || metaOff == 0 {
+		return errors.New("VHDX image lacks BAT or metadata region")
+	}
+
+	// Metadata
+	meta := make([]byte, vhdxRegionSize)
+	if _, err := v.fd.ReadAt(meta, metaOff); err != nil || string(meta[:8]) != "metadata" {
+		return errors.New("Invalid VHDX metadata table")
+	}
+	item := func(guid [16]byte, n int) ([]byte, error) {
+		for i := 0; i < int(binary.LittleEndian.Uint16(meta[10:])) && 32+i*32+32 <= len(meta); i++ {
+			entry := meta[32+i*32:]
+			if [16]byte(entry[:16]) != guid {
+				continue
+			}
+			data := make([]byte, n)
+			off := metaOff + int64(binary.LittleEndian.Uint32(entry[16:]))
+			if _, err := v.fd.ReadAt(data, off); err != nil {
+				return nil, err
+			}
+			return data, nil
+		}
+		return nil, errors.New("VHDX metadata item is missing")
+	}
+	params, err := item(vhdxFileParams, 8)
+	if err != nil {
+		return err
+	}
+	v.bs = int64(binary.LittleEndian.Uint32(params))
+	if binary.LittleEndian.Uint32(params[4:])&vhdxHasParent != 0 {
+		return errors.New("Differencing VHDX images are not supported")
+	}
+	data, err := item(vhdxDiskSize, 8)
+	if err != nil {
+		return err
+	}
+	v.size = int64(binary.LittleEndian.Uint64(data))
+	if data, err = item(vhdxLogical, 4); err != nil {
+		return err
+	}
+	logical := int64(binary.LittleEndian.Uint32(data))
+	if v.bs < vhdxMB || logical == 0 {
+		return errors.New("Invalid VHDX block or sector size")
+	}
+	if v.size < size {
+		return fmt.Errorf("VHDX image is smaller than src: %d < %d", v.size, size)
+	}
+	v.ratio = (1 << 23) * logical / v.bs
+	blocks := (v.size + v.bs - 1) / v.bs
+	entries := blocks + (blocks-1)/v.ratio
+	if entries*8 > batLen {
+		return errors.New("VHDX BAT region is too small")
+	}
+	buf = make([]byte, entries*8)
+	if _, err = v.fd.ReadAt(buf, v.batOff); err != nil {
+		return fmt.Errorf("Unable to read VHDX BAT: %w", err)
+	}
+	v.bat = make([]uint64, entries)
+	for i := range v.bat {
+		v.bat[i] = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+	fi, err := v.fd.Stat()
+	if err != nil {
+		return err
+	}
+	v.end = (fi.Size() + vhdxMB - 1) &^ (vhdxMB - 1)
+	return nil
+}
+
+// Write header with the next sequence number and new write GUIDs over
+// the non-current one.
+func (v *vhdx) writeHeader() (err error) {
+	h := &v.header
+	h.SequenceNumber++
+	if h.FileWriteGUID, err = randomGUID(); err != nil {
+		return
+	}
+	if h.DataWriteGUID, err = randomGUID(); err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	raw := buf.Bytes()
+	vhdxSum(raw)
+	h.Checksum = binary.LittleEndian.Uint32(raw[4:])
+	v.slot = vhdxHeader1 + vhdxHeader2 - v.slot
+	if _, err = v.fd.WriteAt(raw, v.slot); err != nil {
+		return
+	}
+	if h.SequenceNumber == 1 {
+		// New image gets both headers
+		return v.writeHeader()
+	}
+	return nil
+}
+
+func (v *vhdx) writeBAT(from, to int64) error {
+	buf := make([]byte, (to-from)*8)
+	for i := from; i < to; i++ {
+		binary.LittleEndian.PutUint64(buf[(i-from)*8:], v.bat[i])
+	}
+	_, err := v.fd.WriteAt(buf, v.batOff+from*8)
+	return err
+}
+
+// Offset of payload block, zero if it is not present.
+func (v *vhdx) block(block int64) int64 {
+	e := v.bat[v.index(block)]
+	if e&7 != vhdxFullPresent {
+		return 0
+	}
+	return int64(e &^ (vhdxMB - 1))
+}
+
+// Call fn for each block's piece of n bytes at offset.
+func (v *vhdx) pieces(offset int64, n int, fn func(block, within int64, from, to int) error) error {
+	if offset < 0 || offset+int64(n) > v.size {
+		return io.ErrUnexpectedEOF
+	}
+	for from := 0; from < n; {
+		off := offset + int64(from)
+		to := from + int(min(v.bs-off%v.bs, int64(n-from)))
+		if err := fn(off/v.bs, off%v.bs, from, to); err != nil {
+			return err
+		}
+		from = to
+	}
+	return nil
+}
+
+func (v *vhdx) ReadAt(p []byte, offset int64) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	err := v.pieces(offset, len(p), func(block, within int64, from, to int) error {
+		off := v.block(block)
+		if off == 0 {
+			clear(p[from:to])
+			return nil
+		}
+		_, err := v.fd.ReadAt(p[from:to], off+within)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (v *vhdx) WriteAt(p []byte, offset int64) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	err := v.pieces(offset, len(p), func(block, within int64, from, to int) error {
+		off := v.block(block)
+		if off == 0 {
+			// New block is zero filled by extending the file
+			off = v.end
+			v.end += v.bs
+			if err := v.fd.Truncate(v.end); err != nil {
+				return err
+			}
+			i := v.index(block)
+			v.bat[i] = uint64(off) | vhdxFullPresent
+			if err := v.writeBAT(i, i+1); err != nil {
+				return err
+			}
+		}
+		_, err := v.fd.WriteAt(p[from:to], off+within)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (v *vhdx) Sync() error {
+	return v.fd.Sync()
+}
+
+func (v *vhdx) Close() error {
+	return v.fd.Close()
+}
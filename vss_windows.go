@@ -0,0 +1,69 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+type VSSSnapshot struct {
+	id     string
+	device string
+}
+
+// Create Volume Shadow Copy of the volume, which source device (\\.\C:)
+// belongs to.
+func vssSnapshot(src string) (*VSSSnapshot, error) {
+	if !strings.HasPrefix(src, `\\.\`) || len(src) != 6 || src[5] != ':' {
+		return nil, errors.New(`VSS requires volume source like \\.\C:`)
+	}
+	volume := src[4:] + `\`
+	out, err := command(
+		"powershell", "-NoProfile", "-NonInteractive", "-Command",
+		`$r = (Get-WmiObject -List Win32_ShadowCopy).Create('`+volume+`', 'ClientAccessible');`+
+			`if ($r.ReturnValue -ne 0) { Write-Error "Create returned $($r.ReturnValue)"; exit 1 };`+
+			`$s = Get-WmiObject Win32_ShadowCopy | Where-Object { $_.ID -eq $r.ShadowID };`+
+			`Write-Output $s.ID; Write-Output $s.DeviceObject`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Fields(out)
+	if len(lines) != 2 {
+		return nil, errors.New("Unexpected shadow copy creation output: " + out)
+	}
+	return &VSSSnapshot{id: lines[0], device: lines[1]}, nil
+}
+
+func (s *VSSSnapshot) Name() string {
+	return s.id
+}
+
+func (s *VSSSnapshot) Device() string {
+	return s.device
+}
+
+func (s *VSSSnapshot) Remove() error {
+	_, err := command(
+		"powershell", "-NoProfile", "-NonInteractive", "-Command",
+		`Get-WmiObject Win32_ShadowCopy | Where-Object { $_.ID -eq '`+s.id+`' } | ForEach-Object { $_.Delete() }`,
+	)
+	return err
+}
@@ -0,0 +1,135 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Journal of statefile's update: digests of its old and new contents,
+// and the digest of them both.
+var StateWALMagic = []byte("SYNCERSJ")
+
+func walPath(state string) string {
+	return state + ".wal"
+}
+
+// Digest of file's contents, zero one if it does not exist.
+func fileDigest(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return make([]byte, sha256.Size), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// Synchronize directory's entries, where it is supported.
+func syncDir(dir string) {
+	if fd, err := os.Open(dir); err == nil {
+		fd.Sync()
+		fd.Close()
+	}
+}
+
+// Journal the update of statefile to data, before it is written.
+func beginStateUpdate(state string, data []byte) error {
+	old, err := fileDigest(state)
+	if err != nil {
+		return err
+	}
+	cur := sha256.Sum256(data)
+	journal := append(append(append([]byte{}, StateWALMagic...), old...), cur[:]...)
+	sum := sha256.Sum256(journal)
+	fd, err := os.OpenFile(walPath(state), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = fd.Write(append(journal, sum[:]...)); err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	syncDir(filepath.Dir(state))
+	return err
+}
+
+// Remove the journal after statefile is durably replaced.
+func endStateUpdate(state string) error {
+	syncDir(filepath.Dir(state))
+	return os.Remove(walPath(state))
+}
+
+// Check statefile left by the interrupted update. It is valid if it is
+// either entirely old or new, otherwise it is moved aside to .torn and
+// true is returned: everything has to be read again. Signature of the
+// new statefile, if it may be not written yet, is made with signKey.
+func recoverStateUpdate(state string, signKey ed25519.PrivateKey) (bool, error) {
+	journal, err := ioutil.ReadFile(walPath(state))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	size := len(StateWALMagic) + 3*sha256.Size
+	body := journal[:min(len(journal), size-sha256.Size)]
+	sum := sha256.Sum256(body)
+	if len(journal) != size || !bytes.HasPrefix(journal, StateWALMagic) ||
+		!bytes.Equal(journal[len(body):], sum[:]) {
+		// Interrupted before statefile was touched
+		return false, os.Remove(walPath(state))
+	}
+	cur, err := fileDigest(state)
+	if err != nil {
+		return false, err
+	}
+	old := journal[len(StateWALMagic) : len(StateWALMagic)+sha256.Size]
+	if bytes.Equal(cur, old) {
+		return false, os.Remove(walPath(state))
+	}
+	if bytes.Equal(cur, body[len(body)-sha256.Size:]) {
+		if signKey != nil {
+			data, err := ioutil.ReadFile(state)
+			if err != nil {
+				return false, err
+			}
+			if err = signState(signKey, state, data); err != nil {
+				return false, err
+			}
+		}
+		return false, os.Remove(walPath(state))
+	}
+	if err = os.Rename(state, state+".torn"); err != nil {
+		return false, err
+	}
+	if err = os.Remove(walPath(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
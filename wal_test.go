@@ -0,0 +1,123 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Replace statefile the way the run does, stopping after the rename if
+// crash is asked.
+func updateState(t *testing.T, key ed25519.PrivateKey, state string, data []byte, crash bool) {
+	t.Helper()
+	if err := beginStateUpdate(state, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(state+".tmp", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(state+".tmp", state); err != nil {
+		t.Fatal(err)
+	}
+	if crash {
+		return
+	}
+	if err := signState(key, state, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := endStateUpdate(state); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWALSignRollForward(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	state := filepath.Join(t.TempDir(), "state")
+	updateState(t, key, state, []byte("old state"), false)
+	updateState(t, key, state, []byte("new state"), true)
+	if err := verifyState(key, state, []byte("new state")); err == nil {
+		t.Fatal("signature of the old state is valid for the new one")
+	}
+	torn, err := recoverStateUpdate(state, key)
+	if err != nil || torn {
+		t.Fatal(torn, err)
+	}
+	if err = verifyState(key, state, []byte("new state")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(walPath(state)); !os.IsNotExist(err) {
+		t.Fatal("journal is left")
+	}
+}
+
+func TestWALTorn(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state")
+	if err := ioutil.WriteFile(state, []byte("old state"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := beginStateUpdate(state, []byte("new state")); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(state, []byte("new st"), 0600)
+	torn, err := recoverStateUpdate(state, nil)
+	if err != nil || !torn {
+		t.Fatal(torn, err)
+	}
+	if _, err = os.Stat(state); !os.IsNotExist(err) {
+		t.Fatal("torn statefile is left")
+	}
+	if data, _ := ioutil.ReadFile(state + ".torn"); string(data) != "new st" {
+		t.Fatalf("torn statefile: %q", data)
+	}
+}
+
+func TestWALIntact(t *testing.T) {
+	for _, contents := range []string{"old state", "new state"} {
+		state := filepath.Join(t.TempDir(), "state")
+		ioutil.WriteFile(state, []byte("old state"), 0600)
+		if err := beginStateUpdate(state, []byte("new state")); err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(state, []byte(contents), 0600)
+		torn, err := recoverStateUpdate(state, nil)
+		if err != nil || torn {
+			t.Fatal(contents, torn, err)
+		}
+		if data, _ := ioutil.ReadFile(state); string(data) != contents {
+			t.Fatalf("statefile: %q instead of %q", data, contents)
+		}
+	}
+
+	// Journal itself torn: statefile was not touched yet
+	state := filepath.Join(t.TempDir(), "state")
+	ioutil.WriteFile(state, []byte("old state"), 0600)
+	beginStateUpdate(state, []byte("new state"))
+	journal, _ := ioutil.ReadFile(walPath(state))
+	ioutil.WriteFile(walPath(state), journal[:len(journal)-1], 0600)
+	if torn, err := recoverStateUpdate(state, nil); err != nil || torn {
+		t.Fatal(torn, err)
+	}
+	if _, err := os.Stat(walPath(state)); !os.IsNotExist(err) {
+		t.Fatal("journal is left")
+	}
+}
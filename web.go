@@ -0,0 +1,268 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of the latest runs kept for the status page.
+const StatusHistory = 100
+
+// Daemon's jobs and their latest runs, shown on its status page.
+type Status struct {
+	mu      sync.Mutex
+	started time.Time
+	jobs    []*JobStatus
+	history []*Notification
+}
+
+type JobStatus struct {
+	job     *Job
+	next    time.Time
+	running bool
+	last    *Notification
+	beat    time.Time // of the job's scheduler loop
+}
+
+func NewStatus() *Status {
+	return &Status{started: time.Now()}
+}
+
+func (s *Status) Add(job *Job) *JobStatus {
+	js := &JobStatus{job: job, beat: time.Now()}
+	s.mu.Lock()
+	s.jobs = append(s.jobs, js)
+	s.mu.Unlock()
+	return js
+}
+
+func (s *Status) Scheduled(js *JobStatus, next time.Time) {
+	s.mu.Lock()
+	js.next, js.beat = next, time.Now()
+	s.mu.Unlock()
+}
+
+// Record that job's scheduler loop is alive.
+func (s *Status) Beat(js *JobStatus) {
+	s.mu.Lock()
+	js.beat = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *Status) Running(js *JobStatus) {
+	s.mu.Lock()
+	js.running = true
+	s.mu.Unlock()
+}
+
+func (s *Status) Finished(js *JobStatus, err error) {
+	n := js.job.notification(err)
+	s.mu.Lock()
+	js.running, js.last, js.beat = false, n, time.Now()
+	s.history = append(s.history, n)
+	if len(s.history) > StatusHistory {
+		s.history = s.history[len(s.history)-StatusHistory:]
+	}
+	s.mu.Unlock()
+}
+
+// Every waiting job's scheduler loop and every running job beat within
+// the timeout.
+func (s *Status) Healthy(timeout time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, js := range s.jobs {
+		beat := js.beat
+		if js.running {
+			beat = js.job.lastBeat()
+		}
+		if time.Since(beat) > timeout {
+			return false
+		}
+	}
+	return true
+}
+
+// One-line state of the jobs for the service manager.
+func (s *Status) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []string
+	for _, js := range s.jobs {
+		switch {
+		case js.running:
+			done, size := js.job.Progress()
+			if size == 0 {
+				jobs = append(jobs, js.job.Name+" running")
+				break
+			}
+			jobs = append(jobs, fmt.Sprintf("%s running %.1f%%",
+				js.job.Name, 100*float64(done)/float64(size)))
+		case js.last != nil && js.last.Error != "":
+			jobs = append(jobs, js.job.Name+" failed")
+		case !js.next.IsZero():
+			jobs = append(jobs, js.job.Name+" next "+js.next.Format("2006-01-02 15:04"))
+		default:
+			jobs = append(jobs, js.job.Name+" idle")
+		}
+	}
+	return strings.Join(jobs, ", ")
+}
+
+// Latest progress of the running sync, of any group member.
+func (j *Job) lastBeat() time.Time {
+	beat := time.Unix(0, j.beat.Load())
+	for _, m := range j.Group {
+		if b := m.lastBeat(); b.After(beat) {
+			beat = b
+		}
+	}
+	return beat
+}
+
+// Bytes of the source processed by the running sync and source size,
+// summed over group members.
+func (j *Job) Progress() (done, size int64) {
+	if len(j.Group) == 0 {
+		return j.done.Load(), j.size.Load()
+	}
+	for _, m := range j.Group {
+		d, s := m.Progress()
+		done, size = done+d, size+s
+	}
+	return done, size
+}
+
+type jobReport struct {
+	Name    string        `json:"name"`
+	Running bool          `json:"running"`
+	Done    int64         `json:"done,omitempty"`
+	Size    int64         `json:"size,omitempty"`
+	Next    time.Time     `json:"next"`
+	Last    *Notification `json:"last,omitempty"`
+}
+
+type statusReport struct {
+	Started time.Time       `json:"started"`
+	Syncer  string          `json:"syncer"`
+	Jobs    []jobReport     `json:"jobs"`
+	History []*Notification `json:"history"` // newest first
+}
+
+func (s *Status) report() *statusReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := statusReport{Started: s.started, Syncer: Version}
+	for _, js := range s.jobs {
+		jr := jobReport{
+			Name:    js.job.Name,
+			Running: js.running,
+			Next:    js.next,
+			Last:    js.last,
+		}
+		if js.running {
+			jr.Done, jr.Size = js.job.Progress()
+		}
+		r.Jobs = append(r.Jobs, jr)
+	}
+	for i := len(s.history) - 1; i >= 0; i-- {
+		r.History = append(r.History, s.history[i])
+	}
+	return &r
+}
+
+var statusPage = template.Must(template.New("status").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04:05")
+	},
+	"pct": func(done, size int64) string {
+		if size == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%.1f%%", 100*float64(done)/float64(size))
+	},
+	"mib": func(n int64) int64 { return n >> 20 },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="5">
+<title>syncer</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+.failed { color: #b00; }
+</style></head><body>
+<h1>syncer {{.Syncer}}</h1>
+<p>Running since {{time .Started}}</p>
+<h2>Jobs</h2>
+<table>
+<tr><th>Job</th><th>State</th><th>Last run</th><th>Result</th><th>Duration, s</th><th>Changed</th><th>Written, MiB</th><th>Next run</th></tr>
+{{range .Jobs}}<tr>
+<td>{{.Name}}</td>
+<td>{{if .Running}}running {{pct .Done .Size}}{{else}}idle{{end}}</td>
+{{with .Last}}<td>{{time .Started}}</td><td class="{{.Result}}">{{.Result}}</td><td>{{.Duration}}</td><td>{{.Changed}}</td><td>{{mib .Written}}</td>
+{{else}}<td></td><td></td><td></td><td></td><td></td>{{end}}
+<td>{{time .Next}}</td>
+</tr>{{end}}
+</table>
+<h2>Errors</h2>
+<table>
+<tr><th>Job</th><th>Started</th><th>Error</th></tr>
+{{range .History}}{{if .Error}}<tr><td>{{.Job}}</td><td>{{time .Started}}</td><td class="failed">{{.Error}}</td></tr>{{end}}{{end}}
+</table>
+<h2>Runs</h2>
+<table>
+<tr><th>Job</th><th>Started</th><th>Result</th><th>Duration, s</th><th>Blocks</th><th>Changed</th><th>Written, MiB</th></tr>
+{{range .History}}<tr><td>{{.Job}}</td><td>{{time .Started}}</td><td class="{{.Result}}">{{.Result}}</td><td>{{.Duration}}</td><td>{{.Blocks}}</td><td>{{.Changed}}</td><td>{{mib .Written}}</td></tr>{{end}}
+</table>
+<p><a href="status.json">JSON</a></p>
+</body></html>
+`))
+
+// Serve read-only status page and its JSON in background.
+func (s *Status) Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusPage.Execute(w, s.report()); err != nil {
+			log.Println("Unable to render status page:", err)
+		}
+	})
+	mux.HandleFunc("/status.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.report())
+	})
+	go func() {
+		log.Println("Unable to serve status page:", http.ListenAndServe(addr, mux))
+	}()
+}
@@ -0,0 +1,68 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Size of chunks destination's tail is checked and zeroed by.
+const WipeChunk = 1 << 20
+
+// Remove stale data of raw destination beyond the source's size:
+// regular file is truncated, and non-zero chunks of the device are
+// overwritten with zeroes. Number of wiped bytes is returned.
+func wipeTail(fd *os.File, size int64) (int64, error) {
+	fi, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.Mode().IsRegular() {
+		if fi.Size() <= size {
+			return 0, nil
+		}
+		return fi.Size() - size, fd.Truncate(size)
+	}
+	end, err := fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, WipeChunk)
+	zero := make([]byte, WipeChunk)
+	var wiped int64
+	for offset := size; offset < end; offset += WipeChunk {
+		n := int(min(WipeChunk, end-offset))
+		if _, err = fd.ReadAt(buf[:n], offset); err != nil && err != io.EOF {
+			return wiped, err
+		}
+		if bytes.Equal(buf[:n], zero[:n]) {
+			continue
+		}
+		if _, err = fd.WriteAt(zero[:n], offset); err != nil {
+			return wiped, err
+		}
+		wiped += int64(n)
+	}
+	if wiped > 0 {
+		err = fd.Sync()
+	}
+	return wiped, err
+}
@@ -0,0 +1,97 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "fmt"
+
+// Queue of changed blocks written to the destination in background, so
+// reading and hashing continue while temporarily slow destination
+// catches up. Blocks are copied to its own buffers.
+type writeBehind struct {
+	queue  chan SyncEvent
+	spare  chan []byte
+	failed chan error
+	done   chan struct{}
+	free   func()
+}
+
+// Start writing to dst in background with n buffers of size bytes.
+func (j *Job) startWriteBehind(dst Image, flush *flusher, n, size, node int) (*writeBehind, error) {
+	pool, free, err := allocBuffers(n, size, node, j.HugePages)
+	if err != nil {
+		return nil, err
+	}
+	w := &writeBehind{
+		queue:  make(chan SyncEvent, n),
+		spare:  make(chan []byte, n),
+		failed: make(chan error, 1),
+		done:   make(chan struct{}),
+		free:   free,
+	}
+	for _, buf := range pool {
+		w.spare <- buf
+	}
+	go func() {
+		defer close(w.done)
+		var failure error
+		for event := range w.queue {
+			if failure == nil {
+				failure = j.retry("dst write", func() error {
+					_, err := dst.WriteAt(event.data, event.i*int64(size))
+					return err
+				})
+				if failure != nil {
+					failure = fmt.Errorf("Error during dst write: %w", failure)
+				} else {
+					failure = flush.written(len(event.data))
+				}
+				if failure != nil {
+					w.failed <- failure
+				}
+			}
+			w.spare <- event.buf
+		}
+	}()
+	return w, nil
+}
+
+// Queue i-th block's data, waiting for a free buffer. Error of the
+// previous write is returned, if any.
+func (w *writeBehind) write(i int64, data []byte) error {
+	select {
+	case err := <-w.failed:
+		return err
+	default:
+	}
+	buf := <-w.spare
+	w.queue <- SyncEvent{i: i, buf: buf, data: append(buf[:0], data...)}
+	return nil
+}
+
+// Wait for all queued blocks to be written and free the buffers.
+func (w *writeBehind) close() (err error) {
+	close(w.queue)
+	<-w.done
+	select {
+	case err = <-w.failed:
+	default:
+	}
+	w.free()
+	return err
+}
@@ -0,0 +1,85 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Destination file's extended attributes with the whole statefile, if
+// it fits, and its digest.
+const (
+	XattrState    = "user.syncer.state"
+	XattrStateSum = "user.syncer.state.sha256"
+)
+
+// Keep statefile in destination's xattrs, so they are not separated.
+// Too large statefile is kept only as its digest.
+func (j *Job) saveStateXattr(data []byte) error {
+	sum := sha256.Sum256(data)
+	if err := setXattr(j.Dst, XattrStateSum, []byte(hex.EncodeToString(sum[:]))); err != nil {
+		return err
+	}
+	if err := setXattr(j.Dst, XattrState, data); err != nil {
+		j.log.Println("Statefile does not fit in dst xattr, only its digest is kept:", err)
+		removeXattr(j.Dst, XattrState)
+	}
+	return nil
+}
+
+// Check that the statefile belongs to the destination, restoring the
+// missing one from its xattr.
+func (j *Job) checkStateXattr() error {
+	want, err := getXattr(j.Dst, XattrStateSum)
+	if err != nil || want == nil {
+		return err
+	}
+	if _, err = os.Stat(j.State); os.IsNotExist(err) {
+		data, err := getXattr(j.Dst, XattrState)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			return fmt.Errorf("Statefile is missing, dst was synced with one with %s digest", want)
+		}
+		sum := sha256.Sum256(data)
+		if !bytes.Equal([]byte(hex.EncodeToString(sum[:])), want) {
+			return errors.New("Statefile kept in dst xattr is corrupted")
+		}
+		j.log.Println("Statefile restored from dst xattr")
+		return ioutil.WriteFile(j.State, data, 0600)
+	}
+	sum, err := fileDigest(j.State)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal([]byte(hex.EncodeToString(sum)), want) {
+		return fmt.Errorf(
+			"Statefile does not belong to dst, it was synced with one with %s digest",
+			want,
+		)
+	}
+	return nil
+}
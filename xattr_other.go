@@ -0,0 +1,37 @@
+//go:build !linux
+
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "errors"
+
+var errXattr = errors.New("Extended attributes are supported only on Linux")
+
+func getXattr(path, name string) ([]byte, error) {
+	return nil, errXattr
+}
+
+func setXattr(path, name string, data []byte) error {
+	return errXattr
+}
+
+func removeXattr(path, name string) error {
+	return errXattr
+}
@@ -0,0 +1,100 @@
+/*
+syncer -- stateful file/device data syncer.
+Copyright (C) 2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const ZvolDir = "/dev/zvol/"
+
+type ZFSSnapshot struct {
+	dataset string
+	name    string
+
+	// Original snapdev property source, if we changed the property
+	snapdev string
+}
+
+// Snapshot the volume, whose device is specified. Snapshot devices are
+// made visible, if they are hidden, during snapshot's lifetime.
+func zfsSnapshot(dev string) (*ZFSSnapshot, error) {
+	if !strings.HasPrefix(dev, ZvolDir) {
+		return nil, errors.New("Source is not a ZFS volume: " + dev)
+	}
+	snap := &ZFSSnapshot{
+		dataset: strings.TrimPrefix(dev, ZvolDir),
+		name:    fmt.Sprintf("syncer-%d", time.Now().Unix()),
+	}
+	out, err := command("zfs", "get", "-H", "-o", "value,source", "snapdev", snap.dataset)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) >= 2 && fields[0] == "hidden" {
+		if _, err = command("zfs", "set", "snapdev=visible", snap.dataset); err != nil {
+			return nil, err
+		}
+		snap.snapdev = fields[1]
+	}
+	if _, err = command("zfs", "snapshot", snap.Name()); err != nil {
+		snap.restoreSnapdev()
+		return nil, err
+	}
+
+	// Device node is created asynchronously
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(snap.Device()); err == nil {
+			return snap, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	snap.Remove()
+	return nil, errors.New("Snapshot device has not appeared: " + snap.Device())
+}
+
+func (s *ZFSSnapshot) Name() string {
+	return s.dataset + "@" + s.name
+}
+
+func (s *ZFSSnapshot) Device() string {
+	return path.Join(ZvolDir, s.Name())
+}
+
+func (s *ZFSSnapshot) restoreSnapdev() {
+	switch s.snapdev {
+	case "":
+		return
+	case "local":
+		command("zfs", "set", "snapdev=hidden", s.dataset)
+	default:
+		command("zfs", "inherit", "snapdev", s.dataset)
+	}
+}
+
+func (s *ZFSSnapshot) Remove() error {
+	_, err := command("zfs", "destroy", s.Name())
+	s.restoreSnapdev()
+	return err
+}